@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/cache"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// storingResponse holds back a 200 response that will be cached, so it can
+// be stored and tagged before the caller sees it. Any other response, and a
+// text/event-stream, is written straight through, so it streams as usual.
+type storingResponse struct {
+	http.ResponseWriter
+	status int
+	store  bool
+	body   bytes.Buffer
+}
+
+func (storing *storingResponse) WriteHeader(status int) {
+	if storing.status != 0 {
+		return
+	}
+	storing.status = status
+	storing.store = status == http.StatusOK && !strings.HasPrefix(storing.Header().Get("Content-Type"), "text/event-stream")
+	if !storing.store {
+		storing.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (storing *storingResponse) Write(body []byte) (int, error) {
+	storing.WriteHeader(http.StatusOK)
+	if storing.store {
+		return storing.body.Write(body)
+	}
+	return storing.ResponseWriter.Write(body)
+}
+
+// Unwrap lets http.ResponseController flush a response that is written
+// through. A held response has nothing to flush yet, so it unwraps to nil.
+func (storing *storingResponse) Unwrap() http.ResponseWriter {
+	if storing.store {
+		return nil
+	}
+	return storing.ResponseWriter
+}
+
+// invalidatingResponse writes a response straight through, calling
+// invalidate before a successful status reaches the caller, so the caller's
+// next read cannot be served a stale cached response.
+type invalidatingResponse struct {
+	http.ResponseWriter
+	wroteHeader bool
+	invalidate  func()
+}
+
+func (invalidating *invalidatingResponse) WriteHeader(status int) {
+	if !invalidating.wroteHeader {
+		invalidating.wroteHeader = true
+		if status < 400 {
+			invalidating.invalidate()
+		}
+	}
+	invalidating.ResponseWriter.WriteHeader(status)
+}
+
+func (invalidating *invalidatingResponse) Write(body []byte) (int, error) {
+	if !invalidating.wroteHeader {
+		invalidating.WriteHeader(http.StatusOK)
+	}
+	return invalidating.ResponseWriter.Write(body)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streamed responses can still be flushed.
+func (invalidating *invalidatingResponse) Unwrap() http.ResponseWriter {
+	return invalidating.ResponseWriter
+}
+
+// cacheable serves GETs of route from the response cache and stores the 200
+// responses next produces, per tenant. Other responses, event streams and
+// writes are passed straight through, so they stream as next writes them.
+// Every GET answer carries an ETag, and a matching If-None-Match gets 304
+// Not Modified. A successful write through next drops the tenant's cached
+// responses, so a note change is visible on the next read. Whether a GET
+// was served from the cache is recorded as cache.hit on the server span.
+func (application *backendApp) cacheable(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		// The trailing space keeps one tenant's prefix from matching another
+		// whose id it begins.
+		prefix := tenant.FromContext(ctx) + " "
+
+		if request.Method != http.MethodGet {
+			invalidating := &invalidatingResponse{ResponseWriter: response, invalidate: func() {
+				application.responses.Invalidate(ctx, prefix)
+			}}
+			next(invalidating, request)
+			if !invalidating.wroteHeader {
+				invalidating.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+
+		key := prefix + request.URL.RequestURI()
+		entry, hit := application.responses.Get(ctx, key)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.hit", hit))
+		counter := application.cacheMisses
+		if hit {
+			counter = application.cacheHits
+		}
+		if counter != nil {
+			counter.Add(ctx, 1, metric.WithAttributes(attribute.String("route", route)))
+		}
+
+		if hit {
+			response.Header().Set("Age", strconv.Itoa(int(entry.Age().Seconds())))
+		} else {
+			// A write that lands while next reads must keep what next read
+			// out of the cache.
+			generation := application.responses.Generation(prefix)
+			storing := &storingResponse{ResponseWriter: response}
+			next(storing, request)
+			if storing.WriteHeader(http.StatusOK); !storing.store {
+				return
+			}
+			entry = application.responses.SetIfCurrent(ctx, key, prefix, generation, storing.body.Bytes(), response.Header().Get("Content-Type"))
+		}
+
+		response.Header().Set("ETag", entry.ETag)
+		// Clients may keep the response but must revalidate it before reuse.
+		response.Header().Set("Cache-Control", "private, no-cache")
+		if cache.Matches(request.Header.Get("If-None-Match"), entry.ETag) {
+			response.Header().Del("Content-Type")
+			response.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if entry.ContentType != "" {
+			response.Header().Set("Content-Type", entry.ContentType)
+		}
+		response.WriteHeader(http.StatusOK)
+		_, _ = response.Write(entry.Body)
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -22,24 +22,43 @@ import (
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
+	"github.com/cldmnky/observability-workshop/src/breaker"
+	"github.com/cldmnky/observability-workshop/src/cache"
+	"github.com/cldmnky/observability-workshop/src/chaos"
+	"github.com/cldmnky/observability-workshop/src/dbclient"
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/notification"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/proxy"
+	"github.com/cldmnky/observability-workshop/src/ratelimit"
+	"github.com/cldmnky/observability-workshop/src/retry"
 	"github.com/cldmnky/observability-workshop/src/telemetry"
+	"github.com/cldmnky/observability-workshop/src/tenant"
 )
 
 type backendApp struct {
-	client              *http.Client
-	databaseURL         string
-	notifierURL         string
-	serviceName         string
-	requestsProcessed   metric.Int64Counter
-	notificationsSent   metric.Int64Counter
-}
-
-type databaseEventRequest struct {
-	Source  string `json:"source"`
-	Method  string `json:"method"`
-	Route   string `json:"route"`
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	// database calls the database, retrying requests that are safe to
+	// repeat.
+	database *dbclient.Client
+	// databaseBreaker guards database and notifierBreaker the notifier
+	// client of notifications; both are reported by /readyz and may be nil.
+	databaseBreaker *breaker.Breaker
+	notifierBreaker *breaker.Breaker
+	// notifications sends note lifecycle events to the notifier in the
+	// background; nil sends none.
+	notifications     *notifierQueue
+	serviceName       string
+	requestsProcessed metric.Int64Counter
+	invalidRequests   metric.Int64Counter
+	tenants           *tenant.Labeler
+	// maxBodyBytes caps the note bodies sent to the database; 0 disables
+	// the limit.
+	maxBodyBytes int64
+	// responses caches database reads per tenant; nil caches nothing.
+	// cacheHits and cacheMisses may be nil.
+	responses   *cache.Cache
+	cacheHits   metric.Int64Counter
+	cacheMisses metric.Int64Counter
 }
 
 func main() {
@@ -68,6 +87,14 @@ func main() {
 	// OTel meter and application-specific counters.
 	var requestsProcessed metric.Int64Counter
 	var notificationsSent metric.Int64Counter
+	var invalidRequests metric.Int64Counter
+	var faultsInjected metric.Int64Counter
+	var databaseRetries metric.Int64Counter
+	var databaseGiveUps metric.Int64Counter
+	var cacheHits metric.Int64Counter
+	var cacheMisses metric.Int64Counter
+	var cacheEvictions metric.Int64Counter
+	var rateLimited metric.Int64Counter
 	if telemetry.Enabled() {
 		meter := otel.Meter(serviceName)
 		var err error
@@ -87,30 +114,179 @@ func main() {
 		if err != nil {
 			slog.Error("creating backend.notifications_sent_total counter", "err", err)
 		}
+		invalidRequests, err = meter.Int64Counter(
+			"backend.requests.invalid",
+			metric.WithDescription("Requests rejected before proxying, by route and reason"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.requests.invalid counter", "err", err)
+		}
+		faultsInjected, err = meter.Int64Counter(
+			"backend.faults.injected",
+			metric.WithDescription("Faults injected into requests, by fault route and kind"),
+			metric.WithUnit("{fault}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.faults.injected counter", "err", err)
+		}
+		databaseRetries, err = meter.Int64Counter(
+			"backend.database.retries",
+			metric.WithDescription("Database requests retried, by method and reason"),
+			metric.WithUnit("{retry}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.database.retries counter", "err", err)
+		}
+		databaseGiveUps, err = meter.Int64Counter(
+			"backend.database.retry_give_ups",
+			metric.WithDescription("Database requests that still failed on their last attempt, by method and reason"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.database.retry_give_ups counter", "err", err)
+		}
+		cacheHits, err = meter.Int64Counter(
+			"backend.cache.hits",
+			metric.WithDescription("Reads answered from the response cache, by route"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.cache.hits counter", "err", err)
+		}
+		cacheMisses, err = meter.Int64Counter(
+			"backend.cache.misses",
+			metric.WithDescription("Reads sent to the database because the response cache had no entry, by route"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.cache.misses counter", "err", err)
+		}
+		cacheEvictions, err = meter.Int64Counter(
+			"backend.cache.evictions",
+			metric.WithDescription("Entries removed from the response cache, by reason"),
+			metric.WithUnit("{entry}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.cache.evictions counter", "err", err)
+		}
+		rateLimited, err = meter.Int64Counter(
+			"backend.ratelimit.requests",
+			metric.WithDescription("Rate-limited requests allowed or refused, by rule route, key type and decision"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating backend.ratelimit.requests counter", "err", err)
+		}
+	}
+
+	// Rate limiting – a token bucket per client and route, configured by
+	// RATE_LIMIT_*. An invalid RATE_LIMIT_ROUTES keeps the default limit.
+	rateLimits, err := ratelimit.ConfigFromEnv()
+	if err != nil {
+		slog.Error("reading rate limits", "err", err)
+	}
+	limiter := ratelimit.New(rateLimits, rateLimited)
+
+	// Fault injection – /admin/faults and /admin/scenarios inject faults
+	// into incoming requests and into calls to the database and notifier.
+	faults := chaos.NewInjector(faultsInjected)
+	scenarios := chaos.NewScenarios(faults, chaos.Presets("backend"))
+	if telemetry.Enabled() {
+		if err := scenarios.RegisterGauge(otel.Meter(serviceName), "backend.scenarios.active"); err != nil {
+			slog.Error("creating backend.scenarios.active gauge", "err", err)
+		}
+	}
+
+	// HTTP clients – otelhttp transport propagates trace context downstream;
+	// the tenant transport forwards the caller's X-Forwarded-User. Outgoing
+	// faults sit inside otelhttp so the client span records them. Database
+	// retries sit outside otelhttp so each attempt gets its own client span,
+	// marked with http.resend_count by retry.MarkResends. The client timeout
+	// covers every attempt. Circuit breakers sit outermost, so a request
+	// counts once however often it was retried, and an open breaker fails it
+	// before any attempt is made. Proxied requests bypass the client
+	// timeout, since an export may stream for longer, so the wait for
+	// response headers is bounded on the transport.
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	baseTransport.ResponseHeaderTimeout = 10 * time.Second
+	var clientTransport http.RoundTripper = retry.MarkResends(faults.Transport(tenant.NewTransport(baseTransport),
+		chaos.PeersByURL(map[string]string{"database": databaseURL, "notifier": notifierURL})))
+	if telemetry.Enabled() {
+		clientTransport = otelhttp.NewTransport(clientTransport)
+	}
+	retryPolicy := retry.Policy{
+		MaxAttempts:       envIntOrDefault("DATABASE_RETRY_MAX_ATTEMPTS", 3),
+		InitialBackoff:    envDurationOrDefault("DATABASE_RETRY_INITIAL_BACKOFF", 100*time.Millisecond),
+		MaxBackoff:        envDurationOrDefault("DATABASE_RETRY_MAX_BACKOFF", 2*time.Second),
+		Jitter:            envFloatOrDefault("DATABASE_RETRY_JITTER", 0.5),
+		RetryableStatuses: envStatusesOrDefault("DATABASE_RETRY_STATUSES", retry.DefaultPolicy().RetryableStatuses),
+	}
+	databaseBreaker := breaker.New("database", breakerSettings("DATABASE"))
+	notifierBreaker := breaker.New("notifier", breakerSettings("NOTIFIER"))
+	if telemetry.Enabled() {
+		if err := breaker.RegisterGauge(otel.Meter(serviceName), "backend.circuit_breaker.state", databaseBreaker, notifierBreaker); err != nil {
+			slog.Error("creating backend.circuit_breaker.state gauge", "err", err)
+		}
 	}
+	database := dbclient.New(databaseURL, &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: databaseBreaker.Transport(retry.NewTransport(clientTransport, retryPolicy, databaseRetries, databaseGiveUps)),
+	})
 
-	// HTTP client – otelhttp transport propagates trace context downstream.
-	clientTransport := http.DefaultTransport
+	// Notifications – sent in the background by a worker pool, each attempt
+	// a single request since the queue does its own retries.
+	notifications := newNotifierQueue(notifierURL,
+		&http.Client{Timeout: 10 * time.Second, Transport: notifierBreaker.Transport(clientTransport)},
+		database,
+		notifierConfig{
+			Workers:            envIntOrDefault("NOTIFIER_WORKERS", 4),
+			QueueSize:          envIntOrDefault("NOTIFIER_QUEUE_SIZE", 1000),
+			MaxAttempts:        envIntOrDefault("NOTIFIER_MAX_ATTEMPTS", 5),
+			InitialBackoff:     envDurationOrDefault("NOTIFIER_INITIAL_BACKOFF", 500*time.Millisecond),
+			MaxBackoff:         envDurationOrDefault("NOTIFIER_MAX_BACKOFF", 30*time.Second),
+			Outbox:             envOrDefault("NOTIFIER_OUTBOX_ENABLED", "false") == "true",
+			OutboxPollInterval: envDurationOrDefault("NOTIFIER_OUTBOX_POLL_INTERVAL", 30*time.Second),
+		},
+		otel.Tracer(serviceName),
+	)
+	notifications.sent = notificationsSent
 	if telemetry.Enabled() {
-		clientTransport = otelhttp.NewTransport(http.DefaultTransport)
+		if err := notifications.registerMetrics(otel.Meter(serviceName)); err != nil {
+			slog.Error("creating backend.notifications metrics", "err", err)
+		}
 	}
+	notifications.start()
+
 	application := &backendApp{
-		client:              &http.Client{Timeout: 10 * time.Second, Transport: clientTransport},
-		databaseURL:         databaseURL,
-		notifierURL:         notifierURL,
-		serviceName:         serviceName,
-		requestsProcessed:   requestsProcessed,
-		notificationsSent:   notificationsSent,
+		database:          database,
+		databaseBreaker:   databaseBreaker,
+		notifierBreaker:   notifierBreaker,
+		notifications:     notifications,
+		serviceName:       serviceName,
+		requestsProcessed: requestsProcessed,
+		invalidRequests:   invalidRequests,
+		responses: cache.New(cache.Settings{
+			TTL:        envDurationOrDefault("BACKEND_CACHE_TTL", 5*time.Second),
+			MaxEntries: envIntOrDefault("BACKEND_CACHE_MAX_ENTRIES", 1000),
+			MaxBytes:   envIntOrDefault("BACKEND_CACHE_MAX_BYTES", 16<<20),
+		}, cacheEvictions),
+		cacheHits:    cacheHits,
+		cacheMisses:  cacheMisses,
+		tenants:      tenant.NewLabeler(tenant.DefaultLabelLimit),
+		maxBodyBytes: int64(envIntOrDefault("BACKEND_MAX_BODY_BYTES", 1<<20)),
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", application.handleHealth)
+	mux.HandleFunc("/readyz", application.handleReady)
 	mux.HandleFunc("/api/ok", application.handleOK)
 	mux.HandleFunc("/api/error", application.handleError)
-	mux.HandleFunc("/api/events", application.handleEvents)
+	mux.HandleFunc("/api/events", application.cacheable("/api/events", application.handleEvents))
+	mux.HandleFunc("/api/events/stats", application.cacheable("/api/events/stats", application.handleEventStats))
 	mux.HandleFunc("/api/notes/export.md", application.handleNotesExport)
-	mux.HandleFunc("/api/notes", application.handleNotes)
-	mux.HandleFunc("/api/notes/", application.handleNoteByID)
+	mux.HandleFunc("/api/notes", application.cacheable("/api/notes", application.handleNotes))
+	mux.HandleFunc("/api/notes/", application.cacheable("/api/notes/:id", application.handleNoteByID))
 
 	// /metrics — Prometheus text-format endpoint, scraped by the downstream
 	// ServiceMonitor (monitoring.rhobs/v1) in the user's namespace.
@@ -119,8 +295,16 @@ func main() {
 	// add an otelhttp.WithFilter option to skip the /metrics path.
 	mux.Handle("/metrics", telemetry.MetricsHandler())
 
+	mux.Handle(chaos.AdminPath, faults)
+	mux.Handle(chaos.AdminPath+"/", faults)
+	mux.Handle(chaos.ScenariosPath, scenarios)
+	mux.Handle(chaos.ScenariosPath+"/", scenarios)
+
 	// otelhttp outermost so the span-enriched context flows into AccessLog.
-	var handler http.Handler = telemetry.AccessLog(serviceName, mux)
+	// tenant.Middleware resolves the caller's tenant for the outgoing calls.
+	// Refused and injected-fault requests sit inside AccessLog so they are
+	// logged; refused requests never reach a fault.
+	var handler http.Handler = tenant.Middleware(telemetry.AccessLog(serviceName, limiter.Middleware(faults.Middleware(mux))))
 	if telemetry.Enabled() {
 		handler = otelhttp.NewHandler(handler, serviceName,
 			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
@@ -153,20 +337,50 @@ func main() {
 	if err := server.Shutdown(shutdownContext); err != nil {
 		slog.Error("shutdown failed", "service", serviceName, "err", err)
 	}
+	if err := notifications.shutdown(shutdownContext); err != nil {
+		slog.Error("notification queue shutdown failed", "service", serviceName, "err", err)
+	}
 	slog.Info("shutdown complete", "service", serviceName)
 }
 
 func (application *backendApp) handleHealth(response http.ResponseWriter, _ *http.Request) {
-	writeJSON(response, http.StatusOK, map[string]string{"status": "ok", "service": application.serviceName})
+	problem.WriteJSON(response, http.StatusOK, map[string]string{"status": "ok", "service": application.serviceName})
+}
+
+// handleReady reports the state of the circuit breaker for each downstream.
+// The backend is not ready (503) while the database breaker is open, since
+// no database call can succeed; an open notifier breaker only means notes
+// are saved without notifications, so it reports "degraded" with 200.
+func (application *backendApp) handleReady(response http.ResponseWriter, _ *http.Request) {
+	status, code := "ready", http.StatusOK
+	breakers := map[string]string{}
+	for _, guard := range []*breaker.Breaker{application.databaseBreaker, application.notifierBreaker} {
+		if guard == nil {
+			continue
+		}
+		state := guard.State()
+		breakers[guard.Name()] = state.String()
+		switch {
+		case state == breaker.Open && guard == application.databaseBreaker:
+			status, code = "unavailable", http.StatusServiceUnavailable
+		case state == breaker.Open && code == http.StatusOK:
+			status = "degraded"
+		}
+	}
+	problem.WriteJSON(response, code, map[string]any{
+		"status":   status,
+		"service":  application.serviceName,
+		"breakers": breakers,
+	})
 }
 
 func (application *backendApp) handleOK(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	err := application.createDatabaseEvent(request.Context(), databaseEventRequest{
+	_, err := application.database.CreateEvent(request.Context(), dbclient.EventInput{
 		Source:  application.serviceName,
 		Method:  request.Method,
 		Route:   request.URL.Path,
@@ -174,7 +388,7 @@ func (application *backendApp) handleOK(response http.ResponseWriter, request *h
 		Message: "successful request",
 	})
 	if err != nil {
-		writeError(response, http.StatusBadGateway, "failed to store event")
+		writeDatabaseError(response, request, err, "failed to store event")
 		return
 	}
 
@@ -184,20 +398,21 @@ func (application *backendApp) handleOK(response http.ResponseWriter, request *h
 				attribute.String("route", request.URL.Path),
 				attribute.String("method", request.Method),
 				attribute.Int("http_status", http.StatusOK),
+				application.tenants.Attribute(request.Context()),
 			),
 		)
 	}
 
-	writeJSON(response, http.StatusOK, map[string]string{"result": "ok", "service": application.serviceName})
+	problem.WriteJSON(response, http.StatusOK, map[string]string{"result": "ok", "service": application.serviceName})
 }
 
 func (application *backendApp) handleError(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	err := application.createDatabaseEvent(request.Context(), databaseEventRequest{
+	_, err := application.database.CreateEvent(request.Context(), dbclient.EventInput{
 		Source:  application.serviceName,
 		Method:  request.Method,
 		Route:   request.URL.Path,
@@ -205,7 +420,7 @@ func (application *backendApp) handleError(response http.ResponseWriter, request
 		Message: "simulated error response",
 	})
 	if err != nil {
-		writeError(response, http.StatusBadGateway, "failed to store event")
+		writeDatabaseError(response, request, err, "failed to store event")
 		return
 	}
 
@@ -215,118 +430,268 @@ func (application *backendApp) handleError(response http.ResponseWriter, request
 				attribute.String("route", request.URL.Path),
 				attribute.String("method", request.Method),
 				attribute.Int("http_status", http.StatusNotFound),
+				application.tenants.Attribute(request.Context()),
 			),
 		)
 	}
 
-	writeJSON(response, http.StatusNotFound, map[string]string{"error": "simulated error", "service": application.serviceName})
+	problem.Write(response, request, http.StatusNotFound, "simulated error from "+application.serviceName)
 }
 
 func (application *backendApp) handleEvents(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	targetURL := fmt.Sprintf("%s/events?limit=100", application.databaseURL)
-	databaseRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, targetURL, nil)
-	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to build request")
-		return
-	}
+	events, err := application.database.ListEvents(request.Context(), dbclient.EventQuery{
+		Limit:   100,
+		TraceID: request.URL.Query().Get("trace_id"),
+	})
+	application.writeDatabaseRead(response, request, map[string]any{"count": len(events), "events": events}, err)
+}
 
-	databaseResponse, err := application.client.Do(databaseRequest)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "database service unavailable")
+// handleEventStats exposes the database's aggregated event statistics so the
+// frontend can draw a small dashboard without querying Prometheus.
+func (application *backendApp) handleEventStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	defer databaseResponse.Body.Close()
 
-	body, err := io.ReadAll(databaseResponse.Body)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "failed reading database response")
-		return
+	query := dbclient.StatsQuery{
+		Window: request.URL.Query().Get("window"),
+		Bucket: request.URL.Query().Get("bucket"),
+	}
+	if groupBy := request.URL.Query().Get("group_by"); groupBy != "" {
+		query.GroupBy = strings.Split(groupBy, ",")
 	}
+	stats, err := application.database.EventStats(request.Context(), query)
+	application.writeDatabaseRead(response, request, stats, err)
+}
 
-	if application.requestsProcessed != nil {
+// writeDatabaseRead answers a read-only database query with payload, or with
+// err when the query failed, and counts it by the database's status.
+func (application *backendApp) writeDatabaseRead(response http.ResponseWriter, request *http.Request, payload any, err error) {
+	status := http.StatusOK
+	var failed *dbclient.Error
+	if errors.As(err, &failed) {
+		status = failed.Status
+	}
+	if application.requestsProcessed != nil && status != 0 {
 		application.requestsProcessed.Add(request.Context(), 1,
 			metric.WithAttributes(
 				attribute.String("route", request.URL.Path),
 				attribute.String("method", request.Method),
-				attribute.Int("http_status", databaseResponse.StatusCode),
+				attribute.Int("http_status", status),
+				application.tenants.Attribute(request.Context()),
 			),
 		)
 	}
 
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(databaseResponse.StatusCode)
-	_, _ = response.Write(body)
+	if err != nil {
+		writeDatabaseFailure(response, request, err)
+		return
+	}
+	problem.WriteJSON(response, http.StatusOK, payload)
 }
 
-func (application *backendApp) handleNotes(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet && request.Method != http.MethodPost {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+// writeDatabaseFailure answers a failed database call. A failure the
+// database answered without a problem keeps its status.
+func writeDatabaseFailure(response http.ResponseWriter, request *http.Request, err error) {
+	var failed *dbclient.Error
+	if errors.As(err, &failed) && failed.Problem == nil && failed.Status >= http.StatusBadRequest {
+		problem.Write(response, request, failed.Status, "database request failed")
 		return
 	}
+	writeDatabaseError(response, request, err, "database service unavailable")
+}
 
-	// For note creation, capture the request body so we can forward both to
-	// the database (via proxyDatabase) and to the notifier service.
-	var title string
-	if request.Method == http.MethodPost && request.Body != nil {
-		body, err := io.ReadAll(request.Body)
-		if err == nil {
-			request.Body = io.NopCloser(bytes.NewReader(body))
-			var nr struct {
-				Title string `json:"title"`
-			}
-			_ = json.Unmarshal(body, &nr)
-			title = nr.Title
+func (application *backendApp) handleNotes(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		traceDatabaseCall(request, "/notes")
+		notes, err := application.database.ListNotes(noteContext(request), dbclient.NoteQuery{
+			Render: request.URL.Query().Get("render"),
+		})
+		application.writeNoteResult(response, request, "/notes", http.StatusOK, map[string]any{"count": len(notes), "notes": notes}, err)
+	case http.MethodPost:
+		input, ok := application.decodeNoteInput(response, request)
+		if !ok {
+			return
 		}
-	}
-
-	application.proxyDatabase(response, request, "/notes")
+		traceDatabaseCall(request, "/notes")
+		created, err := application.database.CreateNote(noteContext(request), input)
+		if err != nil {
+			application.writeNoteResult(response, request, "/notes", 0, nil, err)
+			return
+		}
+		idempotency.MarkSpan(trace.SpanFromContext(request.Context()), created.Replayed)
+		if created.Replayed {
+			response.Header().Set(idempotency.ReplayedHeader, "true")
+		}
+		application.writeNoteResult(response, request, "/notes", http.StatusCreated, created, nil)
 
-	// Notify the notifier service after a successful create. The call uses the
-	// active request context so the outgoing HTTP span is linked to the current
-	// trace. Errors are intentionally ignored – notification is best-effort.
-	if request.Method == http.MethodPost {
-		_ = application.callNotifier(request.Context(), "created", title)
+		// Notify the notifier service after a create, with the id and title
+		// the database stored. Delivery happens in the background, in a span
+		// linked to this request's span.
+		application.publishNote(request, notification.ActionCreated, created)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
 func (application *backendApp) handleNoteByID(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet && request.Method != http.MethodPut && request.Method != http.MethodDelete {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	identifier := strings.TrimPrefix(request.URL.Path, "/api/notes/")
-	if identifier == "" || strings.Contains(identifier, "/") {
-		writeError(response, http.StatusBadRequest, "invalid note id")
+	id, err := strconv.Atoi(identifier)
+	if err != nil || id <= 0 {
+		problem.Write(response, request, http.StatusBadRequest, "invalid note id")
 		return
 	}
-	application.proxyDatabase(response, request, "/notes/"+identifier)
+	path := "/notes/" + identifier
 
-	// Send notification for mutating operations. Best-effort, errors ignored.
 	switch request.Method {
+	case http.MethodGet:
+		traceDatabaseCall(request, path)
+		stored, err := application.database.GetNote(noteContext(request), id)
+		application.writeNoteResult(response, request, path, http.StatusOK, stored, err)
 	case http.MethodPut:
-		_ = application.callNotifier(request.Context(), "updated", "")
+		input, ok := application.decodeNoteInput(response, request)
+		if !ok {
+			return
+		}
+		traceDatabaseCall(request, path)
+		updated, err := application.database.UpdateNote(noteContext(request), id, input)
+		application.writeNoteResult(response, request, path, http.StatusOK, updated, err)
+		if err == nil {
+			application.publishNote(request, notification.ActionUpdated, updated)
+		}
 	case http.MethodDelete:
-		_ = application.callNotifier(request.Context(), "deleted", "")
+		// A delete returns no body, so the title is read before the note
+		// goes.
+		deleted, _ := application.database.GetNote(noteContext(request), id)
+		traceDatabaseCall(request, path)
+		err := application.database.DeleteNote(noteContext(request), id)
+		application.writeNoteResult(response, request, path, http.StatusNoContent, nil, err)
+		if err == nil {
+			application.publishNote(request, notification.ActionDeleted, deleted)
+		}
 	}
 }
 
+// handleNotesExport streams the database's Markdown export, flushing each
+// read so a large export reaches the caller as the database writes it. An
+// export cut off midway aborts the caller's connection.
 func (application *backendApp) handleNotesExport(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	traceDatabaseCall(request, "/notes/export.md")
+	export, err := application.database.ExportNotes(noteContext(request))
+	if err != nil {
+		application.writeNoteResult(response, request, "/notes/export.md", 0, nil, err)
 		return
 	}
-	application.proxyDatabase(response, request, "/notes/export.md")
+	defer export.Close()
+
+	response.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	response.Header().Set("Content-Disposition", "attachment; filename=workshop-notes.md")
+	response.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(response)
+	var written int64
+	buffer := make([]byte, 32<<10)
+	for {
+		read, err := export.Read(buffer)
+		if read > 0 {
+			if _, err := response.Write(buffer[:read]); err != nil {
+				return
+			}
+			written += int64(read)
+			_ = controller.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.WarnContext(request.Context(), "notes export cut off", "error", err, "response_bytes", written)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	trace.SpanFromContext(request.Context()).SetAttributes(attribute.Int64(proxy.ResponseBodySizeAttributeKey, written))
+	application.recordNoteCall(request, "/notes/export.md", http.StatusOK)
 }
 
-func (application *backendApp) proxyDatabase(response http.ResponseWriter, request *http.Request, path string) {
-	// Simulate variable backend processing time (0–60 ms).
-	time.Sleep(time.Duration(rand.Intn(61)) * time.Millisecond)
+// noteContext returns request's context carrying the caller's actor and
+// Idempotency-Key, so the database records the same actor in its audit log
+// as the notifier is sent, and a retried create replays the stored note
+// instead of writing a second one.
+func noteContext(request *http.Request) context.Context {
+	ctx := request.Context()
+	if actor := request.Header.Get(actorHeader); actor != "" {
+		ctx = dbclient.WithActor(ctx, actor)
+	}
+	if key := request.Header.Get(idempotency.Header); key != "" {
+		ctx = dbclient.WithIdempotencyKey(ctx, key)
+	}
+	return ctx
+}
+
+// decodeNoteInput reads the note in request's body, at most maxBodyBytes
+// of it. A body over the limit gets a 413 and one that is not a note a
+// 400, each listing the violation like the database's own validation and
+// counted in backend.requests.invalid.
+func (application *backendApp) decodeNoteInput(response http.ResponseWriter, request *http.Request) (dbclient.NoteInput, bool) {
+	body := request.Body
+	if application.maxBodyBytes > 0 {
+		body = http.MaxBytesReader(response, request.Body, application.maxBodyBytes)
+	}
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	var input dbclient.NoteInput
+	err := decoder.Decode(&input)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		application.rejectNoteBody(response, request, http.StatusRequestEntityTooLarge, problem.Violation{
+			Field:   "body",
+			Reason:  "body_too_large",
+			Message: fmt.Sprintf("body must be at most %d bytes", tooLarge.Limit),
+		})
+		return input, false
+	case err != nil:
+		application.rejectNoteBody(response, request, http.StatusBadRequest, problem.Violation{
+			Field:   "body",
+			Reason:  "invalid_json",
+			Message: err.Error(),
+		})
+		return input, false
+	}
+	return input, true
+}
 
+// rejectNoteBody answers a note request whose body was rejected with status
+// and violation, and counts it in backend.requests.invalid.
+func (application *backendApp) rejectNoteBody(response http.ResponseWriter, request *http.Request, status int, violation problem.Violation) {
+	if application.invalidRequests != nil {
+		application.invalidRequests.Add(request.Context(), 1,
+			metric.WithAttributes(
+				attribute.String("route", "/api/notes"),
+				attribute.String("reason", violation.Reason),
+			),
+		)
+	}
+	problem.Invalid(request, status, []problem.Violation{violation}).Write(response)
+}
+
+// traceDatabaseCall records the database call for path on the request's
+// span.
+func traceDatabaseCall(request *http.Request, path string) {
 	// Set production-grade span attributes: DB semantic conventions + baggage forwarding.
 	if telemetry.Enabled() {
 		span := trace.SpanFromContext(request.Context())
@@ -344,77 +709,63 @@ func (application *backendApp) proxyDatabase(response http.ResponseWriter, reque
 			attribute.String("net.peer.name", "database"),
 		)
 	}
+}
 
-	targetURL := application.databaseURL + path
-	var bodyBuffer []byte
-
-	if request.Body != nil {
-		readBody, err := io.ReadAll(request.Body)
-		if err != nil {
-			writeError(response, http.StatusBadRequest, "failed reading request body")
-			return
-		}
-		bodyBuffer = readBody
-	}
-
-	databaseRequest, err := http.NewRequestWithContext(request.Context(), request.Method, targetURL, bytes.NewReader(bodyBuffer))
+// writeNoteResult answers a notes call to the database at path with status
+// and payload, or with err when the call failed. A nil payload answers
+// status without a body.
+func (application *backendApp) writeNoteResult(response http.ResponseWriter, request *http.Request, path string, status int, payload any, err error) {
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to build request")
+		status = 0
+		var failed *dbclient.Error
+		if errors.As(err, &failed) {
+			status = failed.Status
+		}
+		application.recordNoteCall(request, path, status)
+		writeDatabaseFailure(response, request, err)
 		return
 	}
-
-	contentType := request.Header.Get("Content-Type")
-	if contentType != "" {
-		databaseRequest.Header.Set("Content-Type", contentType)
-	}
-
-	databaseResponse, err := application.client.Do(databaseRequest)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "database service unavailable")
+	application.recordNoteCall(request, path, status)
+	if payload == nil {
+		response.WriteHeader(status)
 		return
 	}
-	defer databaseResponse.Body.Close()
+	problem.WriteJSON(response, status, payload)
+}
 
-	responseBody, err := io.ReadAll(databaseResponse.Body)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "failed reading database response")
+// recordNoteCall counts and logs a notes call to the database at path that
+// the database answered with status, 0 when it could not be reached.
+func (application *backendApp) recordNoteCall(request *http.Request, path string, status int) {
+	if status == 0 {
 		return
 	}
 
-	// OTel application metric: count database proxy requests.
+	// OTel application metric: count database requests.
 	if application.requestsProcessed != nil {
 		application.requestsProcessed.Add(request.Context(), 1,
 			metric.WithAttributes(
 				attribute.String("route", path),
 				attribute.String("method", request.Method),
-				attribute.Int("http_status", databaseResponse.StatusCode),
+				attribute.Int("http_status", status),
+				application.tenants.Attribute(request.Context()),
 			),
 		)
 	}
 
-	// OTel application log: correlate each database proxy with its trace.
-	slog.InfoContext(request.Context(), "proxied to database",
+	// OTel application log: correlate each database call with its trace.
+	slog.InfoContext(request.Context(), "called database",
 		"route", path,
 		"method", request.Method,
-		"http_status", databaseResponse.StatusCode,
+		"http_status", status,
 	)
 
-	if downstreamType := databaseResponse.Header.Get("Content-Type"); downstreamType != "" {
-		response.Header().Set("Content-Type", downstreamType)
-	}
-	if disposition := databaseResponse.Header.Get("Content-Disposition"); disposition != "" {
-		response.Header().Set("Content-Disposition", disposition)
-	}
-
-	// Record the downstream status code on the span so slow/error proxied
-	// responses are visible without expanding the full attribute list.
+	// Record the downstream status code on the span so slow/error database
+	// calls are visible without expanding the full attribute list.
 	if telemetry.Enabled() {
 		trace.SpanFromContext(request.Context()).SetAttributes(
-			attribute.Int("db.response.status_code", databaseResponse.StatusCode),
+			attribute.Int("db.response.status_code", status),
 		)
 	}
-	response.WriteHeader(databaseResponse.StatusCode)
-	_, _ = response.Write(responseBody)
 }
 
 // dbOperationFromHTTPMethod translates an HTTP verb to a SQL operation name
@@ -444,89 +795,93 @@ func dbTableFromPath(path string) string {
 	return "unknown"
 }
 
-// callNotifier sends a note lifecycle event to the notifier service.
-// ctx is the active request context so W3C trace context headers are forwarded,
-// linking the outgoing span to the current trace.
-func (application *backendApp) callNotifier(ctx context.Context, action, title string) error {
-	if application.notifierURL == "" {
-		return nil
-	}
-	payload, err := json.Marshal(map[string]string{"action": action, "title": title})
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		application.notifierURL+"/notify", bytes.NewReader(payload))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := application.client.Do(req)
-	if err != nil {
-		slog.WarnContext(ctx, "notifier unavailable", "err", err)
-		return nil
+// writeDatabaseError reports a failed database call. A problem returned by
+// the database is relayed as is so its detail and trace_id reach the
+// caller; anything else means the database could not be reached.
+func writeDatabaseError(response http.ResponseWriter, request *http.Request, err error, detail string) {
+	var downstream *problem.Problem
+	if errors.As(err, &downstream) {
+		downstream.Write(response)
+		return
 	}
-	defer resp.Body.Close()
-	_, _ = io.Copy(io.Discard, resp.Body)
+	writeUnavailable(response, request, err, detail)
+}
 
-	// OTel application metric: count notifications sent.
-	if application.notificationsSent != nil {
-		application.notificationsSent.Add(ctx, 1,
-			metric.WithAttributes(
-				attribute.String("action", action),
-			),
-		)
+// writeUnavailable reports a database call that failed with err. Calls an
+// open circuit breaker refused get a 503 circuit-open problem with
+// Retry-After set to when the breaker next lets a request through; anything
+// else is a 502 with detail.
+func writeUnavailable(response http.ResponseWriter, request *http.Request, err error, detail string) {
+	var open *breaker.OpenError
+	if !errors.As(err, &open) {
+		problem.Unavailable(request, detail).Write(response)
+		return
 	}
-
-	// OTel application log: record each notification correlated with its trace.
-	slog.InfoContext(ctx, "notification sent to notifier",
-		"action", action,
-		"notifier_status", resp.StatusCode,
-	)
-	return nil
+	seconds := max(int((open.RetryAfter+time.Second-1)/time.Second), 1)
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	circuitOpen := problem.New(request, http.StatusServiceUnavailable, open.Error())
+	circuitOpen.Type = problem.TypeCircuitOpen
+	circuitOpen.Title = "Circuit breaker open"
+	circuitOpen.Write(response)
 }
 
-// createDatabaseEvent posts an event to the database service.
-// ctx is threaded through so that outgoing HTTP calls carry the active span.
-func (application *backendApp) createDatabaseEvent(ctx context.Context, payload databaseEventRequest) error {
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return err
+func envOrDefault(key string, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
 	}
+	return value
+}
 
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/events", application.databaseURL), bytes.NewReader(jsonPayload))
+func envIntOrDefault(key string, fallback int) int {
+	value, err := strconv.Atoi(envOrDefault(key, strconv.Itoa(fallback)))
 	if err != nil {
-		return err
+		return fallback
 	}
-	request.Header.Set("Content-Type", "application/json")
+	return value
+}
 
-	response, err := application.client.Do(request)
+func envFloatOrDefault(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(envOrDefault(key, ""), 64)
 	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-
-	if response.StatusCode >= 300 {
-		body, _ := io.ReadAll(response.Body)
-		return fmt.Errorf("database returned status %d: %s", response.StatusCode, strings.TrimSpace(string(body)))
+		return fallback
 	}
-	return nil
+	return value
 }
 
-func envOrDefault(key string, fallback string) string {
-	value := strings.TrimSpace(os.Getenv(key))
-	if value == "" {
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(envOrDefault(key, fallback.String()))
+	if err != nil {
 		return fallback
 	}
 	return value
 }
 
-func writeError(response http.ResponseWriter, statusCode int, message string) {
-	writeJSON(response, statusCode, map[string]string{"error": message})
+// envStatusesOrDefault parses a comma-separated list of HTTP status codes,
+// such as "502,503,504".
+func envStatusesOrDefault(key string, fallback []int) []int {
+	raw := envOrDefault(key, "")
+	if raw == "" {
+		return fallback
+	}
+	var statuses []int
+	for _, field := range strings.Split(raw, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || status < 100 || status > 599 {
+			return fallback
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
 }
 
-func writeJSON(response http.ResponseWriter, statusCode int, payload any) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(statusCode)
-	_ = json.NewEncoder(response).Encode(payload)
+// breakerSettings reads the circuit breaker settings for the downstream
+// whose environment variables start with prefix, such as DATABASE.
+func breakerSettings(prefix string) breaker.Settings {
+	defaults := breaker.DefaultSettings()
+	return breaker.Settings{
+		FailureThreshold: envIntOrDefault(prefix+"_BREAKER_FAILURE_THRESHOLD", defaults.FailureThreshold),
+		OpenTimeout:      envDurationOrDefault(prefix+"_BREAKER_OPEN_TIMEOUT", defaults.OpenTimeout),
+		HalfOpenRequests: envIntOrDefault(prefix+"_BREAKER_HALF_OPEN_REQUESTS", defaults.HalfOpenRequests),
+	}
 }
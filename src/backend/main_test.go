@@ -2,18 +2,36 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	otelglobal "go.opentelemetry.io/otel/log/global"
 	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
+	"github.com/cldmnky/observability-workshop/src/breaker"
+	"github.com/cldmnky/observability-workshop/src/cache"
+	"github.com/cldmnky/observability-workshop/src/dbclient"
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/notification"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/retry"
 	"github.com/cldmnky/observability-workshop/src/telemetry"
+	"github.com/cldmnky/observability-workshop/src/tenant"
 )
 
 type testLogExporter struct {
@@ -116,3 +134,707 @@ func TestAccessLogEmitsHttpRequestLog(t *testing.T) {
 		t.Fatalf("expected status attribute %d, got %d", http.StatusCreated, status.AsInt64())
 	}
 }
+
+func TestProxyDatabaseForwardsTenant(t *testing.T) {
+	var forwarded string
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		forwarded = request.Header.Get(tenant.Header)
+		response.Header().Set("Content-Type", "application/json")
+		_, _ = response.Write([]byte(`{"count":0,"notes":[]}`))
+	}))
+	defer database.Close()
+
+	application := &backendApp{
+		database:    dbclient.New(database.URL, &http.Client{Transport: tenant.NewTransport(nil)}),
+		serviceName: "backend",
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/notes", nil)
+	request.Header.Set(tenant.Header, "user7")
+	recorder := httptest.NewRecorder()
+	tenant.Middleware(http.HandlerFunc(application.handleNotes)).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if forwarded != "user7" {
+		t.Fatalf("expected the database to see tenant user7, got %q", forwarded)
+	}
+}
+
+func TestHandleNotesRejectsOversizedBody(t *testing.T) {
+	database := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("oversized body must not reach the database")
+	}))
+	defer database.Close()
+
+	application := &backendApp{
+		database:     dbclient.New(database.URL, database.Client()),
+		serviceName:  "backend",
+		maxBodyBytes: 16,
+	}
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"title":"far too long for the limit"}`)
+	application.handleNotes(recorder, httptest.NewRequest(http.MethodPost, "/api/notes", body))
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var payload struct {
+		Violations []map[string]string `json:"violations"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(payload.Violations) != 1 || payload.Violations[0]["reason"] != "body_too_large" {
+		t.Fatalf("unexpected violations %+v", payload.Violations)
+	}
+
+	recorder = httptest.NewRecorder()
+	application.handleNoteByID(recorder, httptest.NewRequest(http.MethodPut, "/api/notes/1", strings.NewReader(`{"pin":1}`)))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), `"reason":"invalid_json"`) {
+		t.Fatalf("expected an unknown field rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestNotesQueryAndHeadersReachTheDatabase(t *testing.T) {
+	var received *http.Request
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received = request
+		problem.WriteJSON(response, http.StatusOK, map[string]any{"count": 1, "notes": []map[string]any{{"id": 1, "title": "a", "html": "<p>a</p>"}}})
+	}))
+	defer database.Close()
+
+	application := &backendApp{database: dbclient.New(database.URL, database.Client()), serviceName: "backend"}
+	request := httptest.NewRequest(http.MethodGet, "/api/notes?render=html", nil)
+	request.Header.Set(actorHeader, "alice")
+	request.Header.Set("Cookie", "session=secret")
+	recorder := httptest.NewRecorder()
+	application.handleNotes(recorder, request)
+
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"html":"\u003cp\u003ea\u003c/p\u003e"`) {
+		t.Fatalf("expected the rendered notes returned, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if received.URL.Path != "/notes" || received.URL.Query().Get("render") != "html" {
+		t.Fatalf("expected the render option sent, got %s", received.URL)
+	}
+	if received.Header.Get(actorHeader) != "alice" || received.Header.Get("Cookie") != "" {
+		t.Fatalf("expected the actor and not the cookie sent, got %v", received.Header)
+	}
+}
+
+func TestNotesExportStreamsFromTheDatabase(t *testing.T) {
+	release := make(chan struct{})
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, _ = io.WriteString(response, "# Notes export\n")
+		http.NewResponseController(response).Flush()
+		select {
+		case <-release:
+		case <-request.Context().Done():
+			return
+		}
+		_, _ = io.WriteString(response, strings.Repeat("## A note\n\nSome text.\n\n", 50000))
+	}))
+	defer database.Close()
+
+	application := &backendApp{database: dbclient.New(database.URL, database.Client()), serviceName: "backend"}
+	backend := httptest.NewServer(http.HandlerFunc(application.handleNotesExport))
+	defer backend.Close()
+
+	response, err := http.Get(backend.URL + "/api/notes/export.md")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Disposition") != "attachment; filename=workshop-notes.md" {
+		t.Fatalf("expected the export sent as an attachment, got %v", response.Header)
+	}
+	first := make(chan string, 1)
+	go func() {
+		heading := make([]byte, len("# Notes export\n"))
+		_, _ = io.ReadFull(response.Body, heading)
+		first <- string(heading)
+	}()
+	select {
+	case heading := <-first:
+		if heading != "# Notes export\n" {
+			t.Fatalf("expected the export heading first, got %q", heading)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("expected the heading before the database finished the export")
+	}
+	close(release)
+	if rest, err := io.ReadAll(response.Body); err != nil || len(rest) != len("## A note\n\nSome text.\n\n")*50000 {
+		t.Fatalf("expected the whole export, got %d bytes: %v", len(rest), err)
+	}
+}
+
+func TestHandleOKRelaysDatabaseProblem(t *testing.T) {
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		rejected := problem.New(request, http.StatusBadRequest, "invalid request body")
+		rejected.TraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		rejected.Write(response)
+	}))
+
+	application := &backendApp{
+		database:    dbclient.New(database.URL, database.Client()),
+		serviceName: "backend",
+	}
+	recorder := httptest.NewRecorder()
+	application.handleOK(recorder, httptest.NewRequest(http.MethodGet, "/api/ok", nil))
+
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Content-Type") != problem.ContentType {
+		t.Fatalf("expected the database's 400 problem, got %d %q: %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+	var relayed problem.Problem
+	if err := json.NewDecoder(recorder.Body).Decode(&relayed); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if relayed.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || relayed.Instance != "/events" || relayed.Detail != "invalid request body" {
+		t.Fatalf("expected the downstream problem unchanged, got %+v", relayed)
+	}
+
+	// With the database gone the backend answers with its own problem.
+	database.Close()
+	recorder = httptest.NewRecorder()
+	application.handleOK(recorder, httptest.NewRequest(http.MethodGet, "/api/ok", nil))
+	var unavailable problem.Problem
+	if err := json.NewDecoder(recorder.Body).Decode(&unavailable); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if recorder.Code != http.StatusBadGateway || unavailable.Type != problem.TypeUnavailable || unavailable.Instance != "/api/ok" {
+		t.Fatalf("expected an upstream-unavailable problem, got %d %+v", recorder.Code, unavailable)
+	}
+}
+
+func TestDatabaseWritesCarryIdempotencyKeys(t *testing.T) {
+	keys := map[string]string{}
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		keys[request.URL.Path] = request.Header.Get(idempotency.Header)
+		response.Header().Set(idempotency.ReplayedHeader, "true")
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusCreated)
+		_, _ = response.Write([]byte(`{"id":1}`))
+	}))
+	defer database.Close()
+
+	application := &backendApp{
+		database:    dbclient.New(database.URL, database.Client()),
+		serviceName: "backend",
+	}
+	application.handleOK(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/ok", nil))
+	if len(keys["/events"]) != 32 {
+		t.Fatalf("expected a generated key on the event write, got %q", keys["/events"])
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"title":"a"}`))
+	request.Header.Set(idempotency.Header, "client-key")
+	recorder := httptest.NewRecorder()
+	application.handleNotes(recorder, request)
+	if keys["/notes"] != "client-key" {
+		t.Fatalf("expected the caller's key to be forwarded, got %q", keys["/notes"])
+	}
+	if recorder.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("expected the replay to be reported to the caller, got %v", recorder.Header())
+	}
+}
+
+func TestDatabaseCallsAreRetried(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		attempts[request.Method+" "+request.URL.Path]++
+		first := attempts[request.Method+" "+request.URL.Path] == 1
+		mu.Unlock()
+		if first {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if request.Method == http.MethodPost {
+			response.WriteHeader(http.StatusCreated)
+		}
+		_, _ = response.Write([]byte(`{"events":[]}`))
+	}))
+	defer database.Close()
+
+	policy := retry.DefaultPolicy()
+	policy.InitialBackoff = time.Millisecond
+	application := &backendApp{
+		database:    dbclient.New(database.URL, &http.Client{Transport: retry.NewTransport(database.Client().Transport, policy, nil, nil)}),
+		serviceName: "backend",
+	}
+
+	events := httptest.NewRecorder()
+	application.handleEvents(events, httptest.NewRequest(http.MethodGet, "/api/events", nil))
+	ok := httptest.NewRecorder()
+	application.handleOK(ok, httptest.NewRequest(http.MethodGet, "/api/ok", nil))
+	if events.Code != http.StatusOK || ok.Code != http.StatusOK {
+		t.Fatalf("expected both calls to succeed on retry, got %d and %d", events.Code, ok.Code)
+	}
+	if attempts["GET /events"] != 2 || attempts["POST /events"] != 2 {
+		t.Fatalf("expected two attempts each, got %v", attempts)
+	}
+}
+
+func TestOpenDatabaseBreakerFailsFast(t *testing.T) {
+	var received int
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		received++
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer database.Close()
+
+	databaseBreaker := breaker.New("database", breaker.Settings{FailureThreshold: 1, OpenTimeout: 90 * time.Second})
+	application := &backendApp{
+		database:        dbclient.New(database.URL, &http.Client{Transport: databaseBreaker.Transport(database.Client().Transport)}),
+		databaseBreaker: databaseBreaker,
+		notifierBreaker: breaker.New("notifier", breaker.DefaultSettings()),
+		serviceName:     "backend",
+	}
+
+	first := httptest.NewRecorder()
+	application.handleEvents(first, httptest.NewRequest(http.MethodGet, "/api/events", nil))
+	second := httptest.NewRecorder()
+	application.handleOK(second, httptest.NewRequest(http.MethodGet, "/api/ok", nil))
+	if first.Code != http.StatusServiceUnavailable || received != 1 {
+		t.Fatalf("expected the first failure to reach the database, got %d after %d requests", first.Code, received)
+	}
+	var body problem.Problem
+	_ = json.Unmarshal(second.Body.Bytes(), &body)
+	if second.Code != http.StatusServiceUnavailable || body.Type != problem.TypeCircuitOpen || second.Header().Get("Retry-After") != "90" {
+		t.Fatalf("expected a circuit-open 503 retrying after 90s, got %d %q %s", second.Code, second.Header().Get("Retry-After"), second.Body.String())
+	}
+
+	ready := httptest.NewRecorder()
+	application.handleReady(ready, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if ready.Code != http.StatusServiceUnavailable ||
+		!strings.Contains(ready.Body.String(), `"database":"open"`) ||
+		!strings.Contains(ready.Body.String(), `"notifier":"closed"`) {
+		t.Fatalf("expected /readyz to report the open database breaker, got %d %s", ready.Code, ready.Body.String())
+	}
+}
+
+func testNotifierConfig() notifierConfig {
+	return notifierConfig{Workers: 1, QueueSize: 16, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+}
+
+func TestNotificationsAreSentInTheBackground(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 4)
+	var calls int
+	notifier := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		<-release
+		calls++
+		if calls == 1 {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		received <- request.Header.Get(idempotency.Header) + " " + string(body)
+	}))
+	defer notifier.Close()
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get(actorHeader) != "alice" {
+			t.Errorf("expected X-Actor forwarded to the database, got %q", request.Header.Get(actorHeader))
+		}
+		problem.WriteJSON(response, http.StatusCreated, map[string]any{"id": 7, "title": "hello"})
+	}))
+	defer database.Close()
+
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	notifications := newNotifierQueue(notifier.URL, notifier.Client(), dbclient.New(database.URL, database.Client()), testNotifierConfig(), tracer)
+	notifications.start()
+	defer notifications.shutdown(context.Background())
+	application := &backendApp{
+		database:      dbclient.New(database.URL, database.Client()),
+		notifications: notifications,
+		serviceName:   "backend",
+	}
+
+	ctx, requestSpan := tracer.Start(context.Background(), "POST /api/notes")
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"title":"hello"}`)).WithContext(ctx)
+	request.Header.Set(actorHeader, "alice")
+	application.handleNotes(recorder, request)
+	requestSpan.End()
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected the note created without waiting on the notifier, got %d", recorder.Code)
+	}
+
+	close(release)
+	select {
+	case got := <-received:
+		key, body, _ := strings.Cut(got, " ")
+		var sent notification.Payload
+		if err := json.Unmarshal([]byte(body), &sent); err != nil || key == "" || sent.Validate() != nil {
+			t.Fatalf("expected a keyed, valid notification, got %q", got)
+		}
+		if sent.Action != notification.ActionCreated || sent.NoteID != 7 || sent.Title != "hello" || sent.Actor != "alice" {
+			t.Fatalf("expected the created note 7 by alice, got %+v", sent)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification never delivered")
+	}
+	notifications.shutdown(context.Background())
+
+	for _, span := range spans.Ended() {
+		if span.Name() != "notifier.deliver" {
+			continue
+		}
+		links := span.Links()
+		if span.Parent().IsValid() || len(links) != 1 || links[0].SpanContext.SpanID() != requestSpan.SpanContext().SpanID() {
+			t.Fatalf("expected a root delivery span linked to the request span, got parent %v and links %v", span.Parent(), links)
+		}
+		return
+	}
+	t.Fatal("expected a notifier.deliver span")
+}
+
+// fakeOutbox serves the database outbox routes from memory. Like the
+// database, it lists every tenant's messages only on /internal/outbox and
+// deletes a message only for the tenant that stored it.
+type fakeOutbox struct {
+	mu       sync.Mutex
+	nextID   int
+	messages map[int]json.RawMessage
+}
+
+func (outbox *fakeOutbox) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	switch {
+	case request.Method == http.MethodPost:
+		var stored map[string]any
+		_ = json.NewDecoder(request.Body).Decode(&stored)
+		outbox.nextID++
+		stored["id"] = outbox.nextID
+		stored["tenant"] = request.Header.Get(tenant.Header)
+		body, _ := json.Marshal(stored)
+		outbox.messages[outbox.nextID] = body
+		problem.WriteJSON(response, http.StatusCreated, json.RawMessage(body))
+	case request.Method == http.MethodGet && request.URL.Path == "/internal/outbox":
+		messages := []json.RawMessage{}
+		for id := 1; id <= outbox.nextID; id++ {
+			if message, ok := outbox.messages[id]; ok {
+				messages = append(messages, message)
+			}
+		}
+		problem.WriteJSON(response, http.StatusOK, map[string]any{"messages": messages})
+	case request.Method == http.MethodDelete:
+		id, _ := strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/outbox/"))
+		var stored struct {
+			Tenant string `json:"tenant"`
+		}
+		if json.Unmarshal(outbox.messages[id], &stored) == nil && stored.Tenant == request.Header.Get(tenant.Header) {
+			delete(outbox.messages, id)
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		problem.Write(response, request, http.StatusNotFound, "not found")
+	}
+}
+
+func TestOutboxNotificationsSurviveARestart(t *testing.T) {
+	outbox := &fakeOutbox{messages: map[int]json.RawMessage{}}
+	database := httptest.NewServer(outbox)
+	defer database.Close()
+	var up sync.Mutex
+	down := true
+	delivered := make(chan string, 4)
+	notifier := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		up.Lock()
+		defer up.Unlock()
+		if down {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- request.Header.Get(idempotency.Header) + " " + request.Header.Get(tenant.Header)
+	}))
+	defer notifier.Close()
+
+	config := testNotifierConfig()
+	config.Outbox = true
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+	client := &http.Client{Transport: tenant.NewTransport(nil)}
+	first := newNotifierQueue(notifier.URL, client, dbclient.New(database.URL, client), config, tracer)
+	first.start()
+	first.publish(tenant.WithTenant(context.Background(), "user1"), notification.New(notification.ActionDeleted, 3, "old", "user1", time.Now()))
+	if err := first.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if len(outbox.messages) != 1 {
+		t.Fatalf("expected the undelivered notification left in the outbox, got %d messages", len(outbox.messages))
+	}
+
+	up.Lock()
+	down = false
+	up.Unlock()
+	config.OutboxPollInterval = time.Hour
+	second := newNotifierQueue(notifier.URL, client, dbclient.New(database.URL, client), config, tracer)
+	second.start()
+	defer second.shutdown(context.Background())
+	select {
+	case got := <-delivered:
+		if key, caller, _ := strings.Cut(got, " "); key == "" || caller != "user1" {
+			t.Fatalf("expected the stored key and tenant, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stored notification never delivered after the restart")
+	}
+	second.shutdown(context.Background())
+	if len(outbox.messages) != 0 {
+		t.Fatalf("expected the delivered notification removed from the outbox, got %d", len(outbox.messages))
+	}
+}
+
+func TestDeleteNotifiesWithTheDeletedNote(t *testing.T) {
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch {
+		case request.URL.Path != "/notes/5":
+			problem.Write(response, request, http.StatusNotFound, "note not found")
+		case request.Method == http.MethodGet:
+			problem.WriteJSON(response, http.StatusOK, map[string]any{"id": 5, "title": "gone"})
+		default:
+			response.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer database.Close()
+	received := make(chan notification.Payload, 4)
+	notifier := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		var sent notification.Payload
+		_ = json.NewDecoder(request.Body).Decode(&sent)
+		received <- sent
+	}))
+	defer notifier.Close()
+
+	notifications := newNotifierQueue(notifier.URL, notifier.Client(), dbclient.New(database.URL, database.Client()), testNotifierConfig(), sdktrace.NewTracerProvider().Tracer("test"))
+	notifications.start()
+	application := &backendApp{database: dbclient.New(database.URL, database.Client()), notifications: notifications, serviceName: "backend"}
+
+	for _, target := range []string{"/api/notes/6", "/api/notes/5"} {
+		request := httptest.NewRequest(http.MethodDelete, target, nil)
+		request = request.WithContext(tenant.WithTenant(request.Context(), "user1"))
+		application.handleNoteByID(httptest.NewRecorder(), request)
+	}
+	if err := notifications.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("expected only the successful delete notified, got %d notifications", len(received))
+	}
+	sent := <-received
+	if sent.Action != notification.ActionDeleted || sent.NoteID != 5 || sent.Title != "gone" || sent.Actor != "user1" {
+		t.Fatalf("expected note 5 deleted by the tenant, got %+v", sent)
+	}
+}
+
+func TestRejectedNotificationsAreDroppedWithoutRetries(t *testing.T) {
+	var calls atomic.Int32
+	notifier := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		problem.Invalid(request, http.StatusUnprocessableEntity, []problem.Violation{
+			{Field: "schema_version", Reason: "value_error", Message: "unsupported schema_version 1"},
+		}).Write(response)
+	}))
+	defer notifier.Close()
+
+	notifications := newNotifierQueue(notifier.URL, notifier.Client(), nil, testNotifierConfig(), sdktrace.NewTracerProvider().Tracer("test"))
+	notifications.start()
+	delivery := notifierDelivery{notification: notification.New(notification.ActionUpdated, 1, "a", "user1", time.Now())}
+	if _, retryable, err := notifications.send(context.Background(), delivery); retryable || err == nil || !strings.Contains(err.Error(), "schema_version: unsupported schema_version 1") {
+		t.Fatalf("expected a permanent error naming the violation, got retryable=%v %v", retryable, err)
+	}
+
+	// An invalid payload never reaches the notifier, and a rejected one is
+	// sent once.
+	notifications.publish(context.Background(), notification.New(notification.ActionUpdated, 0, "a", "user1", time.Now()))
+	notifications.publish(context.Background(), delivery.notification)
+	if err := notifications.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected 2 notifier calls, got %d", got)
+	}
+}
+
+func TestReadsAreCachedUntilAWrite(t *testing.T) {
+	var reads atomic.Int32
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			problem.WriteJSON(response, http.StatusCreated, map[string]any{"id": 1, "title": "a"})
+			return
+		}
+		problem.WriteJSON(response, http.StatusOK, map[string]any{"notes": []map[string]any{{"id": reads.Add(1), "title": "a"}}})
+	}))
+	defer database.Close()
+	application := &backendApp{
+		database:    dbclient.New(database.URL, database.Client()),
+		serviceName: "backend",
+		responses:   cache.New(cache.DefaultSettings(), nil),
+	}
+	handler := application.cacheable("/api/notes", application.handleNotes)
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+
+	serve := func(method string, tenantID string, ifNoneMatch string) *httptest.ResponseRecorder {
+		ctx, span := tracer.Start(tenant.WithTenant(context.Background(), tenantID), method+" /api/notes")
+		defer span.End()
+		request := httptest.NewRequest(method, "/api/notes", strings.NewReader(`{"title":"a"}`)).WithContext(ctx)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder
+	}
+
+	first := serve(http.MethodGet, "user1", "")
+	second := serve(http.MethodGet, "user1", "")
+	etag := first.Header().Get("ETag")
+	if etag == "" || second.Header().Get("ETag") != etag || second.Body.String() != first.Body.String() || second.Header().Get("Age") == "" {
+		t.Fatalf("expected the second read served from the cache with the same ETag, got %q and %q", first.Body.String(), second.Body.String())
+	}
+	if reads.Load() != 1 {
+		t.Fatalf("expected 1 database read, got %d", reads.Load())
+	}
+	for index, hit := range []bool{false, true} {
+		if ended := spans.Ended(); len(ended) != 2 || !slices.Contains(ended[index].Attributes(), attribute.Bool("cache.hit", hit)) {
+			t.Fatalf("expected cache.hit=%v on read %d", hit, index+1)
+		}
+	}
+
+	if recorder := serve(http.MethodGet, "user1", etag); recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Fatalf("expected 304 for a matching If-None-Match, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	serve(http.MethodGet, "user2", "")
+	if reads.Load() != 2 {
+		t.Fatalf("expected another tenant's read to miss, got %d database reads", reads.Load())
+	}
+
+	if recorder := serve(http.MethodPost, "user1", ""); recorder.Code != http.StatusCreated {
+		t.Fatalf("expected the note created, got %d", recorder.Code)
+	}
+	if recorder := serve(http.MethodGet, "user1", etag); recorder.Code != http.StatusOK || recorder.Header().Get("ETag") == etag {
+		t.Fatalf("expected a fresh read with a new ETag after the write, got %d", recorder.Code)
+	}
+	if reads.Load() != 3 {
+		t.Fatalf("expected the write to invalidate user1's reads, got %d database reads", reads.Load())
+	}
+}
+
+func TestAReadRacingAWriteIsNotCached(t *testing.T) {
+	var reads atomic.Int32
+	var title atomic.Value
+	title.Store("old")
+	reading, release := make(chan struct{}), make(chan struct{})
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			title.Store("new")
+			problem.WriteJSON(response, http.StatusCreated, map[string]any{"id": 1, "title": "new"})
+			return
+		}
+		read := title.Load()
+		if reads.Add(1) == 1 {
+			close(reading)
+			<-release
+		}
+		problem.WriteJSON(response, http.StatusOK, map[string]any{"notes": []map[string]any{{"id": 1, "title": read}}})
+	}))
+	defer database.Close()
+	application := &backendApp{
+		database:    dbclient.New(database.URL, database.Client()),
+		serviceName: "backend",
+		responses:   cache.New(cache.DefaultSettings(), nil),
+	}
+	handler := application.cacheable("/api/notes", application.handleNotes)
+	serve := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(method, "/api/notes", strings.NewReader(`{"title":"new"}`)))
+		return recorder
+	}
+
+	stale := make(chan *httptest.ResponseRecorder, 1)
+	go func() { stale <- serve(http.MethodGet) }()
+	<-reading
+	if recorder := serve(http.MethodPost); recorder.Code != http.StatusCreated {
+		t.Fatalf("expected the note created, got %d", recorder.Code)
+	}
+	close(release)
+	if recorder := <-stale; !strings.Contains(recorder.Body.String(), "old") {
+		t.Fatalf("expected the racing read to see the old title, got %q", recorder.Body.String())
+	}
+
+	if recorder := serve(http.MethodGet); !strings.Contains(recorder.Body.String(), "new") || reads.Load() != 2 {
+		t.Fatalf("expected the next read to miss and see the write, got %q after %d database reads", recorder.Body.String(), reads.Load())
+	}
+}
+
+func TestUncachedResponsesStream(t *testing.T) {
+	release := make(chan struct{})
+	stream := func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodGet {
+			response.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			response.Header().Set("Content-Type", "application/x-ndjson")
+			response.WriteHeader(http.StatusAccepted)
+		}
+		_, _ = io.WriteString(response, "first\n")
+		http.NewResponseController(response).Flush()
+		select {
+		case <-release:
+		case <-request.Context().Done():
+			return
+		}
+		_, _ = io.WriteString(response, "second\n")
+	}
+
+	application := &backendApp{serviceName: "backend", responses: cache.New(cache.DefaultSettings(), nil)}
+	backend := httptest.NewServer(application.cacheable("/api/notes", stream))
+	defer backend.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		// The response is read in the background, since a held response
+		// would not even send its headers before the handler finished.
+		type firstLine struct {
+			response *http.Response
+			line     string
+			err      error
+		}
+		first := make(chan firstLine, 1)
+		go func() {
+			request, _ := http.NewRequest(method, backend.URL+"/api/notes", strings.NewReader(`{"title":"a"}`))
+			response, err := backend.Client().Do(request)
+			if err != nil {
+				first <- firstLine{err: err}
+				return
+			}
+			line := make([]byte, len("first\n"))
+			_, err = io.ReadFull(response.Body, line)
+			first <- firstLine{response, string(line), err}
+		}()
+		var received firstLine
+		select {
+		case received = <-first:
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatalf("%s: expected the first line before the handler finished", method)
+		}
+		if received.err != nil || received.line != "first\n" {
+			t.Fatalf("%s: expected the first line, got %q: %v", method, received.line, received.err)
+		}
+		release <- struct{}{}
+		rest, err := io.ReadAll(received.response.Body)
+		received.response.Body.Close()
+		if err != nil || string(rest) != "second\n" {
+			t.Fatalf("%s: expected the rest of the stream, got %q: %v", method, rest, err)
+		}
+	}
+	if _, hit := application.responses.Get(context.Background(), tenant.Default+" /api/notes"); hit {
+		t.Fatal("expected the event stream not cached")
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/breaker"
+	"github.com/cldmnky/observability-workshop/src/dbclient"
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/notification"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/retry"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// outboxDestination is the database outbox destination of notifications.
+const outboxDestination = "notifier"
+
+// Who made a change, as the database resolves its audit actor: the
+// actorHeader, then the actorBaggageKey member, then the tenant.
+const (
+	actorHeader     = "X-Actor"
+	actorBaggageKey = "actor.id"
+)
+
+// outboxNotification is the payload stored in the database outbox. Key is
+// the Idempotency-Key sent with every attempt, so the notifier records a
+// redelivered notification once.
+type outboxNotification struct {
+	Key          string               `json:"key"`
+	Notification notification.Payload `json:"notification"`
+}
+
+type notifierConfig struct {
+	Workers        int
+	QueueSize      int
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Outbox stores every notification in the database outbox until it is
+	// delivered, and OutboxPollInterval is how often stored notifications
+	// are queued again, including those left by an earlier process.
+	Outbox             bool
+	OutboxPollInterval time.Duration
+}
+
+type notifierDelivery struct {
+	notification notification.Payload
+	key          string
+	// link is the span of the request that produced the notification.
+	link     trace.SpanContext
+	tenant   string
+	outboxID int
+	queuedAt time.Time
+}
+
+// notifierQueue sends notifications to the notifier in the background, so
+// note writes neither wait on the notifier nor fail with it. Notifications
+// are queued and sent by a small worker pool; each one is retried with
+// exponential backoff. Without the outbox a notification that cannot be
+// queued or delivered is dropped; with it, it stays in the database until a
+// later poll delivers it.
+type notifierQueue struct {
+	notifierURL string
+	// client calls the notifier and database the database outbox.
+	client   *http.Client
+	database *dbclient.Client
+	config   notifierConfig
+	// policy spaces a delivery's retries, built from config.
+	policy retry.Policy
+	tracer trace.Tracer
+
+	mu       sync.Mutex
+	closed   bool
+	queue    chan notifierDelivery
+	stopping chan struct{}
+	workers  sync.WaitGroup
+	// pending holds the key and queue time of every notification queued or
+	// being delivered, so outbox polls skip them and the oldest age can be
+	// reported.
+	pending map[string]time.Time
+
+	// sent and dropped may be nil.
+	sent    metric.Int64Counter
+	dropped metric.Int64Counter
+}
+
+func newNotifierQueue(notifierURL string, client *http.Client, database *dbclient.Client, config notifierConfig, tracer trace.Tracer) *notifierQueue {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	return &notifierQueue{
+		notifierURL: notifierURL,
+		client:      client,
+		database:    database,
+		config:      config,
+		policy: retry.Policy{
+			MaxAttempts:    config.MaxAttempts,
+			InitialBackoff: config.InitialBackoff,
+			MaxBackoff:     config.MaxBackoff,
+		},
+		tracer:   tracer,
+		queue:    make(chan notifierDelivery, config.QueueSize),
+		stopping: make(chan struct{}),
+		pending:  map[string]time.Time{},
+	}
+}
+
+// registerMetrics creates backend.notifications.dropped and the queue depth
+// and oldest-age gauges on meter.
+func (queue *notifierQueue) registerMetrics(meter metric.Meter) error {
+	var err error
+	queue.dropped, err = meter.Int64Counter(
+		"backend.notifications.dropped",
+		metric.WithDescription("Notifications dropped without being delivered, by reason"),
+		metric.WithUnit("{notification}"),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableGauge(
+		"backend.notifications.queue.depth",
+		metric.WithDescription("Notifications waiting for a worker"),
+		metric.WithUnit("{notification}"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			observer.Observe(int64(len(queue.queue)))
+			return nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.Float64ObservableGauge(
+		"backend.notifications.queue.oldest_age",
+		metric.WithDescription("Time since the oldest undelivered notification was queued"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, observer metric.Float64Observer) error {
+			observer.Observe(queue.oldestAge().Seconds())
+			return nil
+		}),
+	)
+	return err
+}
+
+func (queue *notifierQueue) start() {
+	for range queue.config.Workers {
+		queue.workers.Add(1)
+		go func() {
+			defer queue.workers.Done()
+			for delivery := range queue.queue {
+				queue.deliver(delivery)
+			}
+		}()
+	}
+	if queue.config.Outbox && queue.config.OutboxPollInterval > 0 {
+		go queue.pollOutbox()
+	}
+}
+
+// shutdown stops accepting notifications, aborts pending backoff waits and
+// waits for in-flight deliveries to finish or ctx to expire.
+func (queue *notifierQueue) shutdown(ctx context.Context) error {
+	if queue == nil {
+		return nil
+	}
+	queue.mu.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.stopping)
+		close(queue.queue)
+	}
+	queue.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		queue.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish queues payload for the request with ctx. It never waits on the
+// notifier. An invalid payload is dropped here rather than sent for the
+// notifier to reject. With the outbox enabled it first stores the
+// notification in the database, as part of the request's trace.
+func (queue *notifierQueue) publish(ctx context.Context, payload notification.Payload) {
+	if queue == nil || queue.notifierURL == "" {
+		return
+	}
+	delivery := notifierDelivery{
+		notification: payload,
+		key:          idempotency.NewKey(),
+		link:         trace.SpanContextFromContext(ctx),
+		tenant:       tenant.FromContext(ctx),
+		queuedAt:     time.Now(),
+	}
+	if err := payload.Validate(); err != nil {
+		queue.drop(ctx, delivery, "invalid", err)
+		return
+	}
+	queue.track(delivery)
+
+	if queue.config.Outbox {
+		id, err := queue.storeInOutbox(ctx, delivery)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to store notification in outbox", "action", payload.Action, "err", err)
+		}
+		delivery.outboxID = id
+	}
+
+	if !queue.enqueue(delivery) {
+		queue.untrack(delivery)
+		if delivery.outboxID != 0 {
+			slog.WarnContext(ctx, "notification queue full, left in outbox", "action", payload.Action, "outbox.id", delivery.outboxID)
+			return
+		}
+		queue.drop(ctx, delivery, "queue_full", nil)
+	}
+}
+
+func (queue *notifierQueue) enqueue(delivery notifierDelivery) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.closed {
+		return false
+	}
+	select {
+	case queue.queue <- delivery:
+		return true
+	default:
+		return false
+	}
+}
+
+func (queue *notifierQueue) track(delivery notifierDelivery) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.pending[delivery.key] = delivery.queuedAt
+}
+
+func (queue *notifierQueue) untrack(delivery notifierDelivery) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	delete(queue.pending, delivery.key)
+}
+
+func (queue *notifierQueue) oldestAge() time.Duration {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	var oldest time.Duration
+	for _, queuedAt := range queue.pending {
+		oldest = max(oldest, time.Since(queuedAt))
+	}
+	return oldest
+}
+
+// deliver sends one notification in a span of its own, linked to the span
+// of the request that produced it, retrying failures with exponential
+// backoff until MaxAttempts is reached.
+func (queue *notifierQueue) deliver(delivery notifierDelivery) {
+	defer queue.untrack(delivery)
+
+	ctx := tenant.WithTenant(context.Background(), delivery.tenant)
+	ctx, span := queue.tracer.Start(ctx, "notifier.deliver",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(trace.Link{SpanContext: delivery.link}),
+		trace.WithAttributes(
+			attribute.String("notification.action", delivery.notification.Action),
+			attribute.Int("note.id", delivery.notification.NoteID),
+			attribute.Int64("notification.queue_wait_ms", time.Since(delivery.queuedAt).Milliseconds()),
+		),
+	)
+	defer span.End()
+	if delivery.outboxID != 0 {
+		span.SetAttributes(attribute.Int("outbox.id", delivery.outboxID))
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= queue.config.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(queue.policy.Backoff(attempt - 1)):
+			case <-queue.stopping:
+				queue.giveUp(ctx, span, delivery, attempt-1, fmt.Errorf("shutdown before retry: %w", lastErr))
+				return
+			}
+		}
+
+		status, retryable, err := queue.send(ctx, delivery)
+		if err == nil {
+			span.SetAttributes(attribute.Int("notification.attempts", attempt))
+			if queue.sent != nil {
+				queue.sent.Add(ctx, 1, metric.WithAttributes(attribute.String("action", delivery.notification.Action)))
+			}
+			slog.InfoContext(ctx, "notification sent to notifier",
+				"action", delivery.notification.Action,
+				"notifier_status", status,
+				"notification.attempts", attempt,
+			)
+			queue.removeFromOutbox(ctx, delivery)
+			return
+		}
+
+		lastErr = err
+		if !errors.Is(err, breaker.ErrOpen) {
+			slog.WarnContext(ctx, "notification attempt failed",
+				"action", delivery.notification.Action,
+				"notification.attempt", attempt,
+				"err", err,
+			)
+		}
+		if !retryable {
+			queue.reject(ctx, span, delivery, attempt, err)
+			return
+		}
+	}
+	queue.giveUp(ctx, span, delivery, queue.config.MaxAttempts, lastErr)
+}
+
+// send makes a single attempt. The boolean reports whether a failure is
+// worth retrying: transport errors, an open circuit breaker, 408, 429 and
+// 5xx. A notifier problem document, such as the 422 for a payload that does
+// not match its schema, is returned as the error.
+func (queue *notifierQueue) send(ctx context.Context, delivery notifierDelivery) (int, bool, error) {
+	payload, err := json.Marshal(delivery.notification)
+	if err != nil {
+		return 0, false, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, queue.notifierURL+"/notify", bytes.NewReader(payload))
+	if err != nil {
+		return 0, false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	// The notifier reuses the key for the event it records.
+	request.Header.Set(idempotency.Header, delivery.key)
+
+	response, err := queue.client.Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, response.Body)
+		return response.StatusCode, false, nil
+	}
+	retryable := response.StatusCode == http.StatusRequestTimeout ||
+		response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode >= 500
+	err = fmt.Errorf("notifier returned status %d", response.StatusCode)
+	if downstream, ok := problem.Decode(response); ok {
+		err = fmt.Errorf("%w: %w", err, downstream)
+		for _, violation := range downstream.Violations {
+			err = fmt.Errorf("%w; %s: %s", err, violation.Field, violation.Message)
+		}
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	return response.StatusCode, retryable, err
+}
+
+// giveUp ends a delivery that failed for good. Notifications in the outbox
+// stay there for the next poll; the rest are dropped.
+func (queue *notifierQueue) giveUp(ctx context.Context, span trace.Span, delivery notifierDelivery, attempts int, err error) {
+	span.SetAttributes(attribute.Int("notification.attempts", attempts))
+	span.SetStatus(codes.Error, err.Error())
+	if delivery.outboxID != 0 {
+		slog.WarnContext(ctx, "notification not delivered, left in outbox",
+			"action", delivery.notification.Action,
+			"notification.attempts", attempts,
+			"outbox.id", delivery.outboxID,
+			"err", err,
+		)
+		return
+	}
+	queue.drop(ctx, delivery, "undeliverable", err)
+}
+
+// reject ends a delivery the notifier refused for a reason retrying cannot
+// fix, such as a payload that does not match its schema. It is dropped and
+// removed from the outbox, so later polls do not send it again.
+func (queue *notifierQueue) reject(ctx context.Context, span trace.Span, delivery notifierDelivery, attempts int, err error) {
+	span.SetAttributes(attribute.Int("notification.attempts", attempts))
+	span.SetStatus(codes.Error, err.Error())
+	queue.removeFromOutbox(ctx, delivery)
+	queue.drop(ctx, delivery, "rejected", err)
+}
+
+// drop counts and logs a notification that will not be delivered, with the
+// error that stopped it, if any.
+func (queue *notifierQueue) drop(ctx context.Context, delivery notifierDelivery, reason string, err error) {
+	if queue.dropped != nil {
+		queue.dropped.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("action", delivery.notification.Action),
+			attribute.String("reason", reason),
+		))
+	}
+	attributes := []any{
+		"action", delivery.notification.Action,
+		"note.id", delivery.notification.NoteID,
+		"reason", reason,
+	}
+	if err != nil {
+		attributes = append(attributes, "err", err)
+	}
+	slog.ErrorContext(ctx, "notification dropped", attributes...)
+}
+
+// storeInOutbox saves delivery in the database outbox and returns its id.
+func (queue *notifierQueue) storeInOutbox(ctx context.Context, delivery notifierDelivery) (int, error) {
+	payload, err := json.Marshal(outboxNotification{Key: delivery.key, Notification: delivery.notification})
+	if err != nil {
+		return 0, err
+	}
+	input := dbclient.OutboxInput{Destination: outboxDestination, Payload: payload}
+	if delivery.link.IsValid() {
+		input.TraceID = delivery.link.TraceID().String()
+		input.SpanID = delivery.link.SpanID().String()
+	}
+	// The notification key doubles as the Idempotency-Key, so a retried
+	// store keeps a single outbox row.
+	stored, err := queue.database.CreateOutboxMessage(dbclient.WithIdempotencyKey(ctx, delivery.key), input)
+	return stored.ID, err
+}
+
+func (queue *notifierQueue) removeFromOutbox(ctx context.Context, delivery notifierDelivery) {
+	if delivery.outboxID == 0 {
+		return
+	}
+	if err := queue.database.DeleteOutboxMessage(ctx, delivery.outboxID); err != nil {
+		// The notification stays in the outbox and is sent again with the
+		// same key, which the notifier records once.
+		slog.WarnContext(ctx, "failed to remove notification from outbox", "outbox.id", delivery.outboxID, "err", err)
+	}
+}
+
+// pollOutbox queues stored notifications right away, picking up those left
+// by an earlier process, and again every OutboxPollInterval until shutdown.
+func (queue *notifierQueue) pollOutbox() {
+	ticker := time.NewTicker(queue.config.OutboxPollInterval)
+	defer ticker.Stop()
+	for {
+		queue.requeueOutbox(context.Background())
+		select {
+		case <-ticker.C:
+		case <-queue.stopping:
+			return
+		}
+	}
+}
+
+// requeueOutbox queues the stored notifications that are not already
+// pending, up to the free space in the queue.
+func (queue *notifierQueue) requeueOutbox(ctx context.Context) {
+	limit := cap(queue.queue) - len(queue.queue)
+	if limit <= 0 {
+		return
+	}
+	messages, err := queue.database.ListOutbox(ctx, outboxDestination, min(limit, 1000))
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read notification outbox", "err", err)
+		return
+	}
+
+	requeued := 0
+	for _, message := range messages {
+		var stored outboxNotification
+		if json.Unmarshal(message.Payload, &stored) != nil || stored.Key == "" {
+			continue
+		}
+		delivery := notifierDelivery{
+			notification: stored.Notification,
+			key:          stored.Key,
+			tenant:       message.Tenant,
+			outboxID:     message.ID,
+			queuedAt:     time.Now(),
+		}
+		if createdAt, err := time.Parse(time.RFC3339, message.CreatedAt); err == nil {
+			delivery.queuedAt = createdAt
+		}
+		// Notifications stored by an older backend may not match the
+		// current schema; resending them would only be rejected.
+		if err := delivery.notification.Validate(); err != nil {
+			queue.removeFromOutbox(tenant.WithTenant(ctx, delivery.tenant), delivery)
+			queue.drop(ctx, delivery, "invalid", err)
+			continue
+		}
+		traceID, traceErr := trace.TraceIDFromHex(message.TraceID)
+		spanID, spanErr := trace.SpanIDFromHex(message.SpanID)
+		if traceErr == nil && spanErr == nil {
+			delivery.link = trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			})
+		}
+
+		queue.mu.Lock()
+		_, pending := queue.pending[delivery.key]
+		if !pending {
+			queue.pending[delivery.key] = delivery.queuedAt
+		}
+		queue.mu.Unlock()
+		if pending {
+			continue
+		}
+		if !queue.enqueue(delivery) {
+			queue.untrack(delivery)
+			break
+		}
+		requeued++
+	}
+	if requeued > 0 {
+		slog.InfoContext(ctx, "queued notifications from outbox", "notification.count", requeued)
+	}
+}
+
+// publishNote queues the notification for action on stored. The note id
+// falls back to the one in the request path, for a delete whose note could
+// not be loaded.
+func (application *backendApp) publishNote(request *http.Request, action string, stored dbclient.Note) {
+	if stored.ID == 0 {
+		stored.ID, _ = strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/api/notes/"))
+	}
+	application.notifications.publish(request.Context(),
+		notification.New(action, stored.ID, stored.Title, noteActor(request), time.Now()))
+}
+
+// noteActor returns who made the change in request.
+func noteActor(request *http.Request) string {
+	if actor := request.Header.Get(actorHeader); actor != "" {
+		return actor
+	}
+	if actor := baggage.FromContext(request.Context()).Member(actorBaggageKey).Value(); actor != "" {
+		return actor
+	}
+	return tenant.FromContext(request.Context())
+}
@@ -0,0 +1,267 @@
+// Package breaker stops calling a downstream service that keeps failing.
+//
+// A Breaker starts closed and passes every request through. After
+// FailureThreshold consecutive failures it opens and fails requests at once
+// with an *OpenError, so callers stop waiting on timeouts. Once OpenTimeout
+// has passed it turns half-open and lets HalfOpenRequests trial requests
+// through: if they all succeed it closes again, and if any fails it reopens.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (state State) String() string {
+	switch state {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return "unknown"
+}
+
+// ErrOpen is matched by every *OpenError.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError is returned for requests a Breaker rejects without sending.
+type OpenError struct {
+	// Name is the name of the breaker, which is the downstream it guards.
+	Name string
+	// RetryAfter is how long until the breaker lets a trial request
+	// through.
+	RetryAfter time.Duration
+}
+
+func (err *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", err.Name)
+}
+
+func (err *OpenError) Is(target error) bool { return target == ErrOpen }
+
+// Settings configure a Breaker.
+type Settings struct {
+	// FailureThreshold is the number of consecutive failures that open the
+	// breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before it lets trial
+	// requests through.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of trial requests let through while
+	// half-open. All of them must succeed for the breaker to close.
+	HalfOpenRequests int
+}
+
+// DefaultSettings open a breaker after 5 consecutive failures and try again
+// with a single request after 30s.
+func DefaultSettings() Settings {
+	return Settings{FailureThreshold: 5, OpenTimeout: 30 * time.Second, HalfOpenRequests: 1}
+}
+
+// Breaker is a circuit breaker guarding one downstream service.
+type Breaker struct {
+	name     string
+	settings Settings
+	now      func() time.Time
+
+	mu    sync.Mutex
+	state State
+	// generation changes on every transition, so outcomes of requests
+	// admitted in an earlier state are ignored.
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	// trials is the number of half-open requests admitted, and successes
+	// the number of those that succeeded.
+	trials    int
+	successes int
+}
+
+// New returns a closed Breaker guarding the downstream called name.
+// Settings below one are raised to one.
+func New(name string, settings Settings) *Breaker {
+	settings.FailureThreshold = max(settings.FailureThreshold, 1)
+	settings.HalfOpenRequests = max(settings.HalfOpenRequests, 1)
+	return &Breaker{name: name, settings: settings, now: time.Now}
+}
+
+// Name returns the name of the downstream the breaker guards.
+func (breaker *Breaker) Name() string { return breaker.name }
+
+// State returns the current state, turning an open breaker half-open once
+// its OpenTimeout has passed.
+func (breaker *Breaker) State() State {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.advanceLocked()
+	return breaker.state
+}
+
+func (breaker *Breaker) advanceLocked() {
+	if breaker.state == Open && !breaker.now().Before(breaker.openedAt.Add(breaker.settings.OpenTimeout)) {
+		breaker.transitionLocked(HalfOpen)
+	}
+}
+
+func (breaker *Breaker) transitionLocked(to State) {
+	from := breaker.state
+	breaker.state = to
+	breaker.generation++
+	breaker.trials, breaker.successes = 0, 0
+	if to == Open {
+		breaker.openedAt = breaker.now()
+	}
+	if to == Closed {
+		breaker.failures = 0
+	}
+
+	level := slog.LevelInfo
+	if to == Open {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "circuit breaker state changed",
+		"breaker.name", breaker.name,
+		"breaker.from", from.String(),
+		"breaker.to", to.String(),
+		"breaker.failures", breaker.failures,
+	)
+}
+
+// allow admits a request, returning the generation to report its outcome
+// against, or an *OpenError.
+func (breaker *Breaker) allow() (uint64, error) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.advanceLocked()
+
+	switch breaker.state {
+	case Open:
+		retryAfter := breaker.openedAt.Add(breaker.settings.OpenTimeout).Sub(breaker.now())
+		return 0, &OpenError{Name: breaker.name, RetryAfter: retryAfter}
+	case HalfOpen:
+		if breaker.trials >= breaker.settings.HalfOpenRequests {
+			return 0, &OpenError{Name: breaker.name, RetryAfter: time.Second}
+		}
+		breaker.trials++
+	}
+	return breaker.generation, nil
+}
+
+// record reports the outcome of a request admitted in generation.
+func (breaker *Breaker) record(generation uint64, failed bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if generation != breaker.generation {
+		return
+	}
+
+	switch {
+	case breaker.state == Closed && failed:
+		breaker.failures++
+		if breaker.failures >= breaker.settings.FailureThreshold {
+			breaker.transitionLocked(Open)
+		}
+	case breaker.state == Closed:
+		breaker.failures = 0
+	case breaker.state == HalfOpen && failed:
+		breaker.transitionLocked(Open)
+	case breaker.state == HalfOpen:
+		breaker.successes++
+		if breaker.successes >= breaker.settings.HalfOpenRequests {
+			breaker.transitionLocked(Closed)
+		}
+	}
+}
+
+// release gives back a half-open trial whose outcome says nothing about the
+// downstream, such as a request the caller cancelled.
+func (breaker *Breaker) release(generation uint64) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if generation == breaker.generation && breaker.state == HalfOpen {
+		breaker.trials--
+	}
+}
+
+// Transport sends requests through next while the breaker allows them.
+// Transport errors, including timeouts, and 5xx responses count as
+// failures; requests the caller cancelled count as neither. Rejected
+// requests fail with an *OpenError and add a "circuit breaker open" event to
+// the span in their context.
+func (breaker *Breaker) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		generation, err := breaker.allow()
+		if err != nil {
+			trace.SpanFromContext(request.Context()).AddEvent("circuit breaker open",
+				trace.WithAttributes(attribute.String("breaker.name", breaker.name)))
+			return nil, err
+		}
+
+		response, err := next.RoundTrip(request)
+		switch {
+		case err != nil && errors.Is(request.Context().Err(), context.Canceled):
+			breaker.release(generation)
+		case err != nil:
+			breaker.record(generation, true)
+		default:
+			breaker.record(generation, response.StatusCode >= http.StatusInternalServerError)
+		}
+		return response, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// RegisterGauge registers an observable gauge called name reporting, for
+// each breaker and state, 1 for the breaker's current state and 0 for the
+// others, labelled by peer and state.
+func RegisterGauge(meter metric.Meter, name string, breakers ...*Breaker) error {
+	_, err := meter.Int64ObservableGauge(name,
+		metric.WithDescription("Circuit breaker state per downstream: 1 for the current state, 0 otherwise"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			for _, breaker := range breakers {
+				current := breaker.State()
+				for _, state := range []State{Closed, HalfOpen, Open} {
+					var value int64
+					if state == current {
+						value = 1
+					}
+					observer.Observe(value, metric.WithAttributes(
+						attribute.String("peer", breaker.name),
+						attribute.String("state", state.String()),
+					))
+				}
+			}
+			return nil
+		}),
+	)
+	return err
+}
@@ -0,0 +1,166 @@
+package breaker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/cldmnky/observability-workshop/src/breaker"
+)
+
+// switchServer answers 503 while failing is set and 200 otherwise, counting
+// the requests it receives.
+type switchServer struct {
+	*httptest.Server
+	failing  atomic.Bool
+	received atomic.Int64
+}
+
+func newSwitchServer(t *testing.T) *switchServer {
+	t.Helper()
+	server := &switchServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		server.received.Add(1)
+		if server.failing.Load() {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(client *http.Client, url string) (int, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	server := newSwitchServer(t)
+	guard := breaker.New("database", breaker.Settings{FailureThreshold: 3, OpenTimeout: 50 * time.Millisecond, HalfOpenRequests: 1})
+	client := &http.Client{Transport: guard.Transport(server.Client().Transport)}
+
+	server.failing.Store(true)
+	for range 3 {
+		if status, err := get(client, server.URL); err != nil || status != http.StatusServiceUnavailable {
+			t.Fatalf("expected the 503 passed through while closed, got %d %v", status, err)
+		}
+	}
+	if state := guard.State(); state != breaker.Open {
+		t.Fatalf("expected the breaker open after 3 failures, got %s", state)
+	}
+
+	_, err := get(client, server.URL)
+	var open *breaker.OpenError
+	if !errors.As(err, &open) || !errors.Is(err, breaker.ErrOpen) || open.Name != "database" || open.RetryAfter <= 0 {
+		t.Fatalf("expected an OpenError with a retry delay, got %v", err)
+	}
+	if received := server.received.Load(); received != 3 {
+		t.Fatalf("expected the open breaker not to send, got %d requests", received)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if state := guard.State(); state != breaker.HalfOpen {
+		t.Fatalf("expected the breaker half-open after the timeout, got %s", state)
+	}
+	if _, err := get(client, server.URL); err != nil || guard.State() != breaker.Open {
+		t.Fatalf("expected a failed trial to reopen the breaker, got %s %v", guard.State(), err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	server.failing.Store(false)
+	if status, err := get(client, server.URL); err != nil || status != http.StatusOK || guard.State() != breaker.Closed {
+		t.Fatalf("expected a successful trial to close the breaker, got %d %s %v", status, guard.State(), err)
+	}
+}
+
+func TestBreakerCountsConsecutiveFailures(t *testing.T) {
+	server := newSwitchServer(t)
+	guard := breaker.New("notifier", breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Minute})
+	client := &http.Client{Transport: guard.Transport(server.Client().Transport)}
+
+	for _, failing := range []bool{true, false, true, false, true} {
+		server.failing.Store(failing)
+		_, _ = get(client, server.URL)
+	}
+	if state := guard.State(); state != breaker.Closed {
+		t.Fatalf("expected successes in between to keep the breaker closed, got %s", state)
+	}
+
+	// Connection errors count as failures.
+	server.Close()
+	for range 2 {
+		_, _ = get(client, server.URL)
+	}
+	if state := guard.State(); state != breaker.Open {
+		t.Fatalf("expected connection errors to open the breaker, got %s", state)
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	blocked := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-blocked }))
+	defer server.Close()
+	defer close(blocked)
+	guard := breaker.New("database", breaker.Settings{FailureThreshold: 1, OpenTimeout: time.Minute})
+	client := &http.Client{Transport: guard.Transport(server.Client().Transport)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err := client.Do(request); err == nil {
+		t.Fatal("expected the cancelled request to fail")
+	}
+	if state := guard.State(); state != breaker.Closed {
+		t.Fatalf("expected a cancelled request not to count, got %s", state)
+	}
+
+	// A client timeout is the downstream's fault and does count.
+	client.Timeout = 20 * time.Millisecond
+	if _, err := get(client, server.URL); err == nil || guard.State() != breaker.Open {
+		t.Fatalf("expected a timeout to open the breaker, got %s %v", guard.State(), err)
+	}
+}
+
+func TestGaugeReportsTheCurrentState(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	server := newSwitchServer(t)
+	database := breaker.New("database", breaker.Settings{FailureThreshold: 1, OpenTimeout: time.Minute})
+	notifier := breaker.New("notifier", breaker.DefaultSettings())
+	if err := breaker.RegisterGauge(meter, "breaker.state", database, notifier); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	server.failing.Store(true)
+	_, _ = get(&http.Client{Transport: database.Transport(server.Client().Transport)}, server.URL)
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	current := map[string]string{}
+	points := 0
+	for _, point := range collected.ScopeMetrics[0].Metrics[0].Data.(metricdata.Gauge[int64]).DataPoints {
+		points++
+		if point.Value == 1 {
+			peer, _ := point.Attributes.Value(attribute.Key("peer"))
+			state, _ := point.Attributes.Value(attribute.Key("state"))
+			current[peer.AsString()] = state.AsString()
+		}
+	}
+	if points != 6 || current["database"] != "open" || current["notifier"] != "closed" {
+		t.Fatalf("expected one point per breaker and state with database open, got %d points %v", points, current)
+	}
+}
@@ -0,0 +1,232 @@
+// Package cache keeps recent downstream responses in memory.
+//
+// A Cache holds response bodies by key for TTL, bounded by MaxEntries and
+// MaxBytes; when either bound is reached the least recently used entries are
+// evicted. Every entry carries a strong ETag derived from its body, so
+// callers can answer conditional requests with 304 Not Modified whether the
+// body came from the cache or from the downstream.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Eviction reasons recorded on the evictions counter.
+const (
+	ReasonExpired     = "expired"
+	ReasonCapacity    = "capacity"
+	ReasonInvalidated = "invalidated"
+)
+
+// Settings configure a Cache.
+type Settings struct {
+	// TTL is how long an entry is served after it is stored. Zero disables
+	// the cache.
+	TTL time.Duration
+	// MaxEntries and MaxBytes bound the number of entries and the total size
+	// of their bodies. Zero leaves a bound off.
+	MaxEntries int
+	MaxBytes   int
+}
+
+// DefaultSettings keep up to 1000 entries totalling 16 MiB for 5s.
+func DefaultSettings() Settings {
+	return Settings{TTL: 5 * time.Second, MaxEntries: 1000, MaxBytes: 16 << 20}
+}
+
+// Entry is one stored response.
+type Entry struct {
+	Body        []byte
+	ContentType string
+	ETag        string
+	Stored      time.Time
+}
+
+// Age is how long ago entry was stored.
+func (entry Entry) Age() time.Duration {
+	return time.Since(entry.Stored)
+}
+
+type item struct {
+	key   string
+	entry Entry
+}
+
+// Cache is safe for concurrent use. A nil *Cache stores nothing.
+type Cache struct {
+	settings Settings
+	// evictions may be nil.
+	evictions metric.Int64Counter
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// order holds the items most recently used first.
+	order *list.List
+	bytes int
+	// generations counts the invalidations of each prefix, so a response
+	// loaded across one is not stored. See Generation.
+	generations map[string]uint64
+}
+
+// New returns an empty Cache, or nil when settings.TTL is not positive.
+// evictions counts removed entries by reason and may be nil.
+func New(settings Settings, evictions metric.Int64Counter) *Cache {
+	if settings.TTL <= 0 {
+		return nil
+	}
+	return &Cache{
+		settings:    settings,
+		evictions:   evictions,
+		items:       map[string]*list.Element{},
+		order:       list.New(),
+		generations: map[string]uint64{},
+	}
+}
+
+// Get returns the entry stored under key, unless it has expired.
+func (cache *Cache) Get(ctx context.Context, key string) (Entry, bool) {
+	if cache == nil {
+		return Entry{}, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	stored := element.Value.(*item)
+	if stored.entry.Age() >= cache.settings.TTL {
+		cache.removeLocked(ctx, element, ReasonExpired)
+		return Entry{}, false
+	}
+	cache.order.MoveToFront(element)
+	return stored.entry, true
+}
+
+// Set stores body under key and returns the new entry. A body larger than
+// MaxBytes is not stored, but the returned entry still carries its ETag.
+func (cache *Cache) Set(ctx context.Context, key string, body []byte, contentType string) Entry {
+	entry := Entry{Body: body, ContentType: contentType, ETag: ETag(body), Stored: time.Now()}
+	if cache == nil || (cache.settings.MaxBytes > 0 && len(body) > cache.settings.MaxBytes) {
+		return entry
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.setLocked(ctx, key, entry)
+	return entry
+}
+
+// Generation returns how many times prefix has been invalidated. A caller
+// reads it before loading a response and passes it to SetIfCurrent.
+func (cache *Cache) Generation(prefix string) uint64 {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generations[prefix]
+}
+
+// SetIfCurrent stores body under key like Set, unless prefix has been
+// invalidated since generation was read with Generation. The response was
+// then loaded before a write it does not reflect, and storing it would
+// serve the old body for a full TTL. The returned entry carries the ETag
+// either way.
+func (cache *Cache) SetIfCurrent(ctx context.Context, key string, prefix string, generation uint64, body []byte, contentType string) Entry {
+	entry := Entry{Body: body, ContentType: contentType, ETag: ETag(body), Stored: time.Now()}
+	if cache == nil || (cache.settings.MaxBytes > 0 && len(body) > cache.settings.MaxBytes) {
+		return entry
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.generations[prefix] == generation {
+		cache.setLocked(ctx, key, entry)
+	}
+	return entry
+}
+
+func (cache *Cache) setLocked(ctx context.Context, key string, entry Entry) {
+	if element, ok := cache.items[key]; ok {
+		cache.bytes -= len(element.Value.(*item).entry.Body)
+		cache.order.Remove(element)
+		delete(cache.items, key)
+	}
+	cache.items[key] = cache.order.PushFront(&item{key: key, entry: entry})
+	cache.bytes += len(entry.Body)
+
+	for cache.overLocked() {
+		cache.removeLocked(ctx, cache.order.Back(), ReasonCapacity)
+	}
+}
+
+// Invalidate removes every entry whose key starts with prefix and returns
+// how many were removed. It also advances prefix's Generation.
+func (cache *Cache) Invalidate(ctx context.Context, prefix string) int {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generations[prefix]++
+	removed := 0
+	for key, element := range cache.items {
+		if strings.HasPrefix(key, prefix) {
+			cache.removeLocked(ctx, element, ReasonInvalidated)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of stored entries, including expired ones not yet
+// removed.
+func (cache *Cache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.items)
+}
+
+func (cache *Cache) overLocked() bool {
+	return (cache.settings.MaxEntries > 0 && len(cache.items) > cache.settings.MaxEntries) ||
+		(cache.settings.MaxBytes > 0 && cache.bytes > cache.settings.MaxBytes)
+}
+
+func (cache *Cache) removeLocked(ctx context.Context, element *list.Element, reason string) {
+	stored := element.Value.(*item)
+	cache.order.Remove(element)
+	delete(cache.items, stored.key)
+	cache.bytes -= len(stored.entry.Body)
+	if cache.evictions != nil {
+		cache.evictions.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+	}
+}
+
+// ETag returns the strong entity tag of body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Matches reports whether an If-None-Match header value matches etag. Weak
+// validators match their strong form, as RFC 9110 asks for GET.
+func Matches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
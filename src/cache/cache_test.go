@@ -0,0 +1,124 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/cldmnky/observability-workshop/src/cache"
+)
+
+func TestEntriesExpireAfterTheTTL(t *testing.T) {
+	ctx := context.Background()
+	store := cache.New(cache.Settings{TTL: 30 * time.Millisecond}, nil)
+
+	stored := store.Set(ctx, "user1 /api/notes", []byte(`{"count":0}`), "application/json")
+	got, ok := store.Get(ctx, "user1 /api/notes")
+	if !ok || string(got.Body) != `{"count":0}` || got.ETag != stored.ETag || got.ContentType != "application/json" {
+		t.Fatalf("expected the stored entry, got %+v %v", got, ok)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := store.Get(ctx, "user1 /api/notes"); ok || store.Len() != 0 {
+		t.Fatalf("expected the entry expired and removed, got %d entries", store.Len())
+	}
+}
+
+func TestBoundsEvictTheLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := cache.New(cache.Settings{TTL: time.Minute, MaxEntries: 2, MaxBytes: 10}, nil)
+
+	store.Set(ctx, "a", []byte("aaa"), "")
+	store.Set(ctx, "b", []byte("bbb"), "")
+	store.Get(ctx, "a")
+	store.Set(ctx, "c", []byte("ccc"), "")
+	if _, ok := store.Get(ctx, "b"); ok {
+		t.Fatal("expected b evicted as the least recently used")
+	}
+	if _, ok := store.Get(ctx, "a"); !ok {
+		t.Fatal("expected a kept")
+	}
+
+	store.Set(ctx, "d", []byte("dddddddd"), "")
+	if store.Len() != 1 {
+		t.Fatalf("expected the byte bound to leave only d, got %d entries", store.Len())
+	}
+	if entry := store.Set(ctx, "e", []byte("too large to store"), ""); entry.ETag == "" || store.Len() != 1 {
+		t.Fatalf("expected an oversized body tagged but not stored, got %+v with %d entries", entry, store.Len())
+	}
+}
+
+func TestInvalidateRemovesByPrefix(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	evictions, _ := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64Counter("evictions")
+	store := cache.New(cache.DefaultSettings(), evictions)
+
+	for _, key := range []string{"user1 /api/notes", "user1 /api/notes/1", "user2 /api/notes"} {
+		store.Set(ctx, key, []byte(key), "")
+	}
+	if removed := store.Invalidate(ctx, "user1 "); removed != 2 {
+		t.Fatalf("expected user1's 2 entries removed, got %d", removed)
+	}
+	if _, ok := store.Get(ctx, "user2 /api/notes"); !ok {
+		t.Fatal("expected user2's entry kept")
+	}
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &collected); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	point := collected.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints[0]
+	if reason, _ := point.Attributes.Value(attribute.Key("reason")); point.Value != 2 || reason.AsString() != cache.ReasonInvalidated {
+		t.Fatalf("expected 2 invalidated evictions, got %d %s", point.Value, reason.AsString())
+	}
+}
+
+func TestAResponseLoadedAcrossAnInvalidationIsNotStored(t *testing.T) {
+	ctx := context.Background()
+	store := cache.New(cache.Settings{TTL: time.Minute}, nil)
+
+	generation := store.Generation("user1 ")
+	store.Invalidate(ctx, "user1 ")
+	stale := store.SetIfCurrent(ctx, "user1 /api/notes", "user1 ", generation, []byte("old"), "")
+	if _, ok := store.Get(ctx, "user1 /api/notes"); ok || stale.ETag != cache.ETag([]byte("old")) {
+		t.Fatalf("expected the stale body returned with its ETag but not stored, got %+v", stale)
+	}
+
+	store.Invalidate(ctx, "user2 ")
+	store.SetIfCurrent(ctx, "user1 /api/notes", "user1 ", store.Generation("user1 "), []byte("new"), "")
+	if got, ok := store.Get(ctx, "user1 /api/notes"); !ok || string(got.Body) != "new" {
+		t.Fatalf("expected a current body stored despite another tenant's write, got %+v %v", got, ok)
+	}
+}
+
+func TestDisabledCacheStoresNothing(t *testing.T) {
+	store := cache.New(cache.Settings{}, nil)
+	if store != nil {
+		t.Fatal("expected no cache without a TTL")
+	}
+	store.Set(context.Background(), "a", []byte("a"), "")
+	if _, ok := store.Get(context.Background(), "a"); ok {
+		t.Fatal("expected a nil cache to miss")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	etag := cache.ETag([]byte("body"))
+	for header, want := range map[string]bool{
+		etag:                    true,
+		`"other", ` + etag:      true,
+		"W/" + etag:             true,
+		"*":                     true,
+		`"other"`:               false,
+		"":                      false,
+		cache.ETag([]byte("x")): false,
+	} {
+		if got := cache.Matches(header, etag); got != want {
+			t.Fatalf("Matches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+// Package chaos injects faults into HTTP handlers at runtime so workshop
+// exercises have something to hunt for in traces, metrics and logs.
+//
+// Faults are managed through the /admin/faults API served by Injector. Each
+// fault targets a route and may add latency drawn from a distribution, fail a
+// share of requests with a chosen status, reset connections or cut responses
+// short. Faults expire on their own after their TTL. Every request a fault
+// touches is marked with fault.injected=true on its span and counted by kind.
+package chaos
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+const (
+	// AdminPath is where Injector serves the fault API.
+	AdminPath = "/admin/faults"
+	// adminPrefix covers the fault and scenario APIs. Requests under it are
+	// never faulted, so faults can always be removed.
+	adminPrefix = "/admin/"
+	// InjectedAttributeKey marks spans of requests a fault was applied to.
+	InjectedAttributeKey = "fault.injected"
+	// IDAttributeKey lists the ids of the faults applied to a request.
+	IDAttributeKey = "fault.ids"
+	// KindAttributeKey lists the kinds of fault applied to a request.
+	KindAttributeKey = "fault.kinds"
+	// ScenarioAttributeKey lists the scenarios whose faults were applied to
+	// a request.
+	ScenarioAttributeKey = "scenario.names"
+
+	// DefaultTTL is how long a fault lasts when it sets no ttl.
+	DefaultTTL = 5 * time.Minute
+	// MaxTTL bounds the ttl of a fault.
+	MaxTTL = 24 * time.Hour
+
+	maxBodyBytes = 64 << 10
+)
+
+// Latency distributions.
+const (
+	DistributionFixed    = "fixed"
+	DistributionUniform  = "uniform"
+	DistributionNormal   = "normal"
+	DistributionLongTail = "long-tail"
+)
+
+// Fault kinds, used as the kind metric attribute and in KindAttributeKey.
+const (
+	KindLatency = "latency"
+	KindError   = "error"
+	KindReset   = "reset"
+	KindPartial = "partial"
+)
+
+// Duration is a time.Duration written in JSON as a Go duration string such
+// as "250ms".
+type Duration time.Duration
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.New("must be a duration string such as \"250ms\"")
+	}
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return errors.New("must be a duration string such as \"250ms\"")
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+// Latency describes how long to delay a request.
+//
+//   - fixed waits Duration.
+//   - uniform waits between Min and Max.
+//   - normal waits Mean plus normally distributed noise of StdDev, never
+//     less than zero.
+//   - long-tail waits a Pareto-distributed time starting at Min with shape
+//     Alpha (default 1.5), capped at Max when set. Most requests wait close
+//     to Min while a few wait many times longer.
+type Latency struct {
+	Distribution string   `json:"distribution"`
+	Duration     Duration `json:"duration,omitempty"`
+	Min          Duration `json:"min,omitempty"`
+	Max          Duration `json:"max,omitempty"`
+	Mean         Duration `json:"mean,omitempty"`
+	StdDev       Duration `json:"stddev,omitempty"`
+	Alpha        float64  `json:"alpha,omitempty"`
+}
+
+// Fault is one configured fault. Rates are probabilities between 0 and 1,
+// rolled independently for every matching request.
+type Fault struct {
+	ID string `json:"id"`
+	// Peer, when set, applies the fault to outgoing requests to that peer
+	// (see Transport) instead of to requests the service receives.
+	Peer string `json:"peer,omitempty"`
+	// Route is the request path the fault applies to. A route ending in "/"
+	// also matches every path below it; "/" matches everything.
+	Route string `json:"route"`
+	// Method restricts the fault to one HTTP method when set.
+	Method  string   `json:"method,omitempty"`
+	Latency *Latency `json:"latency,omitempty"`
+	// ErrorRate of requests are answered with ErrorStatus (default 500)
+	// instead of reaching the handler.
+	ErrorRate   float64 `json:"errorRate,omitempty"`
+	ErrorStatus int     `json:"errorStatus,omitempty"`
+	// ResetRate of requests have their connection closed without a response.
+	ResetRate float64 `json:"resetRate,omitempty"`
+	// PartialRate of requests get only the first half of their response
+	// body before the connection is closed.
+	PartialRate float64  `json:"partialRate,omitempty"`
+	TTL         Duration `json:"ttl,omitempty"`
+	// Scenario names the scenario that added the fault, if any.
+	Scenario  string    `json:"scenario,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// matches reports whether the fault applies to request, which is outgoing to
+// peer or, when peer is empty, incoming.
+func (fault *Fault) matches(request *http.Request, peer string) bool {
+	if fault.Peer != peer {
+		return false
+	}
+	if fault.Method != "" && fault.Method != request.Method {
+		return false
+	}
+	if strings.HasSuffix(fault.Route, "/") {
+		return strings.HasPrefix(request.URL.Path, fault.Route)
+	}
+	return request.URL.Path == fault.Route
+}
+
+// validate checks a fault submitted to the API and fills in defaults.
+func (fault *Fault) validate() []problem.Violation {
+	var violations []problem.Violation
+	add := func(field, reason, message string) {
+		violations = append(violations, problem.Violation{Field: field, Reason: reason, Message: message})
+	}
+
+	if !strings.HasPrefix(fault.Route, "/") {
+		add("route", "invalid", "route must be a path starting with /")
+	} else if fault.Peer == "" && strings.HasPrefix(fault.Route, adminPrefix) {
+		add("route", "invalid", "the admin APIs cannot be faulted")
+	}
+	if fault.Peer != "" && strings.ContainsAny(fault.Peer, "/: ") {
+		add("peer", "invalid", "peer must be a service name such as database")
+	}
+	fault.Method = strings.ToUpper(fault.Method)
+	for _, rate := range []struct {
+		field string
+		value float64
+	}{{"errorRate", fault.ErrorRate}, {"resetRate", fault.ResetRate}, {"partialRate", fault.PartialRate}} {
+		if rate.value < 0 || rate.value > 1 {
+			add(rate.field, "out_of_range", rate.field+" must be between 0 and 1")
+		}
+	}
+	if fault.ErrorStatus == 0 {
+		fault.ErrorStatus = http.StatusInternalServerError
+	}
+	if fault.ErrorStatus < 400 || fault.ErrorStatus > 599 {
+		add("errorStatus", "out_of_range", "errorStatus must be between 400 and 599")
+	}
+	if fault.Latency == nil && fault.ErrorRate == 0 && fault.ResetRate == 0 && fault.PartialRate == 0 {
+		add("", "empty", "set latency or at least one of errorRate, resetRate and partialRate")
+	}
+	if fault.Latency != nil {
+		violations = append(violations, fault.Latency.validate()...)
+	}
+	if fault.TTL == 0 {
+		fault.TTL = Duration(DefaultTTL)
+	}
+	if fault.TTL < 0 || time.Duration(fault.TTL) > MaxTTL {
+		add("ttl", "out_of_range", "ttl must be positive and at most "+MaxTTL.String())
+	}
+	return violations
+}
+
+func (latency *Latency) validate() []problem.Violation {
+	var violations []problem.Violation
+	add := func(field, message string) {
+		violations = append(violations, problem.Violation{Field: "latency." + field, Reason: "invalid", Message: message})
+	}
+	for _, bound := range []struct {
+		field string
+		value Duration
+	}{{"duration", latency.Duration}, {"min", latency.Min}, {"max", latency.Max}, {"mean", latency.Mean}, {"stddev", latency.StdDev}} {
+		if bound.value < 0 {
+			add(bound.field, bound.field+" must not be negative")
+		}
+	}
+
+	switch latency.Distribution {
+	case DistributionFixed:
+		if latency.Duration <= 0 {
+			add("duration", "fixed latency needs a duration")
+		}
+	case DistributionUniform:
+		if latency.Max <= 0 || latency.Max < latency.Min {
+			add("max", "uniform latency needs max at least min")
+		}
+	case DistributionNormal:
+		if latency.Mean <= 0 {
+			add("mean", "normal latency needs a mean")
+		}
+	case DistributionLongTail:
+		if latency.Min <= 0 {
+			add("min", "long-tail latency needs a min")
+		}
+		if latency.Max != 0 && latency.Max < latency.Min {
+			add("max", "max must be at least min")
+		}
+		if latency.Alpha == 0 {
+			latency.Alpha = 1.5
+		}
+		if latency.Alpha <= 0 {
+			add("alpha", "alpha must be positive")
+		}
+	default:
+		add("distribution", "distribution must be one of fixed, uniform, normal, long-tail")
+	}
+	return violations
+}
+
+// sample draws one delay from the distribution.
+func (latency *Latency) sample(random *mathrand.Rand) time.Duration {
+	switch latency.Distribution {
+	case DistributionFixed:
+		return time.Duration(latency.Duration)
+	case DistributionUniform:
+		spread := int64(latency.Max - latency.Min)
+		if spread <= 0 {
+			return time.Duration(latency.Min)
+		}
+		return time.Duration(latency.Min) + time.Duration(random.Int64N(spread+1))
+	case DistributionNormal:
+		delay := float64(latency.Mean) + random.NormFloat64()*float64(latency.StdDev)
+		return time.Duration(math.Max(delay, 0))
+	case DistributionLongTail:
+		// Inverse transform of the Pareto CDF; 1-U is in (0, 1].
+		delay := time.Duration(float64(latency.Min) / math.Pow(1-random.Float64(), 1/latency.Alpha))
+		if latency.Max > 0 && delay > time.Duration(latency.Max) {
+			delay = time.Duration(latency.Max)
+		}
+		return delay
+	}
+	return 0
+}
+
+// Injector holds the active faults of a service, serves the fault API and
+// applies faults to requests through Middleware.
+type Injector struct {
+	// injected counts applied faults by the fault's peer, route and kind.
+	// May be nil.
+	injected metric.Int64Counter
+	now      func() time.Time
+
+	mu     sync.Mutex
+	random *mathrand.Rand
+	faults map[string]*Fault
+}
+
+// NewInjector returns an Injector with no faults. injected, when not nil,
+// counts every applied fault.
+func NewInjector(injected metric.Int64Counter) *Injector {
+	return &Injector{
+		injected: injected,
+		now:      time.Now,
+		random:   mathrand.New(mathrand.NewPCG(mathrand.Uint64(), mathrand.Uint64())),
+		faults:   map[string]*Fault{},
+	}
+}
+
+// Active returns the unexpired faults, oldest first.
+func (injector *Injector) Active() []Fault {
+	injector.mu.Lock()
+	defer injector.mu.Unlock()
+
+	injector.pruneLocked()
+	active := make([]Fault, 0, len(injector.faults))
+	for _, fault := range injector.faults {
+		active = append(active, *fault)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].CreatedAt.Equal(active[j].CreatedAt) {
+			return active[i].ID < active[j].ID
+		}
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+	return active
+}
+
+// Add activates fault after validating it, and returns it with its id and
+// expiry set.
+func (injector *Injector) Add(fault Fault) (Fault, []problem.Violation) {
+	if violations := fault.validate(); len(violations) > 0 {
+		return Fault{}, violations
+	}
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	fault.ID = hex.EncodeToString(id[:])
+	fault.CreatedAt = injector.now().UTC()
+	fault.ExpiresAt = fault.CreatedAt.Add(time.Duration(fault.TTL))
+
+	injector.mu.Lock()
+	defer injector.mu.Unlock()
+	injector.pruneLocked()
+	injector.faults[fault.ID] = &fault
+	return fault, nil
+}
+
+// Remove deactivates the fault with id and reports whether it was active.
+func (injector *Injector) Remove(id string) bool {
+	injector.mu.Lock()
+	defer injector.mu.Unlock()
+	injector.pruneLocked()
+	_, found := injector.faults[id]
+	delete(injector.faults, id)
+	return found
+}
+
+// Clear deactivates every fault.
+func (injector *Injector) Clear() {
+	injector.mu.Lock()
+	defer injector.mu.Unlock()
+	injector.faults = map[string]*Fault{}
+}
+
+func (injector *Injector) pruneLocked() {
+	now := injector.now()
+	for id, fault := range injector.faults {
+		if !now.Before(fault.ExpiresAt) {
+			delete(injector.faults, id)
+		}
+	}
+}
+
+// ServeHTTP serves the fault API:
+//
+//	GET    /admin/faults       list active faults
+//	POST   /admin/faults       add a fault
+//	DELETE /admin/faults       remove every fault
+//	GET    /admin/faults/{id}  fetch one fault
+//	DELETE /admin/faults/{id}  remove one fault
+func (injector *Injector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, AdminPath), "/")
+	if id != "" {
+		injector.serveFault(response, request, id)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		active := injector.Active()
+		problem.WriteJSON(response, http.StatusOK, map[string]any{
+			"count":  len(active),
+			"faults": active,
+		})
+	case http.MethodPost:
+		var fault Fault
+		decoder := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxBodyBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&fault); err != nil {
+			problem.Invalid(request, http.StatusBadRequest, []problem.Violation{
+				{Reason: "malformed", Message: err.Error()},
+			}).Write(response)
+			return
+		}
+		added, violations := injector.Add(fault)
+		if len(violations) > 0 {
+			problem.Invalid(request, http.StatusBadRequest, violations).Write(response)
+			return
+		}
+		problem.WriteJSON(response, http.StatusCreated, added)
+	case http.MethodDelete:
+		injector.Clear()
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (injector *Injector) serveFault(response http.ResponseWriter, request *http.Request, id string) {
+	switch request.Method {
+	case http.MethodGet:
+		for _, fault := range injector.Active() {
+			if fault.ID == id {
+				problem.WriteJSON(response, http.StatusOK, fault)
+				return
+			}
+		}
+		problem.Write(response, request, http.StatusNotFound, "fault not found")
+	case http.MethodDelete:
+		if !injector.Remove(id) {
+			problem.Write(response, request, http.StatusNotFound, "fault not found")
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// plan is what the faults matching one request decided to do to it.
+type plan struct {
+	ids       []string
+	kinds     []string
+	scenarios []string
+	applied   []applied
+	delay     time.Duration
+	status    int
+	reset     bool
+	partial   bool
+}
+
+// applied is one kind of fault applied by the fault with route and peer.
+type applied struct {
+	peer  string
+	route string
+	kind  string
+}
+
+func (decided *plan) apply(fault *Fault, kind string) {
+	decided.applied = append(decided.applied, applied{peer: fault.Peer, route: fault.Route, kind: kind})
+	decided.kinds = appendUnique(decided.kinds, kind)
+	if fault.Scenario != "" {
+		decided.scenarios = appendUnique(decided.scenarios, fault.Scenario)
+	}
+	if len(decided.ids) == 0 || decided.ids[len(decided.ids)-1] != fault.ID {
+		decided.ids = append(decided.ids, fault.ID)
+	}
+}
+
+func (injector *Injector) plan(request *http.Request, peer string) plan {
+	injector.mu.Lock()
+	defer injector.mu.Unlock()
+
+	var decided plan
+	now := injector.now()
+	for _, fault := range injector.faults {
+		if !now.Before(fault.ExpiresAt) || !fault.matches(request, peer) {
+			continue
+		}
+		if fault.Latency != nil {
+			decided.delay += fault.Latency.sample(injector.random)
+			decided.apply(fault, KindLatency)
+		}
+		if fault.ResetRate > 0 && injector.random.Float64() < fault.ResetRate {
+			decided.reset = true
+			decided.apply(fault, KindReset)
+		}
+		if decided.status == 0 && fault.ErrorRate > 0 && injector.random.Float64() < fault.ErrorRate {
+			decided.status = fault.ErrorStatus
+			decided.apply(fault, KindError)
+		}
+		if fault.PartialRate > 0 && injector.random.Float64() < fault.PartialRate {
+			decided.partial = true
+			decided.apply(fault, KindPartial)
+		}
+	}
+	sort.Strings(decided.ids)
+	sort.Strings(decided.scenarios)
+	return decided
+}
+
+// record marks span with the faults applied and counts them.
+func (injector *Injector) record(ctx context.Context, decided plan) {
+	attributes := []attribute.KeyValue{
+		attribute.Bool(InjectedAttributeKey, true),
+		attribute.StringSlice(IDAttributeKey, decided.ids),
+		attribute.StringSlice(KindAttributeKey, decided.kinds),
+	}
+	if len(decided.scenarios) > 0 {
+		attributes = append(attributes, attribute.StringSlice(ScenarioAttributeKey, decided.scenarios))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attributes...)
+
+	if injector.injected != nil {
+		// The fault's route rather than the request path keeps the label
+		// set bounded by the configured faults.
+		for _, hit := range decided.applied {
+			injector.injected.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("peer", hit.peer),
+				attribute.String("route", hit.route),
+				attribute.String("kind", hit.kind),
+			))
+		}
+	}
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// Middleware applies the active faults to requests reaching next. Latency is
+// added first. A reset then closes the connection without a response, an
+// error answers with a problem document instead of calling next, and a
+// partial response sends the head of next's response before closing the
+// connection.
+func (injector *Injector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if strings.HasPrefix(request.URL.Path, adminPrefix) {
+			next.ServeHTTP(response, request)
+			return
+		}
+		decided := injector.plan(request, "")
+		if len(decided.kinds) == 0 {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		ctx := request.Context()
+		injector.record(ctx, decided)
+		if !sleep(ctx, decided.delay) {
+			return
+		}
+		switch {
+		case decided.reset:
+			// The server closes the connection without writing a response.
+			panic(http.ErrAbortHandler)
+		case decided.status != 0:
+			injected := problem.New(request, decided.status, "fault injected")
+			injected.Type = problem.TypeFaultInjected
+			injected.Write(response)
+		case decided.partial:
+			writePartial(response, request, next)
+		default:
+			next.ServeHTTP(response, request)
+		}
+	})
+}
+
+// sleep waits for delay and reports whether it finished before ctx was done.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// writePartial runs next against a buffer, announces the full body length
+// and sends only its first half before aborting the connection, so the
+// client sees a truncated body.
+func writePartial(response http.ResponseWriter, request *http.Request, next http.Handler) {
+	buffered := &bufferingResponseWriter{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(buffered, request)
+
+	for key, values := range buffered.header {
+		response.Header()[key] = values
+	}
+	response.Header().Set("Content-Length", strconv.Itoa(len(buffered.body)))
+	response.WriteHeader(buffered.status)
+	_, _ = response.Write(buffered.body[:len(buffered.body)/2])
+	if flusher, ok := response.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+type bufferingResponseWriter struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (writer *bufferingResponseWriter) Header() http.Header { return writer.header }
+
+func (writer *bufferingResponseWriter) WriteHeader(status int) { writer.status = status }
+
+func (writer *bufferingResponseWriter) Write(data []byte) (int, error) {
+	writer.body = append(writer.body, data...)
+	return len(data), nil
+}
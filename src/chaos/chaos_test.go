@@ -0,0 +1,263 @@
+package chaos_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cldmnky/observability-workshop/src/chaos"
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+func serveAdmin(t *testing.T, injector *chaos.Injector, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	injector.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func addFault(t *testing.T, injector *chaos.Injector, body string) chaos.Fault {
+	t.Helper()
+	recorder := serveAdmin(t, injector, http.MethodPost, chaos.AdminPath, body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201 adding %s, got %d: %s", body, recorder.Code, recorder.Body.String())
+	}
+	var fault chaos.Fault
+	if err := json.Unmarshal(recorder.Body.Bytes(), &fault); err != nil {
+		t.Fatalf("decode fault: %v", err)
+	}
+	return fault
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		response.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(response, "all systems nominal")
+	})
+}
+
+func TestAdminAPIManagesFaults(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+
+	fault := addFault(t, injector, `{"route":"/api/notes","method":"post","latency":{"distribution":"uniform","min":"10ms","max":"60ms"},"ttl":"1m"}`)
+	if fault.ID == "" || fault.Method != http.MethodPost || fault.ErrorStatus != http.StatusInternalServerError {
+		t.Fatalf("unexpected fault %+v", fault)
+	}
+	if lifetime := fault.ExpiresAt.Sub(fault.CreatedAt); lifetime != time.Minute {
+		t.Fatalf("expected a one minute ttl, got %s", lifetime)
+	}
+
+	listed := serveAdmin(t, injector, http.MethodGet, chaos.AdminPath, "")
+	if listed.Code != http.StatusOK || !strings.Contains(listed.Body.String(), `"count":1`) || !strings.Contains(listed.Body.String(), `"max":"60ms"`) {
+		t.Fatalf("unexpected listing %d %s", listed.Code, listed.Body.String())
+	}
+	if fetched := serveAdmin(t, injector, http.MethodGet, chaos.AdminPath+"/"+fault.ID, ""); fetched.Code != http.StatusOK {
+		t.Fatalf("expected 200 fetching the fault, got %d", fetched.Code)
+	}
+	if deleted := serveAdmin(t, injector, http.MethodDelete, chaos.AdminPath+"/"+fault.ID, ""); deleted.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting the fault, got %d", deleted.Code)
+	}
+	if missing := serveAdmin(t, injector, http.MethodDelete, chaos.AdminPath+"/"+fault.ID, ""); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting it again, got %d", missing.Code)
+	}
+
+	addFault(t, injector, `{"route":"/","errorRate":0.5}`)
+	addFault(t, injector, `{"route":"/events","resetRate":0.1}`)
+	if cleared := serveAdmin(t, injector, http.MethodDelete, chaos.AdminPath, ""); cleared.Code != http.StatusNoContent || len(injector.Active()) != 0 {
+		t.Fatalf("expected every fault cleared, got %d and %d active", cleared.Code, len(injector.Active()))
+	}
+}
+
+func TestAdminAPIRejectsInvalidFaults(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+
+	for name, test := range map[string]struct {
+		body  string
+		field string
+	}{
+		"relative route":      {`{"route":"notes","errorRate":1}`, "route"},
+		"admin route":         {`{"route":"/admin/faults","errorRate":1}`, "route"},
+		"nothing to inject":   {`{"route":"/notes"}`, ""},
+		"rate above one":      {`{"route":"/notes","errorRate":1.5}`, "errorRate"},
+		"success status":      {`{"route":"/notes","errorRate":1,"errorStatus":200}`, "errorStatus"},
+		"unknown shape":       {`{"route":"/notes","latency":{"distribution":"bimodal"}}`, "latency.distribution"},
+		"uniform without max": {`{"route":"/notes","latency":{"distribution":"uniform","min":"5ms"}}`, "latency.max"},
+		"ttl too long":        {`{"route":"/notes","errorRate":1,"ttl":"48h"}`, "ttl"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := serveAdmin(t, injector, http.MethodPost, chaos.AdminPath, test.body)
+			if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Content-Type") != problem.ContentType {
+				t.Fatalf("expected a 400 problem, got %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+			}
+			var rejected problem.Problem
+			_ = json.Unmarshal(recorder.Body.Bytes(), &rejected)
+			if len(rejected.Violations) != 1 || rejected.Violations[0].Field != test.field {
+				t.Fatalf("expected one violation of %q, got %+v", test.field, rejected.Violations)
+			}
+		})
+	}
+
+	malformed := serveAdmin(t, injector, http.MethodPost, chaos.AdminPath, `{"route":"/notes","latency":{"distribution":"fixed","duration":5}}`)
+	if malformed.Code != http.StatusBadRequest || len(injector.Active()) != 0 {
+		t.Fatalf("expected a numeric duration to be rejected, got %d", malformed.Code)
+	}
+}
+
+func TestMiddlewareInjectsErrorsOnMatchingRoutes(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	injector := chaos.NewInjector(nil)
+	fault := addFault(t, injector, `{"route":"/api/notes/","method":"DELETE","errorRate":1,"errorStatus":503}`)
+	handler := injector.Middleware(okHandler())
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		ctx, span := tracer.Start(context.Background(), method+" "+path)
+		defer span.End()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil).WithContext(ctx))
+		return recorder
+	}
+
+	faulted := serve(http.MethodDelete, "/api/notes/7")
+	if faulted.Code != http.StatusServiceUnavailable || !strings.Contains(faulted.Body.String(), problem.TypeFaultInjected) {
+		t.Fatalf("expected an injected 503 problem, got %d %s", faulted.Code, faulted.Body.String())
+	}
+	for _, request := range [][2]string{{http.MethodGet, "/api/notes/7"}, {http.MethodDelete, "/api/notes"}, {http.MethodDelete, chaos.AdminPath + "/x"}} {
+		if passed := serve(request[0], request[1]); passed.Code != http.StatusOK {
+			t.Fatalf("expected %s %s to pass through, got %d", request[0], request[1], passed.Code)
+		}
+	}
+
+	ended := spans.Ended()
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range ended[0].Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	if !attributes[chaos.InjectedAttributeKey].AsBool() ||
+		strings.Join(attributes[chaos.IDAttributeKey].AsStringSlice(), ",") != fault.ID ||
+		strings.Join(attributes[chaos.KindAttributeKey].AsStringSlice(), ",") != chaos.KindError {
+		t.Fatalf("expected the faulted span to be marked, got %v", ended[0].Attributes())
+	}
+	for _, span := range ended[1:] {
+		if len(span.Attributes()) != 0 {
+			t.Fatalf("expected unfaulted spans to be unmarked, got %v", span.Attributes())
+		}
+	}
+}
+
+func TestMiddlewareDelaysRequests(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+	addFault(t, injector, `{"route":"/slow","latency":{"distribution":"fixed","duration":"30ms"}}`)
+	addFault(t, injector, `{"route":"/tail","latency":{"distribution":"long-tail","min":"10ms","max":"20ms"}}`)
+	handler := injector.Middleware(okHandler())
+
+	for path, bounds := range map[string][2]time.Duration{
+		"/slow": {30 * time.Millisecond, time.Second},
+		"/tail": {10 * time.Millisecond, time.Second},
+	} {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if elapsed := time.Since(start); elapsed < bounds[0] || elapsed > bounds[1] || recorder.Code != http.StatusOK {
+			t.Fatalf("expected %s to succeed after at least %s, got %d after %s", path, bounds[0], recorder.Code, elapsed)
+		}
+	}
+}
+
+func TestMiddlewareBreaksConnections(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+	addFault(t, injector, `{"route":"/reset","resetRate":1}`)
+	addFault(t, injector, `{"route":"/partial","partialRate":1}`)
+	server := httptest.NewServer(injector.Middleware(okHandler()))
+	defer server.Close()
+
+	if response, err := server.Client().Get(server.URL + "/reset"); err == nil {
+		response.Body.Close()
+		t.Fatalf("expected the connection to be reset, got %d", response.StatusCode)
+	}
+
+	response, err := server.Client().Get(server.URL + "/partial")
+	if err != nil {
+		t.Fatalf("expected the partial response headers, got %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err == nil || string(body) != "all syste" {
+		t.Fatalf("expected a truncated body and a read error, got %q and %v", body, err)
+	}
+}
+
+func TestFaultsExpire(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+	addFault(t, injector, `{"route":"/","errorRate":1,"ttl":"20ms"}`)
+	handler := injector.Middleware(okHandler())
+
+	time.Sleep(30 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes", nil))
+	if recorder.Code != http.StatusOK || len(injector.Active()) != 0 {
+		t.Fatalf("expected the fault to have expired, got %d with %d active", recorder.Code, len(injector.Active()))
+	}
+}
+
+func TestTransportFaultsOutgoingRequestsToPeers(t *testing.T) {
+	upstream := httptest.NewServer(okHandler())
+	defer upstream.Close()
+	other := httptest.NewServer(okHandler())
+	defer other.Close()
+
+	injector := chaos.NewInjector(nil)
+	addFault(t, injector, `{"peer":"notifier","route":"/notify","resetRate":1}`)
+	addFault(t, injector, `{"peer":"notifier","route":"/status","errorRate":1,"errorStatus":502}`)
+	addFault(t, injector, `{"peer":"notifier","route":"/partial","partialRate":1}`)
+	client := &http.Client{Transport: injector.Transport(http.DefaultTransport,
+		chaos.PeersByURL(map[string]string{"notifier": upstream.URL}))}
+
+	if _, err := client.Post(upstream.URL+"/notify", "application/json", nil); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected a connection reset, got %v", err)
+	}
+
+	response, err := client.Get(upstream.URL + "/status")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	injected, ok := problem.Decode(response)
+	if response.StatusCode != http.StatusBadGateway || !ok || injected.Type != problem.TypeFaultInjected {
+		t.Fatalf("expected an injected 502 problem, got %d %+v", response.StatusCode, injected)
+	}
+
+	response, err = client.Get(upstream.URL + "/partial")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(body) != "all syste" {
+		t.Fatalf("expected a truncated body, got %q and %v", body, err)
+	}
+
+	for _, target := range []string{other.URL + "/notify", upstream.URL + "/other"} {
+		response, err := client.Get(target)
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("expected %s to pass through, got %v", target, err)
+		}
+		response.Body.Close()
+	}
+
+	incoming := httptest.NewRecorder()
+	injector.Middleware(okHandler()).ServeHTTP(incoming, httptest.NewRequest(http.MethodPost, "/notify", nil))
+	if incoming.Code != http.StatusOK {
+		t.Fatalf("expected peer faults to leave incoming requests alone, got %d", incoming.Code)
+	}
+}
@@ -0,0 +1,489 @@
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+// ScenariosPath is where Scenarios serves the scenario API.
+const ScenariosPath = "/admin/scenarios"
+
+// Preset scenario names.
+const (
+	ScenarioSlowDatabase   = "slow-database"
+	ScenarioNotifierOutage = "notifier-outage"
+	ScenarioErrorSpike     = "error-spike-notes"
+	ScenarioMemoryLeak     = "memory-leak"
+	ScenarioGoroutineLeak  = "goroutine-leak"
+)
+
+// Scenario states reported by the scenario API.
+const (
+	StateIdle      = "idle"
+	StateScheduled = "scheduled"
+	StateActive    = "active"
+)
+
+const (
+	// DefaultScenarioDuration is how long a scenario runs when started
+	// without a duration.
+	DefaultScenarioDuration = 10 * time.Minute
+
+	leakInterval       = time.Second
+	memoryLeakStep     = 4 << 20
+	memoryLeakLimit    = 512 << 20
+	goroutineLeakStep  = 50
+	goroutineLeakLimit = 50_000
+)
+
+var (
+	// ErrUnknownScenario is returned for names that are not a preset of the
+	// service.
+	ErrUnknownScenario = errors.New("unknown scenario")
+	// ErrScenarioRunning is returned when starting a scenario that is
+	// already scheduled or active.
+	ErrScenarioRunning = errors.New("scenario is already scheduled or active")
+	// ErrScenarioIdle is returned when stopping a scenario that is neither
+	// scheduled nor active.
+	ErrScenarioIdle = errors.New("scenario is not scheduled or active")
+)
+
+// Scenario is a named incident: faults added for as long as it runs, plus an
+// optional background effect such as a leak.
+type Scenario struct {
+	Name        string
+	Description string
+	// Faults are added to the injector while the scenario is active.
+	Faults []Fault
+	// Run, when set, is started when the scenario becomes active and runs
+	// until ctx is done.
+	Run func(ctx context.Context)
+}
+
+// Presets returns the built-in scenarios of service, which is one of
+// "frontend", "backend" and "database". Each preset lives in the service
+// where its cause is; the other services see its effects through their
+// calls to it.
+func Presets(service string) []Scenario {
+	var presets []Scenario
+	switch service {
+	case "database":
+		slow := &Latency{Distribution: DistributionLongTail, Min: Duration(150 * time.Millisecond), Max: Duration(3 * time.Second), Alpha: 1.2}
+		presets = append(presets, Scenario{
+			Name:        ScenarioSlowDatabase,
+			Description: "Notes and events queries slow down with a long tail of multi-second requests.",
+			Faults: []Fault{
+				{Route: "/notes", Latency: slow},
+				{Route: "/notes/", Latency: slow},
+				{Route: "/events", Latency: slow},
+				{Route: "/events/", Latency: slow},
+			},
+		})
+	case "backend":
+		presets = append(presets,
+			Scenario{
+				Name:        ScenarioNotifierOutage,
+				Description: "Every call from the backend to the notifier fails with a connection reset.",
+				Faults:      []Fault{{Peer: "notifier", Route: "/", ResetRate: 1}},
+			},
+			Scenario{
+				Name:        ScenarioErrorSpike,
+				Description: "Four in ten requests to /api/notes fail with 500.",
+				Faults: []Fault{
+					{Route: "/api/notes", ErrorRate: 0.4, ErrorStatus: http.StatusInternalServerError},
+					{Route: "/api/notes/", ErrorRate: 0.4, ErrorStatus: http.StatusInternalServerError},
+				},
+			},
+		)
+	}
+	return append(presets,
+		Scenario{
+			Name:        ScenarioMemoryLeak,
+			Description: "The process retains another 4 MiB every second, up to 512 MiB.",
+			Run:         leakMemory,
+		},
+		Scenario{
+			Name:        ScenarioGoroutineLeak,
+			Description: "The process starts 50 goroutines that never finish every second, up to 50000.",
+			Run:         leakGoroutines,
+		},
+	)
+}
+
+// leakMemory retains memory until ctx is done, then lets it be collected.
+func leakMemory(ctx context.Context) {
+	ticker := time.NewTicker(leakInterval)
+	defer ticker.Stop()
+
+	var retained [][]byte
+	leaked := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if leaked >= memoryLeakLimit {
+			continue
+		}
+		chunk := make([]byte, memoryLeakStep)
+		// Touch every page so the memory is resident, not just reserved.
+		for offset := 0; offset < len(chunk); offset += 4096 {
+			chunk[offset] = 1
+		}
+		retained = append(retained, chunk)
+		leaked += len(chunk)
+		if leaked%(64<<20) == 0 {
+			slog.WarnContext(ctx, "memory retained by leak", "scenario.name", ScenarioMemoryLeak, "leak.bytes", leaked)
+		}
+	}
+}
+
+// leakGoroutines starts goroutines blocked until ctx is done.
+func leakGoroutines(ctx context.Context) {
+	ticker := time.NewTicker(leakInterval)
+	defer ticker.Stop()
+
+	leaked := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if leaked >= goroutineLeakLimit {
+			continue
+		}
+		for range goroutineLeakStep {
+			go func() { <-ctx.Done() }()
+		}
+		leaked += goroutineLeakStep
+		if leaked%5000 == 0 {
+			slog.WarnContext(ctx, "goroutines blocked by leak", "scenario.name", ScenarioGoroutineLeak, "leak.goroutines", leaked)
+		}
+	}
+}
+
+// ScenarioStatus is the state of one scenario as reported by the API.
+type ScenarioStatus struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	State       string     `json:"state"`
+	StartsAt    *time.Time `json:"startsAt,omitempty"`
+	EndsAt      *time.Time `json:"endsAt,omitempty"`
+}
+
+// Scenarios starts, stops and schedules a service's scenarios and serves
+// the scenario API.
+type Scenarios struct {
+	injector *Injector
+	now      func() time.Time
+
+	mu      sync.Mutex
+	presets []Scenario
+	runs    map[string]*scenarioRun
+}
+
+// scenarioRun is a scheduled or active scenario.
+type scenarioRun struct {
+	startsAt time.Time
+	endsAt   time.Time
+	active   bool
+	// timer starts a scheduled run and stops an active one.
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	faultIDs []string
+}
+
+// NewScenarios returns Scenarios offering presets, whose faults are added to
+// injector.
+func NewScenarios(injector *Injector, presets []Scenario) *Scenarios {
+	return &Scenarios{
+		injector: injector,
+		now:      time.Now,
+		presets:  presets,
+		runs:     map[string]*scenarioRun{},
+	}
+}
+
+func (scenarios *Scenarios) preset(name string) (Scenario, bool) {
+	for _, preset := range scenarios.presets {
+		if preset.Name == name {
+			return preset, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// List returns the status of every scenario.
+func (scenarios *Scenarios) List() []ScenarioStatus {
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+
+	statuses := make([]ScenarioStatus, 0, len(scenarios.presets))
+	for _, preset := range scenarios.presets {
+		statuses = append(statuses, scenarios.statusLocked(preset))
+	}
+	return statuses
+}
+
+// Status returns the status of the scenario called name.
+func (scenarios *Scenarios) Status(name string) (ScenarioStatus, error) {
+	preset, found := scenarios.preset(name)
+	if !found {
+		return ScenarioStatus{}, ErrUnknownScenario
+	}
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+	return scenarios.statusLocked(preset), nil
+}
+
+func (scenarios *Scenarios) statusLocked(preset Scenario) ScenarioStatus {
+	status := ScenarioStatus{Name: preset.Name, Description: preset.Description, State: StateIdle}
+	run, found := scenarios.runs[preset.Name]
+	if !found {
+		return status
+	}
+	status.State = StateScheduled
+	if run.active {
+		status.State = StateActive
+	}
+	startsAt, endsAt := run.startsAt, run.endsAt
+	status.StartsAt, status.EndsAt = &startsAt, &endsAt
+	return status
+}
+
+// Start runs the scenario called name for duration, after delay.
+func (scenarios *Scenarios) Start(ctx context.Context, name string, delay, duration time.Duration) (ScenarioStatus, error) {
+	preset, found := scenarios.preset(name)
+	if !found {
+		return ScenarioStatus{}, ErrUnknownScenario
+	}
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+
+	if _, running := scenarios.runs[name]; running {
+		return scenarios.statusLocked(preset), ErrScenarioRunning
+	}
+	startsAt := scenarios.now().UTC().Add(delay)
+	run := &scenarioRun{startsAt: startsAt, endsAt: startsAt.Add(duration)}
+	scenarios.runs[name] = run
+	if delay > 0 {
+		run.timer = time.AfterFunc(delay, func() { scenarios.activate(preset, run, duration) })
+		slog.InfoContext(ctx, "scenario scheduled",
+			"scenario.name", name,
+			"scenario.starts_at", run.startsAt,
+			"scenario.duration", duration.String(),
+		)
+	} else {
+		scenarios.activateLocked(preset, run, duration)
+	}
+	return scenarios.statusLocked(preset), nil
+}
+
+func (scenarios *Scenarios) activate(preset Scenario, run *scenarioRun, duration time.Duration) {
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+	// A stop that raced the timer has already removed the run.
+	if scenarios.runs[preset.Name] != run {
+		return
+	}
+	scenarios.activateLocked(preset, run, duration)
+}
+
+func (scenarios *Scenarios) activateLocked(preset Scenario, run *scenarioRun, duration time.Duration) {
+	run.active = true
+	run.startsAt = scenarios.now().UTC()
+	run.endsAt = run.startsAt.Add(duration)
+	for _, fault := range preset.Faults {
+		fault.Scenario = preset.Name
+		fault.TTL = Duration(duration)
+		if fault.Latency != nil {
+			latency := *fault.Latency
+			fault.Latency = &latency
+		}
+		added, violations := scenarios.injector.Add(fault)
+		if len(violations) > 0 {
+			slog.Error("scenario fault rejected", "scenario.name", preset.Name, "violations", violations)
+			continue
+		}
+		run.faultIDs = append(run.faultIDs, added.ID)
+	}
+	if preset.Run != nil {
+		var ctx context.Context
+		ctx, run.cancel = context.WithCancel(context.Background())
+		go preset.Run(ctx)
+	}
+	run.timer = time.AfterFunc(duration, func() { scenarios.stop(preset.Name, run, "expired") })
+
+	slog.Info("scenario started",
+		"scenario.name", preset.Name,
+		"scenario.duration", duration.String(),
+		"scenario.ends_at", run.endsAt,
+		"scenario.faults", len(run.faultIDs),
+	)
+}
+
+// Stop ends the scenario called name, or cancels it if it is only
+// scheduled.
+func (scenarios *Scenarios) Stop(name string) (ScenarioStatus, error) {
+	preset, found := scenarios.preset(name)
+	if !found {
+		return ScenarioStatus{}, ErrUnknownScenario
+	}
+	scenarios.mu.Lock()
+	run, running := scenarios.runs[name]
+	scenarios.mu.Unlock()
+	if !running {
+		return ScenarioStatus{Name: name, Description: preset.Description, State: StateIdle}, ErrScenarioIdle
+	}
+	scenarios.stop(name, run, "stopped")
+	return scenarios.Status(name)
+}
+
+// stop ends run unless it has already ended. reason is "stopped" or
+// "expired".
+func (scenarios *Scenarios) stop(name string, run *scenarioRun, reason string) {
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+	if scenarios.runs[name] != run {
+		return
+	}
+	delete(scenarios.runs, name)
+	if run.timer != nil {
+		run.timer.Stop()
+	}
+	if !run.active {
+		slog.Info("scenario stopped", "scenario.name", name, "scenario.reason", "cancelled")
+		return
+	}
+	if run.cancel != nil {
+		run.cancel()
+	}
+	for _, id := range run.faultIDs {
+		scenarios.injector.Remove(id)
+	}
+	slog.Info("scenario stopped",
+		"scenario.name", name,
+		"scenario.reason", reason,
+		"scenario.active_for", scenarios.now().Sub(run.startsAt).Round(time.Second).String(),
+	)
+}
+
+// RegisterGauge registers an observable gauge called name reporting 1 for
+// each active scenario and 0 for the others, labelled by scenario.
+func (scenarios *Scenarios) RegisterGauge(meter metric.Meter, name string) error {
+	_, err := meter.Int64ObservableGauge(name,
+		metric.WithDescription("Whether each incident scenario is active (1) or not (0)"),
+		metric.WithUnit("{scenario}"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			for _, status := range scenarios.List() {
+				var active int64
+				if status.State == StateActive {
+					active = 1
+				}
+				observer.Observe(active, metric.WithAttributes(attribute.String("scenario", status.Name)))
+			}
+			return nil
+		}),
+	)
+	return err
+}
+
+// startRequest is the optional body of a start request. At and Delay both
+// schedule the start; Duration defaults to DefaultScenarioDuration.
+type startRequest struct {
+	Duration Duration   `json:"duration"`
+	Delay    Duration   `json:"delay"`
+	At       *time.Time `json:"at"`
+}
+
+// ServeHTTP serves the scenario API:
+//
+//	GET  /admin/scenarios              list scenarios and their state
+//	GET  /admin/scenarios/{name}       fetch one scenario
+//	POST /admin/scenarios/{name}/start start or schedule a scenario
+//	POST /admin/scenarios/{name}/stop  stop or unschedule a scenario
+func (scenarios *Scenarios) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(request.URL.Path, ScenariosPath), "/")
+	name, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case name == "" && request.Method == http.MethodGet:
+		statuses := scenarios.List()
+		problem.WriteJSON(response, http.StatusOK, map[string]any{
+			"count":     len(statuses),
+			"scenarios": statuses,
+		})
+	case name != "" && action == "" && request.Method == http.MethodGet:
+		status, err := scenarios.Status(name)
+		writeScenario(response, request, status, err)
+	case name != "" && action == "start" && request.Method == http.MethodPost:
+		delay, duration, violations := parseStart(request, response, scenarios.now())
+		if len(violations) > 0 {
+			problem.Invalid(request, http.StatusBadRequest, violations).Write(response)
+			return
+		}
+		status, err := scenarios.Start(request.Context(), name, delay, duration)
+		writeScenario(response, request, status, err)
+	case name != "" && action == "stop" && request.Method == http.MethodPost:
+		status, err := scenarios.Stop(name)
+		writeScenario(response, request, status, err)
+	case name == "" || action == "" || action == "start" || action == "stop":
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		problem.Write(response, request, http.StatusNotFound, "unknown scenario action")
+	}
+}
+
+func parseStart(request *http.Request, response http.ResponseWriter, now time.Time) (time.Duration, time.Duration, []problem.Violation) {
+	var input startRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0, []problem.Violation{{Reason: "malformed", Message: err.Error()}}
+	}
+
+	var violations []problem.Violation
+	duration := time.Duration(input.Duration)
+	if duration == 0 {
+		duration = DefaultScenarioDuration
+	}
+	if duration < 0 || duration > MaxTTL {
+		violations = append(violations, problem.Violation{Field: "duration", Reason: "out_of_range", Message: "duration must be positive and at most " + MaxTTL.String()})
+	}
+	delay := time.Duration(input.Delay)
+	if input.At != nil {
+		if input.Delay != 0 {
+			violations = append(violations, problem.Violation{Field: "at", Reason: "conflict", Message: "set at or delay, not both"})
+		}
+		delay = input.At.Sub(now)
+	}
+	if delay < 0 || delay > MaxTTL {
+		violations = append(violations, problem.Violation{Field: "delay", Reason: "out_of_range", Message: "the start must be in the next " + MaxTTL.String()})
+	}
+	return delay, duration, violations
+}
+
+func writeScenario(response http.ResponseWriter, request *http.Request, status ScenarioStatus, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownScenario):
+		problem.Write(response, request, http.StatusNotFound, err.Error())
+	case err != nil:
+		problem.Write(response, request, http.StatusConflict, err.Error())
+	default:
+		problem.WriteJSON(response, http.StatusOK, status)
+	}
+}
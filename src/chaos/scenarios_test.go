@@ -0,0 +1,158 @@
+package chaos_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cldmnky/observability-workshop/src/chaos"
+)
+
+func serveScenarios(t *testing.T, scenarios *chaos.Scenarios, method, path, body string) (*httptest.ResponseRecorder, chaos.ScenarioStatus) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	scenarios.ServeHTTP(recorder, httptest.NewRequest(method, chaos.ScenariosPath+path, strings.NewReader(body)))
+	var status chaos.ScenarioStatus
+	_ = json.Unmarshal(recorder.Body.Bytes(), &status)
+	return recorder, status
+}
+
+func TestPresetsPerService(t *testing.T) {
+	names := func(service string) string {
+		var listed []string
+		for _, preset := range chaos.Presets(service) {
+			listed = append(listed, preset.Name)
+		}
+		return strings.Join(listed, ",")
+	}
+	for service, want := range map[string]string{
+		"database": "slow-database,memory-leak,goroutine-leak",
+		"backend":  "notifier-outage,error-spike-notes,memory-leak,goroutine-leak",
+		"frontend": "memory-leak,goroutine-leak",
+	} {
+		if got := names(service); got != want {
+			t.Fatalf("expected %s presets %s, got %s", service, want, got)
+		}
+	}
+}
+
+func TestScenarioStartsAndStopsItsFaults(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+	scenarios := chaos.NewScenarios(injector, chaos.Presets("backend"))
+
+	recorder, status := serveScenarios(t, scenarios, http.MethodPost, "/error-spike-notes/start", `{"duration":"1m"}`)
+	if recorder.Code != http.StatusOK || status.State != chaos.StateActive || status.EndsAt.Sub(*status.StartsAt) != time.Minute {
+		t.Fatalf("expected the scenario to be active for a minute, got %d %+v", recorder.Code, status)
+	}
+	active := injector.Active()
+	if len(active) != 2 || active[0].Scenario != chaos.ScenarioErrorSpike || active[0].ErrorRate != 0.4 {
+		t.Fatalf("expected the scenario's two faults, got %+v", active)
+	}
+	if again, _ := serveScenarios(t, scenarios, http.MethodPost, "/error-spike-notes/start", ""); again.Code != http.StatusConflict {
+		t.Fatalf("expected 409 starting it twice, got %d", again.Code)
+	}
+
+	listed := httptest.NewRecorder()
+	scenarios.ServeHTTP(listed, httptest.NewRequest(http.MethodGet, chaos.ScenariosPath, nil))
+	if !strings.Contains(listed.Body.String(), `"count":4`) || !strings.Contains(listed.Body.String(), `"state":"active"`) {
+		t.Fatalf("unexpected listing %s", listed.Body.String())
+	}
+
+	recorder, status = serveScenarios(t, scenarios, http.MethodPost, "/error-spike-notes/stop", "")
+	if recorder.Code != http.StatusOK || status.State != chaos.StateIdle || len(injector.Active()) != 0 {
+		t.Fatalf("expected the scenario and its faults gone, got %d %+v with %d faults", recorder.Code, status, len(injector.Active()))
+	}
+	if again, _ := serveScenarios(t, scenarios, http.MethodPost, "/error-spike-notes/stop", ""); again.Code != http.StatusConflict {
+		t.Fatalf("expected 409 stopping an idle scenario, got %d", again.Code)
+	}
+}
+
+func TestScenarioAPIRejectsBadRequests(t *testing.T) {
+	scenarios := chaos.NewScenarios(chaos.NewInjector(nil), chaos.Presets("database"))
+
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/notifier-outage/start", "", http.StatusNotFound},
+		{http.MethodPost, "/slow-database/pause", "", http.StatusNotFound},
+		{http.MethodGet, "/slow-database/start", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/slow-database/start", `{"duration":"-1s"}`, http.StatusBadRequest},
+		{http.MethodPost, "/slow-database/start", `{"delay":"1m","at":"2030-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/slow-database/start", `{"at":"2000-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/slow-database/start", `{"speed":"fast"}`, http.StatusBadRequest},
+	} {
+		if recorder, _ := serveScenarios(t, scenarios, test.method, test.path, test.body); recorder.Code != test.status {
+			t.Fatalf("expected %d for %s %s %s, got %d: %s", test.status, test.method, test.path, test.body, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestScheduledScenarioStartsAndExpires(t *testing.T) {
+	injector := chaos.NewInjector(nil)
+	scenarios := chaos.NewScenarios(injector, chaos.Presets("database"))
+
+	status, err := scenarios.Start(context.Background(), chaos.ScenarioSlowDatabase, 20*time.Millisecond, 40*time.Millisecond)
+	if err != nil || status.State != chaos.StateScheduled || len(injector.Active()) != 0 {
+		t.Fatalf("expected a scheduled scenario without faults, got %+v %v", status, err)
+	}
+
+	waitForState(t, scenarios, chaos.ScenarioSlowDatabase, chaos.StateActive)
+	if active := injector.Active(); len(active) != 4 || active[0].Latency.Distribution != chaos.DistributionLongTail {
+		t.Fatalf("expected the slow database faults, got %+v", active)
+	}
+	waitForState(t, scenarios, chaos.ScenarioSlowDatabase, chaos.StateIdle)
+	if active := injector.Active(); len(active) != 0 {
+		t.Fatalf("expected the faults removed on expiry, got %+v", active)
+	}
+
+	if _, err := scenarios.Start(context.Background(), chaos.ScenarioSlowDatabase, time.Hour, time.Minute); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	if status, err := scenarios.Stop(chaos.ScenarioSlowDatabase); err != nil || status.State != chaos.StateIdle {
+		t.Fatalf("expected a scheduled scenario to be cancelled, got %+v %v", status, err)
+	}
+	if _, err := scenarios.Stop(chaos.ScenarioSlowDatabase); !errors.Is(err, chaos.ErrScenarioIdle) {
+		t.Fatalf("expected ErrScenarioIdle, got %v", err)
+	}
+}
+
+func TestScenarioRunStopsWithTheScenario(t *testing.T) {
+	stopped := make(chan struct{})
+	scenarios := chaos.NewScenarios(chaos.NewInjector(nil), []chaos.Scenario{{
+		Name: "custom",
+		Run: func(ctx context.Context) {
+			<-ctx.Done()
+			close(stopped)
+		},
+	}})
+
+	if _, err := scenarios.Start(context.Background(), "custom", 0, time.Minute); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := scenarios.Stop("custom"); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return when the scenario stopped")
+	}
+}
+
+func waitForState(t *testing.T, scenarios *chaos.Scenarios, name, state string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ := scenarios.Status(name); status.State == state {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("scenario %s never became %s", name, state)
+}
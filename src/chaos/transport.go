@@ -0,0 +1,102 @@
+package chaos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+// PeersByURL returns a peer resolver for Transport that names outgoing
+// requests by the base URL they are sent to, given as peer name to URL such
+// as {"database": "http://database:8082"}. Requests to other hosts are not
+// faulted.
+func PeersByURL(peers map[string]string) func(*http.Request) string {
+	hosts := map[string]string{}
+	for name, raw := range peers {
+		if parsed, err := url.Parse(raw); err == nil && parsed.Host != "" {
+			hosts[parsed.Host] = name
+		}
+	}
+	return func(request *http.Request) string {
+		return hosts[request.URL.Host]
+	}
+}
+
+// Transport applies the faults with a Peer to outgoing requests made through
+// next. peer names the service a request goes to, or returns "" to leave the
+// request alone.
+//
+// Latency delays the request before it is sent. A reset fails it with an
+// error wrapping syscall.ECONNRESET, an error returns a problem response
+// without sending it, and a partial response cuts the real response body in
+// half and fails the read with io.ErrUnexpectedEOF. Place Transport inside
+// any tracing transport so the client span carries the fault attributes.
+func (injector *Injector) Transport(next http.RoundTripper, peer func(*http.Request) string) http.RoundTripper {
+	return &transport{injector: injector, next: next, peer: peer}
+}
+
+type transport struct {
+	injector *Injector
+	next     http.RoundTripper
+	peer     func(*http.Request) string
+}
+
+func (transport *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	peer := transport.peer(request)
+	if peer == "" {
+		return transport.next.RoundTrip(request)
+	}
+	decided := transport.injector.plan(request, peer)
+	if len(decided.kinds) == 0 {
+		return transport.next.RoundTrip(request)
+	}
+
+	ctx := request.Context()
+	transport.injector.record(ctx, decided)
+	if !sleep(ctx, decided.delay) {
+		return nil, ctx.Err()
+	}
+	switch {
+	case decided.reset:
+		return nil, fmt.Errorf("%s: %w (fault injected)", peer, syscall.ECONNRESET)
+	case decided.status != 0:
+		injected := problem.New(request, decided.status, "fault injected")
+		injected.Type = problem.TypeFaultInjected
+		body, _ := json.Marshal(injected)
+		return &http.Response{
+			Status:        strconv.Itoa(decided.status) + " " + http.StatusText(decided.status),
+			StatusCode:    decided.status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {problem.ContentType}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       request,
+		}, nil
+	}
+
+	response, err := transport.next.RoundTrip(request)
+	if err != nil || !decided.partial {
+		return response, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), truncatedReader{}))
+	return response, nil
+}
+
+// truncatedReader fails every read as a connection closed mid-body would.
+type truncatedReader struct{}
+
+func (truncatedReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// Audit actions, one per note mutation.
+const (
+	auditActionCreated = "created"
+	auditActionUpdated = "updated"
+	auditActionDeleted = "deleted"
+)
+
+// Who made a change: the actorHeader, then the actorBaggageKey member, then
+// the tenant.
+const (
+	actorHeader     = "X-Actor"
+	actorBaggageKey = "actor.id"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEntry records one note mutation. BeforeHash and AfterHash are
+// noteHash values of the note before and after the change; BeforeHash is
+// empty for creates and AfterHash for deletes.
+type auditEntry struct {
+	ID         int    `json:"id"`
+	NoteID     int    `json:"noteId"`
+	Action     string `json:"action"`
+	Actor      string `json:"actor"`
+	BeforeHash string `json:"beforeHash"`
+	AfterHash  string `json:"afterHash"`
+	TraceID    string `json:"traceId"`
+	CreatedAt  string `json:"createdAt"`
+	Tenant     string `json:"tenant"`
+}
+
+// noteHash is the hex SHA-256 of a note's title and content, enough to tell
+// whether two audit entries saw the same note without storing its text.
+func noteHash(row note) string {
+	hash := sha256.Sum256([]byte(row.Title + "\x00" + row.Content))
+	return hex.EncodeToString(hash[:])
+}
+
+// forNote completes audit for action on the note with the given before and
+// after states. A nil state leaves its hash empty.
+func (audit auditEntry) forNote(action string, tenantID string, noteID int, before *note, after *note) auditEntry {
+	audit.Action = action
+	audit.Tenant = tenantID
+	audit.NoteID = noteID
+	if before != nil {
+		audit.BeforeHash = noteHash(*before)
+	}
+	if after != nil {
+		audit.AfterHash = noteHash(*after)
+	}
+	return audit
+}
+
+// newAuditEntry starts the audit entry for a note mutation made by request.
+// It fails when the actor is malformed.
+func newAuditEntry(request *http.Request) (auditEntry, error) {
+	actor := request.Header.Get(actorHeader)
+	if actor == "" {
+		actor = baggage.FromContext(request.Context()).Member(actorBaggageKey).Value()
+	}
+	if actor == "" {
+		actor = tenant.FromContext(request.Context())
+	}
+	if !tenant.Valid(actor) {
+		return auditEntry{}, errors.New("invalid actor " + strconv.Quote(actor))
+	}
+
+	traceID, _ := traceIDsFromContext(request.Context())
+	return auditEntry{
+		Actor:     actor,
+		TraceID:   traceID,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// handleAudit serves GET /audit: the tenant's audit log, filtered by the
+// note_id, actor, action, since and until query parameters.
+func (application *app) handleAudit(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	filter, err := parseAuditFilter(request.URL.Query())
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
+		return
+	}
+	application.listAudit(response, request, filter)
+}
+
+// listNoteAudit serves GET /notes/{id}/audit. Entries of deleted notes are
+// still listed.
+func (application *app) listNoteAudit(response http.ResponseWriter, request *http.Request, id int) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	filter, err := parseAuditFilter(url.Values{"limit": request.URL.Query()["limit"]})
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.NoteID = id
+	application.listAudit(response, request, filter)
+}
+
+func (application *app) listAudit(response http.ResponseWriter, request *http.Request, filter auditFilter) {
+	filter.Tenant = tenant.FromContext(request.Context())
+	entries, err := application.audit.ListAudit(request.Context(), filter)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query audit log")
+		return
+	}
+
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+func parseAuditFilter(query url.Values) (auditFilter, error) {
+	filter := auditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Limit:  defaultAuditLimit,
+	}
+	if filter.Action != "" && filter.Action != auditActionCreated && filter.Action != auditActionUpdated && filter.Action != auditActionDeleted {
+		return filter, errors.New("action must be one of created, updated, deleted")
+	}
+	if raw := query.Get("note_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id <= 0 {
+			return filter, errors.New("note_id must be a positive integer")
+		}
+		filter.NoteID = id
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return filter, errors.New("limit must be between 1 and " + strconv.Itoa(maxAuditLimit))
+		}
+		filter.Limit = limit
+	}
+	for _, bound := range []struct {
+		name   string
+		target *int64
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := query.Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, errors.New(bound.name + " must be an RFC 3339 timestamp")
+		}
+		*bound.target = parsed.Unix()
+	}
+	return filter, nil
+}
+
+// auditCreatedUnix returns the unix time of an entry's created_at, or 0 when
+// it cannot be parsed.
+func auditCreatedUnix(entry auditEntry) int64 {
+	parsed, err := time.Parse(time.RFC3339, entry.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return parsed.Unix()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+type auditResponse struct {
+	Count   int          `json:"count"`
+	Entries []auditEntry `json:"entries"`
+}
+
+func TestStoreConformanceAudit(t *testing.T) {
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+
+			decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNotes, "user1", http.MethodPost, "/notes", `{"title":"a","content":"one"}`, http.Header{actorHeader: {"alice"}}), http.StatusCreated)
+			decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNoteByID, "user1", http.MethodPut, "/notes/1", `{"title":"a","content":"two"}`, http.Header{actorHeader: {"bob"}}), http.StatusOK)
+			for range 2 {
+				// The second delete finds nothing and records nothing.
+				serveTenantRequest(t, application.handleNoteByID, "user1", http.MethodDelete, "/notes/1", "")
+			}
+			serveTenantRequest(t, application.handleNoteByID, "user1", http.MethodPut, "/notes/7", `{"title":"missing"}`, http.Header{actorHeader: {"bob"}})
+
+			history := decodeStoreResponse[auditResponse](t, serveTenantRequest(t, application.handleNoteByID, "user1", http.MethodGet, "/notes/1/audit", ""), http.StatusOK)
+			if history.Count != 3 {
+				t.Fatalf("expected 3 entries, got %+v", history.Entries)
+			}
+			deleted, updated, created := history.Entries[0], history.Entries[1], history.Entries[2]
+			if created.Action != auditActionCreated || created.Actor != "alice" || created.BeforeHash != "" || created.NoteID != 1 {
+				t.Fatalf("unexpected create entry %+v", created)
+			}
+			if updated.Action != auditActionUpdated || updated.Actor != "bob" || updated.BeforeHash != created.AfterHash || updated.AfterHash == updated.BeforeHash {
+				t.Fatalf("unexpected update entry %+v after %+v", updated, created)
+			}
+			// Without X-Actor the tenant is the actor.
+			if deleted.Action != auditActionDeleted || deleted.Actor != "user1" || deleted.BeforeHash != updated.AfterHash || deleted.AfterHash != "" {
+				t.Fatalf("unexpected delete entry %+v after %+v", deleted, updated)
+			}
+
+			filtered := decodeStoreResponse[auditResponse](t, serveTenantRequest(t, application.handleAudit, "user1", http.MethodGet, "/audit?actor=bob&action=updated", ""), http.StatusOK)
+			if filtered.Count != 1 || filtered.Entries[0] != updated {
+				t.Fatalf("expected only the update, got %+v", filtered.Entries)
+			}
+			other := decodeStoreResponse[auditResponse](t, serveTenantRequest(t, application.handleAudit, "user2", http.MethodGet, "/audit", ""), http.StatusOK)
+			if other.Count != 0 {
+				t.Fatalf("expected another tenant to see no entries, got %+v", other.Entries)
+			}
+		})
+	}
+}
+
+func TestAuditRejectsBadFiltersAndActors(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+
+	for _, target := range []string{"/audit?action=renamed", "/audit?since=yesterday", "/audit?limit=0", "/audit?note_id=x"} {
+		if recorder := serveStoreRequest(t, application.handleAudit, http.MethodGet, target, ""); recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", target, recorder.Code)
+		}
+	}
+	recorder := serveTenantRequest(t, application.handleNotes, tenant.Default, http.MethodPost, "/notes", `{"title":"a"}`, http.Header{actorHeader: {"bad actor"}})
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed actor, got %d", recorder.Code)
+	}
+}
+
+// newAuditTestApp returns a chai-backed app whose notes table rejects the
+// title "fail", so a note write can fail after its audit entry was written.
+func newAuditTestApp(t *testing.T) (*app, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("chai", ":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	_, err = db.Exec(`CREATE TABLE notes (
+		id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL CHECK (title != 'fail'),
+		content TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		t.Fatalf("create notes: %v", err)
+	}
+	if err := ensureSchema(db); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	application := newStoreTestApp(t, storageDriverMemory)
+	store := newChaiStore(db)
+	application.notes, application.audit = store, store
+	return application, db
+}
+
+func TestAuditEntryRollsBackWithFailedMutation(t *testing.T) {
+	application, _ := newAuditTestApp(t)
+	decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"ok"}`), http.StatusCreated)
+
+	if recorder := serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"fail"}`); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the create to fail, got %d", recorder.Code)
+	}
+	if recorder := serveStoreRequest(t, application.handleNoteByID, http.MethodPut, "/notes/1", `{"title":"fail"}`); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the update to fail, got %d", recorder.Code)
+	}
+
+	entries, err := application.audit.ListAudit(context.Background(), auditFilter{Tenant: tenant.Default, Limit: 10})
+	if err != nil || len(entries) != 1 || entries[0].Action != auditActionCreated {
+		t.Fatalf("expected only the successful create to be audited, got %+v (%v)", entries, err)
+	}
+	stored, _ := application.notes.GetNote(context.Background(), tenant.Default, 1)
+	if stored.Title != "ok" {
+		t.Fatalf("expected the note to be unchanged, got %+v", stored)
+	}
+}
+
+func TestFailedAuditWriteRollsBackMutation(t *testing.T) {
+	application, db := newAuditTestApp(t)
+	decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"kept"}`), http.StatusCreated)
+	if _, err := db.Exec("DROP TABLE audit_log"); err != nil {
+		t.Fatalf("drop audit_log: %v", err)
+	}
+
+	requests := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{application.handleNotes, http.MethodPost, "/notes", `{"title":"new"}`},
+		{application.handleNoteByID, http.MethodPut, "/notes/1", `{"title":"changed"}`},
+		{application.handleNoteByID, http.MethodDelete, "/notes/1", ""},
+	}
+	for _, request := range requests {
+		if recorder := serveStoreRequest(t, request.handler, request.method, request.target, request.body); recorder.Code != http.StatusInternalServerError {
+			t.Fatalf("%s %s: expected 500 without an audit log, got %d", request.method, request.target, recorder.Code)
+		}
+	}
+
+	notes, err := application.notes.ListNotes(context.Background(), tenant.Default)
+	if err != nil || len(notes) != 1 || notes[0].Title != "kept" {
+		t.Fatalf("expected the original note only, got %+v (%v)", notes, err)
+	}
+}
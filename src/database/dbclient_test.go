@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cldmnky/observability-workshop/src/dbclient"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// newClientTestServer serves the database API from a chai-backed app, with
+// the SQL-only outbox on a database of its own, and returns a client for it
+// that sends the tenant in the request context.
+func newClientTestServer(t *testing.T) *dbclient.Client {
+	t.Helper()
+	application := newStoreTestApp(t, storageDriverChai)
+	application.db = newTestDB(t)
+	server := httptest.NewServer(tenant.Middleware(application.routes()))
+	t.Cleanup(server.Close)
+	return dbclient.New(server.URL, &http.Client{Transport: tenant.NewTransport(nil)})
+}
+
+func TestClientNotesRoundTrip(t *testing.T) {
+	client := newClientTestServer(t)
+	ctx := tenant.WithTenant(context.Background(), "user1")
+
+	created, err := client.CreateNote(ctx, dbclient.NoteInput{Title: " Release ", Content: "ship it"})
+	if err != nil || created.ID == 0 || created.Title != "Release" || created.Tenant != "user1" {
+		t.Fatalf("expected the note created for user1, got %+v %v", created, err)
+	}
+	updated, err := client.UpdateNote(ctx, created.ID, dbclient.NoteInput{Title: "Release 2", Content: "shipped"})
+	if err != nil || updated.ID != created.ID || updated.Content != "shipped" {
+		t.Fatalf("expected the note updated, got %+v %v", updated, err)
+	}
+	stored, err := client.GetNote(ctx, created.ID)
+	if err != nil || stored.Title != "Release 2" {
+		t.Fatalf("expected the updated note, got %+v %v", stored, err)
+	}
+	notes, err := client.ListNotes(ctx, dbclient.NoteQuery{})
+	if err != nil || len(notes) != 1 || notes[0].ID != created.ID || notes[0].HTML != "" {
+		t.Fatalf("expected the one note listed, got %+v %v", notes, err)
+	}
+	rendered, err := client.ListNotes(ctx, dbclient.NoteQuery{Render: "html"})
+	if err != nil || len(rendered) != 1 || !strings.Contains(rendered[0].HTML, "<p>shipped</p>") {
+		t.Fatalf("expected the note rendered, got %+v %v", rendered, err)
+	}
+	if _, err := client.ListNotes(ctx, dbclient.NoteQuery{Render: "pdf"}); err == nil {
+		t.Fatal("expected an unknown render rejected")
+	}
+
+	export, err := client.ExportNotes(ctx)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	markdown, _ := io.ReadAll(export)
+	export.Close()
+	if !strings.Contains(string(markdown), "## Release 2\n") {
+		t.Fatalf("expected the note in the export, got %q", markdown)
+	}
+
+	if _, err := client.GetNote(tenant.WithTenant(context.Background(), "user2"), created.ID); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Fatalf("expected another tenant's note not found, got %v", err)
+	}
+	var rejected *problem.Problem
+	if err := client.DeleteNote(dbclient.WithActor(ctx, "not an actor"), created.ID); !errors.As(err, &rejected) || !strings.Contains(rejected.Detail, "invalid actor") {
+		t.Fatalf("expected the actor sent and rejected, got %v", err)
+	}
+	if err := client.DeleteNote(dbclient.WithActor(ctx, "alice"), created.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = client.GetNote(ctx, created.ID)
+	var failed *dbclient.Error
+	if !errors.As(err, &failed) || !errors.Is(err, dbclient.ErrNotFound) || failed.Op != "GetNote" || failed.Problem == nil || failed.Problem.Detail != "note not found" {
+		t.Fatalf("expected a not-found error with the database's problem, got %#v", err)
+	}
+}
+
+func TestClientReportsValidationProblems(t *testing.T) {
+	client := newClientTestServer(t)
+	ctx := tenant.WithTenant(context.Background(), "user1")
+
+	_, err := client.CreateNote(ctx, dbclient.NoteInput{Title: strings.Repeat("x", maxNoteTitleLength+1)})
+	var rejected *problem.Problem
+	if !errors.As(err, &rejected) || rejected.Status != http.StatusBadRequest || len(rejected.Violations) != 1 || rejected.Violations[0].Field != "title" {
+		t.Fatalf("expected the validation problem, got %v", err)
+	}
+	if errors.Is(err, dbclient.ErrNotFound) || errors.Is(err, dbclient.ErrConflict) || errors.Is(err, dbclient.ErrUnavailable) {
+		t.Fatalf("expected a 400 to match no error kind, got %v", err)
+	}
+	if _, err := client.ListEvents(ctx, dbclient.EventQuery{TraceID: "not-a-trace"}); !errors.As(err, &rejected) || rejected.Status != http.StatusBadRequest {
+		t.Fatalf("expected an invalid trace id rejected, got %v", err)
+	}
+}
+
+func TestClientCreatesAreIdempotent(t *testing.T) {
+	client := newClientTestServer(t)
+	ctx := dbclient.WithIdempotencyKey(tenant.WithTenant(context.Background(), "user1"), "note-1")
+
+	first, err := client.CreateNote(ctx, dbclient.NoteInput{Title: "once"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	second, err := client.CreateNote(ctx, dbclient.NoteInput{Title: "once"})
+	if err != nil || second.ID != first.ID || first.Replayed || !second.Replayed {
+		t.Fatalf("expected the keyed create replayed, got %+v %v", second, err)
+	}
+	if notes, _ := client.ListNotes(ctx, dbclient.NoteQuery{}); len(notes) != 1 {
+		t.Fatalf("expected a single note stored, got %d", len(notes))
+	}
+
+	// Without a key each call is a write of its own.
+	plain := tenant.WithTenant(context.Background(), "user1")
+	for range 2 {
+		if _, err := client.CreateEvent(plain, dbclient.EventInput{Source: "backend", Route: "/api/ok"}); err != nil {
+			t.Fatalf("create event: %v", err)
+		}
+	}
+	events, err := client.ListEvents(plain, dbclient.EventQuery{Limit: 1})
+	if err != nil || len(events) != 1 || events[0].Route != "/api/ok" || events[0].Method != http.MethodGet {
+		t.Fatalf("expected one defaulted event within the limit, got %+v %v", events, err)
+	}
+	stats, err := client.EventStats(plain, dbclient.StatsQuery{Window: "1h", Bucket: "1h", GroupBy: []string{"source"}})
+	if err != nil || stats.Total != 2 || stats.Window != "1h0m0s" || len(stats.GroupBy) != 1 {
+		t.Fatalf("expected both events counted, got %+v %v", stats, err)
+	}
+}
+
+func TestClientOutbox(t *testing.T) {
+	client := newClientTestServer(t)
+	ctx := tenant.WithTenant(context.Background(), "user1")
+
+	stored, err := client.CreateOutboxMessage(ctx, dbclient.OutboxInput{Destination: "notifier", Payload: json.RawMessage(`{"key":"k1"}`)})
+	if err != nil || stored.ID == 0 {
+		t.Fatalf("expected the message stored, got %+v %v", stored, err)
+	}
+	if _, err := client.CreateOutboxMessage(ctx, dbclient.OutboxInput{Destination: "webhooks", Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	messages, err := client.ListOutbox(ctx, "notifier", 10)
+	if err != nil || len(messages) != 1 || string(messages[0].Payload) != `{"key":"k1"}` || messages[0].Tenant != "user1" {
+		t.Fatalf("expected the notifier's message listed, got %+v %v", messages, err)
+	}
+	if err := client.DeleteOutboxMessage(ctx, stored.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if messages, _ := client.ListOutbox(ctx, "notifier", 10); len(messages) != 0 {
+		t.Fatalf("expected the message removed, got %+v", messages)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+type bulkEventsConfig struct {
+	// BatchSize is the number of rows inserted per transaction.
+	BatchSize int
+	// MaxBytes caps the request body; larger uploads are rejected with 413.
+	MaxBytes int64
+}
+
+// bulkEventResult reports the outcome of a single NDJSON line.
+type bulkEventResult struct {
+	Line   int    `json:"line"`
+	Status int    `json:"status"`
+	ID     int    `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Violations lists why a line was rejected with 400.
+	Violations []violation `json:"violations,omitempty"`
+}
+
+type bulkEventLine struct {
+	line  int
+	input createEventRequest
+}
+
+// handleEventsBulk ingests newline-delimited createEventRequest documents.
+// Valid lines are inserted in transactions of BatchSize rows; each line gets
+// its own result so a single bad line does not fail the whole upload.
+func (application *app) handleEventsBulk(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(response, request.Body, application.bulkEvents.MaxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			application.rejectRequest(response, request, "/events/bulk", http.StatusRequestEntityTooLarge, []violation{{
+				Field:   "body",
+				Reason:  reasonBodyTooLarge,
+				Message: fmt.Sprintf("body must be at most %d bytes", tooLarge.Limit),
+			}})
+			return
+		}
+		problem.Write(response, request, http.StatusBadRequest, "failed reading request body")
+		return
+	}
+
+	var results []bulkEventResult
+	var pending []bulkEventLine
+	for index, raw := range bytes.Split(body, []byte("\n")) {
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 {
+			continue
+		}
+
+		var input createEventRequest
+		var violations []violation
+		if err := decodeStrictJSON(bytes.NewReader(raw), &input); err != nil {
+			violations = []violation{jsonViolation(err)}
+		} else {
+			input.applyDefaults()
+			violations = input.validate()
+		}
+		if len(violations) > 0 {
+			application.countViolations(request.Context(), "/events/bulk", violations)
+			results = append(results, bulkEventResult{
+				Line:       index + 1,
+				Status:     http.StatusBadRequest,
+				Error:      violationMessages(violations),
+				Violations: violations,
+			})
+			continue
+		}
+		pending = append(pending, bulkEventLine{line: index + 1, input: input})
+	}
+
+	inserted := application.insertEventBatches(request.Context(), pending)
+	results = append(results, inserted...)
+	slices.SortFunc(results, func(left, right bulkEventResult) int { return left.Line - right.Line })
+
+	created := 0
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			created++
+		}
+	}
+
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"created": created,
+		"failed":  len(results) - created,
+		"results": results,
+	})
+}
+
+// insertEventBatches writes lines in BatchSize transactions under a single
+// "events.bulk_insert" span and returns one result per line.
+func (application *app) insertEventBatches(ctx context.Context, lines []bulkEventLine) []bulkEventResult {
+	batchSize := application.bulkEvents.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(lines)
+	}
+
+	ctx, span := otel.Tracer(application.serviceName).Start(ctx, "events.bulk_insert",
+		trace.WithAttributes(
+			attribute.Int("events.bulk.size", len(lines)),
+			attribute.Int("events.bulk.batch_size", batchSize),
+		),
+	)
+	defer span.End()
+
+	traceID, spanID := traceIDsFromContext(ctx)
+	tenantID := tenant.FromContext(ctx)
+	start := time.Now()
+	results := make([]bulkEventResult, 0, len(lines))
+	var created []event
+	batches := 0
+
+	for offset := 0; offset < len(lines); offset += batchSize {
+		batch := lines[offset:min(offset+batchSize, len(lines))]
+		batches++
+
+		pending := make([]event, 0, len(batch))
+		createdAt := time.Now().UTC().Format(time.RFC3339)
+		for _, line := range batch {
+			pending = append(pending, line.input.toEvent(tenantID, createdAt, traceID, spanID))
+		}
+
+		// One store call, and so one transaction, per batch.
+		rows, err := application.events.CreateEvents(ctx, pending)
+		if err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(ctx, "bulk event batch failed", "batch.size", len(batch), "err", err)
+			for _, line := range batch {
+				results = append(results, bulkEventResult{Line: line.line, Status: http.StatusInternalServerError, Error: "failed to insert batch"})
+			}
+			continue
+		}
+
+		for index, row := range rows {
+			results = append(results, bulkEventResult{Line: batch[index].line, Status: http.StatusCreated, ID: row.ID})
+		}
+		created = append(created, rows...)
+	}
+
+	duration := time.Since(start)
+	span.SetAttributes(
+		attribute.Int("events.bulk.batches", batches),
+		attribute.Int("events.bulk.created", len(created)),
+		attribute.Int("events.bulk.failed", len(lines)-len(created)),
+		attribute.Float64("events.bulk.insert_duration_ms", float64(duration.Microseconds())/1000),
+	)
+	if len(created) < len(lines) {
+		span.SetStatus(codes.Error, "some event batches failed")
+	}
+
+	application.eventsCreated.Add(ctx, int64(len(created)),
+		metric.WithAttributes(application.tenants.Attribute(ctx)))
+	published := make([]any, len(created))
+	for index, row := range created {
+		published[index] = row
+	}
+	application.webhooks.publishEach(ctx, webhookEventCreated, published)
+
+	slog.InfoContext(ctx, "bulk events created",
+		"events.bulk.size", len(lines),
+		"events.bulk.created", len(created),
+		"events.bulk.batches", batches,
+		"duration_ms", duration.Milliseconds(),
+	)
+	return results
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHandleEventsBulkInsertsInBatches(t *testing.T) {
+	db := newTestDB(t)
+	counter, _ := noop.NewMeterProvider().Meter("test").Int64Counter("events")
+	application := &app{
+		db:              db,
+		events:          newChaiStore(db),
+		serviceName:     "database",
+		eventsCreated:   counter,
+		invalidRequests: counter,
+		bulkEvents:      bulkEventsConfig{BatchSize: 2, MaxBytes: 1 << 20},
+	}
+
+	body := strings.Join([]string{
+		`{"source":"seed","route":"/api/ok","status":200}`,
+		`{"source":"seed","route":"/api/error","status":404}`,
+		`not json`,
+		``,
+		`{"source":"seed","route":"/api/ok"}`,
+		`{"source":"seed","message":"last"}`,
+	}, "\n")
+
+	recorder := httptest.NewRecorder()
+	application.handleEventsBulk(recorder, httptest.NewRequest(http.MethodPost, "/events/bulk", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var payload struct {
+		Created int               `json:"created"`
+		Failed  int               `json:"failed"`
+		Results []bulkEventResult `json:"results"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if payload.Created != 4 || payload.Failed != 1 || len(payload.Results) != 5 {
+		t.Fatalf("unexpected summary %+v", payload)
+	}
+
+	wantLines := []int{1, 2, 3, 5, 6}
+	wantStatus := []int{201, 201, 400, 201, 201}
+	for index, result := range payload.Results {
+		if result.Line != wantLines[index] || result.Status != wantStatus[index] {
+			t.Fatalf("result %d: expected line %d status %d, got %+v", index, wantLines[index], wantStatus[index], result)
+		}
+	}
+	if payload.Results[4].ID != 4 {
+		t.Fatalf("expected consecutive ids across batches, got %+v", payload.Results)
+	}
+
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM events WHERE source = 'seed'").Scan(&stored); err != nil {
+		t.Fatalf("count events: %v", err)
+	}
+	if stored != 4 {
+		t.Fatalf("expected 4 stored events, got %d", stored)
+	}
+}
+
+func TestHandleEventsBulkRejectsOversizedBody(t *testing.T) {
+	counter, _ := noop.NewMeterProvider().Meter("test").Int64Counter("invalid")
+	application := &app{
+		db:              newTestDB(t),
+		serviceName:     "database",
+		invalidRequests: counter,
+		bulkEvents:      bulkEventsConfig{BatchSize: 10, MaxBytes: 16},
+	}
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"source":"seed","route":"/api/ok","status":200}`)
+	application.handleEventsBulk(recorder, httptest.NewRequest(http.MethodPost, "/events/bulk", body))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", recorder.Code)
+	}
+}
+
+func TestHandleEventsBulkLooksSubscriptionsUpOnce(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	meter := noop.NewMeterProvider().Meter("test")
+	db, err := openChaiDB(":memory:", newSQLInstrumentation(tracer, meter, 0))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := ensureSchema(db); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+	insertTestSubscription(t, db, 1, "http://subscriber.invalid/", webhookEventCreated, "s3cret")
+
+	counter, _ := meter.Int64Counter("events")
+	config := testWebhookConfig()
+	config.QueueSize = 100
+	application := &app{
+		db:              db,
+		events:          newChaiStore(db),
+		serviceName:     "database",
+		eventsCreated:   counter,
+		invalidRequests: counter,
+		bulkEvents:      bulkEventsConfig{BatchSize: 10, MaxBytes: 1 << 20},
+		// Not started, so the deliveries stay queued.
+		webhooks: newWebhookDispatcher(db, http.DefaultClient, config, meter),
+	}
+
+	lines := strings.Repeat(`{"source":"seed","route":"/api/ok"}`+"\n", 50)
+	response := httptest.NewRecorder()
+	application.handleEventsBulk(response, httptest.NewRequest(http.MethodPost, "/events/bulk", strings.NewReader(lines)))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.Code, response.Body.String())
+	}
+
+	queries := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "SELECT subscriptions" {
+			queries++
+		}
+	}
+	if queries != 1 || len(application.webhooks.queue) != 50 {
+		t.Fatalf("expected one subscription query for 50 queued deliveries, got %d queries and %d deliveries", queries, len(application.webhooks.queue))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// idempotencyKeys replays the stored response of a POST repeated with the
+// same Idempotency-Key within ttl, so retried writes do not create duplicate
+// rows.
+type idempotencyKeys struct {
+	store IdempotencyStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu sync.Mutex
+	// inFlight holds the keys whose first request is still running.
+	inFlight map[idempotencyScope]struct{}
+}
+
+func newIdempotencyKeys(store IdempotencyStore, ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{
+		store:    store,
+		ttl:      ttl,
+		now:      time.Now,
+		inFlight: map[idempotencyScope]struct{}{},
+	}
+}
+
+// withIdempotency runs handler for a POST to route. Requests without an
+// Idempotency-Key, or apps without keys configured, run handler directly.
+//
+// The first request with a key runs handler and stores its response along
+// with a hash of the body; body is read up to limit+1 bytes so oversized
+// bodies still reach handler's own limit check. A repeat with the same body
+// gets the stored response with Idempotent-Replayed: true. A repeat with a
+// different body gets 422, and one arriving while the first is still running
+// gets 409. Responses with 5xx status are not stored, so those requests can
+// be retried.
+func (application *app) withIdempotency(response http.ResponseWriter, request *http.Request, route string, limit int64, handler http.HandlerFunc) {
+	key := request.Header.Get(idempotency.Header)
+	keys := application.idempotency
+	if key == "" || keys == nil {
+		handler(response, request)
+		return
+	}
+	if len(key) > idempotency.MaxKeyLength {
+		problem.Write(response, request, http.StatusBadRequest,
+			"Idempotency-Key must be at most "+strconv.Itoa(idempotency.MaxKeyLength)+" characters")
+		return
+	}
+
+	var reader io.Reader = request.Body
+	if limit > 0 {
+		reader = io.LimitReader(request.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, "failed reading request body")
+		return
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(hash[:])
+
+	ctx := request.Context()
+	span := trace.SpanFromContext(ctx)
+	scope := idempotencyScope{tenant: tenant.FromContext(ctx), route: route, key: key}
+
+	if !keys.begin(scope) {
+		problem.Write(response, request, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+		return
+	}
+	defer keys.end(scope)
+
+	// The store is read only while the key is held, so a repeat cannot miss
+	// a record that the first request saves before the repeat runs handler.
+	stored, err := keys.store.GetIdempotencyRecord(ctx, scope.tenant, route, key)
+	switch {
+	case err == nil && stored.CreatedUnix >= keys.expiredBefore():
+		if stored.RequestHash != requestHash {
+			reused := problem.New(request, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body")
+			reused.Type = problem.TypeIdempotencyKeyReused
+			reused.Write(response)
+			return
+		}
+		idempotency.MarkSpan(span, true)
+		response.Header().Set("Content-Type", stored.ContentType)
+		response.Header().Set(idempotency.ReplayedHeader, "true")
+		response.WriteHeader(stored.Status)
+		_, _ = response.Write(stored.Body)
+		return
+	case err != nil && !errors.Is(err, errNotFound):
+		slog.ErrorContext(ctx, "idempotency lookup failed", "route", route, "err", err)
+		problem.Write(response, request, http.StatusInternalServerError, "failed to look up Idempotency-Key")
+		return
+	}
+
+	idempotency.MarkSpan(span, false)
+	capture := &capturingResponseWriter{ResponseWriter: response, status: http.StatusOK}
+	handler(capture, request)
+	if capture.status >= 500 {
+		return
+	}
+
+	err = keys.store.SaveIdempotencyRecord(ctx, idempotencyRecord{
+		Tenant:      scope.tenant,
+		Route:       route,
+		Key:         key,
+		RequestHash: requestHash,
+		Status:      capture.status,
+		ContentType: capture.Header().Get("Content-Type"),
+		Body:        capture.body.Bytes(),
+		CreatedUnix: keys.now().Unix(),
+	}, keys.expiredBefore())
+	if err != nil {
+		// The response is already sent; a repeat will simply run again.
+		slog.ErrorContext(ctx, "failed to store idempotency record", "route", route, "err", err)
+	}
+}
+
+// expiredBefore is the creation time before which records are no longer
+// replayed.
+func (keys *idempotencyKeys) expiredBefore() int64 {
+	return keys.now().Add(-keys.ttl).Unix()
+}
+
+func (keys *idempotencyKeys) begin(scope idempotencyScope) bool {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	if _, running := keys.inFlight[scope]; running {
+		return false
+	}
+	keys.inFlight[scope] = struct{}{}
+	return true
+}
+
+func (keys *idempotencyKeys) end(scope idempotencyScope) {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	delete(keys.inFlight, scope)
+}
+
+// capturingResponseWriter passes a response through while keeping a copy of
+// its status and body.
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (writer *capturingResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *capturingResponseWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
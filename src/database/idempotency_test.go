@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+func TestIdempotencyKeyReplaysResponses(t *testing.T) {
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+
+			first := serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"source":"backend"}`, http.Header{idempotency.Header: {"retry-1"}})
+			created := decodeStoreResponse[event](t, first, http.StatusCreated)
+			if first.Header().Get(idempotency.ReplayedHeader) != "" {
+				t.Fatal("expected the first response not to be marked as replayed")
+			}
+
+			repeat := serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"source":"backend"}`, http.Header{idempotency.Header: {"retry-1"}})
+			replayed := decodeStoreResponse[event](t, repeat, http.StatusCreated)
+			if replayed != created || repeat.Header().Get(idempotency.ReplayedHeader) != "true" {
+				t.Fatalf("expected a replay of %+v, got %+v (%v)", created, replayed, repeat.Header())
+			}
+
+			// The same key is independent per tenant and per route.
+			serveTenantRequest(t, application.handleEvents, "user2", http.MethodPost, "/events", `{"source":"backend"}`, http.Header{idempotency.Header: {"retry-1"}})
+			decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNotes, "user1", http.MethodPost, "/notes", `{"title":"a"}`, http.Header{idempotency.Header: {"retry-1"}}), http.StatusCreated)
+
+			events, err := application.events.ListEvents(context.Background(), eventFilter{Tenant: "user1", Limit: 10})
+			if err != nil || len(events) != 1 {
+				t.Fatalf("expected one stored event for user1, got %d (%v)", len(events), err)
+			}
+
+			reused := serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"source":"other"}`, http.Header{idempotency.Header: {"retry-1"}})
+			mismatch := decodeStoreResponse[problem.Problem](t, reused, http.StatusUnprocessableEntity)
+			if mismatch.Type != problem.TypeIdempotencyKeyReused {
+				t.Fatalf("expected an idempotency-key-reused problem, got %+v", mismatch)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	now := time.Unix(1_700_000_000, 0)
+	application.idempotency.now = func() time.Time { return now }
+
+	decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNotes, tenant.Default, http.MethodPost, "/notes", `{"title":"a"}`, http.Header{idempotency.Header: {"k"}}), http.StatusCreated)
+	now = now.Add(2 * time.Hour)
+	again := serveTenantRequest(t, application.handleNotes, tenant.Default, http.MethodPost, "/notes", `{"title":"b"}`, http.Header{idempotency.Header: {"k"}})
+	if again.Code != http.StatusCreated || again.Header().Get(idempotency.ReplayedHeader) != "" {
+		t.Fatalf("expected an expired key to run again, got %d %v", again.Code, again.Header())
+	}
+
+	notes, _ := application.notes.ListNotes(context.Background(), tenant.Default)
+	if len(notes) != 2 {
+		t.Fatalf("expected two notes, got %d", len(notes))
+	}
+}
+
+func TestIdempotencyKeyRejectsConcurrentRepeat(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := func(response http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		problem.WriteJSON(response, http.StatusCreated, map[string]string{"ok": "true"})
+	}
+	handler := func(response http.ResponseWriter, request *http.Request) {
+		application.withIdempotency(response, request, "/events", 0, slow)
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		serveTenantRequest(t, handler, tenant.Default, http.MethodPost, "/events", `{}`, http.Header{idempotency.Header: {"k"}})
+	}()
+	<-started
+	conflict := serveTenantRequest(t, handler, tenant.Default, http.MethodPost, "/events", `{}`, http.Header{idempotency.Header: {"k"}})
+	close(release)
+	wait.Wait()
+
+	if conflict.Code != http.StatusConflict {
+		t.Fatalf("expected 409 while the first request runs, got %d", conflict.Code)
+	}
+	if replay := serveTenantRequest(t, handler, tenant.Default, http.MethodPost, "/events", `{}`, http.Header{idempotency.Header: {"k"}}); replay.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("expected a replay once the first request finished, got %d", replay.Code)
+	}
+}
+
+// pausingIdempotencyStore holds the first lookup until release is closed,
+// after signalling looking.
+type pausingIdempotencyStore struct {
+	IdempotencyStore
+	looking, release chan struct{}
+	paused           atomic.Bool
+}
+
+func (store *pausingIdempotencyStore) GetIdempotencyRecord(ctx context.Context, tenantID string, route string, key string) (idempotencyRecord, error) {
+	stored, err := store.IdempotencyStore.GetIdempotencyRecord(ctx, tenantID, route, key)
+	if store.paused.CompareAndSwap(false, true) {
+		close(store.looking)
+		<-store.release
+	}
+	return stored, err
+}
+
+func TestIdempotencyKeyLookupCannotRaceTheFirstRequest(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	store := &pausingIdempotencyStore{
+		IdempotencyStore: application.idempotency.store,
+		looking:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	application.idempotency.store = store
+
+	// The first request's lookup finds nothing and is held there while a
+	// repeat arrives and finishes.
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		first <- serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"source":"backend"}`, http.Header{idempotency.Header: {"k"}})
+	}()
+	<-store.looking
+	repeat := serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"source":"backend"}`, http.Header{idempotency.Header: {"k"}})
+	close(store.release)
+	decodeStoreResponse[event](t, <-first, http.StatusCreated)
+
+	if repeat.Code != http.StatusConflict {
+		t.Fatalf("expected the repeat refused while the first request holds the key, got %d", repeat.Code)
+	}
+	events, err := application.events.ListEvents(context.Background(), eventFilter{Tenant: "user1", Limit: 10})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected one stored event, got %d (%v)", len(events), err)
+	}
+}
+
+func TestIdempotencyReplayMarksSpan(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	application := newStoreTestApp(t, storageDriverMemory)
+
+	for range 2 {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/notes", strings.NewReader(`{"title":"a"}`))
+		request.Header.Set(idempotency.Header, "k")
+		ctx, span := tracer.Start(request.Context(), "POST /notes")
+		application.handleNotes(recorder, request.WithContext(ctx))
+		span.End()
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	for index, want := range []bool{false, true} {
+		got := spanAttribute(ended[index], attribute.Key(idempotency.ReplayedAttributeKey))
+		if got.Type() != attribute.BOOL || got.AsBool() != want {
+			t.Fatalf("span %d: expected %s=%v, got %v", index, idempotency.ReplayedAttributeKey, want, got)
+		}
+	}
+}
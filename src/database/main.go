@@ -3,16 +3,17 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,7 +25,11 @@ import (
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
+	"github.com/cldmnky/observability-workshop/src/chaos"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/ratelimit"
 	"github.com/cldmnky/observability-workshop/src/telemetry"
+	"github.com/cldmnky/observability-workshop/src/tenant"
 )
 
 type event struct {
@@ -35,6 +40,9 @@ type event struct {
 	Status    int    `json:"status"`
 	Message   string `json:"message"`
 	CreatedAt string `json:"createdAt"`
+	TraceID   string `json:"traceId"`
+	SpanID    string `json:"spanId"`
+	Tenant    string `json:"tenant"`
 }
 
 type createEventRequest struct {
@@ -51,6 +59,7 @@ type note struct {
 	Content   string `json:"content"`
 	CreatedAt string `json:"createdAt"`
 	UpdatedAt string `json:"updatedAt"`
+	Tenant    string `json:"tenant"`
 }
 
 type createNoteRequest struct {
@@ -59,10 +68,31 @@ type createNoteRequest struct {
 }
 
 type app struct {
+	// db is the chai database behind events and notes, and holds the
+	// SQL-only tables (subscriptions, summaries). Nil with
+	// DATABASE_DRIVER=memory.
 	db            *sql.DB
+	events        EventStore
+	notes         NoteStore
+	audit         AuditStore
 	serviceName   string
 	eventsCreated metric.Int64Counter
 	notesCreated  metric.Int64Counter
+	// invalidRequests counts validation failures by route and reason.
+	invalidRequests metric.Int64Counter
+	bodyLimits      bodyLimits
+	webhooks        *webhookDispatcher
+	bulkEvents      bulkEventsConfig
+	// tenants bounds the tenant label on the created counters.
+	tenants *tenant.Labeler
+	// idempotency replays keyed POST /events and POST /notes requests.
+	idempotency *idempotencyKeys
+	// renderer turns note content into HTML for /notes/{id}.html and
+	// GET /notes?render=html.
+	renderer *noteRenderer
+	// outboxMu serialises outbox inserts, which allocate ids with
+	// MAX(id)+1.
+	outboxMu sync.Mutex
 }
 
 func main() {
@@ -98,42 +128,146 @@ func main() {
 		"database.notes.created",
 		metric.WithDescription("Total number of notes written to the database"),
 	)
+	invalidCounter, _ := meter.Int64Counter(
+		"database.requests.invalid",
+		metric.WithDescription("Request bodies rejected by validation, by route and reason"),
+		metric.WithUnit("{violation}"),
+	)
+	faultsCounter, _ := meter.Int64Counter(
+		"database.faults.injected",
+		metric.WithDescription("Faults injected into requests, by fault route and kind"),
+		metric.WithUnit("{fault}"),
+	)
+	renderCacheCounter, _ := meter.Int64Counter(
+		"database.notes.render.cache",
+		metric.WithDescription("Rendered note cache lookups, by result (hit or miss)"),
+	)
+	rateLimitCounter, _ := meter.Int64Counter(
+		"database.ratelimit.requests",
+		metric.WithDescription("Rate-limited requests allowed or refused, by rule route, key type and decision"),
+		metric.WithUnit("{request}"),
+	)
+
+	// Storage – chai keeps events and notes in an embedded on-disk database;
+	// memory keeps them in process for demos. Subscriptions, retention and
+	// retention summaries are SQL-only and need chai.
+	storageDriver := envOrDefault("DATABASE_DRIVER", storageDriverChai)
+	var db *sql.DB
+	var events EventStore
+	var notes NoteStore
+	var audit AuditStore
+	var keys IdempotencyStore
+	switch storageDriver {
+	case storageDriverChai:
+		if databaseFile != ":memory:" {
+			err = os.MkdirAll(filepath.Dir(databaseFile), 0o755)
+			if err != nil {
+				slog.Error("failed to prepare db directory", "service", serviceName, "err", err)
+				os.Exit(1)
+			}
+		}
 
-	if databaseFile != ":memory:" {
-		err = os.MkdirAll(filepath.Dir(databaseFile), 0o755)
+		// Every statement gets a client span and a db.client.operation.duration
+		// measurement from the instrumented driver; statements slower than
+		// DATABASE_SLOW_QUERY_THRESHOLD are also logged.
+		instrumentation := newSQLInstrumentation(otel.Tracer(serviceName), meter,
+			envDurationOrDefault("DATABASE_SLOW_QUERY_THRESHOLD", 200*time.Millisecond))
+		db, err = openChaiDB(databaseFile, instrumentation)
 		if err != nil {
-			slog.Error("failed to prepare db directory", "service", serviceName, "err", err)
+			slog.Error("failed to open db", "service", serviceName, "err", err)
 			os.Exit(1)
 		}
-	}
+		defer db.Close()
+
+		// Connection pool limits. Defaults match database/sql: unlimited open
+		// connections, 2 idle, no lifetime cap.
+		db.SetMaxOpenConns(envIntOrDefault("DATABASE_MAX_OPEN_CONNS", 0))
+		db.SetMaxIdleConns(envIntOrDefault("DATABASE_MAX_IDLE_CONNS", 2))
+		db.SetConnMaxLifetime(envDurationOrDefault("DATABASE_CONN_MAX_LIFETIME", 0))
+		err = telemetry.RegisterDBStats(db, serviceName, nil, meter)
+		if err != nil {
+			slog.Warn("failed to register db pool metrics", "service", serviceName, "err", err)
+		}
 
-	db, err := sql.Open("chai", databaseFile)
-	if err != nil {
-		slog.Error("failed to open db", "service", serviceName, "err", err)
+		err = ensureSchema(db)
+		if err != nil {
+			slog.Error("failed to ensure schema", "service", serviceName, "err", err)
+			os.Exit(1)
+		}
+
+		store := newChaiStore(db)
+		events, notes, audit, keys = store, store, store, store
+	case storageDriverMemory:
+		store := newMemoryStore()
+		events, notes, audit, keys = store, store, store, store
+		slog.Warn("using in-memory storage; data is lost on restart and subscriptions, retention and summaries are disabled", "service", serviceName)
+	default:
+		slog.Error("invalid storage driver", "service", serviceName, "err", unknownStorageDriver(storageDriver))
 		os.Exit(1)
 	}
-	defer db.Close()
 
-	err = ensureSchema(db)
-	if err != nil {
-		slog.Error("failed to ensure schema", "service", serviceName, "err", err)
-		os.Exit(1)
+	// Webhook delivery client – otelhttp transport injects traceparent so each
+	// delivery shows up as a child span of the request that triggered it.
+	webhookTransport := http.DefaultTransport
+	if telemetry.Enabled() {
+		webhookTransport = otelhttp.NewTransport(http.DefaultTransport)
+	}
+	var webhooks *webhookDispatcher
+	if db != nil {
+		webhooks = newWebhookDispatcher(db,
+			&http.Client{Timeout: envDurationOrDefault("WEBHOOK_TIMEOUT", 5*time.Second), Transport: webhookTransport},
+			webhookConfig{
+				Workers:        envIntOrDefault("WEBHOOK_WORKERS", 4),
+				QueueSize:      envIntOrDefault("WEBHOOK_QUEUE_SIZE", 256),
+				MaxAttempts:    envIntOrDefault("WEBHOOK_MAX_ATTEMPTS", 5),
+				InitialBackoff: envDurationOrDefault("WEBHOOK_INITIAL_BACKOFF", 500*time.Millisecond),
+				MaxBackoff:     envDurationOrDefault("WEBHOOK_MAX_BACKOFF", 30*time.Second),
+			},
+			meter,
+		)
+		webhooks.start()
 	}
 
-	application := &app{
-		db:            db,
-		serviceName:   serviceName,
-		eventsCreated: eventsCounter,
-		notesCreated:  notesCounter,
+	// Retention – keeps the events table bounded. The job only runs when a
+	// max age or max row count is configured.
+	retentionSettings := retentionConfig{
+		MaxAge:    envDurationOrDefault("EVENTS_RETENTION_MAX_AGE", 0),
+		MaxRows:   envIntOrDefault("EVENTS_RETENTION_MAX_ROWS", 0),
+		Interval:  envDurationOrDefault("EVENTS_RETENTION_INTERVAL", 5*time.Minute),
+		BatchSize: envIntOrDefault("EVENTS_RETENTION_BATCH_SIZE", 500),
+		Summarize: envOrDefault("EVENTS_RETENTION_SUMMARIZE", "false") == "true",
 	}
+	if db == nil && retentionSettings.enabled() {
+		slog.Warn("event retention needs DATABASE_DRIVER=chai; not starting it", "service", serviceName)
+		retentionSettings = retentionConfig{}
+	}
+	retention := newEventRetention(db, serviceName, retentionSettings, meter)
+	retention.start()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", application.handleHealth)
-	mux.HandleFunc("/events", application.handleEvents)
-	mux.HandleFunc("/events/", application.handleEventByID)
-	mux.HandleFunc("/notes/export.md", application.exportNotesMarkdown)
-	mux.HandleFunc("/notes", application.handleNotes)
-	mux.HandleFunc("/notes/", application.handleNoteByID)
+	application := &app{
+		db:              db,
+		events:          events,
+		notes:           notes,
+		audit:           audit,
+		serviceName:     serviceName,
+		eventsCreated:   eventsCounter,
+		notesCreated:    notesCounter,
+		invalidRequests: invalidCounter,
+		bodyLimits: bodyLimits{
+			Events: int64(envIntOrDefault("EVENTS_MAX_BODY_BYTES", 16<<10)),
+			Notes:  int64(envIntOrDefault("NOTES_MAX_BODY_BYTES", 1<<20)),
+		},
+		webhooks:    webhooks,
+		tenants:     tenant.NewLabeler(tenant.DefaultLabelLimit),
+		idempotency: newIdempotencyKeys(keys, envDurationOrDefault("IDEMPOTENCY_KEY_TTL", 24*time.Hour)),
+		renderer:    newNoteRenderer(otel.Tracer(serviceName), envIntOrDefault("NOTES_RENDER_CACHE_SIZE", 256), renderCacheCounter),
+		bulkEvents: bulkEventsConfig{
+			BatchSize: envIntOrDefault("EVENTS_BULK_BATCH_SIZE", 500),
+			MaxBytes:  int64(envIntOrDefault("EVENTS_BULK_MAX_BYTES", 10<<20)),
+		},
+	}
+
+	mux := application.routes()
 
 	// /metrics — Prometheus text-format endpoint, scraped by the downstream
 	// ServiceMonitor (monitoring.rhobs/v1) in the user's namespace.
@@ -142,8 +276,30 @@ func main() {
 	// add an otelhttp.WithFilter option to skip the /metrics path.
 	mux.Handle("/metrics", telemetry.MetricsHandler())
 
+	// /admin/faults and /admin/scenarios configure the faults the chaos
+	// middleware injects.
+	faults := chaos.NewInjector(faultsCounter)
+	scenarios := chaos.NewScenarios(faults, chaos.Presets("database"))
+	_ = scenarios.RegisterGauge(meter, "database.scenarios.active")
+	mux.Handle(chaos.AdminPath, faults)
+	mux.Handle(chaos.AdminPath+"/", faults)
+	mux.Handle(chaos.ScenariosPath, scenarios)
+	mux.Handle(chaos.ScenariosPath+"/", scenarios)
+
+	// Rate limiting – a token bucket per client and route, configured by
+	// RATE_LIMIT_*. An invalid RATE_LIMIT_ROUTES keeps the default limit.
+	rateLimits, err := ratelimit.ConfigFromEnv()
+	if err != nil {
+		slog.Error("reading rate limits", "err", err)
+	}
+	limiter := ratelimit.New(rateLimits, rateLimitCounter)
+
 	// otelhttp outermost so the span-enriched context flows into AccessLog.
-	var handler http.Handler = telemetry.AccessLog(serviceName, mux)
+	// tenant.Middleware scopes every request to the caller's tenant, taken
+	// from X-Forwarded-User or tenant.id baggage. Refused requests and
+	// injected faults sit inside AccessLog so their latency and status codes
+	// are logged; refused requests never reach a fault.
+	var handler http.Handler = tenant.Middleware(telemetry.AccessLog(serviceName, limiter.Middleware(faults.Middleware(mux))))
 	if telemetry.Enabled() {
 		handler = otelhttp.NewHandler(handler, serviceName,
 			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
@@ -159,7 +315,7 @@ func main() {
 	}
 
 	go func() {
-		slog.Info("starting", "service", serviceName, "addr", addr, "database_file", databaseFile)
+		slog.Info("starting", "service", serviceName, "addr", addr, "database_driver", storageDriver, "database_file", databaseFile)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			slog.Error("listen failed", "service", serviceName, "err", err)
 			os.Exit(1)
@@ -177,6 +333,14 @@ func main() {
 	if err != nil {
 		slog.Error("shutdown failed", "service", serviceName, "err", err)
 	}
+	err = retention.shutdown(shutdownContext)
+	if err != nil {
+		slog.Error("event retention shutdown failed", "service", serviceName, "err", err)
+	}
+	err = webhooks.shutdown(shutdownContext)
+	if err != nil {
+		slog.Error("webhook dispatcher shutdown failed", "service", serviceName, "err", err)
+	}
 	slog.Info("shutdown complete", "service", serviceName)
 }
 
@@ -198,12 +362,105 @@ func ensureSchema(db *sql.DB) error {
 			created_at TEXT NOT NULL,
 			updated_at TEXT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			id INTEGER PRIMARY KEY,
+			url TEXT NOT NULL,
+			event_types TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id INTEGER PRIMARY KEY,
+			subscription_id INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS event_hourly_summaries (
+			hour_unix BIGINT NOT NULL,
+			source TEXT NOT NULL,
+			route TEXT NOT NULL,
+			count BIGINT NOT NULL,
+			errors BIGINT NOT NULL,
+			PRIMARY KEY (hour_unix, source, route)
+		);
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			tenant TEXT NOT NULL,
+			route TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			content_type TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_unix BIGINT NOT NULL,
+			PRIMARY KEY (tenant, route, idempotency_key)
+		);
+		CREATE INDEX IF NOT EXISTS idempotency_keys_created_unix_idx ON idempotency_keys (created_unix);
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY,
+			note_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			before_hash TEXT NOT NULL,
+			after_hash TEXT NOT NULL,
+			trace_id TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			created_unix BIGINT NOT NULL,
+			tenant TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON audit_log (tenant);
+		CREATE INDEX IF NOT EXISTS audit_log_note_id_idx ON audit_log (note_id);
+		CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER PRIMARY KEY,
+			destination TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			trace_id TEXT NOT NULL,
+			span_id TEXT NOT NULL,
+			tenant TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+	return migrateSchema(db)
+}
+
+// requireSQLStorage writes 501 and returns false when the app runs without
+// the chai database.
+func (application *app) requireSQLStorage(response http.ResponseWriter, request *http.Request) bool {
+	if application.db == nil {
+		problem.Write(response, request, http.StatusNotImplemented, "not available with DATABASE_DRIVER="+storageDriverMemory)
+		return false
+	}
+	return true
+}
+
+// routes returns a mux serving the database API.
+func (application *app) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", application.handleHealth)
+	mux.HandleFunc("/events", application.handleEvents)
+	mux.HandleFunc("/events/stats", application.handleEventStats)
+	mux.HandleFunc("/events/bulk", application.handleEventsBulk)
+	mux.HandleFunc("/events/summaries", application.handleEventSummaries)
+	mux.HandleFunc("/events/", application.handleEventByID)
+	mux.HandleFunc("/notes/export.md", application.exportNotesMarkdown)
+	mux.HandleFunc("/notes", application.handleNotes)
+	mux.HandleFunc("/notes/", application.handleNoteByID)
+	mux.HandleFunc("/audit", application.handleAudit)
+	mux.HandleFunc("/subscriptions", application.handleSubscriptions)
+	mux.HandleFunc("/subscriptions/", application.handleSubscriptionByID)
+	mux.HandleFunc("/outbox", application.handleOutbox)
+	mux.HandleFunc("/outbox/", application.handleOutboxByID)
+	mux.HandleFunc(internalOutboxPath, application.handleInternalOutbox)
+	return mux
 }
 
 func (application *app) handleHealth(response http.ResponseWriter, _ *http.Request) {
-	writeJSON(response, http.StatusOK, map[string]string{
+	problem.WriteJSON(response, http.StatusOK, map[string]string{
 		"status":  "ok",
 		"service": application.serviceName,
 	})
@@ -214,26 +471,26 @@ func (application *app) handleEvents(response http.ResponseWriter, request *http
 	case http.MethodGet:
 		application.listEvents(response, request)
 	case http.MethodPost:
-		application.createEvent(response, request)
+		application.withIdempotency(response, request, "/events", application.bodyLimits.Events, application.createEvent)
 	default:
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
 func (application *app) handleEventByID(response http.ResponseWriter, request *http.Request) {
 	id, err := parseIDFromPath(request.URL.Path, "/events/")
 	if err != nil {
-		writeError(response, http.StatusBadRequest, "invalid event id")
+		problem.Write(response, request, http.StatusBadRequest, "invalid event id")
 		return
 	}
 
 	switch request.Method {
 	case http.MethodGet:
-		application.getEvent(response, id)
+		application.getEvent(response, request, id)
 	case http.MethodDelete:
-		application.deleteEvent(response, id)
+		application.deleteEvent(response, request, id)
 	default:
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
@@ -243,128 +500,85 @@ func (application *app) listEvents(response http.ResponseWriter, request *http.R
 	if queryLimit != "" {
 		parsedLimit, err := strconv.Atoi(queryLimit)
 		if err != nil || parsedLimit <= 0 || parsedLimit > 500 {
-			writeError(response, http.StatusBadRequest, "limit must be between 1 and 500")
+			problem.Write(response, request, http.StatusBadRequest, "limit must be between 1 and 500")
 			return
 		}
 		limit = parsedLimit
 	}
 
-	rows, err := application.db.Query(
-		"SELECT id, source, method, route, status, message, created_at FROM events ORDER BY id DESC LIMIT $1",
-		limit,
-	)
-	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to query events")
-		return
-	}
-	defer rows.Close()
-
-	var events []event
-	for rows.Next() {
-		var row event
-		err = rows.Scan(&row.ID, &row.Source, &row.Method, &row.Route, &row.Status, &row.Message, &row.CreatedAt)
-		if err != nil {
-			writeError(response, http.StatusInternalServerError, "failed to scan event")
+	filter := eventFilter{Tenant: tenant.FromContext(request.Context()), Limit: limit}
+	if traceID := request.URL.Query().Get("trace_id"); traceID != "" {
+		if !isTraceID(traceID) {
+			problem.Write(response, request, http.StatusBadRequest, "trace_id must be 32 lowercase hex characters")
 			return
 		}
-		events = append(events, row)
+		filter.TraceID = traceID
 	}
 
-	err = rows.Err()
+	events, err := application.events.ListEvents(request.Context(), filter)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to read rows")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query events")
 		return
 	}
 
-	writeJSON(response, http.StatusOK, map[string]any{
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
 		"count":  len(events),
 		"events": events,
 	})
 }
 
-func (application *app) getEvent(response http.ResponseWriter, id int) {
-	var stored event
-	err := application.db.QueryRow(
-		"SELECT id, source, method, route, status, message, created_at FROM events WHERE id = $1",
-		id,
-	).Scan(&stored.ID, &stored.Source, &stored.Method, &stored.Route, &stored.Status, &stored.Message, &stored.CreatedAt)
-	if err == sql.ErrNoRows {
-		writeError(response, http.StatusNotFound, "event not found")
+func (application *app) getEvent(response http.ResponseWriter, request *http.Request, id int) {
+	stored, err := application.events.GetEvent(request.Context(), tenant.FromContext(request.Context()), id)
+	if errors.Is(err, errNotFound) {
+		problem.Write(response, request, http.StatusNotFound, "event not found")
 		return
 	}
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to load event")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to load event")
 		return
 	}
 
-	writeJSON(response, http.StatusOK, stored)
+	problem.WriteJSON(response, http.StatusOK, stored)
 }
 
 func (application *app) createEvent(response http.ResponseWriter, request *http.Request) {
-	// Simulate variable database write latency (0–60 ms).
-	time.Sleep(time.Duration(rand.Intn(61)) * time.Millisecond)
-
-	// Set production-grade span attributes.
+	// Copy baggage onto the server span. The SQL statements themselves get
+	// their own client spans from the instrumented driver.
 	if telemetry.Enabled() {
 		span := trace.SpanFromContext(request.Context())
 		bg := baggage.FromContext(request.Context())
 		for _, m := range bg.Members() {
 			span.SetAttributes(attribute.String("baggage."+m.Key(), m.Value()))
 		}
-		span.SetAttributes(
-			attribute.String("db.system", "chainsql"),
-			attribute.String("db.operation", "INSERT"),
-			attribute.String("db.sql.table", "events"),
-		)
 	}
 
 	var input createEventRequest
-	err := json.NewDecoder(request.Body).Decode(&input)
-	if err != nil {
-		writeError(response, http.StatusBadRequest, "invalid JSON payload")
+	if !application.decodeBody(response, request, "/events", application.bodyLimits.Events, &input) {
 		return
 	}
 
-	if input.Source == "" {
-		input.Source = "unknown"
-	}
-	if input.Method == "" {
-		input.Method = "GET"
-	}
-	if input.Route == "" {
-		input.Route = "/"
-	}
-	if input.Status == 0 {
-		input.Status = http.StatusOK
-	}
-	if input.Message == "" {
-		input.Message = "request completed"
-	}
-
-	nextID, err := application.nextEventID()
-	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to allocate event id")
+	input.applyDefaults()
+	if violations := input.validate(); len(violations) > 0 {
+		application.rejectRequest(response, request, "/events", http.StatusBadRequest, violations)
 		return
 	}
 
-	createdAt := time.Now().UTC().Format(time.RFC3339)
-	_, err = application.db.Exec(
-		"INSERT INTO events (id, source, method, route, status, message, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		nextID,
-		input.Source,
-		input.Method,
-		input.Route,
-		input.Status,
-		input.Message,
-		createdAt,
-	)
+	// Remember which trace produced the event so the UI can link a row
+	// straight to Tempo. Empty when the request carried no trace context.
+	traceID, spanID := traceIDsFromContext(request.Context())
+
+	rows, err := application.events.CreateEvents(request.Context(), []event{
+		input.toEvent(tenant.FromContext(request.Context()), time.Now().UTC().Format(time.RFC3339), traceID, spanID),
+	})
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to create event")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to create event")
 		return
 	}
+	created := rows[0]
 
 	// Increment the OTEL counter (no-op when telemetry is disabled).
-	application.eventsCreated.Add(request.Context(), 1)
+	application.eventsCreated.Add(request.Context(), 1,
+		metric.WithAttributes(application.tenants.Attribute(request.Context())))
 
 	// Business-level attributes: event origin and HTTP status stored.
 	if telemetry.Enabled() {
@@ -372,149 +586,145 @@ func (application *app) createEvent(response http.ResponseWriter, request *http.
 			attribute.String("event.source", input.Source),
 			attribute.String("event.route", input.Route),
 			attribute.Int("event.http_status", input.Status),
-			attribute.Int("event.id", nextID),
+			attribute.Int("event.id", created.ID),
 		)
 	}
 
 	// OTel application log: record each event write, correlated with the
 	// trace so it appears alongside the span in Loki.
 	slog.InfoContext(request.Context(), "event created",
-		"event.id", nextID,
+		"event.id", created.ID,
+		"tenant.id", created.Tenant,
 		"event.source", input.Source,
 		"event.route", input.Route,
 		"event.http_status", input.Status,
 	)
 
-	writeJSON(response, http.StatusCreated, event{
-		ID:        nextID,
-		Source:    input.Source,
-		Method:    input.Method,
-		Route:     input.Route,
-		Status:    input.Status,
-		Message:   input.Message,
-		CreatedAt: createdAt,
-	})
+	application.webhooks.publish(request.Context(), webhookEventCreated, created)
+
+	problem.WriteJSON(response, http.StatusCreated, created)
 }
 
-func (application *app) deleteEvent(response http.ResponseWriter, id int) {
-	_, err := application.db.Exec("DELETE FROM events WHERE id = $1", id)
+func (application *app) deleteEvent(response http.ResponseWriter, request *http.Request, id int) {
+	tenantID := tenant.FromContext(request.Context())
+	deleted, err := application.events.DeleteEvent(request.Context(), tenantID, id)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to delete event")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to delete event")
 		return
 	}
 
-	response.WriteHeader(http.StatusNoContent)
-}
+	if deleted {
+		application.webhooks.publish(request.Context(), webhookEventDeleted, map[string]any{"id": id, "tenant": tenantID})
+	}
 
-func (application *app) nextEventID() (int, error) {
-	var nextID int
-	err := application.db.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM events").Scan(&nextID)
-	return nextID, err
+	response.WriteHeader(http.StatusNoContent)
 }
 
 func (application *app) handleNotes(response http.ResponseWriter, request *http.Request) {
 	switch request.Method {
 	case http.MethodGet:
-		application.listNotes(response)
+		application.listNotes(response, request)
 	case http.MethodPost:
-		application.createNote(response, request)
+		application.withIdempotency(response, request, "/notes", application.bodyLimits.Notes, application.createNote)
 	default:
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
 func (application *app) handleNoteByID(response http.ResponseWriter, request *http.Request) {
-	id, err := parseIDFromPath(request.URL.Path, "/notes/")
-	if err != nil {
-		writeError(response, http.StatusBadRequest, "invalid note id")
+	path, isAudit := strings.CutSuffix(request.URL.Path, "/audit")
+	path, isHTML := strings.CutSuffix(path, ".html")
+	id, err := parseIDFromPath(path, "/notes/")
+	if err != nil || (isAudit && isHTML) {
+		problem.Write(response, request, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if isAudit {
+		application.listNoteAudit(response, request, id)
+		return
+	}
+	if isHTML {
+		application.getNoteHTML(response, request, id)
 		return
 	}
 
 	switch request.Method {
 	case http.MethodGet:
-		application.getNote(response, id)
+		application.getNote(response, request, id)
 	case http.MethodPut:
 		application.updateNote(response, request, id)
 	case http.MethodDelete:
-		application.deleteNote(response, id)
+		application.deleteNote(response, request, id)
 	default:
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
-func (application *app) listNotes(response http.ResponseWriter) {
-	rows, err := application.db.Query(
-		"SELECT id, title, content, created_at, updated_at FROM notes ORDER BY id DESC",
-	)
+// listNotes serves GET /notes. With ?render=html each note also carries its
+// content rendered to HTML.
+func (application *app) listNotes(response http.ResponseWriter, request *http.Request) {
+	render := request.URL.Query().Get("render")
+	if render != "" && render != "html" {
+		problem.Write(response, request, http.StatusBadRequest, "render must be html")
+		return
+	}
+
+	notes, err := application.notes.ListNotes(request.Context(), tenant.FromContext(request.Context()))
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to query notes")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query notes")
 		return
 	}
-	defer rows.Close()
 
-	var notes []note
-	for rows.Next() {
-		var row note
-		err = rows.Scan(&row.ID, &row.Title, &row.Content, &row.CreatedAt, &row.UpdatedAt)
+	if render == "html" {
+		rendered, err := application.renderer.renderNotes(request.Context(), notes)
 		if err != nil {
-			writeError(response, http.StatusInternalServerError, "failed to scan note")
+			problem.Write(response, request, http.StatusInternalServerError, "failed to render notes")
 			return
 		}
-		notes = append(notes, row)
-	}
-
-	err = rows.Err()
-	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to read note rows")
+		problem.WriteJSON(response, http.StatusOK, map[string]any{
+			"count": len(rendered),
+			"notes": rendered,
+		})
 		return
 	}
 
-	writeJSON(response, http.StatusOK, map[string]any{
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
 		"count": len(notes),
 		"notes": notes,
 	})
 }
 
-func (application *app) getNote(response http.ResponseWriter, id int) {
-	var stored note
-	err := application.db.QueryRow(
-		"SELECT id, title, content, created_at, updated_at FROM notes WHERE id = $1",
-		id,
-	).Scan(&stored.ID, &stored.Title, &stored.Content, &stored.CreatedAt, &stored.UpdatedAt)
-	if err == sql.ErrNoRows {
-		writeError(response, http.StatusNotFound, "note not found")
+func (application *app) getNote(response http.ResponseWriter, request *http.Request, id int) {
+	stored, err := application.notes.GetNote(request.Context(), tenant.FromContext(request.Context()), id)
+	if errors.Is(err, errNotFound) {
+		problem.Write(response, request, http.StatusNotFound, "note not found")
 		return
 	}
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to load note")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to load note")
 		return
 	}
 
-	writeJSON(response, http.StatusOK, stored)
+	problem.WriteJSON(response, http.StatusOK, stored)
 }
 
 func (application *app) createNote(response http.ResponseWriter, request *http.Request) {
-	// Simulate variable database write latency (0–60 ms).
-	time.Sleep(time.Duration(rand.Intn(61)) * time.Millisecond)
-
-	// Set production-grade span attributes.
+	// Copy baggage onto the server span. The SQL statements themselves get
+	// their own client spans from the instrumented driver.
 	if telemetry.Enabled() {
 		span := trace.SpanFromContext(request.Context())
 		bg := baggage.FromContext(request.Context())
 		for _, m := range bg.Members() {
 			span.SetAttributes(attribute.String("baggage."+m.Key(), m.Value()))
 		}
-		span.SetAttributes(
-			attribute.String("db.system", "chainsql"),
-			attribute.String("db.operation", "INSERT"),
-			attribute.String("db.sql.table", "notes"),
-		)
 	}
 
 	var input createNoteRequest
-	err := json.NewDecoder(request.Body).Decode(&input)
-	if err != nil {
-		writeError(response, http.StatusBadRequest, "invalid JSON payload")
+	if !application.decodeBody(response, request, "/notes", application.bodyLimits.Notes, &input) {
+		return
+	}
+	if violations := input.validate(); len(violations) > 0 {
+		application.rejectRequest(response, request, "/notes", http.StatusBadRequest, violations)
 		return
 	}
 
@@ -522,34 +732,33 @@ func (application *app) createNote(response http.ResponseWriter, request *http.R
 	if title == "" {
 		title = "Untitled Note"
 	}
-
-	nextID, err := application.nextNoteID()
+	audit, err := newAuditEntry(request)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to allocate note id")
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	now := time.Now().UTC().Format(time.RFC3339)
-	_, err = application.db.Exec(
-		"INSERT INTO notes (id, title, content, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)",
-		nextID,
-		title,
-		input.Content,
-		now,
-		now,
-	)
+	created, err := application.notes.CreateNote(request.Context(), note{
+		Title:     title,
+		Content:   input.Content,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Tenant:    tenant.FromContext(request.Context()),
+	}, audit)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to create note")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to create note")
 		return
 	}
 
 	// Increment the OTEL counter (no-op when telemetry is disabled).
-	application.notesCreated.Add(request.Context(), 1)
+	application.notesCreated.Add(request.Context(), 1,
+		metric.WithAttributes(application.tenants.Attribute(request.Context())))
 
 	// Business-level attributes: note identity recorded on the span.
 	if telemetry.Enabled() {
 		trace.SpanFromContext(request.Context()).SetAttributes(
-			attribute.Int("note.id", nextID),
+			attribute.Int("note.id", created.ID),
 			attribute.String("note.title", title),
 			attribute.Int("note.content.length", len(input.Content)),
 		)
@@ -558,25 +767,24 @@ func (application *app) createNote(response http.ResponseWriter, request *http.R
 	// OTel application log: record each note create, correlated with its
 	// trace for cross-signal search in the observability backends.
 	slog.InfoContext(request.Context(), "note created",
-		"note.id", nextID,
+		"note.id", created.ID,
+		"tenant.id", created.Tenant,
 		"note.title", title,
 		"note.content_length", len(input.Content),
 	)
 
-	writeJSON(response, http.StatusCreated, note{
-		ID:        nextID,
-		Title:     title,
-		Content:   input.Content,
-		CreatedAt: now,
-		UpdatedAt: now,
-	})
+	application.webhooks.publish(request.Context(), webhookNoteCreated, created)
+
+	problem.WriteJSON(response, http.StatusCreated, created)
 }
 
 func (application *app) updateNote(response http.ResponseWriter, request *http.Request, id int) {
 	var input createNoteRequest
-	err := json.NewDecoder(request.Body).Decode(&input)
-	if err != nil {
-		writeError(response, http.StatusBadRequest, "invalid JSON payload")
+	if !application.decodeBody(response, request, "/notes/{id}", application.bodyLimits.Notes, &input) {
+		return
+	}
+	if violations := input.validate(); len(violations) > 0 {
+		application.rejectRequest(response, request, "/notes/{id}", http.StatusBadRequest, violations)
 		return
 	}
 
@@ -584,70 +792,66 @@ func (application *app) updateNote(response http.ResponseWriter, request *http.R
 	if title == "" {
 		title = "Untitled Note"
 	}
-
-	now := time.Now().UTC().Format(time.RFC3339)
-	_, err = application.db.Exec(
-		"UPDATE notes SET title = $1, content = $2, updated_at = $3 WHERE id = $4",
-		title,
-		input.Content,
-		now,
-		id,
-	)
+	audit, err := newAuditEntry(request)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to update note")
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	application.getNote(response, id)
-}
-
-func (application *app) deleteNote(response http.ResponseWriter, id int) {
-	_, err := application.db.Exec("DELETE FROM notes WHERE id = $1", id)
+	updated, err := application.notes.UpdateNote(request.Context(), note{
+		ID:        id,
+		Title:     title,
+		Content:   input.Content,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+		Tenant:    tenant.FromContext(request.Context()),
+	}, audit)
+	if errors.Is(err, errNotFound) {
+		problem.Write(response, request, http.StatusNotFound, "note not found")
+		return
+	}
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to delete note")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to update note")
 		return
 	}
 
-	response.WriteHeader(http.StatusNoContent)
-}
+	application.webhooks.publish(request.Context(), webhookNoteUpdated, updated)
 
-func (application *app) nextNoteID() (int, error) {
-	var nextID int
-	err := application.db.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM notes").Scan(&nextID)
-	return nextID, err
+	problem.WriteJSON(response, http.StatusOK, updated)
 }
 
-func (application *app) exportNotesMarkdown(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+func (application *app) deleteNote(response http.ResponseWriter, request *http.Request, id int) {
+	audit, err := newAuditEntry(request)
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	rows, err := application.db.Query(
-		"SELECT id, title, content, created_at, updated_at FROM notes ORDER BY id ASC",
-	)
+	tenantID := tenant.FromContext(request.Context())
+	deleted, err := application.notes.DeleteNote(request.Context(), tenantID, id, audit)
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to query notes for export")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to delete note")
 		return
 	}
-	defer rows.Close()
 
-	var notes []note
-	for rows.Next() {
-		var row note
-		err = rows.Scan(&row.ID, &row.Title, &row.Content, &row.CreatedAt, &row.UpdatedAt)
-		if err != nil {
-			writeError(response, http.StatusInternalServerError, "failed to scan note for export")
-			return
-		}
-		notes = append(notes, row)
+	if deleted {
+		application.webhooks.publish(request.Context(), webhookNoteDeleted, map[string]any{"id": id, "tenant": tenantID})
 	}
 
-	err = rows.Err()
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (application *app) exportNotesMarkdown(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	notes, err := application.notes.ListNotes(request.Context(), tenant.FromContext(request.Context()))
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to read exported note rows")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query notes for export")
 		return
 	}
+	// Export oldest first.
+	slices.Reverse(notes)
 
 	var builder strings.Builder
 	builder.WriteString("# Workshop Notes\n\n")
@@ -676,6 +880,66 @@ func (application *app) exportNotesMarkdown(response http.ResponseWriter, reques
 	_, _ = response.Write([]byte(builder.String()))
 }
 
+// applyDefaults fills the fields callers may omit when recording an event.
+func (input *createEventRequest) applyDefaults() {
+	if input.Source == "" {
+		input.Source = "unknown"
+	}
+	if input.Method == "" {
+		input.Method = "GET"
+	}
+	if input.Route == "" {
+		input.Route = "/"
+	}
+	if input.Status == 0 {
+		input.Status = http.StatusOK
+	}
+	if input.Message == "" {
+		input.Message = "request completed"
+	}
+}
+
+// toEvent builds the row to store for input, owned by tenantID and stamped
+// with createdAt and the ids of the trace that recorded it. The store assigns
+// the id.
+func (input createEventRequest) toEvent(tenantID string, createdAt string, traceID string, spanID string) event {
+	return event{
+		Tenant:    tenantID,
+		Source:    input.Source,
+		Method:    input.Method,
+		Route:     input.Route,
+		Status:    input.Status,
+		Message:   input.Message,
+		CreatedAt: createdAt,
+		TraceID:   traceID,
+		SpanID:    spanID,
+	}
+}
+
+// traceIDsFromContext returns the hex trace and span ids of the active span,
+// or empty strings when ctx carries no valid span context.
+func traceIDsFromContext(ctx context.Context) (string, string) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return "", ""
+	}
+	return spanContext.TraceID().String(), spanContext.SpanID().String()
+}
+
+// isTraceID reports whether value is a W3C trace id as rendered by
+// trace.TraceID.String: 32 lowercase hex characters.
+func isTraceID(value string) bool {
+	if len(value) != 32 {
+		return false
+	}
+	for _, character := range value {
+		if (character < '0' || character > '9') && (character < 'a' || character > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func parseIDFromPath(path string, prefix string) (int, error) {
 	rawID := strings.TrimPrefix(path, prefix)
 	if rawID == "" || strings.Contains(rawID, "/") {
@@ -698,12 +962,18 @@ func envOrDefault(key string, fallback string) string {
 	return value
 }
 
-func writeError(response http.ResponseWriter, statusCode int, message string) {
-	writeJSON(response, statusCode, map[string]string{"error": message})
+func envIntOrDefault(key string, fallback int) int {
+	value, err := strconv.Atoi(envOrDefault(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
 }
 
-func writeJSON(response http.ResponseWriter, statusCode int, payload any) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(statusCode)
-	_ = json.NewEncoder(response).Encode(payload)
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(envOrDefault(key, fallback.String()))
+	if err != nil {
+		return fallback
+	}
+	return value
 }
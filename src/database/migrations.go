@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// schemaMigration is a forward-only change applied to databases created by an
+// earlier release. ensureSchema only creates tables that are missing, so any
+// column or index added to an existing table must be expressed here.
+type schemaMigration struct {
+	version     int
+	description string
+	statements  []string
+	// backfill optionally rewrites existing rows after the statements ran.
+	backfill func(tx *sql.Tx) error
+}
+
+// schemaMigrations must be append-only: released versions are recorded in
+// schema_migrations and never re-run.
+var schemaMigrations = []schemaMigration{
+	{
+		version:     1,
+		description: "store trace and span ids on events",
+		statements: []string{
+			"ALTER TABLE events ADD COLUMN trace_id TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE events ADD COLUMN span_id TEXT NOT NULL DEFAULT ''",
+			"CREATE INDEX IF NOT EXISTS events_trace_id_idx ON events (trace_id)",
+		},
+	},
+	{
+		version:     2,
+		description: "store event creation time as unix seconds for time-bucketed stats",
+		statements: []string{
+			"ALTER TABLE events ADD COLUMN created_unix BIGINT NOT NULL DEFAULT 0",
+			"CREATE INDEX IF NOT EXISTS events_created_unix_idx ON events (created_unix)",
+		},
+		backfill: backfillEventCreatedUnix,
+	},
+	{
+		version:     3,
+		description: "scope events and notes to a tenant",
+		statements: []string{
+			"ALTER TABLE events ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'",
+			"ALTER TABLE notes ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'",
+			"CREATE INDEX IF NOT EXISTS events_tenant_idx ON events (tenant)",
+			"CREATE INDEX IF NOT EXISTS notes_tenant_idx ON notes (tenant)",
+		},
+	},
+	{
+		version:     4,
+		description: "scope webhook subscriptions, dead letters and event summaries to a tenant",
+		statements: []string{
+			"ALTER TABLE subscriptions ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'",
+			"ALTER TABLE webhook_dead_letters ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'",
+			"CREATE INDEX IF NOT EXISTS subscriptions_tenant_idx ON subscriptions (tenant)",
+			// chai cannot change a primary key, so the summaries are copied
+			// into a table keyed by tenant as well.
+			"ALTER TABLE event_hourly_summaries RENAME TO event_hourly_summaries_untenanted",
+			`CREATE TABLE event_hourly_summaries (
+				tenant TEXT NOT NULL,
+				hour_unix BIGINT NOT NULL,
+				source TEXT NOT NULL,
+				route TEXT NOT NULL,
+				count BIGINT NOT NULL,
+				errors BIGINT NOT NULL,
+				PRIMARY KEY (tenant, hour_unix, source, route)
+			)`,
+			"INSERT INTO event_hourly_summaries (tenant, hour_unix, source, route, count, errors) SELECT 'default', hour_unix, source, route, count, errors FROM event_hourly_summaries_untenanted",
+			"DROP TABLE event_hourly_summaries_untenanted",
+		},
+	},
+}
+
+// migrateSchema applies every migration newer than the recorded schema
+// version, each inside its own transaction.
+func migrateSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for _, migration := range schemaMigrations {
+		if migration.version <= current {
+			continue
+		}
+
+		err = applyMigration(db, migration)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.version, migration.description, err)
+		}
+		slog.Info("applied schema migration", "version", migration.version, "description", migration.description)
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, migration schemaMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, statement := range migration.statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	if migration.backfill != nil {
+		err = migration.backfill(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)",
+		migration.version,
+		migration.description,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillEventCreatedUnix derives created_unix from the RFC 3339 created_at
+// text of rows written before the column existed.
+func backfillEventCreatedUnix(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, created_at FROM events WHERE created_unix = 0")
+	if err != nil {
+		return err
+	}
+
+	createdAt := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var raw string
+		err = rows.Scan(&id, &raw)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		parsed, parseErr := time.Parse(time.RFC3339, raw)
+		if parseErr != nil {
+			continue
+		}
+		createdAt[id] = parsed.Unix()
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, unix := range createdAt {
+		_, err = tx.Exec("UPDATE events SET created_unix = $1 WHERE id = $2", unix, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
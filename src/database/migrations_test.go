@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+func TestMigrateSchemaUpgradesExistingEventsTable(t *testing.T) {
+	db, err := sql.Open("chai", ":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	// Layout written by releases before trace ids were stored.
+	_, err = db.Exec(`
+		CREATE TABLE events (
+			id INTEGER PRIMARY KEY,
+			source TEXT NOT NULL,
+			method TEXT NOT NULL,
+			route TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			message TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+		INSERT INTO events (id, source, method, route, status, message, created_at)
+		VALUES (1, 'backend', 'GET', '/api/ok', 200, 'legacy', '2026-01-01T00:00:00Z');
+		CREATE TABLE event_hourly_summaries (
+			hour_unix BIGINT NOT NULL,
+			source TEXT NOT NULL,
+			route TEXT NOT NULL,
+			count BIGINT NOT NULL,
+			errors BIGINT NOT NULL,
+			PRIMARY KEY (hour_unix, source, route)
+		);
+		INSERT INTO event_hourly_summaries (hour_unix, source, route, count, errors)
+		VALUES (1767225600, 'backend', '/api/ok', 3, 1);
+	`)
+	if err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+
+	for range 2 {
+		if err := ensureSchema(db); err != nil {
+			t.Fatalf("ensure schema: %v", err)
+		}
+	}
+
+	var traceID, spanID string
+	err = db.QueryRow("SELECT trace_id, span_id FROM events WHERE id = 1").Scan(&traceID, &spanID)
+	if err != nil {
+		t.Fatalf("select migrated columns: %v", err)
+	}
+	if traceID != "" || spanID != "" {
+		t.Fatalf("expected empty ids on legacy row, got %q/%q", traceID, spanID)
+	}
+
+	var createdUnix int64
+	err = db.QueryRow("SELECT created_unix FROM events WHERE id = 1").Scan(&createdUnix)
+	if err != nil {
+		t.Fatalf("select backfilled created_unix: %v", err)
+	}
+	if createdUnix != 1767225600 {
+		t.Fatalf("expected created_unix backfilled from created_at, got %d", createdUnix)
+	}
+
+	var tenantID string
+	err = db.QueryRow("SELECT tenant FROM events WHERE id = 1").Scan(&tenantID)
+	if err != nil {
+		t.Fatalf("select migrated tenant: %v", err)
+	}
+	if tenantID != tenant.Default {
+		t.Fatalf("expected legacy row owned by %q, got %q", tenant.Default, tenantID)
+	}
+
+	var summaryCount int
+	err = db.QueryRow("SELECT count FROM event_hourly_summaries WHERE tenant = $1", tenant.Default).Scan(&summaryCount)
+	if err != nil || summaryCount != 3 {
+		t.Fatalf("expected the legacy summary kept for %q, got %d: %v", tenant.Default, summaryCount, err)
+	}
+
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("count migrations: %v", err)
+	}
+	if applied != len(schemaMigrations) {
+		t.Fatalf("expected %d recorded migrations, got %d", len(schemaMigrations), applied)
+	}
+}
+
+func TestListEventsFiltersByTraceID(t *testing.T) {
+	db := newTestDB(t)
+	const wanted = "4bf92f3577b34da6a3ce929d0e0e4736"
+	_, err := db.Exec(`
+		INSERT INTO events (id, source, method, route, status, message, created_at, trace_id, span_id) VALUES
+			(1, 'backend', 'GET', '/api/ok', 200, 'one', '2026-01-01T00:00:00Z', '4bf92f3577b34da6a3ce929d0e0e4736', '00f067aa0ba902b7'),
+			(2, 'backend', 'GET', '/api/ok', 200, 'two', '2026-01-01T00:00:01Z', '0af7651916cd43dd8448eb211c80319c', 'b7ad6b7169203331')
+	`)
+	if err != nil {
+		t.Fatalf("seed events: %v", err)
+	}
+	application := &app{db: db, events: newChaiStore(db)}
+
+	recorder := httptest.NewRecorder()
+	application.handleEvents(recorder, httptest.NewRequest(http.MethodGet, "/events?trace_id="+wanted, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var payload struct {
+		Events []event `json:"events"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(payload.Events) != 1 || payload.Events[0].TraceID != wanted || payload.Events[0].SpanID != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected events %+v", payload.Events)
+	}
+
+	recorder = httptest.NewRecorder()
+	application.handleEvents(recorder, httptest.NewRequest(http.MethodGet, "/events?trace_id=not-a-trace", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for malformed trace id, got %d", recorder.Code)
+	}
+}
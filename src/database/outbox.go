@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// The outbox holds messages other services have yet to deliver, such as the
+// backend's notifications, so they survive a restart of that service.
+// Messages stay until the sender deletes them after delivery. Each message
+// belongs to the tenant that stored it; only the sender's poll, on
+// internalOutboxPath, reads across tenants.
+const (
+	internalOutboxPath = "/internal/outbox"
+
+	maxOutboxBodyBytes         = 64 << 10
+	maxOutboxDestinationLength = 100
+	defaultOutboxLimit         = 100
+	maxOutboxLimit             = 1000
+)
+
+// outboxMessage is one stored message. TraceID and SpanID identify the span
+// of the request that produced it, so its delivery can link back to it.
+type outboxMessage struct {
+	ID          int             `json:"id"`
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+	TraceID     string          `json:"traceId"`
+	SpanID      string          `json:"spanId"`
+	Tenant      string          `json:"tenant"`
+	CreatedAt   string          `json:"createdAt"`
+}
+
+type createOutboxRequest struct {
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+	TraceID     string          `json:"traceId"`
+	SpanID      string          `json:"spanId"`
+}
+
+// validate checks an outbox message payload.
+func (input createOutboxRequest) validate() []violation {
+	var violations []violation
+	if input.Destination == "" {
+		violations = append(violations, violation{Field: "destination", Reason: reasonRequired, Message: "destination is required"})
+	}
+	violations = appendTooLong(violations, "destination", input.Destination, maxOutboxDestinationLength)
+	if payload := bytes.TrimSpace(input.Payload); len(payload) == 0 || payload[0] != '{' {
+		violations = append(violations, violation{Field: "payload", Reason: reasonInvalidType, Message: "payload must be a JSON object"})
+	}
+	if _, err := trace.TraceIDFromHex(input.TraceID); input.TraceID != "" && err != nil {
+		violations = append(violations, violation{Field: "traceId", Reason: reasonInvalidType, Message: "traceId must be 32 hex characters"})
+	}
+	if _, err := trace.SpanIDFromHex(input.SpanID); input.SpanID != "" && err != nil {
+		violations = append(violations, violation{Field: "spanId", Reason: reasonInvalidType, Message: "spanId must be 16 hex characters"})
+	}
+	return violations
+}
+
+func (application *app) handleOutbox(response http.ResponseWriter, request *http.Request) {
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		application.listOutbox(response, request, false)
+	case http.MethodPost:
+		application.withIdempotency(response, request, "/outbox", maxOutboxBodyBytes, application.createOutboxMessage)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (application *app) handleOutboxByID(response http.ResponseWriter, request *http.Request) {
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+	id, err := parseIDFromPath(request.URL.Path, "/outbox/")
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, "invalid outbox message id")
+		return
+	}
+	if request.Method != http.MethodDelete {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	_, err = application.db.ExecContext(request.Context(), "DELETE FROM outbox WHERE id = $1 AND tenant = $2", id, tenant.FromContext(request.Context()))
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to delete outbox message")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// handleInternalOutbox lists the messages of every tenant, for the sender
+// that delivers them. It is not meant to be reachable from outside the
+// cluster.
+func (application *app) handleInternalOutbox(response http.ResponseWriter, request *http.Request) {
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	application.listOutbox(response, request, true)
+}
+
+// listOutbox returns stored messages oldest first, optionally only those
+// for ?destination=, up to ?limit=. Only the request's tenant's messages
+// are listed unless allTenants is set.
+func (application *app) listOutbox(response http.ResponseWriter, request *http.Request, allTenants bool) {
+	limit := defaultOutboxLimit
+	if raw := request.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxOutboxLimit {
+			problem.Write(response, request, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxOutboxLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	var conditions []string
+	var args []any
+	if !allTenants {
+		args = append(args, tenant.FromContext(request.Context()))
+		conditions = append(conditions, "tenant = $"+strconv.Itoa(len(args)))
+	}
+	if destination := request.URL.Query().Get("destination"); destination != "" {
+		args = append(args, destination)
+		conditions = append(conditions, "destination = $"+strconv.Itoa(len(args)))
+	}
+	query := "SELECT id, destination, payload, trace_id, span_id, tenant, created_at FROM outbox"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id ASC LIMIT " + strconv.Itoa(limit)
+
+	messages, err := loadOutboxMessages(request.Context(), application.db, query, args...)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query outbox")
+		return
+	}
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"count":    len(messages),
+		"messages": messages,
+	})
+}
+
+func (application *app) createOutboxMessage(response http.ResponseWriter, request *http.Request) {
+	var input createOutboxRequest
+	if !application.decodeBody(response, request, "/outbox", maxOutboxBodyBytes, &input) {
+		return
+	}
+	input.Destination = strings.TrimSpace(input.Destination)
+	if violations := input.validate(); len(violations) > 0 {
+		application.rejectRequest(response, request, "/outbox", http.StatusBadRequest, violations)
+		return
+	}
+
+	// Compact the payload so it is stored and listed as a single line.
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, input.Payload); err != nil {
+		problem.Write(response, request, http.StatusBadRequest, "payload must be a JSON object")
+		return
+	}
+	stored := outboxMessage{
+		Destination: input.Destination,
+		Payload:     payload.Bytes(),
+		TraceID:     input.TraceID,
+		SpanID:      input.SpanID,
+		Tenant:      tenant.FromContext(request.Context()),
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	application.outboxMu.Lock()
+	defer application.outboxMu.Unlock()
+	err := application.db.QueryRowContext(request.Context(), "SELECT COALESCE(MAX(id), 0) + 1 FROM outbox").Scan(&stored.ID)
+	if err == nil {
+		_, err = application.db.ExecContext(request.Context(),
+			"INSERT INTO outbox (id, destination, payload, trace_id, span_id, tenant, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			stored.ID,
+			stored.Destination,
+			string(stored.Payload),
+			stored.TraceID,
+			stored.SpanID,
+			stored.Tenant,
+			stored.CreatedAt,
+		)
+	}
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to store outbox message")
+		return
+	}
+
+	slog.InfoContext(request.Context(), "outbox message stored",
+		"outbox.id", stored.ID,
+		"outbox.destination", stored.Destination,
+	)
+	problem.WriteJSON(response, http.StatusCreated, stored)
+}
+
+func loadOutboxMessages(ctx context.Context, db *sql.DB, query string, args ...any) ([]outboxMessage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []outboxMessage{}
+	for rows.Next() {
+		var row outboxMessage
+		var payload string
+		err = rows.Scan(&row.ID, &row.Destination, &payload, &row.TraceID, &row.SpanID, &row.Tenant, &row.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		row.Payload = json.RawMessage(payload)
+		messages = append(messages, row)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOutboxStoresListsAndDeletesMessages(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverChai)
+	application.db = newTestDB(t)
+
+	for _, body := range []string{
+		`{"destination":"notifier","payload":{"action":"created", "title":"a"},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7"}`,
+		`{"destination":"audit","payload":{"n":1}}`,
+		`{"destination":"notifier","payload":{"action":"deleted"}}`,
+	} {
+		recorder := serveTenantRequest(t, application.handleOutbox, "user1", http.MethodPost, "/outbox", body)
+		decodeStoreResponse[outboxMessage](t, recorder, http.StatusCreated)
+	}
+
+	listed := decodeStoreResponse[struct {
+		Count    int             `json:"count"`
+		Messages []outboxMessage `json:"messages"`
+	}](t, serveTenantRequest(t, application.handleOutbox, "user1", http.MethodGet, "/outbox?destination=notifier", ""), http.StatusOK)
+	if listed.Count != 2 || listed.Messages[0].ID != 1 || listed.Messages[1].ID != 3 {
+		t.Fatalf("expected messages 1 and 3 oldest first, got %+v", listed.Messages)
+	}
+	first := listed.Messages[0]
+	if string(first.Payload) != `{"action":"created","title":"a"}` || first.Tenant != "user1" || first.SpanID != "00f067aa0ba902b7" {
+		t.Fatalf("expected the stored payload, tenant and span, got %+v", first)
+	}
+
+	if recorder := serveTenantRequest(t, application.handleOutboxByID, "user1", http.MethodDelete, "/outbox/1", ""); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+	recorder := serveTenantRequest(t, application.handleOutbox, "user1", http.MethodGet, "/outbox?limit=1", "")
+	if !strings.Contains(recorder.Body.String(), `"count":1`) || !strings.Contains(recorder.Body.String(), `"id":2`) {
+		t.Fatalf("expected message 2 left first, got %s", recorder.Body.String())
+	}
+}
+
+func TestOutboxRejectsInvalidMessages(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverChai)
+	application.db = newTestDB(t)
+
+	for body, field := range map[string]string{
+		`{"payload":{}}`: "destination",
+		`{"destination":"notifier","payload":[1]}`:                "payload",
+		`{"destination":"notifier"}`:                              "payload",
+		`{"destination":"notifier","payload":{},"traceId":"xyz"}`: "traceId",
+		`{"destination":"notifier","payload":{},"spanId":"123"}`:  "spanId",
+	} {
+		recorder := serveStoreRequest(t, application.handleOutbox, http.MethodPost, "/outbox", body)
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), `"field":"`+field+`"`) {
+			t.Fatalf("expected a %s violation for %s, got %d %s", field, body, recorder.Code, recorder.Body.String())
+		}
+	}
+	if recorder := serveStoreRequest(t, application.handleOutbox, http.MethodGet, "/outbox?limit=0", ""); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for limit=0, got %d", recorder.Code)
+	}
+}
+
+func TestOutboxIsScopedToItsTenant(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverChai)
+	application.db = newTestDB(t)
+	for _, tenantID := range []string{"user1", "user2"} {
+		recorder := serveTenantRequest(t, application.handleOutbox, tenantID, http.MethodPost, "/outbox", `{"destination":"notifier","payload":{"title":"secret"}}`)
+		decodeStoreResponse[outboxMessage](t, recorder, http.StatusCreated)
+	}
+
+	type listing struct {
+		Messages []outboxMessage `json:"messages"`
+	}
+	listed := decodeStoreResponse[listing](t, serveTenantRequest(t, application.handleOutbox, "user2", http.MethodGet, "/outbox", ""), http.StatusOK)
+	if len(listed.Messages) != 1 || listed.Messages[0].Tenant != "user2" {
+		t.Fatalf("expected only user2's message, got %+v", listed.Messages)
+	}
+
+	// Deleting another tenant's message is a no-op.
+	serveTenantRequest(t, application.handleOutboxByID, "user2", http.MethodDelete, "/outbox/1", "")
+	pending := decodeStoreResponse[listing](t, serveTenantRequest(t, application.handleInternalOutbox, "user2", http.MethodGet, internalOutboxPath+"?destination=notifier", ""), http.StatusOK)
+	if len(pending.Messages) != 2 || pending.Messages[0].Tenant != "user1" {
+		t.Fatalf("expected both tenants' messages on the internal path, got %+v", pending.Messages)
+	}
+	if recorder := serveStoreRequest(t, application.handleInternalOutbox, http.MethodPost, internalOutboxPath, `{}`); recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the internal path to be read-only, got %d", recorder.Code)
+	}
+}
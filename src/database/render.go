@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"sync"
+
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// renderedNote is a note with its content rendered to HTML.
+type renderedNote struct {
+	note
+	HTML string `json:"html"`
+}
+
+// noteRenderer turns note content into sanitised HTML. GitHub-flavoured
+// Markdown is rendered with goldmark, whose default renderer drops raw HTML
+// and links with dangerous schemes such as javascript:. Fenced code blocks
+// are highlighted with inline styles.
+//
+// Rendering and highlighting are CPU-bound, so results are cached by note and
+// updated_at. updated_at has one-second resolution, so the key also carries
+// a hash of the content in case a note changes twice within a second.
+type noteRenderer struct {
+	markdown goldmark.Markdown
+	tracer   trace.Tracer
+	// lookups counts cache lookups by result (hit or miss).
+	lookups metric.Int64Counter
+
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[renderKey]*list.Element
+}
+
+type renderKey struct {
+	tenant    string
+	id        int
+	updatedAt string
+	hash      string
+}
+
+type renderCacheEntry struct {
+	key  renderKey
+	html string
+}
+
+// newNoteRenderer returns a renderer caching up to capacity notes. Zero
+// disables the cache.
+func newNoteRenderer(tracer trace.Tracer, capacity int, lookups metric.Int64Counter) *noteRenderer {
+	return &noteRenderer{
+		markdown: goldmark.New(goldmark.WithExtensions(
+			extension.GFM,
+			highlighting.NewHighlighting(highlighting.WithStyle("github")),
+		)),
+		tracer:   tracer,
+		lookups:  lookups,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[renderKey]*list.Element{},
+	}
+}
+
+// render returns the HTML for row's content under a "notes.render" span, so
+// the rendering cost (or the cache hit that avoided it) is visible in the
+// trace.
+func (renderer *noteRenderer) render(ctx context.Context, row note) (string, error) {
+	ctx, span := renderer.tracer.Start(ctx, "notes.render",
+		trace.WithAttributes(
+			attribute.Int("note.id", row.ID),
+			attribute.Int("note.content.length", len(row.Content)),
+		),
+	)
+	defer span.End()
+
+	key := renderKey{tenant: row.Tenant, id: row.ID, updatedAt: row.UpdatedAt, hash: noteHash(row)}
+	if html, ok := renderer.cached(key); ok {
+		span.SetAttributes(attribute.Bool("render.cache.hit", true))
+		renderer.lookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "hit")))
+		return html, nil
+	}
+	span.SetAttributes(attribute.Bool("render.cache.hit", false))
+	renderer.lookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "miss")))
+
+	var output bytes.Buffer
+	err := renderer.markdown.Convert([]byte(row.Content), &output)
+	if err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+	html := output.String()
+	renderer.store(key, html)
+	return html, nil
+}
+
+func (renderer *noteRenderer) cached(key renderKey) (string, bool) {
+	renderer.mu.Lock()
+	defer renderer.mu.Unlock()
+
+	element, found := renderer.entries[key]
+	if !found {
+		return "", false
+	}
+	renderer.order.MoveToFront(element)
+	return element.Value.(renderCacheEntry).html, true
+}
+
+// store caches html, evicting the least recently used notes beyond capacity.
+// Entries for earlier versions of a note are left to age out.
+func (renderer *noteRenderer) store(key renderKey, html string) {
+	if renderer.capacity <= 0 {
+		return
+	}
+	renderer.mu.Lock()
+	defer renderer.mu.Unlock()
+
+	if element, found := renderer.entries[key]; found {
+		renderer.order.MoveToFront(element)
+		return
+	}
+	renderer.entries[key] = renderer.order.PushFront(renderCacheEntry{key: key, html: html})
+	for renderer.order.Len() > renderer.capacity {
+		oldest := renderer.order.Back()
+		renderer.order.Remove(oldest)
+		delete(renderer.entries, oldest.Value.(renderCacheEntry).key)
+	}
+}
+
+// renderNotes renders every note for GET /notes?render=html.
+func (renderer *noteRenderer) renderNotes(ctx context.Context, notes []note) ([]renderedNote, error) {
+	rendered := make([]renderedNote, 0, len(notes))
+	for _, row := range notes {
+		html, err := renderer.render(ctx, row)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, renderedNote{note: row, HTML: html})
+	}
+	return rendered, nil
+}
+
+var notePageTemplate = template.Must(template.New("note").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<article>
+<h1>{{.Title}}</h1>
+{{.Body}}
+</article>
+</body>
+</html>
+`))
+
+// getNoteHTML serves GET /notes/{id}.html: the note as a standalone HTML
+// page. The rendered content is already sanitised; the Content-Security-Policy
+// additionally blocks scripts and only allows the highlighter's inline
+// styles.
+func (application *app) getNoteHTML(response http.ResponseWriter, request *http.Request, id int) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stored, err := application.notes.GetNote(request.Context(), tenant.FromContext(request.Context()), id)
+	if errors.Is(err, errNotFound) {
+		problem.Write(response, request, http.StatusNotFound, "note not found")
+		return
+	}
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to load note")
+		return
+	}
+	html, err := application.renderer.render(request.Context(), stored)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to render note")
+		return
+	}
+
+	var page bytes.Buffer
+	err = notePageTemplate.Execute(&page, struct {
+		Title string
+		Body  template.HTML
+	}{Title: stored.Title, Body: template.HTML(html)})
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to render note")
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	response.WriteHeader(http.StatusOK)
+	_, _ = response.Write(page.Bytes())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const renderTestContent = "# Plan\n\n<script>alert(1)</script>\n\n[click](javascript:alert(1))\n\n```go\nfunc main() {}\n```\n"
+
+func TestNoteHTMLIsSanitisedAndHighlighted(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	body, _ := json.Marshal(createNoteRequest{Title: "<b>plan</b>", Content: renderTestContent})
+	decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", string(body)), http.StatusCreated)
+
+	recorder := serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1.html", "")
+	page := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected an HTML page, got %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Header().Get("Content-Security-Policy"), "default-src 'none'") {
+		t.Fatalf("expected a restrictive CSP, got %q", recorder.Header().Get("Content-Security-Policy"))
+	}
+	for _, forbidden := range []string{"<script", "javascript:", "<b>plan"} {
+		if strings.Contains(page, forbidden) {
+			t.Fatalf("expected %q to be removed or escaped:\n%s", forbidden, page)
+		}
+	}
+	for _, wanted := range []string{"<h1>Plan</h1>", "&lt;b&gt;plan&lt;/b&gt;", `<pre style=`, `<span style=`} {
+		if !strings.Contains(page, wanted) {
+			t.Fatalf("expected %q in:\n%s", wanted, page)
+		}
+	}
+
+	if missing := serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/9.html", ""); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing note, got %d", missing.Code)
+	}
+}
+
+func TestListNotesRendersHTMLOnRequest(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"a","content":"*hi*"}`)
+
+	rendered := decodeStoreResponse[struct {
+		Notes []renderedNote `json:"notes"`
+	}](t, serveStoreRequest(t, application.handleNotes, http.MethodGet, "/notes?render=html", ""), http.StatusOK)
+	if len(rendered.Notes) != 1 || rendered.Notes[0].HTML != "<p><em>hi</em></p>\n" || rendered.Notes[0].Content != "*hi*" {
+		t.Fatalf("unexpected rendered notes %+v", rendered.Notes)
+	}
+
+	plain := serveStoreRequest(t, application.handleNotes, http.MethodGet, "/notes", "").Body.String()
+	if strings.Contains(plain, `"html"`) {
+		t.Fatalf("expected no html without render, got %s", plain)
+	}
+	if recorder := serveStoreRequest(t, application.handleNotes, http.MethodGet, "/notes?render=pdf", ""); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown render format, got %d", recorder.Code)
+	}
+}
+
+func TestRenderCacheKeyedByUpdate(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	application := newStoreTestApp(t, storageDriverMemory)
+	application.renderer.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+
+	serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"a","content":"one"}`)
+	serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1.html", "")
+	serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1.html", "")
+	// Updating within the same second keeps updated_at; the content hash
+	// still invalidates the cached HTML.
+	serveStoreRequest(t, application.handleNoteByID, http.MethodPut, "/notes/1", `{"title":"a","content":"two"}`)
+	page := serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1.html", "").Body.String()
+	if !strings.Contains(page, "<p>two</p>") {
+		t.Fatalf("expected the updated content, got %s", page)
+	}
+
+	var hits []bool
+	for _, span := range spans.Ended() {
+		if span.Name() == "notes.render" {
+			hits = append(hits, spanAttribute(span, attribute.Key("render.cache.hit")).AsBool())
+		}
+	}
+	if len(hits) != 3 || hits[0] || !hits[1] || hits[2] {
+		t.Fatalf("expected miss, hit, miss; got %v", hits)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+type retentionConfig struct {
+	// MaxAge deletes events older than this. Zero disables the age limit.
+	MaxAge time.Duration
+	// MaxRows keeps at most this many events, deleting the oldest first.
+	// Zero disables the row limit.
+	MaxRows int
+	// Interval is the pause between runs.
+	Interval time.Duration
+	// BatchSize is the number of rows deleted per transaction.
+	BatchSize int
+	// Summarize rolls expired rows up into event_hourly_summaries before
+	// deleting them.
+	Summarize bool
+}
+
+func (config retentionConfig) enabled() bool {
+	return config.MaxAge > 0 || config.MaxRows > 0
+}
+
+// hourlySummary is one row of event_hourly_summaries: the number of events
+// (and errors) a source wrote to a route during one hour, for one tenant.
+type hourlySummary struct {
+	HourStart string `json:"hourStart"`
+	Source    string `json:"source"`
+	Route     string `json:"route"`
+	Count     int    `json:"count"`
+	Errors    int    `json:"errors"`
+}
+
+type hourlySummaryKey struct {
+	tenant   string
+	hourUnix int64
+	source   string
+	route    string
+}
+
+// retentionResult describes what one run of the job removed.
+type retentionResult struct {
+	expired    int
+	overflow   int
+	batches    int
+	summarized int
+}
+
+// eventRetention is the background job that enforces the events retention
+// policy. Each run deletes in batches of BatchSize rows, one transaction per
+// batch, so the table is never locked for long.
+type eventRetention struct {
+	db          *sql.DB
+	serviceName string
+	config      retentionConfig
+
+	stopOnce sync.Once
+	stopping chan struct{}
+	done     chan struct{}
+
+	deleted metric.Int64Counter
+	lastRun metric.Int64Gauge
+}
+
+func newEventRetention(db *sql.DB, serviceName string, config retentionConfig, meter metric.Meter) *eventRetention {
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Minute
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+
+	// Retention metrics. These are no-ops when OTEL is disabled (global
+	// noop meter).
+	deleted, _ := meter.Int64Counter(
+		"database.events.retention.deleted",
+		metric.WithDescription("Events removed by the retention job, by reason"),
+		metric.WithUnit("{event}"),
+	)
+	lastRun, _ := meter.Int64Gauge(
+		"database.events.retention.last_run",
+		metric.WithDescription("Unix time of the last completed retention run"),
+		metric.WithUnit("s"),
+	)
+
+	return &eventRetention{
+		db:          db,
+		serviceName: serviceName,
+		config:      config,
+		stopping:    make(chan struct{}),
+		done:        make(chan struct{}),
+		deleted:     deleted,
+		lastRun:     lastRun,
+	}
+}
+
+// start runs the job immediately and then every Interval until shutdown. It
+// does nothing when neither MaxAge nor MaxRows is set.
+func (retention *eventRetention) start() {
+	if !retention.config.enabled() {
+		close(retention.done)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-retention.stopping
+		cancel()
+	}()
+
+	go func() {
+		defer close(retention.done)
+		ticker := time.NewTicker(retention.config.Interval)
+		defer ticker.Stop()
+		for {
+			_, err := retention.run(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				slog.ErrorContext(ctx, "event retention run failed", "service", retention.serviceName, "err", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-retention.stopping:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown cancels a run in progress between batches and waits for the job
+// to exit or ctx to expire.
+func (retention *eventRetention) shutdown(ctx context.Context) error {
+	retention.stopOnce.Do(func() { close(retention.stopping) })
+	select {
+	case <-retention.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run applies the age limit and then the row limit under a single
+// "events.retention" span.
+func (retention *eventRetention) run(ctx context.Context) (retentionResult, error) {
+	ctx, span := otel.Tracer(retention.serviceName).Start(ctx, "events.retention")
+	defer span.End()
+
+	start := time.Now()
+	var result retentionResult
+	var err error
+
+	if retention.config.MaxAge > 0 {
+		cutoff := start.Add(-retention.config.MaxAge).Unix()
+		result.expired, err = retention.deleteExpired(ctx, cutoff, &result)
+	}
+	if err == nil && retention.config.MaxRows > 0 {
+		result.overflow, err = retention.deleteOverflow(ctx, &result)
+	}
+
+	span.SetAttributes(
+		attribute.Int64("events.retention.max_age_seconds", int64(retention.config.MaxAge/time.Second)),
+		attribute.Int("events.retention.max_rows", retention.config.MaxRows),
+		attribute.Int("events.retention.expired", result.expired),
+		attribute.Int("events.retention.overflow", result.overflow),
+		attribute.Int("events.retention.batches", result.batches),
+		attribute.Int("events.retention.summarized", result.summarized),
+	)
+	retention.deleted.Add(ctx, int64(result.expired), metric.WithAttributes(attribute.String("reason", "max_age")))
+	retention.deleted.Add(ctx, int64(result.overflow), metric.WithAttributes(attribute.String("reason", "max_rows")))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "retention run failed")
+		return result, err
+	}
+	retention.lastRun.Record(ctx, time.Now().Unix())
+
+	if result.expired+result.overflow > 0 {
+		slog.InfoContext(ctx, "event retention run",
+			"events.retention.expired", result.expired,
+			"events.retention.overflow", result.overflow,
+			"events.retention.batches", result.batches,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	}
+	return result, nil
+}
+
+// deleteExpired removes events created before cutoff, oldest id first.
+func (retention *eventRetention) deleteExpired(ctx context.Context, cutoff int64, result *retentionResult) (int, error) {
+	total := 0
+	for {
+		deleted, err := retention.deleteBatch(ctx,
+			"SELECT id, source, route, status, created_unix, tenant FROM events WHERE created_unix < $1 ORDER BY id LIMIT $2",
+			"DELETE FROM events WHERE created_unix < $1 AND id <= $2",
+			cutoff,
+			retention.config.BatchSize,
+			result,
+		)
+		total += deleted
+		if err != nil || deleted < retention.config.BatchSize {
+			return total, err
+		}
+	}
+}
+
+// deleteOverflow removes the oldest events until at most MaxRows remain.
+func (retention *eventRetention) deleteOverflow(ctx context.Context, result *retentionResult) (int, error) {
+	var count int
+	err := retention.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for excess := count - retention.config.MaxRows; excess > 0; {
+		limit := min(excess, retention.config.BatchSize)
+		// Every row selected here has id <= the batch's highest id and no
+		// other row does, so the DELETE matches exactly the selected batch.
+		deleted, err := retention.deleteBatch(ctx,
+			"SELECT id, source, route, status, created_unix, tenant FROM events WHERE id > $1 ORDER BY id LIMIT $2",
+			"DELETE FROM events WHERE id > $1 AND id <= $2",
+			0,
+			limit,
+			result,
+		)
+		total += deleted
+		if err != nil || deleted == 0 {
+			return total, err
+		}
+		excess -= deleted
+	}
+	return total, nil
+}
+
+// deleteBatch selects up to limit rows with selectSQL, optionally rolls them
+// up into hourly summaries, and deletes them with deleteSQL bounded by the
+// highest selected id — all in one transaction. chai supports neither
+// subqueries in DELETE nor RowsAffected, hence the two statements.
+func (retention *eventRetention) deleteBatch(ctx context.Context, selectSQL string, deleteSQL string, bound int64, limit int, result *retentionResult) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := retention.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, selectSQL, bound, limit)
+	if err != nil {
+		return 0, err
+	}
+	summaries := map[hourlySummaryKey]hourlySummary{}
+	selected := 0
+	maxID := 0
+	for rows.Next() {
+		var id, status int
+		var source, route, tenantID string
+		var createdUnix int64
+		err = rows.Scan(&id, &source, &route, &status, &createdUnix, &tenantID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		selected++
+		maxID = max(maxID, id)
+
+		key := hourlySummaryKey{tenant: tenantID, hourUnix: createdUnix - createdUnix%3600, source: source, route: route}
+		summary := summaries[key]
+		summary.Count++
+		if status >= 400 {
+			summary.Errors++
+		}
+		summaries[key] = summary
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if selected == 0 {
+		return 0, nil
+	}
+
+	if retention.config.Summarize {
+		err = addHourlySummaries(ctx, tx, summaries)
+		if err != nil {
+			return 0, err
+		}
+		result.summarized += selected
+	}
+
+	_, err = tx.ExecContext(ctx, deleteSQL, bound, maxID)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	result.batches++
+	return selected, nil
+}
+
+// addHourlySummaries adds counts onto existing summary rows, creating the
+// rows that do not exist yet.
+func addHourlySummaries(ctx context.Context, tx *sql.Tx, summaries map[hourlySummaryKey]hourlySummary) error {
+	for key, summary := range summaries {
+		var count, errorCount int
+		err := tx.QueryRowContext(ctx,
+			"SELECT count, errors FROM event_hourly_summaries WHERE tenant = $1 AND hour_unix = $2 AND source = $3 AND route = $4",
+			key.tenant, key.hourUnix, key.source, key.route,
+		).Scan(&count, &errorCount)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO event_hourly_summaries (tenant, hour_unix, source, route, count, errors) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO REPLACE",
+			key.tenant, key.hourUnix, key.source, key.route, count+summary.Count, errorCount+summary.Errors,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (application *app) handleEventSummaries(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+
+	rows, err := application.db.QueryContext(request.Context(),
+		"SELECT hour_unix, source, route, count, errors FROM event_hourly_summaries WHERE tenant = $1",
+		tenant.FromContext(request.Context()),
+	)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query event summaries")
+		return
+	}
+	defer rows.Close()
+
+	summaries := []hourlySummary{}
+	for rows.Next() {
+		var summary hourlySummary
+		var hourUnix int64
+		err = rows.Scan(&hourUnix, &summary.Source, &summary.Route, &summary.Count, &summary.Errors)
+		if err != nil {
+			problem.Write(response, request, http.StatusInternalServerError, "failed to scan event summary")
+			return
+		}
+		summary.HourStart = time.Unix(hourUnix, 0).UTC().Format(time.RFC3339)
+		summaries = append(summaries, summary)
+	}
+	if err = rows.Err(); err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to read rows")
+		return
+	}
+
+	// Newest hour first, then by source and route.
+	slices.SortFunc(summaries, func(left, right hourlySummary) int {
+		if order := strings.Compare(right.HourStart, left.HourStart); order != 0 {
+			return order
+		}
+		if order := strings.Compare(left.Source, right.Source); order != 0 {
+			return order
+		}
+		return strings.Compare(left.Route, right.Route)
+	})
+
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"count":     len(summaries),
+		"summaries": summaries,
+	})
+}
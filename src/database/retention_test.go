@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func seedRetentionEvents(t *testing.T, db *sql.DB, createdUnix ...int64) {
+	t.Helper()
+	for index, unix := range createdUnix {
+		status := 200
+		if index%2 == 1 {
+			status = 500
+		}
+		_, err := db.Exec(
+			"INSERT INTO events (id, source, method, route, status, message, created_at, created_unix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			index+1, "backend", "GET", "/api/ok", status, "seeded", time.Unix(unix, 0).UTC().Format(time.RFC3339), unix,
+		)
+		if err != nil {
+			t.Fatalf("seed event %d: %v", index+1, err)
+		}
+	}
+}
+
+func remainingEventIDs(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT id FROM events ORDER BY id")
+	if err != nil {
+		t.Fatalf("list events: %v", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatalf("scan id: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestEventRetentionDeletesExpiredRowsAndSummarizes(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().Unix()
+	oldHour := now - now%3600 - 48*3600
+	// Five expired rows in one hour, two recent rows.
+	seedRetentionEvents(t, db, oldHour+10, oldHour+20, oldHour+30, oldHour+40, oldHour+50, now-60, now-30)
+
+	retention := newEventRetention(db, "database", retentionConfig{
+		MaxAge:    24 * time.Hour,
+		BatchSize: 2,
+		Summarize: true,
+	}, noop.NewMeterProvider().Meter("test"))
+
+	result, err := retention.run(context.Background())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if result.expired != 5 || result.batches != 3 || result.summarized != 5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if ids := remainingEventIDs(t, db); len(ids) != 2 || ids[0] != 6 || ids[1] != 7 {
+		t.Fatalf("expected recent events 6 and 7 to remain, got %v", ids)
+	}
+
+	recorder := httptest.NewRecorder()
+	(&app{db: db}).handleEventSummaries(recorder, httptest.NewRequest(http.MethodGet, "/events/summaries", nil))
+	var payload struct {
+		Summaries []hourlySummary `json:"summaries"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := hourlySummary{
+		HourStart: time.Unix(oldHour, 0).UTC().Format(time.RFC3339),
+		Source:    "backend",
+		Route:     "/api/ok",
+		Count:     5,
+		Errors:    2,
+	}
+	if len(payload.Summaries) != 1 || payload.Summaries[0] != want {
+		t.Fatalf("expected summary %+v, got %+v", want, payload.Summaries)
+	}
+}
+
+func TestEventRetentionEnforcesMaxRows(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().Unix()
+	seedRetentionEvents(t, db, now-50, now-40, now-30, now-20, now-10)
+
+	retention := newEventRetention(db, "database", retentionConfig{
+		MaxRows:   2,
+		BatchSize: 2,
+	}, noop.NewMeterProvider().Meter("test"))
+
+	result, err := retention.run(context.Background())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if result.overflow != 3 || result.batches != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if ids := remainingEventIDs(t, db); len(ids) != 2 || ids[0] != 4 || ids[1] != 5 {
+		t.Fatalf("expected newest events 4 and 5 to remain, got %v", ids)
+	}
+
+	var summaries int
+	if err := db.QueryRow("SELECT COUNT(*) FROM event_hourly_summaries").Scan(&summaries); err != nil {
+		t.Fatalf("count summaries: %v", err)
+	}
+	if summaries != 0 {
+		t.Fatalf("expected no summaries without Summarize, got %d", summaries)
+	}
+}
+
+func TestEventRetentionShutdownStopsJob(t *testing.T) {
+	for _, config := range []retentionConfig{{}, {MaxAge: time.Hour, Interval: time.Hour}} {
+		retention := newEventRetention(newTestDB(t), "database", config, noop.NewMeterProvider().Meter("test"))
+		retention.start()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := retention.shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("shutdown with %+v: %v", config, err)
+		}
+	}
+}
+
+func TestEventSummariesAreScopedToTheirTenant(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().Unix()
+	oldHour := now - now%3600 - 48*3600
+	for index, tenantID := range []string{"user1", "user1", "user2"} {
+		_, err := db.Exec(
+			"INSERT INTO events (id, source, method, route, status, message, created_at, created_unix, tenant) VALUES ($1, 'backend', 'GET', '/api/ok', 200, 'seeded', $2, $3, $4)",
+			index+1, time.Unix(oldHour, 0).UTC().Format(time.RFC3339), oldHour, tenantID,
+		)
+		if err != nil {
+			t.Fatalf("seed event %d: %v", index+1, err)
+		}
+	}
+
+	retention := newEventRetention(db, "database", retentionConfig{
+		MaxAge:    24 * time.Hour,
+		BatchSize: 10,
+		Summarize: true,
+	}, noop.NewMeterProvider().Meter("test"))
+	if _, err := retention.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	application := &app{db: db}
+	for tenantID, want := range map[string]int{"user1": 2, "user2": 1, "user3": 0} {
+		payload := decodeStoreResponse[struct {
+			Summaries []hourlySummary `json:"summaries"`
+		}](t, serveTenantRequest(t, application.handleEventSummaries, tenantID, http.MethodGet, "/events/summaries", ""), http.StatusOK)
+		total := 0
+		for _, summary := range payload.Summaries {
+			total += summary.Count
+		}
+		if total != want {
+			t.Fatalf("expected %s to see %d summarized events, got %+v", tenantID, want, payload.Summaries)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dbSystemName is reported as db.system.name on every SQL span and metric.
+const dbSystemName = "chai"
+
+// sqlInstrumentation creates a client span and a duration measurement for
+// every statement that goes through a traced driver, and logs statements
+// slower than slowThreshold.
+type sqlInstrumentation struct {
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+
+	// slowThreshold is the duration at or above which a statement is logged
+	// as a slow query. Zero disables the slow query log.
+	slowThreshold time.Duration
+	slowQueries   metric.Int64Counter
+}
+
+func newSQLInstrumentation(tracer trace.Tracer, meter metric.Meter, slowThreshold time.Duration) *sqlInstrumentation {
+	// Follows the OTel database client semantic conventions. A no-op when
+	// OTEL is disabled (global noop meter).
+	duration, _ := meter.Float64Histogram(
+		"db.client.operation.duration",
+		metric.WithDescription("Duration of database client operations"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10),
+	)
+	slowQueries, _ := meter.Int64Counter(
+		"database.sql.slow_queries",
+		metric.WithDescription("Statements that took at least the slow query threshold, by table and operation"),
+		metric.WithUnit("{statement}"),
+	)
+	return &sqlInstrumentation{
+		tracer:        tracer,
+		duration:      duration,
+		slowThreshold: slowThreshold,
+		slowQueries:   slowQueries,
+	}
+}
+
+// openChaiDB opens the chai database at path through a driver wrapper that
+// traces every statement and transaction with instrumentation.
+func openChaiDB(path string, instrumentation *sqlInstrumentation) (*sql.DB, error) {
+	// database/sql cannot look a registered driver up by name, and sql.Open
+	// opens the data source straight away for drivers implementing
+	// driver.DriverContext, as chai does. Borrow the driver from a throwaway
+	// in-memory handle so path is only ever opened through the wrapper.
+	borrowed, err := sql.Open("chai", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	base := borrowed.Driver()
+	err = borrowed.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	baseContext, ok := base.(driver.DriverContext)
+	if !ok {
+		return nil, fmt.Errorf("chai driver %T does not implement driver.DriverContext", base)
+	}
+	connector, err := baseContext.OpenConnector(path)
+	if err != nil {
+		return nil, err
+	}
+
+	traced := &tracedDriver{base: base, instrumentation: instrumentation}
+	return sql.OpenDB(&tracedConnector{base: connector, driver: traced}), nil
+}
+
+// sqlOperation is one in-flight traced operation.
+type sqlOperation struct {
+	instrumentation *sqlInstrumentation
+	ctx             context.Context
+	span            trace.Span
+	start           time.Time
+	attributes      []attribute.KeyValue
+
+	// Slow query log fields. returnedRows is -1 for statements that do not
+	// return a result set.
+	queryText    string
+	args         int
+	returnedRows int
+}
+
+// startOperation opens a client span named "<operation> <collection>" as
+// recommended by the semantic conventions. query is sanitised before it is
+// recorded; pass "" for BEGIN, COMMIT and ROLLBACK. args is the number of
+// bound arguments.
+func (instrumentation *sqlInstrumentation) startOperation(ctx context.Context, operation string, query string, args int) *sqlOperation {
+	collection := ""
+	if query != "" {
+		operation, collection = queryOperation(query)
+	}
+
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system.name", dbSystemName),
+		attribute.String("db.operation.name", operation),
+	}
+	spanName := operation
+	if collection != "" {
+		attributes = append(attributes, attribute.String("db.collection.name", collection))
+		spanName += " " + collection
+	}
+
+	spanAttributes := attributes
+	queryText := ""
+	if query != "" {
+		queryText = sanitizeQuery(query)
+		spanAttributes = append(slices.Clip(spanAttributes), attribute.String("db.query.text", queryText))
+	}
+
+	ctx, span := instrumentation.tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(spanAttributes...),
+	)
+	return &sqlOperation{
+		instrumentation: instrumentation,
+		ctx:             ctx,
+		span:            span,
+		start:           time.Now(),
+		attributes:      attributes,
+		queryText:       queryText,
+		args:            args,
+		returnedRows:    -1,
+	}
+}
+
+// end records err (if any) and extra attributes, ends the span, records
+// the operation duration and logs the statement if it was slow.
+func (operation *sqlOperation) end(err error, extra ...attribute.KeyValue) {
+	elapsed := time.Since(operation.start)
+	if operation.returnedRows >= 0 {
+		extra = append(extra, attribute.Int("db.response.returned_rows", operation.returnedRows))
+	}
+
+	attributes := operation.attributes
+	if err != nil {
+		operation.span.RecordError(err)
+		operation.span.SetStatus(codes.Error, err.Error())
+		attributes = append(slices.Clip(attributes), attribute.String("error.type", fmt.Sprintf("%T", err)))
+	}
+	operation.span.SetAttributes(extra...)
+
+	threshold := operation.instrumentation.slowThreshold
+	if threshold > 0 && elapsed >= threshold && operation.queryText != "" {
+		operation.logSlowQuery(elapsed, err)
+	}
+
+	operation.span.End()
+	operation.instrumentation.duration.Record(operation.ctx, elapsed.Seconds(),
+		metric.WithAttributes(attributes...))
+}
+
+// logSlowQuery writes the slow query record through slog while the statement
+// span is still recording, so the log line carries its trace and span ids
+// and is correlated with the trace in Loki.
+func (operation *sqlOperation) logSlowQuery(elapsed time.Duration, err error) {
+	operation.instrumentation.slowQueries.Add(operation.ctx, 1, metric.WithAttributes(operation.attributes...))
+
+	logAttributes := []any{
+		"db.query.text", operation.queryText,
+		"db.query.args", operation.args,
+		"duration_ms", float64(elapsed.Microseconds()) / 1000,
+		"threshold_ms", operation.instrumentation.slowThreshold.Milliseconds(),
+	}
+	for _, kv := range operation.attributes {
+		logAttributes = append(logAttributes, string(kv.Key), kv.Value.Emit())
+	}
+	if operation.returnedRows >= 0 {
+		logAttributes = append(logAttributes, "db.response.returned_rows", operation.returnedRows)
+	}
+	if err != nil {
+		logAttributes = append(logAttributes, "err", err)
+	}
+	slog.WarnContext(operation.ctx, "slow query", logAttributes...)
+}
+
+type tracedDriver struct {
+	base            driver.Driver
+	instrumentation *sqlInstrumentation
+}
+
+func (traced *tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := traced.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{base: conn, instrumentation: traced.instrumentation}, nil
+}
+
+type tracedConnector struct {
+	base   driver.Connector
+	driver *tracedDriver
+}
+
+func (connector *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{base: conn, instrumentation: connector.driver.instrumentation}, nil
+}
+
+func (connector *tracedConnector) Driver() driver.Driver {
+	return connector.driver
+}
+
+// Close releases the underlying database; sql.DB.Close calls it.
+func (connector *tracedConnector) Close() error {
+	if closer, ok := connector.base.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type tracedConn struct {
+	base            driver.Conn
+	instrumentation *sqlInstrumentation
+}
+
+func (conn *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.PrepareContext(context.Background(), query)
+}
+
+func (conn *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := conn.base.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = conn.base.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{base: stmt, query: query, instrumentation: conn.instrumentation}, nil
+}
+
+func (conn *tracedConn) Close() error {
+	return conn.base.Close()
+}
+
+func (conn *tracedConn) Begin() (driver.Tx, error) {
+	return conn.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (conn *tracedConn) BeginTx(ctx context.Context, options driver.TxOptions) (driver.Tx, error) {
+	operation := conn.instrumentation.startOperation(ctx, "BEGIN", "", 0)
+	var tx driver.Tx
+	var err error
+	if beginner, ok := conn.base.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, options)
+	} else {
+		tx, err = conn.base.Begin()
+	}
+	operation.end(err, attribute.Bool("db.transaction.read_only", options.ReadOnly))
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{base: tx, ctx: ctx, instrumentation: conn.instrumentation}, nil
+}
+
+func (conn *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := conn.base.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	operation := conn.instrumentation.startOperation(ctx, "", query, len(args))
+	rows, err := queryer.QueryContext(operation.ctx, query, args)
+	if err != nil {
+		operation.end(err)
+		return nil, err
+	}
+	return &tracedRows{base: rows, operation: operation}, nil
+}
+
+func (conn *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := conn.base.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	operation := conn.instrumentation.startOperation(ctx, "", query, len(args))
+	result, err := execer.ExecContext(operation.ctx, query, args)
+	operation.end(err, rowsAffected(result)...)
+	return result, err
+}
+
+func (conn *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := conn.base.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+type tracedStmt struct {
+	base            driver.Stmt
+	query           string
+	instrumentation *sqlInstrumentation
+}
+
+func (stmt *tracedStmt) Close() error {
+	return stmt.base.Close()
+}
+
+func (stmt *tracedStmt) NumInput() int {
+	return stmt.base.NumInput()
+}
+
+func (stmt *tracedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stmt.base.Exec(args)
+}
+
+func (stmt *tracedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.base.Query(args)
+}
+
+func (stmt *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := stmt.base.(driver.StmtExecContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	operation := stmt.instrumentation.startOperation(ctx, "", stmt.query, len(args))
+	result, err := execer.ExecContext(operation.ctx, args)
+	operation.end(err, rowsAffected(result)...)
+	return result, err
+}
+
+func (stmt *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := stmt.base.(driver.StmtQueryContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	operation := stmt.instrumentation.startOperation(ctx, "", stmt.query, len(args))
+	rows, err := queryer.QueryContext(operation.ctx, args)
+	if err != nil {
+		operation.end(err)
+		return nil, err
+	}
+	return &tracedRows{base: rows, operation: operation}, nil
+}
+
+// tracedTx records COMMIT and ROLLBACK as spans under the context the
+// transaction was started with.
+type tracedTx struct {
+	base            driver.Tx
+	ctx             context.Context
+	instrumentation *sqlInstrumentation
+}
+
+func (tx *tracedTx) Commit() error {
+	operation := tx.instrumentation.startOperation(tx.ctx, "COMMIT", "", 0)
+	err := tx.base.Commit()
+	operation.end(err)
+	return err
+}
+
+func (tx *tracedTx) Rollback() error {
+	operation := tx.instrumentation.startOperation(tx.ctx, "ROLLBACK", "", 0)
+	err := tx.base.Rollback()
+	operation.end(err)
+	return err
+}
+
+// tracedRows keeps the query span open while the caller iterates, so the
+// span covers reading the result set and reports how many rows it returned.
+type tracedRows struct {
+	base      driver.Rows
+	operation *sqlOperation
+	returned  int
+	err       error
+	closed    bool
+}
+
+func (rows *tracedRows) Columns() []string {
+	return rows.base.Columns()
+}
+
+func (rows *tracedRows) Next(dest []driver.Value) error {
+	err := rows.base.Next(dest)
+	switch {
+	case err == nil:
+		rows.returned++
+	case !errors.Is(err, io.EOF):
+		rows.err = err
+	}
+	return err
+}
+
+func (rows *tracedRows) Close() error {
+	err := rows.base.Close()
+	if !rows.closed {
+		rows.closed = true
+		rows.operation.returnedRows = rows.returned
+		rows.operation.end(errors.Join(rows.err, err))
+	}
+	return err
+}
+
+// rowsAffected returns the affected row count as a span attribute when the
+// driver reports one. chai does not, so this is usually empty.
+func rowsAffected(result driver.Result) []attribute.KeyValue {
+	if result == nil {
+		return nil
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.Int64("db.response.affected_rows", affected)}
+}
+
+// queryOperation returns the upper-cased leading keyword of query and the
+// table it targets, if one follows FROM, INTO, UPDATE or TABLE.
+func queryOperation(query string) (string, string) {
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return "", ""
+	}
+
+	operation := strings.ToUpper(words[0])
+	for index := 0; index < len(words)-1; index++ {
+		switch strings.ToUpper(words[index]) {
+		case "FROM", "INTO", "UPDATE", "TABLE":
+		default:
+			continue
+		}
+		next := index + 1
+		for next < len(words) && slices.Contains([]string{"IF", "NOT", "EXISTS"}, strings.ToUpper(words[next])) {
+			next++
+		}
+		if next < len(words) {
+			return operation, strings.TrimRight(words[next], "(,;")
+		}
+	}
+	return operation, ""
+}
+
+// sanitizeQuery replaces string and numeric literals with "?" and collapses
+// whitespace, so db.query.text never carries note content or other values
+// inlined into a statement. $n placeholders are kept.
+func sanitizeQuery(query string) string {
+	var builder strings.Builder
+	builder.Grow(len(query))
+
+	runes := []rune(query)
+	pendingSpace := false
+	for index := 0; index < len(runes); index++ {
+		character := runes[index]
+		if unicode.IsSpace(character) {
+			pendingSpace = builder.Len() > 0
+			continue
+		}
+		if pendingSpace {
+			builder.WriteByte(' ')
+			pendingSpace = false
+		}
+
+		switch {
+		case character == '\'':
+			// Skip to the closing quote; '' is an escaped quote.
+			for index++; index < len(runes); index++ {
+				if runes[index] == '\'' {
+					if index+1 < len(runes) && runes[index+1] == '\'' {
+						index++
+						continue
+					}
+					break
+				}
+			}
+			builder.WriteByte('?')
+		case unicode.IsDigit(character) && (index == 0 || !isIdentifierRune(runes[index-1])):
+			for index+1 < len(runes) && (unicode.IsDigit(runes[index+1]) || runes[index+1] == '.') {
+				index++
+			}
+			builder.WriteByte('?')
+		default:
+			builder.WriteRune(character)
+		}
+	}
+	return builder.String()
+}
+
+func isIdentifierRune(character rune) bool {
+	return character == '_' || character == '$' || unicode.IsLetter(character) || unicode.IsDigit(character)
+}
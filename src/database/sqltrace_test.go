@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestInstrumentedDriverCreatesClientSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	db, err := openChaiDB(":memory:", newSQLInstrumentation(tracer, meter, 0))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	if err := ensureSchema(db); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO events (id, source, method, route, status, message, created_at) VALUES (1, 'backend', 'GET', '/api/ok', 200, 'secret text', '2026-01-01T00:00:00Z')")
+	if err != nil {
+		t.Fatalf("seed event: %v", err)
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "GET /events")
+	recorder.Reset()
+	application := &app{db: db, events: newChaiStore(db)}
+	response := httptest.NewRecorder()
+	application.handleEvents(response, httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx))
+	_, err = db.ExecContext(ctx, "SELECT * FROM missing_table")
+	if err == nil {
+		t.Fatalf("expected error querying a missing table")
+	}
+	parent.End()
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", response.Code)
+	}
+
+	var selectSpan, failedSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "SELECT events":
+			selectSpan = span
+		case "SELECT missing_table":
+			failedSpan = span
+		}
+	}
+	if selectSpan == nil || failedSpan == nil {
+		t.Fatalf("expected SELECT spans, got %d spans", len(recorder.Ended()))
+	}
+
+	if selectSpan.SpanKind() != trace.SpanKindClient || selectSpan.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("expected client span under the request span, got kind %v parent %v", selectSpan.SpanKind(), selectSpan.Parent().SpanID())
+	}
+	if got := spanAttribute(selectSpan, "db.query.text").AsString(); got != "SELECT "+eventColumns+" FROM events WHERE tenant = $1 ORDER BY id DESC LIMIT $2" {
+		t.Fatalf("unexpected db.query.text %q", got)
+	}
+	if got := spanAttribute(selectSpan, "db.response.returned_rows").AsInt64(); got != 1 {
+		t.Fatalf("expected 1 returned row, got %d", got)
+	}
+	if failedSpan.Status().Code != codes.Error {
+		t.Fatalf("expected error status on failed statement, got %v", failedSpan.Status())
+	}
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	found := false
+	for _, scope := range collected.ScopeMetrics {
+		for _, metric := range scope.Metrics {
+			found = found || metric.Name == "db.client.operation.duration"
+		}
+	}
+	if !found {
+		t.Fatalf("expected db.client.operation.duration to be recorded")
+	}
+}
+
+func TestSlowQueryLogRecordsStatementsOverThreshold(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	instrumentation := newSQLInstrumentation(tracer, meter, time.Hour)
+
+	db, err := openChaiDB(":memory:", instrumentation)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	if err := ensureSchema(db); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+	if strings.Contains(logs.String(), "slow query") {
+		t.Fatalf("expected no slow queries under a 1h threshold, got %s", logs.String())
+	}
+	logs.Reset()
+
+	// Every statement is slow against a 1ns threshold.
+	instrumentation.slowThreshold = time.Nanosecond
+	ctx, parent := tracer.Start(context.Background(), "GET /notes")
+	rows, err := db.QueryContext(ctx, "SELECT id, title FROM notes WHERE id > $1 AND title != 'private'", 0)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	parent.End()
+
+	var record map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(logs.Bytes()), &record); err != nil {
+		t.Fatalf("decode slow query log %q: %v", logs.String(), err)
+	}
+	if record["msg"] != "slow query" || record["level"] != "WARN" {
+		t.Fatalf("unexpected log record %v", record)
+	}
+	if record["db.query.text"] != "SELECT id, title FROM notes WHERE id > $1 AND title != ?" ||
+		record["db.collection.name"] != "notes" ||
+		record["db.operation.name"] != "SELECT" ||
+		record["db.query.args"] != float64(1) ||
+		record["db.response.returned_rows"] != float64(0) {
+		t.Fatalf("unexpected slow query fields %v", record)
+	}
+	if _, ok := record["duration_ms"].(float64); !ok {
+		t.Fatalf("expected duration_ms in %v", record)
+	}
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	for _, scope := range collected.ScopeMetrics {
+		for _, metric := range scope.Metrics {
+			if metric.Name != "database.sql.slow_queries" {
+				continue
+			}
+			points := metric.Data.(metricdata.Sum[int64]).DataPoints
+			if len(points) != 1 || points[0].Value != 1 {
+				t.Fatalf("expected one slow SELECT notes, got %+v", points)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected database.sql.slow_queries to be recorded")
+}
+
+func TestSanitizeQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT id FROM notes WHERE id = $1":                           "SELECT id FROM notes WHERE id = $1",
+		"INSERT INTO notes VALUES (1, 'it''s private', 2.5)":           "INSERT INTO notes VALUES (?, ?, ?)",
+		"SELECT CAST(created_unix - created_unix % 60 AS TEXT)\n\t  x": "SELECT CAST(created_unix - created_unix % ? AS TEXT) x",
+		"SELECT col2 FROM t1 LIMIT 10":                                 "SELECT col2 FROM t1 LIMIT ?",
+	}
+	for query, want := range cases {
+		if got := sanitizeQuery(query); got != want {
+			t.Fatalf("sanitizeQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+
+	for query, want := range map[string][2]string{
+		"CREATE TABLE IF NOT EXISTS notes (id INTEGER)":  {"CREATE", "notes"},
+		"update notes SET title = $1":                    {"UPDATE", "notes"},
+		"SELECT COALESCE(MAX(id), 0) + 1 FROM events":    {"SELECT", "events"},
+		"INSERT INTO events (id) VALUES ($1)":            {"INSERT", "events"},
+		"DELETE FROM webhook_dead_letters WHERE id = $1": {"DELETE", "webhook_dead_letters"},
+	} {
+		operation, collection := queryOperation(query)
+		if operation != want[0] || collection != want[1] {
+			t.Fatalf("queryOperation(%q) = %q, %q, want %q, %q", query, operation, collection, want[0], want[1])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// Dimensions GET /events/stats can group by, mapped to the SQL expression
+// that produces each group key.
+var eventStatsDimensions = map[string]string{
+	"source":       "source",
+	"route":        "route",
+	"method":       "method",
+	"status_class": "CAST(status / 100 AS TEXT)",
+}
+
+const (
+	defaultStatsWindow = time.Hour
+	defaultStatsBucket = time.Minute
+	maxStatsWindow     = 7 * 24 * time.Hour
+	maxStatsBuckets    = 1440
+
+	// statsKeySeparator joins dimension values into the single GROUP BY
+	// expression chai supports. It is a control character that never
+	// appears in sources, routes or methods.
+	statsKeySeparator = "\x1f"
+)
+
+type eventStatsQuery struct {
+	Tenant  string
+	Window  time.Duration
+	Bucket  time.Duration
+	GroupBy []string
+	Now     time.Time
+}
+
+type eventStatsPoint struct {
+	BucketStart string            `json:"bucketStart"`
+	Group       map[string]string `json:"group,omitempty"`
+	Count       int               `json:"count"`
+	Errors      int               `json:"errors"`
+}
+
+type routeErrorRatio struct {
+	Route      string  `json:"route"`
+	Count      int     `json:"count"`
+	Errors     int     `json:"errors"`
+	ErrorRatio float64 `json:"errorRatio"`
+}
+
+type eventStats struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Window  string            `json:"window"`
+	Bucket  string            `json:"bucket"`
+	GroupBy []string          `json:"groupBy"`
+	Total   int               `json:"total"`
+	Errors  int               `json:"errors"`
+	Series  []eventStatsPoint `json:"series"`
+	Routes  []routeErrorRatio `json:"routes"`
+}
+
+func (application *app) handleEventStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query, err := parseEventStatsQuery(request)
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := application.events.EventStats(request.Context(), query)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to compute event stats")
+		return
+	}
+
+	problem.WriteJSON(response, http.StatusOK, stats)
+}
+
+// parseEventStatsQuery reads ?window=, ?bucket= (Go durations) and
+// ?group_by= (comma-separated dimensions) from the request.
+func parseEventStatsQuery(request *http.Request) (eventStatsQuery, error) {
+	values := request.URL.Query()
+	query := eventStatsQuery{
+		Tenant: tenant.FromContext(request.Context()),
+		Window: defaultStatsWindow,
+		Bucket: defaultStatsBucket,
+		Now:    time.Now().UTC(),
+	}
+
+	if raw := values.Get("window"); raw != "" {
+		window, err := time.ParseDuration(raw)
+		if err != nil || window < time.Second || window > maxStatsWindow {
+			return query, fmt.Errorf("window must be a duration between 1s and %s", maxStatsWindow)
+		}
+		query.Window = window
+	}
+
+	if raw := values.Get("bucket"); raw != "" {
+		bucket, err := time.ParseDuration(raw)
+		if err != nil || bucket < time.Second || bucket%time.Second != 0 {
+			return query, fmt.Errorf("bucket must be a whole number of seconds, at least 1s")
+		}
+		query.Bucket = bucket
+	}
+	if query.Window/query.Bucket > maxStatsBuckets {
+		return query, fmt.Errorf("window/bucket must not exceed %d buckets", maxStatsBuckets)
+	}
+
+	if raw := values.Get("group_by"); raw != "" {
+		for _, dimension := range strings.Split(raw, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if _, ok := eventStatsDimensions[dimension]; !ok {
+				return query, fmt.Errorf("group_by must be a list of source, route, method, status_class")
+			}
+			if !slices.Contains(query.GroupBy, dimension) {
+				query.GroupBy = append(query.GroupBy, dimension)
+			}
+		}
+	}
+
+	return query, nil
+}
+
+// newEventStats returns the empty result for query, covering the events
+// created at or after the returned from time.
+func newEventStats(query eventStatsQuery) (eventStats, time.Time) {
+	from := query.Now.Add(-query.Window)
+	stats := eventStats{
+		From:    from.Format(time.RFC3339),
+		To:      query.Now.Format(time.RFC3339),
+		Window:  query.Window.String(),
+		Bucket:  query.Bucket.String(),
+		GroupBy: query.GroupBy,
+		Series:  []eventStatsPoint{},
+		Routes:  []routeErrorRatio{},
+	}
+	if stats.GroupBy == nil {
+		stats.GroupBy = []string{}
+	}
+	return stats, from
+}
+
+// queryEventStats aggregates the tenant's events in SQL: counts per time
+// bucket and group, plus the per-route error ratio. An event counts as an error when its
+// status is 400 or above.
+func queryEventStats(ctx context.Context, db *sql.DB, query eventStatsQuery) (eventStats, error) {
+	stats, from := newEventStats(query)
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return stats, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// chai fails GROUP BY over an empty input, so count first and skip the
+	// grouped queries when the window holds no events.
+	var errorCount sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		"SELECT COUNT(*), SUM(CAST(status >= 400 AS INTEGER)) FROM events WHERE tenant = $1 AND created_unix >= $2",
+		query.Tenant, from.Unix(),
+	).Scan(&stats.Total, &errorCount)
+	if err != nil {
+		return stats, err
+	}
+	stats.Errors = int(errorCount.Int64)
+	if stats.Total == 0 {
+		return stats, nil
+	}
+
+	bucketSeconds := int64(query.Bucket / time.Second)
+	keyParts := []string{fmt.Sprintf("CAST(created_unix - created_unix %% %d AS TEXT)", bucketSeconds)}
+	for _, dimension := range query.GroupBy {
+		keyParts = append(keyParts, eventStatsDimensions[dimension])
+	}
+	keyExpression := strings.Join(keyParts, " || '"+statsKeySeparator+"' || ")
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+keyExpression+", COUNT(*), SUM(CAST(status >= 400 AS INTEGER)) FROM events WHERE tenant = $1 AND created_unix >= $2 GROUP BY "+keyExpression,
+		query.Tenant, from.Unix(),
+	)
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var key string
+		var point eventStatsPoint
+		err = rows.Scan(&key, &point.Count, &point.Errors)
+		if err != nil {
+			rows.Close()
+			return stats, err
+		}
+
+		parts := strings.Split(key, statsKeySeparator)
+		bucketStart, parseErr := strconv.ParseInt(parts[0], 10, 64)
+		if parseErr != nil || len(parts) != len(query.GroupBy)+1 {
+			rows.Close()
+			return stats, fmt.Errorf("unexpected stats key %q", key)
+		}
+		point.BucketStart = time.Unix(bucketStart, 0).UTC().Format(time.RFC3339)
+		point.Group = eventStatsGroup(parts[1:], query.GroupBy)
+		stats.Series = append(stats.Series, point)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	rows, err = tx.QueryContext(ctx,
+		"SELECT route, COUNT(*), SUM(CAST(status >= 400 AS INTEGER)) FROM events WHERE tenant = $1 AND created_unix >= $2 GROUP BY route",
+		query.Tenant, from.Unix(),
+	)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ratio routeErrorRatio
+		err = rows.Scan(&ratio.Route, &ratio.Count, &ratio.Errors)
+		if err != nil {
+			return stats, err
+		}
+		ratio.ErrorRatio = float64(ratio.Errors) / float64(ratio.Count)
+		stats.Routes = append(stats.Routes, ratio)
+	}
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	// chai cannot ORDER BY aggregates or composite keys, so sort here.
+	sortEventStats(&stats)
+	return stats, nil
+}
+
+// sortEventStats orders series by bucket then group, and routes by name.
+func sortEventStats(stats *eventStats) {
+	slices.SortFunc(stats.Series, func(left, right eventStatsPoint) int {
+		if order := strings.Compare(left.BucketStart, right.BucketStart); order != 0 {
+			return order
+		}
+		return strings.Compare(groupSortKey(left.Group, stats.GroupBy), groupSortKey(right.Group, stats.GroupBy))
+	})
+	slices.SortFunc(stats.Routes, func(left, right routeErrorRatio) int {
+		return strings.Compare(left.Route, right.Route)
+	})
+}
+
+func groupSortKey(group map[string]string, dimensions []string) string {
+	values := make([]string, len(dimensions))
+	for index, dimension := range dimensions {
+		values[index] = group[dimension]
+	}
+	return strings.Join(values, statsKeySeparator)
+}
+
+// eventDimensionValue returns the group key of row for dimension, matching
+// what the eventStatsDimensions SQL expressions produce.
+func eventDimensionValue(row event, dimension string) string {
+	switch dimension {
+	case "source":
+		return row.Source
+	case "route":
+		return row.Route
+	case "method":
+		return row.Method
+	case "status_class":
+		return strconv.Itoa(row.Status / 100)
+	}
+	return ""
+}
+
+// eventStatsGroup maps each dimension to its group key value, rendering
+// status classes as "2xx", "4xx" and so on. It returns nil without
+// dimensions so the group is omitted from the JSON.
+func eventStatsGroup(values []string, dimensions []string) map[string]string {
+	if len(dimensions) == 0 {
+		return nil
+	}
+	group := make(map[string]string, len(dimensions))
+	for index, dimension := range dimensions {
+		value := values[index]
+		if dimension == "status_class" {
+			value += "xx"
+		}
+		group[dimension] = value
+	}
+	return group
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+func seedStatsEvents(t *testing.T, db *sql.DB, now time.Time) {
+	t.Helper()
+	seed := []struct {
+		source string
+		method string
+		route  string
+		status int
+		age    time.Duration
+	}{
+		{"backend", "GET", "/api/ok", 200, 30 * time.Second},
+		{"backend", "GET", "/api/ok", 200, 50 * time.Second},
+		{"backend", "GET", "/api/error", 404, 40 * time.Second},
+		{"notifier", "POST", "/notify", 200, 90 * time.Second},
+		{"backend", "GET", "/api/error", 500, 100 * time.Second},
+		// Outside a 5 minute window.
+		{"backend", "GET", "/api/ok", 200, 2 * time.Hour},
+	}
+	for index, row := range seed {
+		createdAt := now.Add(-row.age)
+		_, err := db.Exec(
+			"INSERT INTO events (id, source, method, route, status, message, created_at, created_unix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			index+1, row.source, row.method, row.route, row.status, "seeded", createdAt.Format(time.RFC3339), createdAt.Unix(),
+		)
+		if err != nil {
+			t.Fatalf("seed event %d: %v", index+1, err)
+		}
+	}
+}
+
+func TestQueryEventStatsGroupsByBucketAndDimension(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	seedStatsEvents(t, db, now)
+
+	stats, err := queryEventStats(context.Background(), db, eventStatsQuery{
+		Tenant:  tenant.Default,
+		Window:  5 * time.Minute,
+		Bucket:  time.Minute,
+		GroupBy: []string{"source", "status_class"},
+		Now:     now,
+	})
+	if err != nil {
+		t.Fatalf("query stats: %v", err)
+	}
+
+	if stats.Total != 5 || stats.Errors != 2 {
+		t.Fatalf("expected 5 events with 2 errors, got %d/%d", stats.Total, stats.Errors)
+	}
+
+	type key struct{ bucket, source, class string }
+	got := map[key]eventStatsPoint{}
+	for _, point := range stats.Series {
+		got[key{point.BucketStart, point.Group["source"], point.Group["status_class"]}] = point
+	}
+	want := map[key]int{
+		{"2026-03-01T11:59:00Z", "backend", "2xx"}:  2,
+		{"2026-03-01T11:59:00Z", "backend", "4xx"}:  1,
+		{"2026-03-01T11:58:00Z", "notifier", "2xx"}: 1,
+		{"2026-03-01T11:58:00Z", "backend", "5xx"}:  1,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d series points, got %+v", len(want), stats.Series)
+	}
+	for wantedKey, count := range want {
+		if got[wantedKey].Count != count {
+			t.Fatalf("point %+v: expected count %d, got %+v", wantedKey, count, got[wantedKey])
+		}
+	}
+	if stats.Series[0].BucketStart != "2026-03-01T11:58:00Z" {
+		t.Fatalf("expected series sorted by bucket, got %+v", stats.Series)
+	}
+
+	ratios := map[string]routeErrorRatio{}
+	for _, ratio := range stats.Routes {
+		ratios[ratio.Route] = ratio
+	}
+	if ratio := ratios["/api/error"]; ratio.Count != 2 || ratio.ErrorRatio != 1 {
+		t.Fatalf("unexpected /api/error ratio %+v", ratio)
+	}
+	if ratio := ratios["/api/ok"]; ratio.Count != 2 || ratio.ErrorRatio != 0 {
+		t.Fatalf("unexpected /api/ok ratio %+v", ratio)
+	}
+}
+
+func TestQueryEventStatsEmptyWindow(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	seedStatsEvents(t, db, now.Add(-24*time.Hour))
+
+	stats, err := queryEventStats(context.Background(), db, eventStatsQuery{
+		Tenant:  tenant.Default,
+		Window:  time.Minute,
+		Bucket:  time.Minute,
+		GroupBy: []string{"route"},
+		Now:     now,
+	})
+	if err != nil {
+		t.Fatalf("query stats: %v", err)
+	}
+	if stats.Total != 0 || len(stats.Series) != 0 || len(stats.Routes) != 0 {
+		t.Fatalf("expected empty stats, got %+v", stats)
+	}
+}
+
+func TestHandleEventStatsRejectsUnknownDimension(t *testing.T) {
+	application := &app{db: newTestDB(t)}
+
+	for _, target := range []string{
+		"/events/stats?group_by=message",
+		"/events/stats?bucket=500ms",
+		"/events/stats?window=168h&bucket=1s",
+	} {
+		recorder := httptest.NewRecorder()
+		application.handleEventStats(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", target, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errNotFound is returned by stores when the requested row does not exist.
+var errNotFound = errors.New("not found")
+
+// eventFilter narrows ListEvents to one tenant. A zero TraceID matches every
+// event of the tenant.
+type eventFilter struct {
+	Tenant  string
+	Limit   int
+	TraceID string
+}
+
+// EventStore persists the event log. Implementations allocate ids and return
+// events newest first. Every read and delete is scoped to one tenant: rows of
+// other tenants behave as if they did not exist.
+type EventStore interface {
+	ListEvents(ctx context.Context, filter eventFilter) ([]event, error)
+	GetEvent(ctx context.Context, tenantID string, id int) (event, error)
+	// CreateEvents stores rows atomically, assigning consecutive ids, and
+	// returns them with ID set. Each row carries its own Tenant.
+	CreateEvents(ctx context.Context, rows []event) ([]event, error)
+	// DeleteEvent reports whether the tenant had an event with id.
+	DeleteEvent(ctx context.Context, tenantID string, id int) (bool, error)
+	EventStats(ctx context.Context, query eventStatsQuery) (eventStats, error)
+}
+
+// NoteStore persists notes. Implementations allocate ids and return notes
+// newest first, scoped to one tenant like EventStore.
+//
+// Every mutation appends an audit entry in the same transaction, so a
+// mutation and its audit entry are stored together or not at all. Callers
+// pass the entry with Actor, TraceID and CreatedAt set; the store fills in
+// the rest.
+type NoteStore interface {
+	ListNotes(ctx context.Context, tenantID string) ([]note, error)
+	GetNote(ctx context.Context, tenantID string, id int) (note, error)
+	CreateNote(ctx context.Context, row note, audit auditEntry) (note, error)
+	// UpdateNote replaces title, content and updated_at, returning
+	// errNotFound when the row's tenant has no note with its id.
+	UpdateNote(ctx context.Context, row note, audit auditEntry) (note, error)
+	// DeleteNote reports whether the note existed. It is a no-op, and
+	// records nothing, when it did not.
+	DeleteNote(ctx context.Context, tenantID string, id int, audit auditEntry) (bool, error)
+}
+
+// auditFilter narrows ListAudit to one tenant. Zero fields match every
+// entry; Since and Until are inclusive unix seconds.
+type auditFilter struct {
+	Tenant string
+	NoteID int
+	Actor  string
+	Action string
+	Since  int64
+	Until  int64
+	Limit  int
+}
+
+// AuditStore reads the audit log written by NoteStore, newest first.
+type AuditStore interface {
+	ListAudit(ctx context.Context, filter auditFilter) ([]auditEntry, error)
+}
+
+// idempotencyRecord is the stored response to a POST made with an
+// Idempotency-Key. Keys are scoped to a tenant and route.
+type idempotencyRecord struct {
+	Tenant      string
+	Route       string
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedUnix int64
+}
+
+// idempotencyScope identifies the record of one key.
+type idempotencyScope struct {
+	tenant string
+	route  string
+	key    string
+}
+
+// IdempotencyStore keeps the responses of keyed requests so repeats can be
+// replayed. Expiry is the caller's concern: GetIdempotencyRecord may return
+// records older than the replay window.
+type IdempotencyStore interface {
+	// GetIdempotencyRecord returns errNotFound when nothing is stored for
+	// the key.
+	GetIdempotencyRecord(ctx context.Context, tenantID string, route string, key string) (idempotencyRecord, error)
+	// SaveIdempotencyRecord stores row, replacing any record for its key,
+	// and deletes every record created before expiredBefore.
+	SaveIdempotencyRecord(ctx context.Context, row idempotencyRecord, expiredBefore int64) error
+}
+
+// Storage drivers selectable with DATABASE_DRIVER.
+const (
+	storageDriverChai   = "chai"
+	storageDriverMemory = "memory"
+)
+
+// eventCreatedUnix returns the unix time of an event's RFC 3339 created_at,
+// or 0 when it cannot be parsed.
+func eventCreatedUnix(row event) int64 {
+	parsed, err := time.Parse(time.RFC3339, row.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return parsed.Unix()
+}
+
+func unknownStorageDriver(name string) error {
+	return fmt.Errorf("unknown DATABASE_DRIVER %q: use %s or %s", name, storageDriverChai, storageDriverMemory)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// chaiStore is the EventStore and NoteStore backed by the embedded chai
+// database. Ids are allocated with MAX(id)+1 inside the inserting
+// transaction.
+type chaiStore struct {
+	db *sql.DB
+}
+
+func newChaiStore(db *sql.DB) *chaiStore {
+	return &chaiStore{db: db}
+}
+
+// insertEventSQL writes one event row; arguments follow the column order.
+const insertEventSQL = "INSERT INTO events (id, source, method, route, status, message, created_at, trace_id, span_id, tenant, created_unix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+
+// eventColumns is the column list every events query selects, in the order
+// the event struct fields are scanned.
+const eventColumns = "id, source, method, route, status, message, created_at, trace_id, span_id, tenant"
+
+// noteColumns is the column list every notes query selects, in the order
+// the note struct fields are scanned.
+const noteColumns = "id, title, content, created_at, updated_at, tenant"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEvent(scanner rowScanner) (event, error) {
+	var row event
+	err := scanner.Scan(&row.ID, &row.Source, &row.Method, &row.Route, &row.Status, &row.Message, &row.CreatedAt, &row.TraceID, &row.SpanID, &row.Tenant)
+	return row, err
+}
+
+func scanNote(scanner rowScanner) (note, error) {
+	var row note
+	err := scanner.Scan(&row.ID, &row.Title, &row.Content, &row.CreatedAt, &row.UpdatedAt, &row.Tenant)
+	return row, err
+}
+
+func (store *chaiStore) ListEvents(ctx context.Context, filter eventFilter) ([]event, error) {
+	query := "SELECT " + eventColumns + " FROM events WHERE tenant = $1 ORDER BY id DESC LIMIT $2"
+	args := []any{filter.Tenant, filter.Limit}
+	if filter.TraceID != "" {
+		query = "SELECT " + eventColumns + " FROM events WHERE tenant = $1 AND trace_id = $3 ORDER BY id DESC LIMIT $2"
+		args = append(args, filter.TraceID)
+	}
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []event
+	for rows.Next() {
+		row, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, row)
+	}
+	return events, rows.Err()
+}
+
+func (store *chaiStore) GetEvent(ctx context.Context, tenantID string, id int) (event, error) {
+	row, err := scanEvent(store.db.QueryRowContext(ctx, "SELECT "+eventColumns+" FROM events WHERE id = $1 AND tenant = $2", id, tenantID))
+	if err == sql.ErrNoRows {
+		return row, errNotFound
+	}
+	return row, err
+}
+
+func (store *chaiStore) CreateEvents(ctx context.Context, rows []event) ([]event, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var nextID int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM events").Scan(&nextID)
+	if err != nil {
+		return nil, err
+	}
+
+	created := make([]event, 0, len(rows))
+	for _, row := range rows {
+		row.ID = nextID
+		_, err = tx.ExecContext(ctx, insertEventSQL,
+			row.ID, row.Source, row.Method, row.Route, row.Status, row.Message,
+			row.CreatedAt, row.TraceID, row.SpanID, row.Tenant, eventCreatedUnix(row),
+		)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, row)
+		nextID++
+	}
+
+	return created, tx.Commit()
+}
+
+// DeleteEvent looks the row up before deleting it, since chai does not
+// report rows affected.
+func (store *chaiStore) DeleteEvent(ctx context.Context, tenantID string, id int) (bool, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var found int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM events WHERE id = $1 AND tenant = $2", id, tenantID).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM events WHERE id = $1 AND tenant = $2", id, tenantID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (store *chaiStore) EventStats(ctx context.Context, query eventStatsQuery) (eventStats, error) {
+	return queryEventStats(ctx, store.db, query)
+}
+
+func (store *chaiStore) ListNotes(ctx context.Context, tenantID string) ([]note, error) {
+	rows, err := store.db.QueryContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE tenant = $1 ORDER BY id DESC", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []note
+	for rows.Next() {
+		row, err := scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, row)
+	}
+	return notes, rows.Err()
+}
+
+func (store *chaiStore) GetNote(ctx context.Context, tenantID string, id int) (note, error) {
+	row, err := scanNote(store.db.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1 AND tenant = $2", id, tenantID))
+	if err == sql.ErrNoRows {
+		return row, errNotFound
+	}
+	return row, err
+}
+
+func (store *chaiStore) CreateNote(ctx context.Context, row note, audit auditEntry) (note, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return row, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM notes").Scan(&row.ID)
+	if err != nil {
+		return row, err
+	}
+
+	err = insertAuditEntry(ctx, tx, audit.forNote(auditActionCreated, row.Tenant, row.ID, nil, &row))
+	if err != nil {
+		return row, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO notes ("+noteColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		row.ID, row.Title, row.Content, row.CreatedAt, row.UpdatedAt, row.Tenant,
+	)
+	if err != nil {
+		return row, err
+	}
+	return row, tx.Commit()
+}
+
+func (store *chaiStore) UpdateNote(ctx context.Context, row note, audit auditEntry) (note, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return row, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	before, err := scanNote(tx.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1 AND tenant = $2", row.ID, row.Tenant))
+	if err == sql.ErrNoRows {
+		return row, errNotFound
+	}
+	if err != nil {
+		return row, err
+	}
+	row.CreatedAt = before.CreatedAt
+
+	err = insertAuditEntry(ctx, tx, audit.forNote(auditActionUpdated, row.Tenant, row.ID, &before, &row))
+	if err != nil {
+		return row, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE notes SET title = $1, content = $2, updated_at = $3 WHERE id = $4 AND tenant = $5",
+		row.Title, row.Content, row.UpdatedAt, row.ID, row.Tenant,
+	)
+	if err != nil {
+		return row, err
+	}
+	return row, tx.Commit()
+}
+
+func (store *chaiStore) DeleteNote(ctx context.Context, tenantID string, id int, audit auditEntry) (bool, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	before, err := scanNote(tx.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1 AND tenant = $2", id, tenantID))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = insertAuditEntry(ctx, tx, audit.forNote(auditActionDeleted, tenantID, id, &before, nil))
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM notes WHERE id = $1 AND tenant = $2", id, tenantID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// auditColumns is the column list every audit_log query selects, in the
+// order the auditEntry fields are scanned.
+const auditColumns = "id, note_id, action, actor, before_hash, after_hash, trace_id, created_at, tenant"
+
+// insertAuditEntry appends entry to audit_log inside tx, ahead of the
+// mutation it describes, so a failed mutation rolls it back.
+func insertAuditEntry(ctx context.Context, tx *sql.Tx, entry auditEntry) error {
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM audit_log").Scan(&entry.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO audit_log ("+auditColumns+", created_unix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		entry.ID, entry.NoteID, entry.Action, entry.Actor, entry.BeforeHash, entry.AfterHash,
+		entry.TraceID, entry.CreatedAt, entry.Tenant, auditCreatedUnix(entry),
+	)
+	return err
+}
+
+func (store *chaiStore) ListAudit(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	conditions := []string{"tenant = $1"}
+	args := []any{filter.Tenant}
+	addCondition := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.NoteID != 0 {
+		addCondition("note_id = $%d", filter.NoteID)
+	}
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+	if filter.Since != 0 {
+		addCondition("created_unix >= $%d", filter.Since)
+	}
+	if filter.Until != 0 {
+		addCondition("created_unix <= $%d", filter.Until)
+	}
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf("SELECT %s FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d",
+		auditColumns, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var entry auditEntry
+		err = rows.Scan(&entry.ID, &entry.NoteID, &entry.Action, &entry.Actor, &entry.BeforeHash, &entry.AfterHash, &entry.TraceID, &entry.CreatedAt, &entry.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (store *chaiStore) GetIdempotencyRecord(ctx context.Context, tenantID string, route string, key string) (idempotencyRecord, error) {
+	row := idempotencyRecord{Tenant: tenantID, Route: route, Key: key}
+	var body string
+	err := store.db.QueryRowContext(ctx,
+		"SELECT request_hash, status, content_type, body, created_unix FROM idempotency_keys WHERE tenant = $1 AND route = $2 AND idempotency_key = $3",
+		tenantID, route, key,
+	).Scan(&row.RequestHash, &row.Status, &row.ContentType, &body, &row.CreatedUnix)
+	if err == sql.ErrNoRows {
+		return row, errNotFound
+	}
+	row.Body = []byte(body)
+	return row, err
+}
+
+func (store *chaiStore) SaveIdempotencyRecord(ctx context.Context, row idempotencyRecord, expiredBefore int64) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_unix < $1", expiredBefore)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE tenant = $1 AND route = $2 AND idempotency_key = $3",
+		row.Tenant, row.Route, row.Key,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (tenant, route, idempotency_key, request_hash, status, content_type, body, created_unix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		row.Tenant, row.Route, row.Key, row.RequestHash, row.Status, row.ContentType, string(row.Body), row.CreatedUnix,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
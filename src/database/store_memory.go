@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a pure-Go EventStore and NoteStore for tests and demos.
+// Nothing survives a restart. Rows are kept in id order.
+type memoryStore struct {
+	mu          sync.RWMutex
+	events      []event
+	notes       []note
+	audit       []auditEntry
+	idempotency map[idempotencyScope]idempotencyRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{idempotency: map[idempotencyScope]idempotencyRecord{}}
+}
+
+// nextID mirrors the chai store's MAX(id)+1 allocation.
+func nextID[T any](rows []T, id func(T) int) int {
+	if len(rows) == 0 {
+		return 1
+	}
+	return id(rows[len(rows)-1]) + 1
+}
+
+func (store *memoryStore) ListEvents(_ context.Context, filter eventFilter) ([]event, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var events []event
+	for index := len(store.events) - 1; index >= 0 && len(events) < filter.Limit; index-- {
+		row := store.events[index]
+		if row.Tenant != filter.Tenant || (filter.TraceID != "" && row.TraceID != filter.TraceID) {
+			continue
+		}
+		events = append(events, row)
+	}
+	return events, nil
+}
+
+func (store *memoryStore) GetEvent(_ context.Context, tenantID string, id int) (event, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	index, found := slices.BinarySearchFunc(store.events, id, func(row event, id int) int { return row.ID - id })
+	if !found || store.events[index].Tenant != tenantID {
+		return event{}, errNotFound
+	}
+	return store.events[index], nil
+}
+
+func (store *memoryStore) CreateEvents(_ context.Context, rows []event) ([]event, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	id := nextID(store.events, func(row event) int { return row.ID })
+	created := make([]event, 0, len(rows))
+	for _, row := range rows {
+		row.ID = id
+		created = append(created, row)
+		id++
+	}
+	store.events = append(store.events, created...)
+	return created, nil
+}
+
+func (store *memoryStore) DeleteEvent(_ context.Context, tenantID string, id int) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	before := len(store.events)
+	store.events = slices.DeleteFunc(store.events, func(row event) bool { return row.ID == id && row.Tenant == tenantID })
+	return len(store.events) < before, nil
+}
+
+// EventStats computes the same aggregation as queryEventStats by scanning
+// every event in the window.
+func (store *memoryStore) EventStats(_ context.Context, query eventStatsQuery) (eventStats, error) {
+	stats, from := newEventStats(query)
+	bucketSeconds := int64(query.Bucket / time.Second)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	points := map[string]*eventStatsPoint{}
+	routes := map[string]*routeErrorRatio{}
+	for _, row := range store.events {
+		createdUnix := eventCreatedUnix(row)
+		if row.Tenant != query.Tenant || createdUnix < from.Unix() {
+			continue
+		}
+		isError := 0
+		if row.Status >= 400 {
+			isError = 1
+		}
+		stats.Total++
+		stats.Errors += isError
+
+		bucketStart := createdUnix - createdUnix%bucketSeconds
+		keyParts := []string{strconv.FormatInt(bucketStart, 10)}
+		for _, dimension := range query.GroupBy {
+			keyParts = append(keyParts, eventDimensionValue(row, dimension))
+		}
+		key := strings.Join(keyParts, statsKeySeparator)
+		point, ok := points[key]
+		if !ok {
+			point = &eventStatsPoint{
+				BucketStart: time.Unix(bucketStart, 0).UTC().Format(time.RFC3339),
+				Group:       eventStatsGroup(keyParts[1:], query.GroupBy),
+			}
+			points[key] = point
+		}
+		point.Count++
+		point.Errors += isError
+
+		ratio, ok := routes[row.Route]
+		if !ok {
+			ratio = &routeErrorRatio{Route: row.Route}
+			routes[row.Route] = ratio
+		}
+		ratio.Count++
+		ratio.Errors += isError
+	}
+
+	for _, point := range points {
+		stats.Series = append(stats.Series, *point)
+	}
+	for _, ratio := range routes {
+		ratio.ErrorRatio = float64(ratio.Errors) / float64(ratio.Count)
+		stats.Routes = append(stats.Routes, *ratio)
+	}
+	sortEventStats(&stats)
+	return stats, nil
+}
+
+func (store *memoryStore) ListNotes(_ context.Context, tenantID string) ([]note, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var notes []note
+	for index := len(store.notes) - 1; index >= 0; index-- {
+		if store.notes[index].Tenant == tenantID {
+			notes = append(notes, store.notes[index])
+		}
+	}
+	return notes, nil
+}
+
+func (store *memoryStore) GetNote(_ context.Context, tenantID string, id int) (note, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	index, found := store.findNote(tenantID, id)
+	if !found {
+		return note{}, errNotFound
+	}
+	return store.notes[index], nil
+}
+
+func (store *memoryStore) CreateNote(_ context.Context, row note, audit auditEntry) (note, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row.ID = nextID(store.notes, func(row note) int { return row.ID })
+	store.notes = append(store.notes, row)
+	store.appendAudit(audit.forNote(auditActionCreated, row.Tenant, row.ID, nil, &row))
+	return row, nil
+}
+
+func (store *memoryStore) UpdateNote(_ context.Context, row note, audit auditEntry) (note, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index, found := store.findNote(row.Tenant, row.ID)
+	if !found {
+		return row, errNotFound
+	}
+	before := store.notes[index]
+	row.CreatedAt = before.CreatedAt
+	store.notes[index] = row
+	store.appendAudit(audit.forNote(auditActionUpdated, row.Tenant, row.ID, &before, &row))
+	return row, nil
+}
+
+func (store *memoryStore) DeleteNote(_ context.Context, tenantID string, id int, audit auditEntry) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index, found := store.findNote(tenantID, id)
+	if !found {
+		return false, nil
+	}
+	before := store.notes[index]
+	store.notes = slices.Delete(store.notes, index, index+1)
+	store.appendAudit(audit.forNote(auditActionDeleted, tenantID, id, &before, nil))
+	return true, nil
+}
+
+// appendAudit stores entry under the lock held by the mutation it describes.
+func (store *memoryStore) appendAudit(entry auditEntry) {
+	entry.ID = nextID(store.audit, func(row auditEntry) int { return row.ID })
+	store.audit = append(store.audit, entry)
+}
+
+func (store *memoryStore) ListAudit(_ context.Context, filter auditFilter) ([]auditEntry, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var entries []auditEntry
+	for index := len(store.audit) - 1; index >= 0 && len(entries) < filter.Limit; index-- {
+		entry := store.audit[index]
+		createdUnix := auditCreatedUnix(entry)
+		switch {
+		case entry.Tenant != filter.Tenant,
+			filter.NoteID != 0 && entry.NoteID != filter.NoteID,
+			filter.Actor != "" && entry.Actor != filter.Actor,
+			filter.Action != "" && entry.Action != filter.Action,
+			filter.Since != 0 && createdUnix < filter.Since,
+			filter.Until != 0 && createdUnix > filter.Until:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// findNote returns the index of the tenant's note with id.
+func (store *memoryStore) findNote(tenantID string, id int) (int, bool) {
+	index, found := slices.BinarySearchFunc(store.notes, id, func(row note, id int) int { return row.ID - id })
+	return index, found && store.notes[index].Tenant == tenantID
+}
+
+func (store *memoryStore) GetIdempotencyRecord(_ context.Context, tenantID string, route string, key string) (idempotencyRecord, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	row, found := store.idempotency[idempotencyScope{tenantID, route, key}]
+	if !found {
+		return row, errNotFound
+	}
+	return row, nil
+}
+
+func (store *memoryStore) SaveIdempotencyRecord(_ context.Context, row idempotencyRecord, expiredBefore int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	maps.DeleteFunc(store.idempotency, func(_ idempotencyScope, stored idempotencyRecord) bool {
+		return stored.CreatedUnix < expiredBefore
+	})
+	store.idempotency[idempotencyScope{row.Tenant, row.Route, row.Key}] = row
+	return nil
+}
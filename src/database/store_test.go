@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// conformanceStore is what each storage driver provides to the app.
+type conformanceStore interface {
+	EventStore
+	NoteStore
+	AuditStore
+	IdempotencyStore
+}
+
+// storeFactories lists every storage driver the conformance suite runs
+// against. Each factory returns a fresh, empty store.
+var storeFactories = map[string]func(t *testing.T) conformanceStore{
+	storageDriverChai:   func(t *testing.T) conformanceStore { return newChaiStore(newTestDB(t)) },
+	storageDriverMemory: func(*testing.T) conformanceStore { return newMemoryStore() },
+}
+
+// newStoreTestApp wires an app to one store with no-op instruments. db stays
+// nil, as with DATABASE_DRIVER=memory, so SQL-only handlers are not reached.
+func newStoreTestApp(t *testing.T, driver string) *app {
+	t.Helper()
+	store := storeFactories[driver](t)
+	meter := noop.NewMeterProvider().Meter("test")
+	eventsCounter, _ := meter.Int64Counter("events")
+	notesCounter, _ := meter.Int64Counter("notes")
+	invalidCounter, _ := meter.Int64Counter("invalid")
+	renderCounter, _ := meter.Int64Counter("render")
+	return &app{
+		events:          store,
+		notes:           store,
+		audit:           store,
+		serviceName:     "database",
+		eventsCreated:   eventsCounter,
+		notesCreated:    notesCounter,
+		invalidRequests: invalidCounter,
+		bulkEvents:      bulkEventsConfig{BatchSize: 2, MaxBytes: 1 << 20},
+		idempotency:     newIdempotencyKeys(store, time.Hour),
+		renderer:        newNoteRenderer(tracenoop.NewTracerProvider().Tracer("test"), 16, renderCounter),
+	}
+}
+
+func serveStoreRequest(t *testing.T, handler http.HandlerFunc, method string, target string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return recorder
+}
+
+// serveTenantRequest sends the request as tenantID through tenant.Middleware,
+// the way the proxies forward X-Forwarded-User, with any extra headers.
+func serveTenantRequest(t *testing.T, handler http.HandlerFunc, tenantID string, method string, target string, body string, headers ...http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set(tenant.Header, tenantID)
+	for _, header := range headers {
+		for name, values := range header {
+			for _, value := range values {
+				request.Header.Add(name, value)
+			}
+		}
+	}
+	tenant.Middleware(handler).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decodeStoreResponse[T any](t *testing.T, recorder *httptest.ResponseRecorder, wantStatus int) T {
+	t.Helper()
+	var decoded T
+	if recorder.Code != wantStatus {
+		t.Fatalf("expected %d, got %d: %s", wantStatus, recorder.Code, recorder.Body.String())
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return decoded
+}
+
+func TestStoreConformanceEvents(t *testing.T) {
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+
+			first := decodeStoreResponse[event](t, serveStoreRequest(t, application.handleEvents, http.MethodPost, "/events", `{"source":"backend","route":"/api/ok"}`), http.StatusCreated)
+			second := decodeStoreResponse[event](t, serveStoreRequest(t, application.handleEvents, http.MethodPost, "/events", `{"source":"backend","route":"/api/error","status":500}`), http.StatusCreated)
+			if first.ID != 1 || second.ID != 2 {
+				t.Fatalf("expected ids 1 and 2, got %d and %d", first.ID, second.ID)
+			}
+			if first.Method != "GET" || first.Status != 200 {
+				t.Fatalf("expected defaults applied, got %+v", first)
+			}
+
+			listed := decodeStoreResponse[struct {
+				Count  int     `json:"count"`
+				Events []event `json:"events"`
+			}](t, serveStoreRequest(t, application.handleEvents, http.MethodGet, "/events?limit=1", ""), http.StatusOK)
+			if listed.Count != 1 || listed.Events[0].ID != second.ID {
+				t.Fatalf("expected newest event only, got %+v", listed)
+			}
+
+			fetched := decodeStoreResponse[event](t, serveStoreRequest(t, application.handleEventByID, http.MethodGet, "/events/1", ""), http.StatusOK)
+			if !reflect.DeepEqual(fetched, first) {
+				t.Fatalf("expected %+v, got %+v", first, fetched)
+			}
+
+			recorder := serveStoreRequest(t, application.handleEventByID, http.MethodDelete, "/events/1", "")
+			if recorder.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d", recorder.Code)
+			}
+			recorder = serveStoreRequest(t, application.handleEventByID, http.MethodGet, "/events/1", "")
+			if recorder.Code != http.StatusNotFound {
+				t.Fatalf("expected 404 after delete, got %d", recorder.Code)
+			}
+
+			// Ids keep counting from the highest surviving row.
+			third := decodeStoreResponse[event](t, serveStoreRequest(t, application.handleEvents, http.MethodPost, "/events", `{}`), http.StatusCreated)
+			if third.ID != 3 {
+				t.Fatalf("expected id 3, got %d", third.ID)
+			}
+		})
+	}
+}
+
+func TestStoreConformanceEventTraceFilterAndBulk(t *testing.T) {
+	const wanted = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+			_, err := application.events.CreateEvents(context.Background(), []event{
+				{Source: "backend", Method: "GET", Route: "/a", Status: 200, CreatedAt: "2026-01-01T00:00:00Z", TraceID: wanted, Tenant: tenant.Default},
+				{Source: "backend", Method: "GET", Route: "/b", Status: 200, CreatedAt: "2026-01-01T00:00:01Z", TraceID: "0af7651916cd43dd8448eb211c80319c", Tenant: tenant.Default},
+			})
+			if err != nil {
+				t.Fatalf("create events: %v", err)
+			}
+
+			listed := decodeStoreResponse[struct {
+				Events []event `json:"events"`
+			}](t, serveStoreRequest(t, application.handleEvents, http.MethodGet, "/events?trace_id="+wanted, ""), http.StatusOK)
+			if len(listed.Events) != 1 || listed.Events[0].Route != "/a" {
+				t.Fatalf("expected only the /a event, got %+v", listed.Events)
+			}
+
+			body := strings.Join([]string{
+				`{"source":"seed","route":"/bulk/1"}`,
+				`{"source":"seed","route":"/bulk/2"}`,
+				`{"source":"seed","route":"/bulk/3"}`,
+			}, "\n")
+			bulk := decodeStoreResponse[struct {
+				Created int `json:"created"`
+			}](t, serveStoreRequest(t, application.handleEventsBulk, http.MethodPost, "/events/bulk", body), http.StatusOK)
+			if bulk.Created != 3 {
+				t.Fatalf("expected 3 created, got %d", bulk.Created)
+			}
+
+			all, err := application.events.ListEvents(context.Background(), eventFilter{Tenant: tenant.Default, Limit: 10})
+			if err != nil {
+				t.Fatalf("list events: %v", err)
+			}
+			if len(all) != 5 || all[0].ID != 5 || all[0].Route != "/bulk/3" {
+				t.Fatalf("expected 5 events newest first, got %+v", all)
+			}
+		})
+	}
+}
+
+func TestStoreConformanceEventStats(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	seed := []event{
+		{Source: "backend", Method: "GET", Route: "/api/ok", Status: 200, CreatedAt: now.Add(-30 * time.Second).Format(time.RFC3339), Tenant: tenant.Default},
+		{Source: "backend", Method: "GET", Route: "/api/error", Status: 404, CreatedAt: now.Add(-40 * time.Second).Format(time.RFC3339), Tenant: tenant.Default},
+		{Source: "notifier", Method: "POST", Route: "/notify", Status: 200, CreatedAt: now.Add(-90 * time.Second).Format(time.RFC3339), Tenant: tenant.Default},
+		{Source: "backend", Method: "GET", Route: "/api/error", Status: 500, CreatedAt: now.Add(-100 * time.Second).Format(time.RFC3339), Tenant: tenant.Default},
+		{Source: "backend", Method: "GET", Route: "/api/ok", Status: 200, CreatedAt: now.Add(-2 * time.Hour).Format(time.RFC3339), Tenant: tenant.Default},
+		// Another tenant's event inside the window.
+		{Source: "backend", Method: "GET", Route: "/api/other", Status: 500, CreatedAt: now.Add(-10 * time.Second).Format(time.RFC3339), Tenant: "user2"},
+	}
+	query := eventStatsQuery{
+		Tenant:  tenant.Default,
+		Window:  5 * time.Minute,
+		Bucket:  time.Minute,
+		GroupBy: []string{"source", "status_class"},
+		Now:     now,
+	}
+
+	results := map[string]eventStats{}
+	for driver, factory := range storeFactories {
+		store := factory(t)
+		if _, err := store.CreateEvents(context.Background(), seed); err != nil {
+			t.Fatalf("%s: create events: %v", driver, err)
+		}
+		stats, err := store.EventStats(context.Background(), query)
+		if err != nil {
+			t.Fatalf("%s: event stats: %v", driver, err)
+		}
+		if stats.Total != 4 || stats.Errors != 2 || len(stats.Series) != 4 || len(stats.Routes) != 3 {
+			t.Fatalf("%s: unexpected stats %+v", driver, stats)
+		}
+		results[driver] = stats
+	}
+	if !reflect.DeepEqual(results[storageDriverChai], results[storageDriverMemory]) {
+		t.Fatalf("stores disagree:\nchai:   %+v\nmemory: %+v", results[storageDriverChai], results[storageDriverMemory])
+	}
+}
+
+func TestStoreConformanceNotes(t *testing.T) {
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+
+			first := decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"  ","content":"first"}`), http.StatusCreated)
+			second := decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"title":"Second","content":"second"}`), http.StatusCreated)
+			if first.ID != 1 || first.Title != "Untitled Note" || second.ID != 2 {
+				t.Fatalf("unexpected created notes %+v and %+v", first, second)
+			}
+
+			listed := decodeStoreResponse[struct {
+				Notes []note `json:"notes"`
+			}](t, serveStoreRequest(t, application.handleNotes, http.MethodGet, "/notes", ""), http.StatusOK)
+			if len(listed.Notes) != 2 || listed.Notes[0].ID != second.ID {
+				t.Fatalf("expected notes newest first, got %+v", listed.Notes)
+			}
+
+			updated := decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNoteByID, http.MethodPut, "/notes/1", `{"title":"Renamed","content":"edited"}`), http.StatusOK)
+			if updated.Title != "Renamed" || updated.Content != "edited" || updated.CreatedAt != first.CreatedAt {
+				t.Fatalf("unexpected updated note %+v", updated)
+			}
+			fetched := decodeStoreResponse[note](t, serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1", ""), http.StatusOK)
+			if !reflect.DeepEqual(fetched, updated) {
+				t.Fatalf("expected %+v, got %+v", updated, fetched)
+			}
+
+			recorder := serveStoreRequest(t, application.handleNoteByID, http.MethodPut, "/notes/99", `{"title":"Missing"}`)
+			if recorder.Code != http.StatusNotFound {
+				t.Fatalf("expected 404 updating a missing note, got %d", recorder.Code)
+			}
+
+			recorder = serveStoreRequest(t, application.exportNotesMarkdown, http.MethodGet, "/notes/export.md", "")
+			export := recorder.Body.String()
+			if recorder.Code != http.StatusOK || strings.Index(export, "## Renamed") > strings.Index(export, "## Second") {
+				t.Fatalf("expected export oldest first, got %d: %s", recorder.Code, export)
+			}
+
+			recorder = serveStoreRequest(t, application.handleNoteByID, http.MethodDelete, "/notes/1", "")
+			if recorder.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d", recorder.Code)
+			}
+			recorder = serveStoreRequest(t, application.handleNoteByID, http.MethodGet, "/notes/1", "")
+			if recorder.Code != http.StatusNotFound {
+				t.Fatalf("expected 404 after delete, got %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestStoreConformanceTenantIsolation(t *testing.T) {
+	for driver := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			application := newStoreTestApp(t, driver)
+
+			owned := decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNotes, "user1", http.MethodPost, "/notes", `{"title":"mine"}`), http.StatusCreated)
+			if owned.Tenant != "user1" {
+				t.Fatalf("expected note owned by user1, got %+v", owned)
+			}
+			ownedEvent := decodeStoreResponse[event](t, serveTenantRequest(t, application.handleEvents, "user1", http.MethodPost, "/events", `{"status":500}`), http.StatusCreated)
+
+			for _, request := range []struct {
+				handler http.HandlerFunc
+				method  string
+				target  string
+				body    string
+			}{
+				{application.handleNoteByID, http.MethodGet, "/notes/1", ""},
+				{application.handleNoteByID, http.MethodPut, "/notes/1", `{"title":"stolen"}`},
+				{application.handleEventByID, http.MethodGet, "/events/1", ""},
+			} {
+				recorder := serveTenantRequest(t, request.handler, "user2", request.method, request.target, request.body)
+				if recorder.Code != http.StatusNotFound {
+					t.Fatalf("%s %s as user2: expected 404, got %d", request.method, request.target, recorder.Code)
+				}
+			}
+
+			// Deleting another tenant's row is a no-op.
+			serveTenantRequest(t, application.handleNoteByID, "user2", http.MethodDelete, "/notes/1", "")
+			serveTenantRequest(t, application.handleEventByID, "user2", http.MethodDelete, "/events/1", "")
+
+			notes := decodeStoreResponse[struct {
+				Count int `json:"count"`
+			}](t, serveTenantRequest(t, application.handleNotes, "user2", http.MethodGet, "/notes", ""), http.StatusOK)
+			events := decodeStoreResponse[struct {
+				Count int `json:"count"`
+			}](t, serveTenantRequest(t, application.handleEvents, "user2", http.MethodGet, "/events", ""), http.StatusOK)
+			stats := decodeStoreResponse[eventStats](t, serveTenantRequest(t, application.handleEventStats, "user2", http.MethodGet, "/events/stats", ""), http.StatusOK)
+			if notes.Count != 0 || events.Count != 0 || stats.Total != 0 {
+				t.Fatalf("expected user2 to see nothing, got %d notes, %d events, %d in stats", notes.Count, events.Count, stats.Total)
+			}
+
+			fetched := decodeStoreResponse[note](t, serveTenantRequest(t, application.handleNoteByID, "user1", http.MethodGet, "/notes/1", ""), http.StatusOK)
+			if !reflect.DeepEqual(fetched, owned) {
+				t.Fatalf("expected user1's note untouched, got %+v", fetched)
+			}
+			fetchedEvent := decodeStoreResponse[event](t, serveTenantRequest(t, application.handleEventByID, "user1", http.MethodGet, "/events/1", ""), http.StatusOK)
+			if !reflect.DeepEqual(fetchedEvent, ownedEvent) {
+				t.Fatalf("expected user1's event untouched, got %+v", fetchedEvent)
+			}
+		})
+	}
+}
+
+func TestTenantMiddlewareRejectsMalformedTenant(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	recorder := serveTenantRequest(t, application.handleNotes, "user1; DROP TABLE notes", http.MethodGet, "/notes", "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", recorder.Code)
+	}
+}
+
+func TestSQLOnlyHandlersRequireChai(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+
+	for _, target := range []struct {
+		handler http.HandlerFunc
+		path    string
+	}{
+		{application.handleSubscriptions, "/subscriptions"},
+		{application.handleSubscriptionByID, "/subscriptions/1"},
+		{application.handleEventSummaries, "/events/summaries"},
+		{application.handleOutbox, "/outbox"},
+		{application.handleOutboxByID, "/outbox/1"},
+	} {
+		recorder := serveStoreRequest(t, target.handler, http.MethodGet, target.path, "")
+		if recorder.Code != http.StatusNotImplemented {
+			t.Fatalf("%s: expected 501, got %d", target.path, recorder.Code)
+		}
+	}
+}
+
+func TestStoreConformanceDeletesReportRemoval(t *testing.T) {
+	for driver, factory := range storeFactories {
+		t.Run(driver, func(t *testing.T) {
+			store := factory(t)
+			ctx := context.Background()
+
+			created, err := store.CreateEvents(ctx, []event{{Tenant: "user1", Status: http.StatusOK}})
+			if err != nil {
+				t.Fatalf("create event: %v", err)
+			}
+			stored, err := store.CreateNote(ctx, note{Tenant: "user1", Title: "mine"}, auditEntry{})
+			if err != nil {
+				t.Fatalf("create note: %v", err)
+			}
+
+			// Another tenant's delete, and a repeated one, remove nothing.
+			for _, attempt := range []struct {
+				tenant  string
+				deleted bool
+			}{{"user2", false}, {"user1", true}, {"user1", false}} {
+				eventDeleted, err := store.DeleteEvent(ctx, attempt.tenant, created[0].ID)
+				if err != nil || eventDeleted != attempt.deleted {
+					t.Fatalf("delete event as %s: expected deleted=%v, got %v %v", attempt.tenant, attempt.deleted, eventDeleted, err)
+				}
+				noteDeleted, err := store.DeleteNote(ctx, attempt.tenant, stored.ID, auditEntry{})
+				if err != nil || noteDeleted != attempt.deleted {
+					t.Fatalf("delete note as %s: expected deleted=%v, got %v %v", attempt.tenant, attempt.deleted, noteDeleted, err)
+				}
+			}
+		})
+	}
+}
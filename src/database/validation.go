@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+// Field limits for event and note payloads.
+const (
+	maxEventSourceLength  = 100
+	maxEventRouteLength   = 2048
+	maxEventMessageLength = 4096
+	maxNoteTitleLength    = 200
+	maxNoteContentBytes   = 256 << 10
+)
+
+// allowedEventMethods are the HTTP methods an event may record.
+var allowedEventMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// Violation reasons, also used as the reason label on
+// database.requests.invalid.
+const (
+	reasonBodyTooLarge = "body_too_large"
+	reasonInvalidJSON  = "invalid_json"
+	reasonUnknownField = "unknown_field"
+	reasonInvalidType  = "invalid_type"
+	reasonTooLong      = "too_long"
+	reasonOutOfRange   = "out_of_range"
+	reasonNotAllowed   = "not_allowed"
+	reasonRequired     = "required"
+)
+
+// bodyLimits caps request bodies per route. Zero means no limit.
+type bodyLimits struct {
+	Events int64
+	Notes  int64
+}
+
+// violation is one problem with a request body, listed in 400 and 413
+// problem responses.
+type violation = problem.Violation
+
+var errTrailingData = errors.New("unexpected data after the JSON object")
+
+// decodeStrictJSON decodes a single JSON document from reader into target,
+// rejecting unknown fields and trailing data.
+func decodeStrictJSON(reader io.Reader, target any) error {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err != nil {
+		return err
+	}
+	var extra json.RawMessage
+	err = decoder.Decode(&extra)
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		return errTrailingData
+	}
+	return err
+}
+
+// jsonViolation describes a decodeStrictJSON error.
+func jsonViolation(err error) violation {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) && typeError.Field != "" {
+		return violation{
+			Field:   typeError.Field,
+			Reason:  reasonInvalidType,
+			Message: fmt.Sprintf("%s must be a %s", typeError.Field, typeError.Type),
+		}
+	}
+	// encoding/json has no typed error for unknown fields.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		return violation{Field: field, Reason: reasonUnknownField, Message: fmt.Sprintf("unknown field %q", field)}
+	}
+	return violation{Field: "body", Reason: reasonInvalidJSON, Message: "body must be a single JSON object"}
+}
+
+// decodeBody reads the JSON body of request into target, capped at limit
+// bytes. On failure it writes a 413 or 400 listing the violation and returns
+// false.
+func (application *app) decodeBody(response http.ResponseWriter, request *http.Request, route string, limit int64, target any) bool {
+	var reader io.Reader = request.Body
+	if limit > 0 {
+		reader = http.MaxBytesReader(response, request.Body, limit)
+	}
+	err := decodeStrictJSON(reader, target)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		application.rejectRequest(response, request, route, http.StatusRequestEntityTooLarge, []violation{{
+			Field:   "body",
+			Reason:  reasonBodyTooLarge,
+			Message: fmt.Sprintf("body must be at most %d bytes", tooLarge.Limit),
+		}})
+		return false
+	}
+	application.rejectRequest(response, request, route, http.StatusBadRequest, []violation{jsonViolation(err)})
+	return false
+}
+
+// rejectRequest writes statusCode with every violation and counts them.
+func (application *app) rejectRequest(response http.ResponseWriter, request *http.Request, route string, statusCode int, violations []violation) {
+	application.countViolations(request.Context(), route, violations)
+
+	problem.Invalid(request, statusCode, violations).Write(response)
+}
+
+// countViolations adds each violation to database.requests.invalid.
+func (application *app) countViolations(ctx context.Context, route string, violations []violation) {
+	for _, item := range violations {
+		application.invalidRequests.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("route", route),
+			attribute.String("reason", item.Reason),
+		))
+	}
+}
+
+// validate checks an event after applyDefaults.
+func (input createEventRequest) validate() []violation {
+	var violations []violation
+	violations = appendTooLong(violations, "source", input.Source, maxEventSourceLength)
+	violations = appendTooLong(violations, "route", input.Route, maxEventRouteLength)
+	violations = appendTooLong(violations, "message", input.Message, maxEventMessageLength)
+	if !slices.Contains(allowedEventMethods, input.Method) {
+		violations = append(violations, violation{
+			Field:   "method",
+			Reason:  reasonNotAllowed,
+			Message: "method must be one of " + strings.Join(allowedEventMethods, ", "),
+		})
+	}
+	if input.Status < 100 || input.Status > 599 {
+		violations = append(violations, violation{
+			Field:   "status",
+			Reason:  reasonOutOfRange,
+			Message: "status must be between 100 and 599",
+		})
+	}
+	return violations
+}
+
+// validate checks a note create or update payload.
+func (input createNoteRequest) validate() []violation {
+	violations := appendTooLong(nil, "title", strings.TrimSpace(input.Title), maxNoteTitleLength)
+	if len(input.Content) > maxNoteContentBytes {
+		violations = append(violations, violation{
+			Field:   "content",
+			Reason:  reasonTooLong,
+			Message: fmt.Sprintf("content must be at most %d bytes", maxNoteContentBytes),
+		})
+	}
+	return violations
+}
+
+// appendTooLong adds a violation when value has more than limit characters.
+func appendTooLong(violations []violation, field string, value string, limit int) []violation {
+	if utf8.RuneCountInString(value) <= limit {
+		return violations
+	}
+	return append(violations, violation{
+		Field:   field,
+		Reason:  reasonTooLong,
+		Message: fmt.Sprintf("%s must be at most %d characters", field, limit),
+	})
+}
+
+// violationMessages joins the messages of violations for single-line errors.
+func violationMessages(violations []violation) string {
+	messages := make([]string, len(violations))
+	for index, item := range violations {
+		messages[index] = item.Message
+	}
+	return strings.Join(messages, "; ")
+}
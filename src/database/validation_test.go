@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+func TestCreateHandlersRejectInvalidBodies(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+	application.bodyLimits = bodyLimits{Events: 256, Notes: 1 << 20}
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		want    []violation
+	}{
+		{
+			name: "unknown field", handler: application.handleEvents, method: http.MethodPost, target: "/events",
+			body: `{"source":"seed","sauce":"x"}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "sauce", Reason: reasonUnknownField}},
+		},
+		{
+			name: "wrong type", handler: application.handleEvents, method: http.MethodPost, target: "/events",
+			body: `{"status":"ok"}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "status", Reason: reasonInvalidType}},
+		},
+		{
+			name: "trailing data", handler: application.handleEvents, method: http.MethodPost, target: "/events",
+			body: `{"source":"seed"} {"source":"again"}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "body", Reason: reasonInvalidJSON}},
+		},
+		{
+			name: "every field violation", handler: application.handleEvents, method: http.MethodPost, target: "/events",
+			body: `{"method":"BREW","status":42,"source":"` + strings.Repeat("s", maxEventSourceLength+1) + `"}`, status: http.StatusBadRequest,
+			want: []violation{
+				{Field: "source", Reason: reasonTooLong},
+				{Field: "method", Reason: reasonNotAllowed},
+				{Field: "status", Reason: reasonOutOfRange},
+			},
+		},
+		{
+			name: "event body too large", handler: application.handleEvents, method: http.MethodPost, target: "/events",
+			body: `{"message":"` + strings.Repeat("m", 300) + `"}`, status: http.StatusRequestEntityTooLarge,
+			want: []violation{{Field: "body", Reason: reasonBodyTooLarge}},
+		},
+		{
+			name: "note title too long", handler: application.handleNotes, method: http.MethodPost, target: "/notes",
+			body: `{"title":"` + strings.Repeat("é", maxNoteTitleLength+1) + `"}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "title", Reason: reasonTooLong}},
+		},
+		{
+			name: "note content too large", handler: application.handleNotes, method: http.MethodPost, target: "/notes",
+			body: `{"content":"` + strings.Repeat("c", maxNoteContentBytes+1) + `"}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "content", Reason: reasonTooLong}},
+		},
+		{
+			name: "note update unknown field", handler: application.handleNoteByID, method: http.MethodPut, target: "/notes/1",
+			body: `{"title":"x","pinned":true}`, status: http.StatusBadRequest,
+			want: []violation{{Field: "pinned", Reason: reasonUnknownField}},
+		},
+	}
+
+	for _, test := range cases {
+		recorder := serveStoreRequest(t, test.handler, test.method, test.target, test.body)
+		payload := decodeStoreResponse[problem.Problem](t, recorder, test.status)
+		if contentType := recorder.Header().Get("Content-Type"); contentType != problem.ContentType {
+			t.Fatalf("%s: expected %s, got %q", test.name, problem.ContentType, contentType)
+		}
+		wantType := problem.TypeValidation
+		if test.status == http.StatusRequestEntityTooLarge {
+			wantType = problem.TypeBodyTooLarge
+		}
+		if payload.Type != wantType || payload.Status != test.status || payload.Instance != test.target {
+			t.Fatalf("%s: unexpected problem %+v", test.name, payload)
+		}
+		if len(payload.Violations) != len(test.want) {
+			t.Fatalf("%s: expected %d violations, got %+v", test.name, len(test.want), payload.Violations)
+		}
+		for index, want := range test.want {
+			got := payload.Violations[index]
+			if got.Field != want.Field || got.Reason != want.Reason || got.Message == "" {
+				t.Fatalf("%s: violation %d: expected %s/%s, got %+v", test.name, index, want.Field, want.Reason, got)
+			}
+		}
+	}
+
+	// Nothing invalid was stored.
+	events, _ := application.events.ListEvents(context.Background(), eventFilter{Tenant: "default", Limit: 10})
+	if len(events) != 0 {
+		t.Fatalf("expected no stored events, got %+v", events)
+	}
+}
+
+func TestHandleEventsBulkReportsLineViolations(t *testing.T) {
+	application := newStoreTestApp(t, storageDriverMemory)
+
+	body := strings.Join([]string{
+		`{"source":"seed"}`,
+		`{"source":"seed","status":700}`,
+		`{"source":"seed","extra":1}`,
+	}, "\n")
+	recorder := serveStoreRequest(t, application.handleEventsBulk, http.MethodPost, "/events/bulk", body)
+	var payload struct {
+		Results []bulkEventResult `json:"results"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(payload.Results) != 3 || payload.Results[0].Status != http.StatusCreated {
+		t.Fatalf("unexpected results %+v", payload.Results)
+	}
+	for index, reason := range map[int]string{1: reasonOutOfRange, 2: reasonUnknownField} {
+		result := payload.Results[index]
+		if result.Status != http.StatusBadRequest || len(result.Violations) != 1 || result.Violations[0].Reason != reason || result.Error == "" {
+			t.Fatalf("line %d: expected a %s violation, got %+v", result.Line, reason, result)
+		}
+	}
+}
+
+func TestInvalidRequestsCountedByRouteAndReason(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	application := newStoreTestApp(t, storageDriverMemory)
+	application.invalidRequests, _ = meter.Int64Counter("database.requests.invalid")
+
+	serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"tags":[]}`)
+	serveStoreRequest(t, application.handleNotes, http.MethodPost, "/notes", `{"tags":[]}`)
+	serveStoreRequest(t, application.handleEvents, http.MethodPost, "/events", `{"status":1000}`)
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	counts := map[[2]string]int64{}
+	for _, scope := range collected.ScopeMetrics {
+		for _, metric := range scope.Metrics {
+			for _, point := range metric.Data.(metricdata.Sum[int64]).DataPoints {
+				route, _ := point.Attributes.Value(attribute.Key("route"))
+				reason, _ := point.Attributes.Value(attribute.Key("reason"))
+				counts[[2]string{route.AsString(), reason.AsString()}] = point.Value
+			}
+		}
+	}
+	if counts[[2]string{"/notes", reasonUnknownField}] != 2 || counts[[2]string{"/events", reasonOutOfRange}] != 1 || len(counts) != 2 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
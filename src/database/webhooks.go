@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// Webhook event types published by the database service. Subscribers may use
+// "*" to receive every type.
+const (
+	webhookEventCreated = "event.created"
+	webhookEventDeleted = "event.deleted"
+	webhookNoteCreated  = "note.created"
+	webhookNoteUpdated  = "note.updated"
+	webhookNoteDeleted  = "note.deleted"
+	webhookAllEvents    = "*"
+)
+
+var webhookEventTypes = []string{
+	webhookEventCreated,
+	webhookEventDeleted,
+	webhookNoteCreated,
+	webhookNoteUpdated,
+	webhookNoteDeleted,
+}
+
+type subscription struct {
+	ID         int      `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	Secret     string   `json:"secret,omitempty"`
+	CreatedAt  string   `json:"createdAt"`
+	Tenant     string   `json:"tenant"`
+}
+
+// Limits on POST /subscriptions.
+const (
+	maxSubscriptionBodyBytes    = 16 << 10
+	maxSubscriptionURLLength    = 2048
+	maxSubscriptionSecretLength = 256
+)
+
+type createSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	Secret     string   `json:"secret"`
+}
+
+// validate checks a subscription after its URL is trimmed.
+func (input createSubscriptionRequest) validate() []violation {
+	var violations []violation
+	if target, err := url.Parse(input.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		violations = append(violations, violation{Field: "url", Reason: reasonInvalidType, Message: "url must be an absolute http or https URL"})
+	}
+	violations = appendTooLong(violations, "url", input.URL, maxSubscriptionURLLength)
+	for _, eventType := range input.EventTypes {
+		if eventType != webhookAllEvents && !slices.Contains(webhookEventTypes, eventType) {
+			violations = append(violations, violation{
+				Field:   "eventTypes",
+				Reason:  reasonNotAllowed,
+				Message: fmt.Sprintf("unknown event type %q, must be one of %s or %s", eventType, strings.Join(webhookEventTypes, ", "), webhookAllEvents),
+			})
+		}
+	}
+	return appendTooLong(violations, "secret", input.Secret, maxSubscriptionSecretLength)
+}
+
+type deadLetter struct {
+	ID             int             `json:"id"`
+	SubscriptionID int             `json:"subscriptionId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"lastError"`
+	CreatedAt      string          `json:"createdAt"`
+}
+
+// webhookEnvelope is the JSON document POSTed to every subscriber.
+type webhookEnvelope struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	OccurredAt string `json:"occurredAt"`
+	Data       any    `json:"data"`
+}
+
+type webhookConfig struct {
+	Workers        int
+	QueueSize      int
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type webhookDelivery struct {
+	// ctx is detached from the triggering request's cancellation but keeps its
+	// span context and baggage, so the outgoing call is parented to that span.
+	ctx          context.Context
+	subscription subscription
+	eventType    string
+	deliveryID   string
+	body         []byte
+}
+
+// webhookDispatcher fans lifecycle events out to registered subscriptions.
+// Deliveries are queued and sent by a small worker pool; each one is retried
+// with exponential backoff and dead-lettered once attempts are exhausted.
+type webhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	config webhookConfig
+
+	mu       sync.Mutex
+	closed   bool
+	queue    chan webhookDelivery
+	stopping chan struct{}
+	workers  sync.WaitGroup
+
+	// deadLetterMu serialises dead-letter inserts, which allocate ids with
+	// MAX(id)+1 like the rest of the schema.
+	deadLetterMu sync.Mutex
+
+	// subscriptions caches the subscriptions table so that publishing does
+	// not scan it on every write. It is nil until first loaded and reset by
+	// invalidateSubscriptions; generation keeps a load that raced a reset
+	// from caching what it read.
+	subscriptionsMu sync.Mutex
+	subscriptions   []subscription
+	generation      int
+
+	deliveries       metric.Int64Counter
+	deliveryAttempts metric.Int64Counter
+	deliveryDuration metric.Float64Histogram
+}
+
+func newWebhookDispatcher(db *sql.DB, client *http.Client, config webhookConfig, meter metric.Meter) *webhookDispatcher {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+
+	// Per-subscription delivery metrics. These are no-ops when OTEL is
+	// disabled (global noop meter).
+	deliveries, _ := meter.Int64Counter(
+		"database.webhook.deliveries",
+		metric.WithDescription("Webhook deliveries by subscription and final outcome"),
+		metric.WithUnit("{delivery}"),
+	)
+	deliveryAttempts, _ := meter.Int64Counter(
+		"database.webhook.delivery.attempts",
+		metric.WithDescription("Webhook HTTP attempts by subscription and result"),
+		metric.WithUnit("{attempt}"),
+	)
+	deliveryDuration, _ := meter.Float64Histogram(
+		"database.webhook.delivery.duration",
+		metric.WithDescription("Duration of individual webhook HTTP attempts"),
+		metric.WithUnit("s"),
+	)
+
+	return &webhookDispatcher{
+		db:               db,
+		client:           client,
+		config:           config,
+		queue:            make(chan webhookDelivery, config.QueueSize),
+		stopping:         make(chan struct{}),
+		deliveries:       deliveries,
+		deliveryAttempts: deliveryAttempts,
+		deliveryDuration: deliveryDuration,
+	}
+}
+
+func (dispatcher *webhookDispatcher) start() {
+	for range dispatcher.config.Workers {
+		dispatcher.workers.Add(1)
+		go func() {
+			defer dispatcher.workers.Done()
+			for delivery := range dispatcher.queue {
+				dispatcher.deliver(delivery)
+			}
+		}()
+	}
+}
+
+// shutdown stops accepting new deliveries, aborts pending backoff waits and
+// waits for in-flight deliveries to finish or ctx to expire.
+func (dispatcher *webhookDispatcher) shutdown(ctx context.Context) error {
+	if dispatcher == nil {
+		return nil
+	}
+	dispatcher.mu.Lock()
+	if !dispatcher.closed {
+		dispatcher.closed = true
+		close(dispatcher.stopping)
+		close(dispatcher.queue)
+	}
+	dispatcher.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		dispatcher.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish queues eventType for every subscription that asked for it. It never
+// blocks the calling handler: if the queue is full the delivery goes straight
+// to the dead-letter table.
+func (dispatcher *webhookDispatcher) publish(ctx context.Context, eventType string, data any) {
+	dispatcher.publishEach(ctx, eventType, []any{data})
+}
+
+// publishEach publishes one eventType event per item in data, looking the
+// matching subscriptions up once for all of them. Events go only to
+// subscriptions of the tenant in ctx.
+func (dispatcher *webhookDispatcher) publishEach(ctx context.Context, eventType string, data []any) {
+	if dispatcher == nil || len(data) == 0 {
+		return
+	}
+
+	subscriptions, err := dispatcher.matchingSubscriptions(ctx, tenant.FromContext(ctx), eventType)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load webhook subscriptions", "event.type", eventType, "err", err)
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	deliveryCtx := context.WithoutCancel(ctx)
+	occurredAt := time.Now().UTC().Format(time.RFC3339)
+	for _, item := range data {
+		for _, target := range subscriptions {
+			deliveryID := newDeliveryID()
+			body, err := json.Marshal(webhookEnvelope{
+				ID:         deliveryID,
+				Type:       eventType,
+				OccurredAt: occurredAt,
+				Data:       item,
+			})
+			if err != nil {
+				slog.WarnContext(ctx, "failed to encode webhook payload", "event.type", eventType, "subscription.id", target.ID, "err", err)
+				continue
+			}
+
+			delivery := webhookDelivery{
+				ctx:          deliveryCtx,
+				subscription: target,
+				eventType:    eventType,
+				deliveryID:   deliveryID,
+				body:         body,
+			}
+			if !dispatcher.enqueue(delivery) {
+				dispatcher.deadLetter(delivery, 0, "delivery queue full")
+			}
+		}
+	}
+}
+
+func (dispatcher *webhookDispatcher) enqueue(delivery webhookDelivery) bool {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	if dispatcher.closed {
+		return false
+	}
+	select {
+	case dispatcher.queue <- delivery:
+		return true
+	default:
+		return false
+	}
+}
+
+func (dispatcher *webhookDispatcher) matchingSubscriptions(ctx context.Context, tenantID string, eventType string) ([]subscription, error) {
+	subscriptions, err := dispatcher.cachedSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []subscription
+	for _, candidate := range subscriptions {
+		if candidate.Tenant == tenantID && candidate.wants(eventType) {
+			matched = append(matched, candidate)
+		}
+	}
+	return matched, nil
+}
+
+// cachedSubscriptions returns the subscriptions of every tenant, loading them
+// on first use and after invalidateSubscriptions.
+func (dispatcher *webhookDispatcher) cachedSubscriptions(ctx context.Context) ([]subscription, error) {
+	dispatcher.subscriptionsMu.Lock()
+	cached, generation := dispatcher.subscriptions, dispatcher.generation
+	dispatcher.subscriptionsMu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	loaded, err := loadSubscriptions(ctx, dispatcher.db, "SELECT "+subscriptionColumns+" FROM subscriptions ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	if loaded == nil {
+		loaded = []subscription{}
+	}
+	dispatcher.subscriptionsMu.Lock()
+	if dispatcher.generation == generation {
+		dispatcher.subscriptions = loaded
+	}
+	dispatcher.subscriptionsMu.Unlock()
+	return loaded, nil
+}
+
+// invalidateSubscriptions drops the cached subscriptions after the registry
+// changed, so the next publish reloads them.
+func (dispatcher *webhookDispatcher) invalidateSubscriptions() {
+	if dispatcher == nil {
+		return
+	}
+	dispatcher.subscriptionsMu.Lock()
+	defer dispatcher.subscriptionsMu.Unlock()
+	dispatcher.subscriptions = nil
+	dispatcher.generation++
+}
+
+// deliver sends one payload, retrying retryable failures with exponential
+// backoff until MaxAttempts is reached.
+func (dispatcher *webhookDispatcher) deliver(delivery webhookDelivery) {
+	subscriptionAttr := attribute.Int("subscription.id", delivery.subscription.ID)
+	eventTypeAttr := attribute.String("event.type", delivery.eventType)
+
+	var lastErr error
+	for attempt := 1; attempt <= dispatcher.config.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(dispatcher.backoff(attempt - 1)):
+			case <-dispatcher.stopping:
+				dispatcher.deadLetter(delivery, attempt-1, fmt.Sprintf("shutdown before retry: %v", lastErr))
+				return
+			}
+		}
+
+		start := time.Now()
+		retryable, err := dispatcher.send(delivery, attempt)
+		dispatcher.deliveryDuration.Record(delivery.ctx, time.Since(start).Seconds(),
+			metric.WithAttributes(subscriptionAttr))
+
+		result := "success"
+		switch {
+		case err != nil && retryable:
+			result = "retryable_error"
+		case err != nil:
+			result = "permanent_error"
+		}
+		dispatcher.deliveryAttempts.Add(delivery.ctx, 1,
+			metric.WithAttributes(subscriptionAttr, eventTypeAttr, attribute.String("result", result)))
+
+		if err == nil {
+			dispatcher.deliveries.Add(delivery.ctx, 1,
+				metric.WithAttributes(subscriptionAttr, eventTypeAttr, attribute.String("outcome", "delivered")))
+			slog.InfoContext(delivery.ctx, "webhook delivered",
+				"subscription.id", delivery.subscription.ID,
+				"event.type", delivery.eventType,
+				"webhook.delivery_id", delivery.deliveryID,
+				"webhook.attempt", attempt,
+			)
+			return
+		}
+
+		lastErr = err
+		slog.WarnContext(delivery.ctx, "webhook attempt failed",
+			"subscription.id", delivery.subscription.ID,
+			"event.type", delivery.eventType,
+			"webhook.delivery_id", delivery.deliveryID,
+			"webhook.attempt", attempt,
+			"err", err,
+		)
+		if !retryable {
+			dispatcher.deadLetter(delivery, attempt, err.Error())
+			return
+		}
+	}
+
+	dispatcher.deadLetter(delivery, dispatcher.config.MaxAttempts, lastErr.Error())
+}
+
+// send performs a single signed POST. The boolean reports whether a failure
+// is worth retrying (transport errors, 408, 429 and 5xx).
+func (dispatcher *webhookDispatcher) send(delivery webhookDelivery, attempt int) (bool, error) {
+	request, err := http.NewRequestWithContext(delivery.ctx, http.MethodPost, delivery.subscription.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Event", delivery.eventType)
+	request.Header.Set("X-Webhook-Delivery", delivery.deliveryID)
+	request.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	request.Header.Set("X-Webhook-Signature", signWebhookPayload(delivery.subscription.Secret, timestamp, delivery.body))
+
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	retryable := response.StatusCode == http.StatusRequestTimeout ||
+		response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode >= 500
+	return retryable, fmt.Errorf("subscriber returned status %d", response.StatusCode)
+}
+
+// backoff returns the wait before retry number n (1-based): InitialBackoff
+// doubled for every previous retry and capped at MaxBackoff.
+func (dispatcher *webhookDispatcher) backoff(retry int) time.Duration {
+	wait := dispatcher.config.InitialBackoff
+	for i := 1; i < retry; i++ {
+		wait *= 2
+		if dispatcher.config.MaxBackoff > 0 && wait >= dispatcher.config.MaxBackoff {
+			return dispatcher.config.MaxBackoff
+		}
+	}
+	return wait
+}
+
+func (dispatcher *webhookDispatcher) deadLetter(delivery webhookDelivery, attempts int, reason string) {
+	dispatcher.deliveries.Add(delivery.ctx, 1,
+		metric.WithAttributes(
+			attribute.Int("subscription.id", delivery.subscription.ID),
+			attribute.String("event.type", delivery.eventType),
+			attribute.String("outcome", "dead_lettered"),
+		))
+	slog.ErrorContext(delivery.ctx, "webhook dead-lettered",
+		"subscription.id", delivery.subscription.ID,
+		"event.type", delivery.eventType,
+		"webhook.delivery_id", delivery.deliveryID,
+		"webhook.attempts", attempts,
+		"reason", reason,
+	)
+
+	dispatcher.deadLetterMu.Lock()
+	defer dispatcher.deadLetterMu.Unlock()
+
+	var nextID int
+	err := dispatcher.db.QueryRowContext(delivery.ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM webhook_dead_letters").Scan(&nextID)
+	if err == nil {
+		_, err = dispatcher.db.ExecContext(delivery.ctx,
+			"INSERT INTO webhook_dead_letters (id, subscription_id, event_type, payload, attempts, last_error, created_at, tenant) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			nextID,
+			delivery.subscription.ID,
+			delivery.eventType,
+			string(delivery.body),
+			attempts,
+			reason,
+			time.Now().UTC().Format(time.RFC3339),
+			delivery.subscription.Tenant,
+		)
+	}
+	if err != nil {
+		slog.ErrorContext(delivery.ctx, "failed to store webhook dead letter", "subscription.id", delivery.subscription.ID, "err", err)
+	}
+}
+
+// signWebhookPayload returns the X-Webhook-Signature value for body: an
+// HMAC-SHA256 over "<timestamp>.<body>" keyed with the subscription secret.
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (target subscription) wants(eventType string) bool {
+	return slices.Contains(target.EventTypes, webhookAllEvents) || slices.Contains(target.EventTypes, eventType)
+}
+
+func newDeliveryID() string {
+	return randomHex(16)
+}
+
+func randomHex(size int) string {
+	buffer := make([]byte, size)
+	_, _ = rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// ---------------------------------------------------------------------------
+// Subscription registry handlers
+// ---------------------------------------------------------------------------
+
+func (application *app) handleSubscriptions(response http.ResponseWriter, request *http.Request) {
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		application.listSubscriptions(response, request)
+	case http.MethodPost:
+		application.createSubscription(response, request)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (application *app) handleSubscriptionByID(response http.ResponseWriter, request *http.Request) {
+	if !application.requireSQLStorage(response, request) {
+		return
+	}
+	path := request.URL.Path
+	deadLetters := strings.HasSuffix(path, "/dead-letters")
+	id, err := parseIDFromPath(strings.TrimSuffix(path, "/dead-letters"), "/subscriptions/")
+	if err != nil {
+		problem.Write(response, request, http.StatusBadRequest, "invalid subscription id")
+		return
+	}
+
+	switch {
+	case deadLetters && request.Method == http.MethodGet:
+		application.listDeadLetters(response, request, id)
+	case deadLetters:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	case request.Method == http.MethodGet:
+		application.getSubscription(response, request, id)
+	case request.Method == http.MethodDelete:
+		application.deleteSubscription(response, request, id)
+	default:
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (application *app) listSubscriptions(response http.ResponseWriter, request *http.Request) {
+	subscriptions, err := loadSubscriptions(request.Context(), application.db,
+		"SELECT "+subscriptionColumns+" FROM subscriptions WHERE tenant = $1 ORDER BY id ASC",
+		tenant.FromContext(request.Context()),
+	)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query subscriptions")
+		return
+	}
+
+	for index := range subscriptions {
+		subscriptions[index].Secret = ""
+	}
+
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"count":         len(subscriptions),
+		"subscriptions": subscriptions,
+	})
+}
+
+func (application *app) getSubscription(response http.ResponseWriter, request *http.Request, id int) {
+	var stored subscription
+	var eventTypes string
+	err := application.db.QueryRowContext(request.Context(),
+		"SELECT id, url, event_types, created_at, tenant FROM subscriptions WHERE id = $1 AND tenant = $2",
+		id,
+		tenant.FromContext(request.Context()),
+	).Scan(&stored.ID, &stored.URL, &eventTypes, &stored.CreatedAt, &stored.Tenant)
+	if err == sql.ErrNoRows {
+		problem.Write(response, request, http.StatusNotFound, "subscription not found")
+		return
+	}
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to load subscription")
+		return
+	}
+	stored.EventTypes = strings.Split(eventTypes, ",")
+
+	problem.WriteJSON(response, http.StatusOK, stored)
+}
+
+func (application *app) createSubscription(response http.ResponseWriter, request *http.Request) {
+	var input createSubscriptionRequest
+	if !application.decodeBody(response, request, "/subscriptions", maxSubscriptionBodyBytes, &input) {
+		return
+	}
+	input.URL = strings.TrimSpace(input.URL)
+	if violations := input.validate(); len(violations) > 0 {
+		application.rejectRequest(response, request, "/subscriptions", http.StatusBadRequest, violations)
+		return
+	}
+	target, _ := url.Parse(input.URL)
+
+	eventTypes := input.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = []string{webhookAllEvents}
+	}
+
+	secret := input.Secret
+	if secret == "" {
+		secret = randomHex(32)
+	}
+
+	nextID, err := application.nextSubscriptionID(request.Context())
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to allocate subscription id")
+		return
+	}
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	tenantID := tenant.FromContext(request.Context())
+	_, err = application.db.ExecContext(request.Context(),
+		"INSERT INTO subscriptions ("+subscriptionColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		nextID,
+		target.String(),
+		strings.Join(eventTypes, ","),
+		secret,
+		createdAt,
+		tenantID,
+	)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to create subscription")
+		return
+	}
+	application.webhooks.invalidateSubscriptions()
+
+	slog.InfoContext(request.Context(), "webhook subscription created",
+		"subscription.id", nextID,
+		"subscription.url", target.String(),
+		"subscription.event_types", strings.Join(eventTypes, ","),
+	)
+
+	// The secret is only ever returned on creation.
+	problem.WriteJSON(response, http.StatusCreated, subscription{
+		ID:         nextID,
+		URL:        target.String(),
+		EventTypes: eventTypes,
+		Secret:     secret,
+		CreatedAt:  createdAt,
+		Tenant:     tenantID,
+	})
+}
+
+func (application *app) deleteSubscription(response http.ResponseWriter, request *http.Request, id int) {
+	tenantID := tenant.FromContext(request.Context())
+	_, err := application.db.ExecContext(request.Context(), "DELETE FROM subscriptions WHERE id = $1 AND tenant = $2", id, tenantID)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to delete subscription")
+		return
+	}
+	application.webhooks.invalidateSubscriptions()
+	_, err = application.db.ExecContext(request.Context(), "DELETE FROM webhook_dead_letters WHERE subscription_id = $1 AND tenant = $2", id, tenantID)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to delete subscription dead letters")
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (application *app) listDeadLetters(response http.ResponseWriter, request *http.Request, subscriptionID int) {
+	rows, err := application.db.QueryContext(request.Context(),
+		"SELECT id, subscription_id, event_type, payload, attempts, last_error, created_at FROM webhook_dead_letters WHERE subscription_id = $1 AND tenant = $2 ORDER BY id DESC",
+		subscriptionID,
+		tenant.FromContext(request.Context()),
+	)
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to query dead letters")
+		return
+	}
+	defer rows.Close()
+
+	var letters []deadLetter
+	for rows.Next() {
+		var row deadLetter
+		var payload string
+		err = rows.Scan(&row.ID, &row.SubscriptionID, &row.EventType, &payload, &row.Attempts, &row.LastError, &row.CreatedAt)
+		if err != nil {
+			problem.Write(response, request, http.StatusInternalServerError, "failed to scan dead letter")
+			return
+		}
+		row.Payload = json.RawMessage(payload)
+		letters = append(letters, row)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		problem.Write(response, request, http.StatusInternalServerError, "failed to read dead letter rows")
+		return
+	}
+
+	problem.WriteJSON(response, http.StatusOK, map[string]any{
+		"count":       len(letters),
+		"deadLetters": letters,
+	})
+}
+
+func (application *app) nextSubscriptionID(ctx context.Context) (int, error) {
+	var nextID int
+	err := application.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM subscriptions").Scan(&nextID)
+	return nextID, err
+}
+
+// subscriptionColumns is the column list every subscriptions query selects,
+// in the order loadSubscriptions scans them.
+const subscriptionColumns = "id, url, event_types, secret, created_at, tenant"
+
+// loadSubscriptions runs query, which selects subscriptionColumns, with args.
+func loadSubscriptions(ctx context.Context, db *sql.DB, query string, args ...any) ([]subscription, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []subscription
+	for rows.Next() {
+		var row subscription
+		var eventTypes string
+		err = rows.Scan(&row.ID, &row.URL, &eventTypes, &row.Secret, &row.CreatedAt, &row.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		row.EventTypes = strings.Split(eventTypes, ",")
+		subscriptions = append(subscriptions, row)
+	}
+	return subscriptions, rows.Err()
+}
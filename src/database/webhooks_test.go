@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("chai", ":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := ensureSchema(db); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+	return db
+}
+
+func insertTestSubscription(t *testing.T, db *sql.DB, id int, url string, eventTypes string, secret string) {
+	t.Helper()
+	_, err := db.Exec(
+		"INSERT INTO subscriptions (id, url, event_types, secret, created_at) VALUES ($1, $2, $3, $4, $5)",
+		id, url, eventTypes, secret, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		t.Fatalf("insert subscription: %v", err)
+	}
+}
+
+func testWebhookConfig() webhookConfig {
+	return webhookConfig{
+		Workers:        1,
+		QueueSize:      16,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+}
+
+func TestWebhookDeliveryIsSignedAndFiltered(t *testing.T) {
+	db := newTestDB(t)
+
+	type received struct {
+		eventType string
+		body      []byte
+		signature string
+		timestamp string
+	}
+	var (
+		mu         sync.Mutex
+		deliveries []received
+	)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		mu.Lock()
+		deliveries = append(deliveries, received{
+			eventType: request.Header.Get("X-Webhook-Event"),
+			body:      body,
+			signature: request.Header.Get("X-Webhook-Signature"),
+			timestamp: request.Header.Get("X-Webhook-Timestamp"),
+		})
+		mu.Unlock()
+		response.WriteHeader(http.StatusNoContent)
+	}))
+	defer subscriber.Close()
+
+	insertTestSubscription(t, db, 1, subscriber.URL, webhookNoteCreated, "s3cret")
+
+	dispatcher := newWebhookDispatcher(db, subscriber.Client(), testWebhookConfig(), noop.NewMeterProvider().Meter("test"))
+	dispatcher.start()
+
+	dispatcher.publish(context.Background(), webhookEventCreated, event{ID: 7})
+	dispatcher.publish(context.Background(), webhookNoteCreated, note{ID: 3, Title: "hello"})
+
+	if err := dispatcher.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if len(deliveries) != 1 {
+		t.Fatalf("expected exactly one delivery for the note.created filter, got %d", len(deliveries))
+	}
+	got := deliveries[0]
+	if got.eventType != webhookNoteCreated {
+		t.Fatalf("expected event type %q, got %q", webhookNoteCreated, got.eventType)
+	}
+	if want := signWebhookPayload("s3cret", got.timestamp, got.body); got.signature != want {
+		t.Fatalf("signature mismatch: got %q want %q", got.signature, want)
+	}
+
+	var envelope struct {
+		Type string `json:"type"`
+		Data note   `json:"data"`
+	}
+	if err := json.Unmarshal(got.body, &envelope); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if envelope.Type != webhookNoteCreated || envelope.Data.ID != 3 {
+		t.Fatalf("unexpected payload %+v", envelope)
+	}
+}
+
+func TestWebhookDeliveryRetriesThenDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer subscriber.Close()
+
+	insertTestSubscription(t, db, 1, subscriber.URL, webhookAllEvents, "s3cret")
+
+	dispatcher := newWebhookDispatcher(db, subscriber.Client(), testWebhookConfig(), noop.NewMeterProvider().Meter("test"))
+	dispatcher.start()
+	dispatcher.publish(context.Background(), webhookNoteDeleted, map[string]int{"id": 1})
+
+	// Shutdown aborts pending retries, so wait for the dead letter first.
+	var storedAttempts int
+	var eventType string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err := db.QueryRow("SELECT attempts, event_type FROM webhook_dead_letters WHERE subscription_id = $1", 1).Scan(&storedAttempts, &eventType)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows || time.Now().After(deadline) {
+			t.Fatalf("load dead letter: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := dispatcher.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	if storedAttempts != 3 || eventType != webhookNoteDeleted {
+		t.Fatalf("unexpected dead letter attempts=%d type=%q", storedAttempts, eventType)
+	}
+}
+
+func TestWebhookDeliveryPropagatesTraceContext(t *testing.T) {
+	db := newTestDB(t)
+
+	traceparents := make(chan string, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		traceparents <- request.Header.Get("traceparent")
+		response.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+
+	insertTestSubscription(t, db, 1, subscriber.URL, webhookAllEvents, "s3cret")
+
+	tracerProvider := sdktrace.NewTracerProvider()
+	defer func() { _ = tracerProvider.Shutdown(context.Background()) }()
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport,
+		otelhttp.WithTracerProvider(tracerProvider),
+		otelhttp.WithPropagators(propagation.TraceContext{}),
+	)}
+
+	ctx, span := tracerProvider.Tracer("test").Start(context.Background(), "POST /notes")
+	dispatcher := newWebhookDispatcher(db, client, testWebhookConfig(), noop.NewMeterProvider().Meter("test"))
+	dispatcher.start()
+	dispatcher.publish(ctx, webhookNoteCreated, note{ID: 1})
+	span.End()
+	if err := dispatcher.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	traceparent := <-traceparents
+	want := span.SpanContext().TraceID().String()
+	if len(traceparent) < 35 || traceparent[3:35] != want {
+		t.Fatalf("expected traceparent for trace %s, got %q", want, traceparent)
+	}
+}
+
+func TestWebhookSubscriptionsAreCachedUntilTheRegistryChanges(t *testing.T) {
+	db := newTestDB(t)
+	insertTestSubscription(t, db, 1, "http://subscriber.invalid/one", webhookAllEvents, "s3cret")
+	dispatcher := newWebhookDispatcher(db, http.DefaultClient, testWebhookConfig(), noop.NewMeterProvider().Meter("test"))
+
+	if matched, err := dispatcher.matchingSubscriptions(context.Background(), tenant.Default, webhookNoteCreated); err != nil || len(matched) != 1 {
+		t.Fatalf("expected one subscription, got %v %v", matched, err)
+	}
+	insertTestSubscription(t, db, 2, "http://subscriber.invalid/two", webhookAllEvents, "s3cret")
+	if matched, _ := dispatcher.matchingSubscriptions(context.Background(), tenant.Default, webhookNoteCreated); len(matched) != 1 {
+		t.Fatalf("expected the cached subscriptions, got %v", matched)
+	}
+	dispatcher.invalidateSubscriptions()
+	if matched, _ := dispatcher.matchingSubscriptions(context.Background(), tenant.Default, webhookNoteCreated); len(matched) != 2 {
+		t.Fatalf("expected the subscriptions reloaded, got %v", matched)
+	}
+}
+
+func TestWebhookSubscriptionsAreScopedToTheirTenant(t *testing.T) {
+	db := newTestDB(t)
+	dispatcher := newWebhookDispatcher(db, http.DefaultClient, testWebhookConfig(), noop.NewMeterProvider().Meter("test"))
+	application := &app{db: db, webhooks: dispatcher}
+
+	created := decodeStoreResponse[subscription](t, serveTenantRequest(t, application.handleSubscriptions, "user1", http.MethodPost, "/subscriptions", `{"url":"http://subscriber.invalid/"}`), http.StatusCreated)
+	if created.Tenant != "user1" {
+		t.Fatalf("expected the subscription owned by user1, got %+v", created)
+	}
+	dispatcher.deadLetter(webhookDelivery{ctx: context.Background(), subscription: created, eventType: webhookNoteCreated, body: []byte(`{}`)}, 1, "boom")
+
+	listed := decodeStoreResponse[struct {
+		Count int `json:"count"`
+	}](t, serveTenantRequest(t, application.handleSubscriptions, "user2", http.MethodGet, "/subscriptions", ""), http.StatusOK)
+	letters := decodeStoreResponse[struct {
+		Count int `json:"count"`
+	}](t, serveTenantRequest(t, application.handleSubscriptionByID, "user2", http.MethodGet, "/subscriptions/1/dead-letters", ""), http.StatusOK)
+	if listed.Count != 0 || letters.Count != 0 {
+		t.Fatalf("expected user2 to see nothing, got %d subscriptions and %d dead letters", listed.Count, letters.Count)
+	}
+	if recorder := serveTenantRequest(t, application.handleSubscriptionByID, "user2", http.MethodGet, "/subscriptions/1", ""); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 reading user1's subscription as user2, got %d", recorder.Code)
+	}
+
+	// A note written by user2 is not delivered to user1's subscription.
+	dispatcher.publish(tenant.WithTenant(context.Background(), "user2"), webhookNoteCreated, note{ID: 1, Title: "secret"})
+	if len(dispatcher.queue) != 0 {
+		t.Fatalf("expected no delivery for another tenant's note, got %d", len(dispatcher.queue))
+	}
+	dispatcher.publish(tenant.WithTenant(context.Background(), "user1"), webhookNoteCreated, note{ID: 2})
+	if len(dispatcher.queue) != 1 {
+		t.Fatalf("expected user1's note delivered, got %d deliveries", len(dispatcher.queue))
+	}
+
+	// Deleting another tenant's subscription is a no-op.
+	serveTenantRequest(t, application.handleSubscriptionByID, "user2", http.MethodDelete, "/subscriptions/1", "")
+	fetched := decodeStoreResponse[subscription](t, serveTenantRequest(t, application.handleSubscriptionByID, "user1", http.MethodGet, "/subscriptions/1", ""), http.StatusOK)
+	letters = decodeStoreResponse[struct {
+		Count int `json:"count"`
+	}](t, serveTenantRequest(t, application.handleSubscriptionByID, "user1", http.MethodGet, "/subscriptions/1/dead-letters", ""), http.StatusOK)
+	if fetched.ID != created.ID || letters.Count != 1 {
+		t.Fatalf("expected user1's subscription and dead letter untouched, got %+v and %d dead letters", fetched, letters.Count)
+	}
+}
+
+func TestSubscriptionsRejectInvalidBodies(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	invalid, _ := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64Counter("database.requests.invalid")
+	db := newTestDB(t)
+	application := &app{
+		db:              db,
+		webhooks:        newWebhookDispatcher(db, http.DefaultClient, testWebhookConfig(), noop.NewMeterProvider().Meter("test")),
+		invalidRequests: invalid,
+	}
+
+	for _, test := range []struct {
+		body   string
+		status int
+		want   violation
+	}{
+		{`{"url":"http://subscriber.invalid/","events":["*"]}`, http.StatusBadRequest, violation{Field: "events", Reason: reasonUnknownField}},
+		{`{"url":"ftp://subscriber.invalid/"}`, http.StatusBadRequest, violation{Field: "url", Reason: reasonInvalidType}},
+		{`{"url":"http://subscriber.invalid/","eventTypes":["note.archived"]}`, http.StatusBadRequest, violation{Field: "eventTypes", Reason: reasonNotAllowed}},
+		{`{"url":"http://subscriber.invalid/","secret":"` + strings.Repeat("s", maxSubscriptionBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, violation{Field: "body", Reason: reasonBodyTooLarge}},
+	} {
+		recorder := serveTenantRequest(t, application.handleSubscriptions, "user1", http.MethodPost, "/subscriptions", test.body)
+		rejected := decodeStoreResponse[problem.Problem](t, recorder, test.status)
+		if len(rejected.Violations) != 1 || rejected.Violations[0].Field != test.want.Field || rejected.Violations[0].Reason != test.want.Reason {
+			t.Fatalf("expected a %s/%s violation, got %+v", test.want.Field, test.want.Reason, rejected.Violations)
+		}
+	}
+
+	listed := decodeStoreResponse[struct {
+		Count int `json:"count"`
+	}](t, serveTenantRequest(t, application.handleSubscriptions, "user1", http.MethodGet, "/subscriptions", ""), http.StatusOK)
+	if listed.Count != 0 {
+		t.Fatalf("expected nothing stored, got %d subscriptions", listed.Count)
+	}
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	var counted int64
+	for _, point := range collected.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints {
+		if route, _ := point.Attributes.Value(attribute.Key("route")); route.AsString() == "/subscriptions" {
+			counted += point.Value
+		}
+	}
+	if counted != 4 {
+		t.Fatalf("expected 4 invalid /subscriptions requests counted, got %d", counted)
+	}
+}
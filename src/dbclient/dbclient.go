@@ -0,0 +1,474 @@
+// Package dbclient is a typed client for the database service's HTTP API.
+//
+// Every call takes a context, which carries the caller's trace and tenant
+// to the database, and runs in a span of its own named after the method.
+// A failed call returns an *Error, which matches ErrNotFound, ErrConflict
+// or ErrUnavailable with errors.Is and unwraps to the transport error or to
+// the *problem.Problem the database answered with.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+// instrumentationName names the tracer the client's spans come from.
+const instrumentationName = "github.com/cldmnky/observability-workshop/src/dbclient"
+
+// actorHeader carries the actor set with WithActor.
+const actorHeader = "X-Actor"
+
+// Event is a stored request event.
+type Event struct {
+	ID        int    `json:"id"`
+	Source    string `json:"source"`
+	Method    string `json:"method"`
+	Route     string `json:"route"`
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	CreatedAt string `json:"createdAt"`
+	TraceID   string `json:"traceId"`
+	SpanID    string `json:"spanId"`
+	Tenant    string `json:"tenant"`
+}
+
+// EventInput is an event to record. The database fills in the fields left
+// empty.
+type EventInput struct {
+	Source  string `json:"source,omitempty"`
+	Method  string `json:"method,omitempty"`
+	Route   string `json:"route,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// EventQuery filters ListEvents. Zero fields are left to the database's
+// defaults.
+type EventQuery struct {
+	Limit   int
+	TraceID string
+}
+
+// StatsQuery selects the events EventStats aggregates. Window and Bucket are
+// Go durations such as "1h"; empty ones are left to the database's defaults.
+type StatsQuery struct {
+	Window  string
+	Bucket  string
+	GroupBy []string
+}
+
+// EventStats aggregates events over a window, per bucket and per route.
+type EventStats struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Window  string            `json:"window"`
+	Bucket  string            `json:"bucket"`
+	GroupBy []string          `json:"groupBy"`
+	Total   int               `json:"total"`
+	Errors  int               `json:"errors"`
+	Series  []StatsPoint      `json:"series"`
+	Routes  []RouteErrorRatio `json:"routes"`
+}
+
+// StatsPoint counts the events of one bucket, and group when grouped.
+type StatsPoint struct {
+	BucketStart string            `json:"bucketStart"`
+	Group       map[string]string `json:"group,omitempty"`
+	Count       int               `json:"count"`
+	Errors      int               `json:"errors"`
+}
+
+// RouteErrorRatio is one route's share of failed events.
+type RouteErrorRatio struct {
+	Route      string  `json:"route"`
+	Count      int     `json:"count"`
+	Errors     int     `json:"errors"`
+	ErrorRatio float64 `json:"errorRatio"`
+}
+
+// Note is a stored note.
+type Note struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+	Tenant    string `json:"tenant"`
+	// HTML is Content rendered to sanitised HTML, set only by ListNotes
+	// with Render "html".
+	HTML string `json:"html,omitempty"`
+	// Replayed reports that CreateNote returned the note an earlier call
+	// with the same idempotency key stored.
+	Replayed bool `json:"-"`
+}
+
+// NoteQuery selects how ListNotes returns notes. Render "html" adds each
+// note's rendered HTML; an empty one leaves it out.
+type NoteQuery struct {
+	Render string
+}
+
+// NoteInput is the content of a note to create or update.
+type NoteInput struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// OutboxMessage is a message stored in the outbox for later delivery.
+type OutboxMessage struct {
+	ID          int             `json:"id"`
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+	TraceID     string          `json:"traceId"`
+	SpanID      string          `json:"spanId"`
+	Tenant      string          `json:"tenant"`
+	CreatedAt   string          `json:"createdAt"`
+}
+
+// OutboxInput is a message to store in the outbox. Payload must be a JSON
+// object. TraceID and SpanID, when set, identify the span that produced it.
+type OutboxInput struct {
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+	TraceID     string          `json:"traceId,omitempty"`
+	SpanID      string          `json:"spanId,omitempty"`
+}
+
+// Errors that a failed call's *Error matches.
+var (
+	// ErrNotFound matches a 404: the resource does not exist for the
+	// tenant.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict matches a 409, such as a write whose Idempotency-Key is
+	// still in progress.
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable matches a call that got no response, other than one
+	// the caller cancelled, or a 502, 503 or 504.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// Error is a failed call.
+type Error struct {
+	// Op is the client method that failed, such as "GetNote".
+	Op string
+	// Status is the database's response status, or 0 when there was no
+	// response.
+	Status int
+	// Problem is the problem the database answered with, if any.
+	Problem *problem.Problem
+	// Err is the transport or decoding error, if any.
+	Err error
+}
+
+func (err *Error) Error() string {
+	switch {
+	case err.Err != nil:
+		return "database " + err.Op + ": " + err.Err.Error()
+	case err.Problem != nil:
+		return "database " + err.Op + ": " + err.Problem.Error()
+	default:
+		return fmt.Sprintf("database %s: status %d", err.Op, err.Status)
+	}
+}
+
+func (err *Error) Unwrap() error {
+	if err.Err != nil {
+		return err.Err
+	}
+	if err.Problem != nil {
+		return err.Problem
+	}
+	return nil
+}
+
+// Is matches ErrNotFound, ErrConflict and ErrUnavailable by status.
+func (err *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return err.Status == http.StatusNotFound
+	case ErrConflict:
+		return err.Status == http.StatusConflict
+	case ErrUnavailable:
+		if err.Status == 0 {
+			return !errors.Is(err.Err, context.Canceled)
+		}
+		return err.Status == http.StatusBadGateway || err.Status == http.StatusServiceUnavailable || err.Status == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+type (
+	idempotencyKeyKey struct{}
+	actorKey          struct{}
+)
+
+// WithIdempotencyKey returns ctx carrying key, which the create calls made
+// with it send as their Idempotency-Key. Without one they send a new key
+// each, so retries of a call cannot store it twice.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// WithActor returns ctx carrying actor, which the calls made with it send
+// as X-Actor, so the database records who changed a note in its audit log.
+// Without one the database falls back to the actor.id baggage member and
+// then to the tenant.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Client calls the database at one base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	tracer  trace.Tracer
+}
+
+// New returns a Client for the database at baseURL that sends its requests
+// with client. Nil uses http.DefaultClient.
+func New(baseURL string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+		tracer:  otel.Tracer(instrumentationName),
+	}
+}
+
+// ListEvents returns the tenant's events matching query, newest first.
+func (client *Client) ListEvents(ctx context.Context, query EventQuery) ([]Event, error) {
+	values := url.Values{}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	if query.TraceID != "" {
+		values.Set("trace_id", query.TraceID)
+	}
+	var listed struct {
+		Events []Event `json:"events"`
+	}
+	err := client.call(ctx, "ListEvents", http.MethodGet, "/events", values, nil, http.StatusOK, &listed)
+	return listed.Events, err
+}
+
+// CreateEvent records input and returns the stored event.
+func (client *Client) CreateEvent(ctx context.Context, input EventInput) (Event, error) {
+	var created Event
+	err := client.call(ctx, "CreateEvent", http.MethodPost, "/events", nil, input, http.StatusCreated, &created)
+	return created, err
+}
+
+// EventStats aggregates the tenant's events as query selects.
+func (client *Client) EventStats(ctx context.Context, query StatsQuery) (EventStats, error) {
+	values := url.Values{}
+	if query.Window != "" {
+		values.Set("window", query.Window)
+	}
+	if query.Bucket != "" {
+		values.Set("bucket", query.Bucket)
+	}
+	if len(query.GroupBy) > 0 {
+		values.Set("group_by", strings.Join(query.GroupBy, ","))
+	}
+	var stats EventStats
+	err := client.call(ctx, "EventStats", http.MethodGet, "/events/stats", values, nil, http.StatusOK, &stats)
+	return stats, err
+}
+
+// ListNotes returns the tenant's notes, newest first, as query selects.
+func (client *Client) ListNotes(ctx context.Context, query NoteQuery) ([]Note, error) {
+	values := url.Values{}
+	if query.Render != "" {
+		values.Set("render", query.Render)
+	}
+	var listed struct {
+		Notes []Note `json:"notes"`
+	}
+	err := client.call(ctx, "ListNotes", http.MethodGet, "/notes", values, nil, http.StatusOK, &listed)
+	return listed.Notes, err
+}
+
+// GetNote returns the note with id.
+func (client *Client) GetNote(ctx context.Context, id int) (Note, error) {
+	var stored Note
+	err := client.call(ctx, "GetNote", http.MethodGet, "/notes/"+strconv.Itoa(id), nil, nil, http.StatusOK, &stored, attribute.Int("note.id", id))
+	return stored, err
+}
+
+// CreateNote stores input as a new note and returns it.
+func (client *Client) CreateNote(ctx context.Context, input NoteInput) (Note, error) {
+	ctx, span := client.start(ctx, "CreateNote")
+	defer span.End()
+	response, err := client.send(ctx, "CreateNote", http.MethodPost, "/notes", nil, input, http.StatusCreated)
+	if err != nil {
+		fail(span, err)
+		return Note{}, err
+	}
+	defer response.Body.Close()
+	var created Note
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil {
+		err := &Error{Op: "CreateNote", Status: response.StatusCode, Err: err}
+		fail(span, err)
+		return Note{}, err
+	}
+	created.Replayed = idempotency.Replayed(response)
+	return created, nil
+}
+
+// UpdateNote replaces the note with id by input and returns it.
+func (client *Client) UpdateNote(ctx context.Context, id int, input NoteInput) (Note, error) {
+	var updated Note
+	err := client.call(ctx, "UpdateNote", http.MethodPut, "/notes/"+strconv.Itoa(id), nil, input, http.StatusOK, &updated, attribute.Int("note.id", id))
+	return updated, err
+}
+
+// DeleteNote deletes the note with id. Deleting a missing note succeeds.
+func (client *Client) DeleteNote(ctx context.Context, id int) error {
+	return client.call(ctx, "DeleteNote", http.MethodDelete, "/notes/"+strconv.Itoa(id), nil, nil, http.StatusNoContent, nil, attribute.Int("note.id", id))
+}
+
+// ExportNotes returns the tenant's notes as a Markdown document, read as
+// the database writes it. The caller must close it. The call's span ends
+// once the export starts.
+func (client *Client) ExportNotes(ctx context.Context) (io.ReadCloser, error) {
+	ctx, span := client.start(ctx, "ExportNotes")
+	defer span.End()
+	response, err := client.send(ctx, "ExportNotes", http.MethodGet, "/notes/export.md", nil, nil, http.StatusOK)
+	if err != nil {
+		fail(span, err)
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// CreateOutboxMessage stores input in the outbox and returns it.
+func (client *Client) CreateOutboxMessage(ctx context.Context, input OutboxInput) (OutboxMessage, error) {
+	var created OutboxMessage
+	err := client.call(ctx, "CreateOutboxMessage", http.MethodPost, "/outbox", nil, input, http.StatusCreated, &created)
+	return created, err
+}
+
+// ListOutbox returns up to limit stored messages for destination, oldest
+// first, whichever tenant stored them. An empty destination lists every
+// message. It is for the sender that delivers them, which deletes each one
+// with its Tenant in the context.
+func (client *Client) ListOutbox(ctx context.Context, destination string, limit int) ([]OutboxMessage, error) {
+	values := url.Values{}
+	if destination != "" {
+		values.Set("destination", destination)
+	}
+	if limit > 0 {
+		values.Set("limit", strconv.Itoa(limit))
+	}
+	var listed struct {
+		Messages []OutboxMessage `json:"messages"`
+	}
+	err := client.call(ctx, "ListOutbox", http.MethodGet, "/internal/outbox", values, nil, http.StatusOK, &listed)
+	return listed.Messages, err
+}
+
+// DeleteOutboxMessage removes the outbox message with id stored by the
+// tenant in ctx.
+func (client *Client) DeleteOutboxMessage(ctx context.Context, id int) error {
+	return client.call(ctx, "DeleteOutboxMessage", http.MethodDelete, "/outbox/"+strconv.Itoa(id), nil, nil, http.StatusNoContent, nil, attribute.Int("outbox.id", id))
+}
+
+func (client *Client) start(ctx context.Context, op string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return client.tracer.Start(ctx, "dbclient."+op, trace.WithAttributes(
+		append(attributes, attribute.String("peer.service", "database"))...,
+	))
+}
+
+// call sends one request in a span of its own and decodes a want response
+// into out, when not nil.
+func (client *Client) call(ctx context.Context, op string, method string, path string, query url.Values, input any, want int, out any, attributes ...attribute.KeyValue) error {
+	ctx, span := client.start(ctx, op, attributes...)
+	defer span.End()
+
+	response, err := client.send(ctx, op, method, path, query, input, want)
+	if err != nil {
+		fail(span, err)
+		return err
+	}
+	defer response.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			err := &Error{Op: op, Status: response.StatusCode, Err: err}
+			fail(span, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// send makes the request and returns the response when its status is want.
+// Any other response is closed and returned as an *Error.
+func (client *Client) send(ctx context.Context, op string, method string, path string, query url.Values, input any, want int) (*http.Response, error) {
+	target := client.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var body io.Reader
+	if input != nil {
+		encoded, err := json.Marshal(input)
+		if err != nil {
+			return nil, &Error{Op: op, Err: err}
+		}
+		body = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, &Error{Op: op, Err: err}
+	}
+	if input != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if actor, _ := ctx.Value(actorKey{}).(string); actor != "" {
+		request.Header.Set(actorHeader, actor)
+	}
+	if method == http.MethodPost {
+		key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+		if key == "" {
+			key = idempotency.NewKey()
+		}
+		request.Header.Set(idempotency.Header, key)
+	}
+
+	response, err := client.client.Do(request)
+	if err != nil {
+		return nil, &Error{Op: op, Err: err}
+	}
+	if method == http.MethodPost {
+		idempotency.MarkSpan(trace.SpanFromContext(ctx), idempotency.Replayed(response))
+	}
+	if response.StatusCode == want {
+		return response, nil
+	}
+	defer response.Body.Close()
+	failed := &Error{Op: op, Status: response.StatusCode}
+	failed.Problem, _ = problem.Decode(response)
+	return nil, failed
+}
+
+func fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,108 @@
+package dbclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cldmnky/observability-workshop/src/dbclient"
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+func TestErrorsMatchTheirKind(t *testing.T) {
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/notes/1":
+			problem.Write(response, request, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+		case "/notes/2":
+			problem.Unavailable(request, "database overloaded").Write(response)
+		default:
+			http.Error(response, "boom", http.StatusServiceUnavailable)
+		}
+	}))
+	client := dbclient.New(database.URL, database.Client())
+	ctx := context.Background()
+
+	if _, err := client.GetNote(ctx, 1); !errors.Is(err, dbclient.ErrConflict) || errors.Is(err, dbclient.ErrUnavailable) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	_, err := client.GetNote(ctx, 2)
+	var downstream *problem.Problem
+	if !errors.Is(err, dbclient.ErrUnavailable) || !errors.As(err, &downstream) || downstream.Detail != "database overloaded" {
+		t.Fatalf("expected an unavailable error with its problem, got %v", err)
+	}
+	var failed *dbclient.Error
+	if err := client.DeleteNote(ctx, 3); !errors.As(err, &failed) || failed.Status != http.StatusServiceUnavailable || failed.Problem != nil {
+		t.Fatalf("expected a plain 503 without a problem, got %#v", err)
+	}
+
+	database.Close()
+	if _, err := client.ListNotes(ctx, dbclient.NoteQuery{}); !errors.Is(err, dbclient.ErrUnavailable) {
+		t.Fatalf("expected an unreachable database unavailable, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.ListNotes(cancelled, dbclient.NoteQuery{}); errors.Is(err, dbclient.ErrUnavailable) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled call to be only cancelled, got %v", err)
+	}
+}
+
+func TestCallsAreTraced(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	var keys []string
+	database := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			keys = append(keys, request.Header.Get(idempotency.Header))
+			response.Header().Set(idempotency.ReplayedHeader, "true")
+			problem.WriteJSON(response, http.StatusCreated, dbclient.Event{ID: 7})
+			return
+		}
+		problem.Write(response, request, http.StatusNotFound, "note not found")
+	}))
+	defer database.Close()
+	client := dbclient.New(database.URL, database.Client())
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "GET /api/ok")
+	if _, err := client.CreateEvent(ctx, dbclient.EventInput{Route: "/api/ok"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := client.GetNote(ctx, 42); err == nil {
+		t.Fatal("expected the missing note to fail")
+	}
+	parent.End()
+
+	if len(keys) != 1 || len(keys[0]) != 32 {
+		t.Fatalf("expected a generated Idempotency-Key, got %q", keys)
+	}
+	ended := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		ended[span.Name()] = span
+	}
+	create, get := ended["dbclient.CreateEvent"], ended["dbclient.GetNote"]
+	if create == nil || get == nil || create.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("expected a child span per call, got %v", ended)
+	}
+	attributes := map[string]any{}
+	for _, attribute := range append(create.Attributes(), get.Attributes()...) {
+		attributes[string(attribute.Key)] = attribute.Value.AsInterface()
+	}
+	if attributes[idempotency.ReplayedAttributeKey] != true || attributes["note.id"] != int64(42) || attributes["peer.service"] != "database" {
+		t.Fatalf("expected the replay and note id recorded, got %v", attributes)
+	}
+	if get.Status().Code != codes.Error || create.Status().Code == codes.Error {
+		t.Fatalf("expected only the failed call marked as an error, got %v %v", create.Status(), get.Status())
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"embed"
-	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -22,7 +22,12 @@ import (
 	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/metric"
 
+	"github.com/cldmnky/observability-workshop/src/chaos"
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/proxy"
+	"github.com/cldmnky/observability-workshop/src/ratelimit"
 	"github.com/cldmnky/observability-workshop/src/telemetry"
+	"github.com/cldmnky/observability-workshop/src/tenant"
 )
 
 //go:embed static/*
@@ -39,13 +44,22 @@ type frontendApp struct {
 	client           *http.Client
 	backendURL       string
 	serviceName      string
+	traceURLTemplate string
 	requestsProxied  metric.Int64Counter
+	invalidRequests  metric.Int64Counter
+	tenants          *tenant.Labeler
+	// maxBodyBytes caps request bodies proxied to the backend; 0 disables
+	// the limit.
+	maxBodyBytes int64
 }
 
 func main() {
 	addr := envOrDefault("FRONTEND_ADDR", ":8080")
 	backendURL := strings.TrimRight(envOrDefault("BACKEND_URL", "http://backend:8081"), "/")
 	serviceName := envOrDefault("SERVICE_NAME", "frontend")
+	// TRACE_URL_TEMPLATE turns event trace ids into links, e.g. a Tempo or
+	// console trace view URL containing the {traceId} placeholder.
+	traceURLTemplate := envOrDefault("TRACE_URL_TEMPLATE", "")
 
 	// ------------------------------------------------------------------
 	// Telemetry – set up traces, metrics and logs when OTEL_ENABLED=true
@@ -68,6 +82,9 @@ func main() {
 
 	// OTel meter and application-specific counters.
 	var requestsProxied metric.Int64Counter
+	var invalidRequests metric.Int64Counter
+	var faultsInjected metric.Int64Counter
+	var rateLimited metric.Int64Counter
 	if telemetry.Enabled() {
 		meter := otel.Meter(serviceName)
 		var err error
@@ -79,30 +96,86 @@ func main() {
 		if err != nil {
 			slog.Error("creating frontend.requests.proxied_total counter", "err", err)
 		}
+		invalidRequests, err = meter.Int64Counter(
+			"frontend.requests.invalid",
+			metric.WithDescription("Requests rejected before proxying, by route and reason"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating frontend.requests.invalid counter", "err", err)
+		}
+		faultsInjected, err = meter.Int64Counter(
+			"frontend.faults.injected",
+			metric.WithDescription("Faults injected into requests, by fault route and kind"),
+			metric.WithUnit("{fault}"),
+		)
+		if err != nil {
+			slog.Error("creating frontend.faults.injected counter", "err", err)
+		}
+		rateLimited, err = meter.Int64Counter(
+			"frontend.ratelimit.requests",
+			metric.WithDescription("Rate-limited requests allowed or refused, by rule route, key type and decision"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			slog.Error("creating frontend.ratelimit.requests counter", "err", err)
+		}
+	}
+
+	// Rate limiting – a token bucket per client and route, configured by
+	// RATE_LIMIT_*. An invalid RATE_LIMIT_ROUTES keeps the default limit.
+	rateLimits, err := ratelimit.ConfigFromEnv()
+	if err != nil {
+		slog.Error("reading rate limits", "err", err)
+	}
+	limiter := ratelimit.New(rateLimits, rateLimited)
+
+	// Fault injection – /admin/faults and /admin/scenarios inject faults
+	// into incoming requests and into calls to the backend.
+	faults := chaos.NewInjector(faultsInjected)
+	scenarios := chaos.NewScenarios(faults, chaos.Presets("frontend"))
+	if telemetry.Enabled() {
+		if err := scenarios.RegisterGauge(otel.Meter(serviceName), "frontend.scenarios.active"); err != nil {
+			slog.Error("creating frontend.scenarios.active gauge", "err", err)
+		}
 	}
 
 	// HTTP client – wrap transport with otelhttp so outgoing requests
-	// carry W3C trace-context and are recorded as child spans.
-	clientTransport := http.DefaultTransport
+	// carry W3C trace-context and are recorded as child spans. The tenant
+	// transport forwards the caller's X-Forwarded-User to the backend.
+	// Outgoing faults sit inside otelhttp so the client span records them.
+	// Proxied requests bypass the client timeout, since an export may
+	// stream for longer, so the wait for response headers is bounded on the
+	// transport.
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	baseTransport.ResponseHeaderTimeout = 10 * time.Second
+	var clientTransport http.RoundTripper = faults.Transport(tenant.NewTransport(baseTransport),
+		chaos.PeersByURL(map[string]string{"backend": backendURL}))
 	if telemetry.Enabled() {
-		clientTransport = otelhttp.NewTransport(http.DefaultTransport)
+		clientTransport = otelhttp.NewTransport(clientTransport)
 	}
 	application := &frontendApp{
 		client:           &http.Client{Timeout: 10 * time.Second, Transport: clientTransport},
 		backendURL:       backendURL,
 		serviceName:      serviceName,
+		traceURLTemplate: traceURLTemplate,
 		requestsProxied:  requestsProxied,
+		invalidRequests:  invalidRequests,
+		tenants:          tenant.NewLabeler(tenant.DefaultLabelLimit),
+		maxBodyBytes:     int64(envIntOrDefault("FRONTEND_MAX_BODY_BYTES", 1<<20)),
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.FileServer(http.FS(staticFiles)))
 	mux.HandleFunc("/healthz", application.handleHealth)
+	mux.HandleFunc("/api/config", application.handleConfig)
 	mux.HandleFunc("/api/code", application.handleCodeList)
 	mux.HandleFunc("/api/code/", application.handleCodeFile)
 	mux.HandleFunc("/", application.handleHome)
 	mux.HandleFunc("/ping", application.handlePing)
 	mux.HandleFunc("/error", application.handleError)
 	mux.HandleFunc("/events", application.handleEvents)
+	mux.HandleFunc("/api/events/stats", application.handleEventStats)
 	mux.HandleFunc("/api/notes/export.md", application.handleNotesExport)
 	mux.HandleFunc("/api/notes", application.handleNotes)
 	mux.HandleFunc("/api/notes/", application.handleNoteByID)
@@ -114,13 +187,22 @@ func main() {
 	// those, add an otelhttp.WithFilter option to skip the path.
 	mux.Handle("/metrics", telemetry.MetricsHandler())
 
+	mux.Handle(chaos.AdminPath, faults)
+	mux.Handle(chaos.AdminPath+"/", faults)
+	mux.Handle(chaos.ScenariosPath, scenarios)
+	mux.Handle(chaos.ScenariosPath+"/", scenarios)
+
 	// otelhttp.NewHandler is the outermost layer for application routes: it
 	// extracts the incoming traceparent header, creates a server span, and
 	// enriches the request context before control passes inward.
 	// AccessLog middleware sits *inside* otelhttp so that it observes real
 	// HTTP status codes (otelhttp may override them) and records Prometheus
 	// metrics labelled by method/route/status.
-	var handler http.Handler = telemetry.AccessLog(serviceName, mux)
+	// tenant.Middleware resolves the caller's tenant from the OAuth proxy's
+	// X-Forwarded-User header so the backend and database scope their data.
+	// Refused and injected-fault requests sit inside AccessLog so they are
+	// logged; refused requests never reach a fault.
+	var handler http.Handler = tenant.Middleware(telemetry.AccessLog(serviceName, limiter.Middleware(faults.Middleware(mux))))
 	if telemetry.Enabled() {
 		// baggageMiddleware runs inside otelhttp so it enriches the already-extracted
 		// context; the W3C baggage header is then injected into all outgoing requests
@@ -162,14 +244,24 @@ func main() {
 }
 
 func (application *frontendApp) handleHealth(response http.ResponseWriter, _ *http.Request) {
-	writeJSON(response, http.StatusOK, map[string]string{"status": "ok", "service": application.serviceName})
+	problem.WriteJSON(response, http.StatusOK, map[string]string{"status": "ok", "service": application.serviceName})
+}
+
+// handleConfig exposes the runtime settings the single-page UI needs, such as
+// the template used to link events to their trace.
+func (application *frontendApp) handleConfig(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	problem.WriteJSON(response, http.StatusOK, map[string]string{"traceUrlTemplate": application.traceURLTemplate})
 }
 
 // handleCodeList returns a JSON array of all embedded source file paths,
 // relative to the code/ root (e.g. ["backend/main.go", "go.mod", ...]).
 func (application *frontendApp) handleCodeList(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
@@ -191,26 +283,26 @@ func (application *frontendApp) handleCodeList(response http.ResponseWriter, req
 		paths = []string{}
 	}
 	sort.Strings(paths)
-	writeJSON(response, http.StatusOK, map[string]any{"files": paths})
+	problem.WriteJSON(response, http.StatusOK, map[string]any{"files": paths})
 }
 
 // handleCodeFile returns the raw content of a single embedded source file.
 // The request path must be /api/code/<relative-path>, e.g. /api/code/backend/main.go.
 func (application *frontendApp) handleCodeFile(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	rel := strings.TrimPrefix(request.URL.Path, "/api/code/")
 	if rel == "" || strings.Contains(rel, "..") {
-		writeError(response, http.StatusBadRequest, "invalid path")
+		problem.Write(response, request, http.StatusBadRequest, "invalid path")
 		return
 	}
 
 	content, err := codeFiles.ReadFile("code/" + rel)
 	if err != nil {
-		writeError(response, http.StatusNotFound, "file not found")
+		problem.Write(response, request, http.StatusNotFound, "file not found")
 		return
 	}
 
@@ -221,17 +313,17 @@ func (application *frontendApp) handleCodeFile(response http.ResponseWriter, req
 
 func (application *frontendApp) handleHome(response http.ResponseWriter, request *http.Request) {
 	if request.URL.Path != "/" {
-		writeError(response, http.StatusNotFound, "not found")
+		problem.Write(response, request, http.StatusNotFound, "not found")
 		return
 	}
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	content, err := staticFiles.ReadFile("static/index.html")
 	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to load frontend")
+		problem.Write(response, request, http.StatusInternalServerError, "failed to load frontend")
 		return
 	}
 
@@ -242,7 +334,7 @@ func (application *frontendApp) handleHome(response http.ResponseWriter, request
 
 func (application *frontendApp) handlePing(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	application.forwardGet(response, request, "/api/ok")
@@ -250,7 +342,7 @@ func (application *frontendApp) handlePing(response http.ResponseWriter, request
 
 func (application *frontendApp) handleError(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	application.forwardGet(response, request, "/api/error")
@@ -258,15 +350,23 @@ func (application *frontendApp) handleError(response http.ResponseWriter, reques
 
 func (application *frontendApp) handleEvents(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	application.forwardGet(response, request, "/api/events")
 }
 
+func (application *frontendApp) handleEventStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	application.forwardGet(response, request, "/api/events/stats")
+}
+
 func (application *frontendApp) handleNotes(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet && request.Method != http.MethodPost {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	application.forwardWithRequestMethod(response, request, "/api/notes")
@@ -274,12 +374,12 @@ func (application *frontendApp) handleNotes(response http.ResponseWriter, reques
 
 func (application *frontendApp) handleNoteByID(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet && request.Method != http.MethodPut && request.Method != http.MethodDelete {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	identifier := strings.TrimPrefix(request.URL.Path, "/api/notes/")
 	if identifier == "" || strings.Contains(identifier, "/") {
-		writeError(response, http.StatusBadRequest, "invalid note id")
+		problem.Write(response, request, http.StatusBadRequest, "invalid note id")
 		return
 	}
 	application.forwardWithRequestMethod(response, request, "/api/notes/"+identifier)
@@ -287,7 +387,7 @@ func (application *frontendApp) handleNoteByID(response http.ResponseWriter, req
 
 func (application *frontendApp) handleNotesExport(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
-		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		problem.Write(response, request, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	application.forwardGet(response, request, "/api/notes/export.md")
@@ -301,40 +401,22 @@ func (application *frontendApp) forwardWithRequestMethod(response http.ResponseW
 	application.proxyToBackend(response, request, request.Method, path)
 }
 
+// proxyToBackend relays the request to the backend at path, streaming both
+// bodies.
 func (application *frontendApp) proxyToBackend(response http.ResponseWriter, request *http.Request, method string, path string) {
 	target := application.backendURL + path
-	var requestBody []byte
-
-	if request.Body != nil {
-		body, err := io.ReadAll(request.Body)
-		if err != nil {
-			writeError(response, http.StatusBadRequest, "failed to read request body")
-			return
-		}
-		requestBody = body
-	}
-
-	backendRequest, err := http.NewRequestWithContext(request.Context(), method, target, bytes.NewReader(requestBody))
-	if err != nil {
-		writeError(response, http.StatusInternalServerError, "failed to build backend request")
+	result := proxy.Proxy{
+		Transport:    application.client.Transport,
+		MaxBodyBytes: application.maxBodyBytes,
+	}.Serve(response, request, method, target)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(result.Err, &tooLarge):
+		application.writeBodyTooLarge(response, request, tooLarge)
 		return
-	}
-
-	contentType := request.Header.Get("Content-Type")
-	if contentType != "" {
-		backendRequest.Header.Set("Content-Type", contentType)
-	}
-
-	backendResponse, err := application.client.Do(backendRequest)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "backend unavailable")
-		return
-	}
-	defer backendResponse.Body.Close()
-
-	body, err := io.ReadAll(backendResponse.Body)
-	if err != nil {
-		writeError(response, http.StatusBadGateway, "failed reading backend response")
+	case result.Err != nil:
+		problem.Unavailable(request, "backend unavailable").Write(response)
 		return
 	}
 
@@ -346,7 +428,8 @@ func (application *frontendApp) proxyToBackend(response http.ResponseWriter, req
 			metric.WithAttributes(
 				attribute.String("method", method),
 				attribute.String("path", path),
-				attribute.Int("backend_status", backendResponse.StatusCode),
+				attribute.Int("backend_status", result.Status),
+				application.tenants.Attribute(request.Context()),
 			),
 		)
 	}
@@ -357,19 +440,34 @@ func (application *frontendApp) proxyToBackend(response http.ResponseWriter, req
 	slog.InfoContext(request.Context(), "proxied request to backend",
 		"method", method,
 		"path", path,
-		"backend_status", backendResponse.StatusCode,
+		"backend_status", result.Status,
 		"target", target,
+		"response_bytes", result.ResponseBytes,
 	)
+}
 
-	if downstreamType := backendResponse.Header.Get("Content-Type"); downstreamType != "" {
-		response.Header().Set("Content-Type", downstreamType)
-	}
-	if disposition := backendResponse.Header.Get("Content-Disposition"); disposition != "" {
-		response.Header().Set("Content-Disposition", disposition)
+// writeBodyTooLarge answers a request whose body is over maxBodyBytes with a
+// 413 listing the violation, like the database's own validation, and counts
+// it in frontend.requests.invalid.
+func (application *frontendApp) writeBodyTooLarge(response http.ResponseWriter, request *http.Request, tooLarge *http.MaxBytesError) {
+	if application.invalidRequests != nil {
+		// Collapse note ids so the route label stays bounded.
+		route := request.URL.Path
+		if strings.HasPrefix(route, "/api/notes/") && route != "/api/notes/export.md" {
+			route = "/api/notes/{id}"
+		}
+		application.invalidRequests.Add(request.Context(), 1,
+			metric.WithAttributes(
+				attribute.String("route", route),
+				attribute.String("reason", "body_too_large"),
+			),
+		)
 	}
-
-	response.WriteHeader(backendResponse.StatusCode)
-	_, _ = response.Write(body)
+	problem.Invalid(request, http.StatusRequestEntityTooLarge, []problem.Violation{{
+		Field:   "body",
+		Reason:  "body_too_large",
+		Message: fmt.Sprintf("body must be at most %d bytes", tooLarge.Limit),
+	}}).Write(response)
 }
 
 func envOrDefault(key string, fallback string) string {
@@ -380,6 +478,14 @@ func envOrDefault(key string, fallback string) string {
 	return value
 }
 
+func envIntOrDefault(key string, fallback int) int {
+	value, err := strconv.Atoi(envOrDefault(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 // baggageMiddleware injects standard request metadata as W3C baggage so that
 // all downstream services (backend, database) can expose it as span attributes
 // without any application-level plumbing.
@@ -392,13 +498,3 @@ func baggageMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
-
-func writeError(response http.ResponseWriter, statusCode int, message string) {
-	writeJSON(response, statusCode, map[string]string{"error": message})
-}
-
-func writeJSON(response http.ResponseWriter, statusCode int, payload any) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(statusCode)
-	_ = json.NewEncoder(response).Encode(payload)
-}
@@ -12,10 +12,25 @@ function setStatus(message) {
   statusMessage.textContent = message;
 }
 
+// requestError turns a failed response into an Error. Every service answers
+// with an RFC 7807 problem document, so include its detail and trace_id: the
+// trace id is what to search for in Tempo when reporting the failure.
+async function requestError(response, fallback) {
+  if (!(response.headers.get('Content-Type') || '').startsWith('application/problem+json')) {
+    return new Error(fallback);
+  }
+  const problem = await response.json().catch(() => ({}));
+  let message = problem.detail ? `${fallback}: ${problem.detail}` : fallback;
+  if (problem.trace_id) {
+    message += ` (trace ${problem.trace_id})`;
+  }
+  return new Error(message);
+}
+
 async function getNotes() {
-  const response = await fetch('/api/notes');
+  const response = await fetch('/api/notes?render=html');
   if (!response.ok) {
-    throw new Error('Failed to load notes');
+    throw await requestError(response, 'Failed to load notes');
   }
   const payload = await response.json();
   return payload.notes || [];
@@ -29,7 +44,7 @@ async function createNote(title, content) {
   });
 
   if (!response.ok) {
-    throw new Error('Failed to save note');
+    throw await requestError(response, 'Failed to save note');
   }
 }
 
@@ -41,7 +56,7 @@ async function updateNote(id, title, content) {
   });
 
   if (!response.ok) {
-    throw new Error('Failed to update note');
+    throw await requestError(response, 'Failed to update note');
   }
 }
 
@@ -51,7 +66,7 @@ async function deleteNote(id) {
   });
 
   if (!response.ok) {
-    throw new Error('Failed to delete note');
+    throw await requestError(response, 'Failed to delete note');
   }
 }
 
@@ -93,12 +108,15 @@ function renderNotes(notes) {
     const card = fragment.querySelector('.note-card');
     const titleField = fragment.querySelector('.note-title');
     const contentField = fragment.querySelector('.note-content');
+    const preview = fragment.querySelector('.note-preview');
     const meta = fragment.querySelector('.note-meta');
     const saveButton = fragment.querySelector('.save-button');
     const deleteButton = fragment.querySelector('.delete-button');
 
     titleField.value = note.title;
     contentField.value = note.content;
+    // The database sanitises rendered markdown, so it is safe to insert.
+    preview.innerHTML = note.html || '';
     meta.textContent = `Created ${formatTimestamp(note.createdAt)} • Updated ${formatTimestamp(note.updatedAt)}`;
 
     saveButton.addEventListener('click', async () => {
@@ -173,7 +191,7 @@ exportButton.addEventListener('click', async () => {
   try {
     const response = await fetch('/api/notes/export.md');
     if (!response.ok) {
-      throw new Error('Failed to export notes');
+      throw await requestError(response, 'Failed to export notes');
     }
 
     const blob = await response.blob();
@@ -194,36 +212,238 @@ exportButton.addEventListener('click', async () => {
 refreshNotes();
 
 // ---------------------------------------------------------------------------
-// Tab switching – Notes ↔ Source Code
+// Tab switching – Notes ↔ Events ↔ Source Code
 // ---------------------------------------------------------------------------
 
 const tabNotes    = document.getElementById('tabNotes');
+const tabEvents   = document.getElementById('tabEvents');
 const tabSource   = document.getElementById('tabSource');
 const panelNotes  = document.getElementById('panelNotes');
+const panelEvents = document.getElementById('panelEvents');
 const panelSource = document.getElementById('panelSource');
 
+const tabPanels = new Map([
+  [tabNotes, panelNotes],
+  [tabEvents, panelEvents],
+  [tabSource, panelSource],
+]);
+
 let sourceTabInitialised = false;
 
 function activateTab(tab) {
-  const isSource = tab === tabSource;
-
-  tabNotes.classList.toggle('tab-active', !isSource);
-  tabNotes.setAttribute('aria-selected', String(!isSource));
-  tabSource.classList.toggle('tab-active', isSource);
-  tabSource.setAttribute('aria-selected', String(isSource));
+  for (const [candidate, panel] of tabPanels) {
+    const active = candidate === tab;
+    candidate.classList.toggle('tab-active', active);
+    candidate.setAttribute('aria-selected', String(active));
+    panel.hidden = !active;
+  }
 
-  panelNotes.hidden  =  isSource;
-  panelSource.hidden = !isSource;
+  if (tab === tabEvents) {
+    refreshEvents();
+  }
 
-  if (isSource && !sourceTabInitialised) {
+  if (tab === tabSource && !sourceTabInitialised) {
     sourceTabInitialised = true;
     initSourceTab();
   }
 }
 
 tabNotes.addEventListener('click',  () => activateTab(tabNotes));
+tabEvents.addEventListener('click', () => activateTab(tabEvents));
 tabSource.addEventListener('click', () => activateTab(tabSource));
 
+// ---------------------------------------------------------------------------
+// Events tab – recent events with links to their trace
+// ---------------------------------------------------------------------------
+
+const eventsBody       = document.getElementById('eventsBody');
+const eventCount       = document.getElementById('eventCount');
+const eventFilterForm  = document.getElementById('eventFilterForm');
+const traceFilterInput = document.getElementById('traceFilterInput');
+const clearTraceFilter = document.getElementById('clearTraceFilter');
+const eventsChart      = document.getElementById('eventsChart');
+const routeErrorList   = document.getElementById('routeErrorList');
+
+/**
+ * Runtime settings from /api/config. traceUrlTemplate contains a {traceId}
+ * placeholder, e.g. a Tempo or console trace view URL.
+ */
+const appConfig = fetch('/api/config')
+  .then(response => (response.ok ? response.json() : {}))
+  .catch(() => ({}));
+
+function traceLink(traceId, template) {
+  if (!traceId) {
+    const none = document.createElement('span');
+    none.className = 'event-trace-none';
+    none.textContent = '—';
+    return none;
+  }
+
+  const label = traceId.slice(0, 8) + '…';
+  if (!template) {
+    const code = document.createElement('code');
+    code.textContent = label;
+    code.title = traceId;
+    return code;
+  }
+
+  const anchor = document.createElement('a');
+  anchor.href = template.replaceAll('{traceId}', encodeURIComponent(traceId));
+  anchor.target = '_blank';
+  anchor.rel = 'noopener';
+  anchor.textContent = label;
+  anchor.title = traceId;
+  return anchor;
+}
+
+function renderEvents(events, template) {
+  eventCount.textContent = `${events.length} event${events.length === 1 ? '' : 's'}`;
+  eventsBody.innerHTML = '';
+
+  if (events.length === 0) {
+    const row = document.createElement('tr');
+    const cell = document.createElement('td');
+    cell.colSpan = 7;
+    cell.className = 'empty-state';
+    cell.textContent = 'No events recorded yet. Use the app to generate some.';
+    row.appendChild(cell);
+    eventsBody.appendChild(row);
+    return;
+  }
+
+  for (const evt of events) {
+    const row = document.createElement('tr');
+    const cells = [
+      `#${evt.id}`,
+      formatTimestamp(evt.createdAt),
+      evt.source,
+      `${evt.method} ${evt.route}`,
+      String(evt.status),
+      evt.message,
+    ];
+    for (const text of cells) {
+      const cell = document.createElement('td');
+      cell.textContent = text;
+      row.appendChild(cell);
+    }
+    if (evt.status >= 400) {
+      row.classList.add('event-error');
+    }
+
+    const traceCell = document.createElement('td');
+    traceCell.appendChild(traceLink(evt.traceId, template));
+    row.appendChild(traceCell);
+
+    eventsBody.appendChild(row);
+  }
+}
+
+/**
+ * Draw one bar per minute of the stats window. Buckets without events are
+ * not returned by the API, so the gaps are filled with empty bars.
+ */
+function renderEventsChart(stats) {
+  eventsChart.innerHTML = '';
+
+  const byBucket = new Map(stats.series.map(point => [Date.parse(point.bucketStart), point]));
+  const bucketMs = 60 * 1000;
+  const end = Math.floor(Date.parse(stats.to) / bucketMs) * bucketMs;
+  const start = Math.floor(Date.parse(stats.from) / bucketMs) * bucketMs;
+  const peak = Math.max(1, ...stats.series.map(point => point.count));
+
+  for (let bucket = start; bucket <= end; bucket += bucketMs) {
+    const point = byBucket.get(bucket) || { count: 0, errors: 0 };
+    const bar = document.createElement('div');
+    bar.className = 'bar';
+    bar.style.height = `${(point.count / peak) * 100}%`;
+    bar.title = `${new Date(bucket).toLocaleTimeString()}: ${point.count} events, ${point.errors} errors`;
+
+    if (point.errors > 0) {
+      const errors = document.createElement('div');
+      errors.className = 'bar-errors';
+      errors.style.height = `${(point.errors / point.count) * 100}%`;
+      bar.appendChild(errors);
+    }
+    eventsChart.appendChild(bar);
+  }
+}
+
+function renderRouteErrors(routes) {
+  routeErrorList.innerHTML = '';
+
+  if (routes.length === 0) {
+    const item = document.createElement('li');
+    item.className = 'empty-state';
+    item.textContent = 'No events in the last hour.';
+    routeErrorList.appendChild(item);
+    return;
+  }
+
+  for (const route of routes) {
+    const item = document.createElement('li');
+    const label = document.createElement('span');
+    label.className = 'route-errors-label';
+    label.textContent = route.route;
+
+    const meter = document.createElement('span');
+    meter.className = 'route-errors-meter';
+    const fill = document.createElement('span');
+    fill.style.width = `${route.errorRatio * 100}%`;
+    meter.appendChild(fill);
+
+    const value = document.createElement('span');
+    value.className = 'route-errors-value';
+    value.textContent = `${Math.round(route.errorRatio * 100)}% of ${route.count}`;
+
+    item.append(label, meter, value);
+    routeErrorList.appendChild(item);
+  }
+}
+
+async function refreshEventStats() {
+  try {
+    const response = await fetch('/api/events/stats?window=1h&bucket=1m');
+    if (!response.ok) {
+      throw new Error('Failed to load event stats');
+    }
+    const stats = await response.json();
+    renderEventsChart(stats);
+    renderRouteErrors(stats.routes || []);
+  } catch (error) {
+    eventsChart.textContent = error.message;
+  }
+}
+
+async function refreshEvents() {
+  refreshEventStats();
+
+  const traceId = traceFilterInput.value.trim();
+  const query = traceId ? `?trace_id=${encodeURIComponent(traceId)}` : '';
+
+  try {
+    const response = await fetch(`/events${query}`);
+    if (!response.ok) {
+      throw new Error('Failed to load events');
+    }
+    const payload = await response.json();
+    const { traceUrlTemplate = '' } = await appConfig;
+    renderEvents(payload.events || [], traceUrlTemplate);
+  } catch (error) {
+    eventCount.textContent = error.message;
+  }
+}
+
+eventFilterForm.addEventListener('submit', event => {
+  event.preventDefault();
+  refreshEvents();
+});
+
+clearTraceFilter.addEventListener('click', () => {
+  traceFilterInput.value = '';
+  refreshEvents();
+});
+
 // ---------------------------------------------------------------------------
 // Source Code tab – file tree + Monaco editor
 // ---------------------------------------------------------------------------
@@ -0,0 +1,55 @@
+// Package idempotency holds the Idempotency-Key conventions shared by the
+// services. The database stores the response to each keyed POST and replays
+// it when the key is seen again; callers attach a fresh key to every logical
+// write so retries of it cannot create duplicate rows.
+package idempotency
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Header carries the client-chosen key of a write.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set to "true" on responses replayed from a stored
+	// earlier response.
+	ReplayedHeader = "Idempotent-Replayed"
+	// ReplayedAttributeKey is the span attribute recording whether a keyed
+	// response was replayed.
+	ReplayedAttributeKey = "http.idempotency.replayed"
+	// MaxKeyLength bounds the length of a key.
+	MaxKeyLength = 255
+)
+
+// NewKey returns a random key for one logical write.
+func NewKey() string {
+	var key [16]byte
+	_, _ = rand.Read(key[:])
+	return hex.EncodeToString(key[:])
+}
+
+// Ensure sets Header on request to a new key unless it already has one, and
+// returns the key.
+func Ensure(request *http.Request) string {
+	key := request.Header.Get(Header)
+	if key == "" {
+		key = NewKey()
+		request.Header.Set(Header, key)
+	}
+	return key
+}
+
+// Replayed reports whether response was replayed by the database.
+func Replayed(response *http.Response) bool {
+	return response.Header.Get(ReplayedHeader) == "true"
+}
+
+// MarkSpan records on span whether a keyed response was replayed.
+func MarkSpan(span trace.Span, replayed bool) {
+	span.SetAttributes(attribute.Bool(ReplayedAttributeKey, replayed))
+}
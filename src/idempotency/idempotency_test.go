@@ -0,0 +1,23 @@
+package idempotency_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+)
+
+func TestEnsureKeepsExistingKey(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/events", nil)
+	generated := idempotency.Ensure(request)
+	if len(generated) != 32 || request.Header.Get(idempotency.Header) != generated {
+		t.Fatalf("expected a generated 32 character key, got %q", generated)
+	}
+	if again := idempotency.Ensure(request); again != generated {
+		t.Fatalf("expected Ensure to keep %q, got %q", generated, again)
+	}
+	if idempotency.NewKey() == idempotency.NewKey() {
+		t.Fatal("expected distinct keys")
+	}
+}
@@ -0,0 +1,219 @@
+package notification_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cldmnky/observability-workshop/src/notification"
+)
+
+// schema is the subset of JSON Schema used by notifier/notify.schema.json.
+type schema struct {
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Properties           map[string]*schema `json:"properties"`
+	Const                any                `json:"const"`
+	Enum                 []any              `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	MinLength            *int               `json:"minLength"`
+	Format               string             `json:"format"`
+}
+
+func loadSchema(t *testing.T) *schema {
+	t.Helper()
+	raw, err := os.ReadFile("../notifier/notify.schema.json")
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	var loaded schema
+	if err := json.Unmarshal(raw, &loaded); err != nil {
+		t.Fatalf("parse schema: %v", err)
+	}
+	return &loaded
+}
+
+// check returns every way value breaks rules, which is flat: an object of
+// scalar properties.
+func (rules *schema) check(value any) []string {
+	object, ok := value.(map[string]any)
+	if rules.Type != "object" || !ok {
+		return []string{"payload must be an object"}
+	}
+	var problems []string
+	for _, name := range rules.Required {
+		if _, present := object[name]; !present {
+			problems = append(problems, name+" is required")
+		}
+	}
+	for name, field := range object {
+		property, known := rules.Properties[name]
+		if !known {
+			if rules.AdditionalProperties != nil && !*rules.AdditionalProperties {
+				problems = append(problems, name+" is not allowed")
+			}
+			continue
+		}
+		problems = append(problems, property.checkField(name, field)...)
+	}
+	return problems
+}
+
+func (rules *schema) checkField(name string, value any) []string {
+	var problems []string
+	switch rules.Type {
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return []string{name + " must be an integer"}
+		}
+		if rules.Minimum != nil && number < *rules.Minimum {
+			problems = append(problems, fmt.Sprintf("%s must be at least %v", name, *rules.Minimum))
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []string{name + " must be a string"}
+		}
+		if rules.MinLength != nil && len(text) < *rules.MinLength {
+			problems = append(problems, fmt.Sprintf("%s must be at least %d characters", name, *rules.MinLength))
+		}
+		if _, err := time.Parse(time.RFC3339, text); rules.Format == "date-time" && err != nil {
+			problems = append(problems, name+" must be an RFC 3339 date-time")
+		}
+	}
+	if rules.Const != nil && value != rules.Const {
+		problems = append(problems, fmt.Sprintf("%s must be %v", name, rules.Const))
+	}
+	if rules.Enum != nil && !slices.Contains(rules.Enum, value) {
+		problems = append(problems, fmt.Sprintf("%s must be one of %v", name, rules.Enum))
+	}
+	return problems
+}
+
+func asJSON(t *testing.T, payload any) any {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded any
+	_ = json.Unmarshal(raw, &decoded)
+	return decoded
+}
+
+func TestPayloadsMatchTheNotifierSchema(t *testing.T) {
+	rules := loadSchema(t)
+	if rules.Properties["schema_version"].Const != float64(notification.SchemaVersion) {
+		t.Fatalf("expected the schema to describe version %d, got %v", notification.SchemaVersion, rules.Properties["schema_version"].Const)
+	}
+	enum := rules.Properties["action"].Enum
+	if len(enum) != len(notification.Actions) {
+		t.Fatalf("expected schema actions %v, got %v", notification.Actions, enum)
+	}
+
+	at := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	for _, action := range notification.Actions {
+		payload := notification.New(action, 42, "Groceries", "user1", at)
+		if err := payload.Validate(); err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+		if problems := rules.check(asJSON(t, payload)); len(problems) > 0 {
+			t.Fatalf("%s payload breaks the schema: %v", action, problems)
+		}
+	}
+	if got := asJSON(t, notification.New(notification.ActionDeleted, 7, "", "user1", at)).(map[string]any)["timestamp"]; got != "2026-03-01T11:30:00Z" {
+		t.Fatalf("expected the timestamp in UTC, got %v", got)
+	}
+}
+
+func TestInvalidPayloadsAreRejectedOnBothSides(t *testing.T) {
+	rules := loadSchema(t)
+	valid := notification.New(notification.ActionUpdated, 1, "title", "user1", time.Now())
+
+	for name, test := range map[string]struct {
+		change func(*notification.Payload)
+		want   string
+	}{
+		"version":     {func(payload *notification.Payload) { payload.SchemaVersion = 2 }, "schema_version must be 1"},
+		"action":      {func(payload *notification.Payload) { payload.Action = "archived" }, "action must be one of"},
+		"missing id":  {func(payload *notification.Payload) { payload.NoteID = 0 }, "note_id must be at least 1"},
+		"empty actor": {func(payload *notification.Payload) { payload.Actor = "" }, "actor is required"},
+	} {
+		payload := valid
+		test.change(&payload)
+		err := payload.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Fatalf("%s: expected Validate to fail with %q, got %v", name, test.want, err)
+		}
+		if problems := rules.check(asJSON(t, payload)); len(problems) == 0 {
+			t.Fatalf("%s: expected the schema to reject the payload too", name)
+		}
+	}
+
+	// The payload the backend sent before versioning lacks most fields.
+	if problems := rules.check(map[string]any{"action": "deleted", "title": ""}); len(problems) != 4 {
+		t.Fatalf("expected the unversioned payload to miss 4 fields, got %v", problems)
+	}
+	if problems := rules.check(map[string]any{"extra": true}); !slices.Contains(problems, "extra is not allowed") {
+		t.Fatalf("expected unknown fields rejected, got %v", problems)
+	}
+}
+
+// sharedPayloads are the payloads in notifier/testdata/payloads.json, which
+// the notifier's test_app.py also checks against its NotifyRequest model.
+type sharedPayloads struct {
+	Valid   map[string]json.RawMessage `json:"valid"`
+	Invalid map[string]json.RawMessage `json:"invalid"`
+}
+
+func loadSharedPayloads(t *testing.T) sharedPayloads {
+	t.Helper()
+	raw, err := os.ReadFile("../notifier/testdata/payloads.json")
+	if err != nil {
+		t.Fatalf("read payloads: %v", err)
+	}
+	var loaded sharedPayloads
+	if err := json.Unmarshal(raw, &loaded); err != nil {
+		t.Fatalf("parse payloads: %v", err)
+	}
+	if len(loaded.Valid) == 0 || len(loaded.Invalid) == 0 {
+		t.Fatal("expected both valid and invalid payloads")
+	}
+	return loaded
+}
+
+func TestSharedPayloadsMatchTheSchemaAndPayload(t *testing.T) {
+	rules := loadSchema(t)
+	payloads := loadSharedPayloads(t)
+
+	for name, raw := range payloads.Valid {
+		var decoded any
+		_ = json.Unmarshal(raw, &decoded)
+		if problems := rules.check(decoded); len(problems) > 0 {
+			t.Fatalf("%s: expected the schema to accept the payload, got %v", name, problems)
+		}
+		var payload notification.Payload
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&payload); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if err := payload.Validate(); err != nil {
+			t.Fatalf("%s: expected Validate to accept the payload, got %v", name, err)
+		}
+	}
+	for name, raw := range payloads.Invalid {
+		var decoded any
+		_ = json.Unmarshal(raw, &decoded)
+		if problems := rules.check(decoded); len(problems) == 0 {
+			t.Fatalf("%s: expected the schema to reject the payload", name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package notification defines the payload the backend POSTs to the
+// notifier's /notify for every note create, update and delete.
+//
+// The payload is versioned. notifier/notify.schema.json is the contract for
+// SchemaVersion, and the notifier's NotifyRequest model accepts exactly that
+// schema. The payloads in notifier/testdata/payloads.json are checked against
+// Payload and the schema by the contract test in this package, and against
+// the model by the notifier's test_app.py. A change to any of them that
+// breaks the others fails a test instead of reaching the notifier as silently
+// defaulted fields.
+package notification
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the payload schema this package sends.
+const SchemaVersion = 1
+
+// Note lifecycle actions.
+const (
+	ActionCreated = "created"
+	ActionUpdated = "updated"
+	ActionDeleted = "deleted"
+)
+
+// Actions lists every valid Action.
+var Actions = []string{ActionCreated, ActionUpdated, ActionDeleted}
+
+// Payload is one note lifecycle notification.
+type Payload struct {
+	SchemaVersion int    `json:"schema_version"`
+	Action        string `json:"action"`
+	NoteID        int    `json:"note_id"`
+	// Title is the note's title after the change, or before it for deletes.
+	Title string `json:"title"`
+	// Actor is who made the change, resolved like the database's audit
+	// actor: the X-Actor header, then the actor.id baggage member, then the
+	// tenant.
+	Actor string `json:"actor"`
+	// Timestamp is when the change was made, in UTC.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// New returns a Payload of the current SchemaVersion for a change made at
+// now.
+func New(action string, noteID int, title, actor string, now time.Time) Payload {
+	return Payload{
+		SchemaVersion: SchemaVersion,
+		Action:        action,
+		NoteID:        noteID,
+		Title:         title,
+		Actor:         actor,
+		Timestamp:     now.UTC().Truncate(time.Second),
+	}
+}
+
+// Validate reports every way payload breaks the schema, so a bad payload is
+// rejected before it is sent rather than by the notifier.
+func (payload Payload) Validate() error {
+	var problems []string
+	if payload.SchemaVersion != SchemaVersion {
+		problems = append(problems, fmt.Sprintf("schema_version must be %d, got %d", SchemaVersion, payload.SchemaVersion))
+	}
+	if !slices.Contains(Actions, payload.Action) {
+		problems = append(problems, fmt.Sprintf("action must be one of %s, got %q", strings.Join(Actions, ", "), payload.Action))
+	}
+	if payload.NoteID < 1 {
+		problems = append(problems, fmt.Sprintf("note_id must be at least 1, got %d", payload.NoteID))
+	}
+	if payload.Actor == "" {
+		problems = append(problems, "actor is required")
+	}
+	if payload.Timestamp.IsZero() {
+		problems = append(problems, "timestamp is required")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid notification: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -13,21 +13,124 @@ Endpoints:
 """
 
 import os
+import uuid
+from datetime import datetime
+from http import HTTPStatus
+from typing import Literal
 
 import httpx
-from fastapi import FastAPI, HTTPException
-from pydantic import BaseModel
+from fastapi import FastAPI, Header, HTTPException, Request
+from fastapi.exceptions import RequestValidationError
+from fastapi.responses import JSONResponse
+from pydantic import BaseModel, ConfigDict, Field, StrictInt, StrictStr, field_validator
 
 app = FastAPI(title="notifier")
 
 DATABASE_URL = os.environ.get("DATABASE_API_URL", "http://database:8082").rstrip("/")
 SERVICE_NAME = os.environ.get("SERVICE_NAME", "notifier")
 
+# Trusted header naming the workshop user (tenant) a request belongs to.
+# Forwarded to the database so notifier events land in the caller's tenant.
+TENANT_HEADER = "X-Forwarded-User"
+
+# The database replays POSTs repeated with the same key instead of storing a
+# duplicate event. The caller's key is reused so a retried /notify records
+# its event once.
+IDEMPOTENCY_HEADER = "Idempotency-Key"
+
+# Errors are RFC 7807 problem documents, like the Go services' (src/problem).
+PROBLEM_CONTENT_TYPE = "application/problem+json"
+
+
+def trace_id(request: Request) -> str:
+    """Return the trace id from the incoming W3C traceparent header."""
+    parts = request.headers.get("traceparent", "").split("-")
+    return parts[1] if len(parts) == 4 else ""
+
+
+def problem_response(request: Request, status: int, title: str, detail: str, **extra) -> JSONResponse:
+    body = {
+        "type": extra.pop("type", "about:blank"),
+        "title": title,
+        "status": status,
+        "detail": detail,
+        "instance": request.url.path,
+        **extra,
+    }
+    if tid := trace_id(request):
+        body["trace_id"] = tid
+    return JSONResponse(body, status_code=status, media_type=PROBLEM_CONTENT_TYPE)
+
+
+class DownstreamProblem(Exception):
+    """A problem document returned by the database, relayed unchanged."""
+
+    def __init__(self, status: int, body: dict):
+        self.status = status
+        self.body = body
+
+
+@app.exception_handler(HTTPException)
+def http_problem(request: Request, exc: HTTPException) -> JSONResponse:
+    title = HTTPStatus(exc.status_code).phrase
+    return problem_response(request, exc.status_code, title, str(exc.detail))
+
+
+@app.exception_handler(RequestValidationError)
+def validation_problem(request: Request, exc: RequestValidationError) -> JSONResponse:
+    violations = [
+        {
+            "field": ".".join(str(part) for part in error["loc"] if part != "body"),
+            "reason": error["type"],
+            "message": error["msg"],
+        }
+        for error in exc.errors()
+    ]
+    return problem_response(
+        request,
+        422,
+        "Invalid request body",
+        "invalid request body",
+        type="/problems/validation",
+        violations=violations,
+    )
+
+
+@app.exception_handler(DownstreamProblem)
+def downstream_problem(_: Request, exc: DownstreamProblem) -> JSONResponse:
+    return JSONResponse(exc.body, status_code=exc.status, media_type=PROBLEM_CONTENT_TYPE)
+
+
+# Version of the /notify payload this notifier accepts.
+SCHEMA_VERSION = 1
+
 
 class NotifyRequest(BaseModel):
-    action: str  # "created" | "updated" | "deleted"
-    title: str = ""
-    note_id: int = 0
+    """
+    Version 1 of the /notify payload, as described by notify.schema.json.
+
+    Every field is required and unknown fields are rejected, so a payload
+    that does not match the backend's (src/notification) fails with a 422
+    validation problem instead of being filled in with defaults. test_app.py
+    checks this model against the schema and the payloads in testdata, which
+    the Go contract test in src/notification checks against Payload.
+    """
+
+    model_config = ConfigDict(extra="forbid")
+
+    schema_version: StrictInt
+    action: Literal["created", "updated", "deleted"]
+    note_id: StrictInt = Field(ge=1)
+    title: StrictStr
+    actor: StrictStr = Field(min_length=1)
+    timestamp: datetime
+
+    @field_validator("schema_version")
+    @classmethod
+    def supported_version(cls, version: int) -> int:
+        if version != SCHEMA_VERSION:
+            raise ValueError(f"unsupported schema_version {version}, this notifier accepts {SCHEMA_VERSION}")
+        return version
 
 
 @app.get("/healthz")
@@ -36,7 +139,11 @@ def health() -> dict:
 
 
 @app.post("/notify")
-def notify(req: NotifyRequest) -> dict:
+def notify(
+    req: NotifyRequest,
+    x_forwarded_user: str | None = Header(default=None),
+    idempotency_key: str | None = Header(default=None),
+) -> dict:
     """
     Record a note lifecycle event in the database service.
 
@@ -44,8 +151,10 @@ def notify(req: NotifyRequest) -> dict:
     (backend → notifier → database) appears in the distributed trace once
     auto-instrumentation is enabled via the OTel Operator.
     """
-    label = req.title if req.title else f"note_id={req.note_id}"
-    message = f"note {req.action}: {label}"
+    message = f"note {req.action}: {req.title} (note_id={req.note_id}, actor={req.actor})"
+    headers = {IDEMPOTENCY_HEADER: idempotency_key or str(uuid.uuid4())}
+    if x_forwarded_user:
+        headers[TENANT_HEADER] = x_forwarded_user
 
     try:
         with httpx.Client(timeout=5.0) as client:
@@ -58,9 +167,12 @@ def notify(req: NotifyRequest) -> dict:
                     "status": 200,
                     "message": message,
                 },
+                headers=headers,
             )
+            if resp.is_error and resp.headers.get("content-type", "").startswith(PROBLEM_CONTENT_TYPE):
+                raise DownstreamProblem(resp.status_code, resp.json())
             resp.raise_for_status()
     except httpx.HTTPError as exc:
         raise HTTPException(status_code=502, detail=str(exc)) from exc
 
-    return {"status": "ok", "service": SERVICE_NAME, "action": req.action}
+    return {"status": "ok", "service": SERVICE_NAME, "action": req.action, "note_id": req.note_id}
@@ -0,0 +1,39 @@
+"""
+Contract tests for NotifyRequest.
+
+testdata/payloads.json is shared with the Go contract test in
+src/notification, which checks the same payloads against notify.schema.json
+and the backend's Payload. Run with:
+
+  pip install -r requirements-dev.txt && pytest
+"""
+
+import json
+from pathlib import Path
+
+import pytest
+from pydantic import ValidationError
+
+from app import SCHEMA_VERSION, NotifyRequest
+
+HERE = Path(__file__).parent
+SCHEMA = json.loads((HERE / "notify.schema.json").read_text())
+PAYLOADS = json.loads((HERE / "testdata" / "payloads.json").read_text())
+
+
+@pytest.mark.parametrize("payload", list(PAYLOADS["valid"].values()), ids=list(PAYLOADS["valid"]))
+def test_valid_payloads_are_accepted(payload):
+    NotifyRequest.model_validate(payload)
+
+
+@pytest.mark.parametrize("payload", list(PAYLOADS["invalid"].values()), ids=list(PAYLOADS["invalid"]))
+def test_invalid_payloads_are_rejected(payload):
+    with pytest.raises(ValidationError):
+        NotifyRequest.model_validate(payload)
+
+
+def test_model_fields_match_the_schema():
+    model = NotifyRequest.model_json_schema()
+    assert set(model["properties"]) == set(SCHEMA["properties"])
+    assert set(model["required"]) == set(SCHEMA["required"])
+    assert SCHEMA_VERSION == SCHEMA["properties"]["schema_version"]["const"]
@@ -0,0 +1,153 @@
+// Package problem writes the JSON responses shared by every service: RFC 7807
+// application/problem+json documents for errors, and plain JSON otherwise.
+//
+// Each problem carries the trace_id of the request that failed, so a user
+// reporting an error message gives operators a trace to search for in Tempo
+// and Loki. Proxies relay downstream problems unchanged (see Decode) so the
+// detail and trace_id of the service that failed reach the browser.
+package problem
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ContentType is the media type of problem documents.
+const ContentType = "application/problem+json"
+
+// Problem type URIs. They are relative references identifying the kind of
+// problem; anything without a more specific type uses TypeDefault.
+const (
+	TypeDefault      = "about:blank"
+	TypeValidation   = "/problems/validation"
+	TypeBodyTooLarge = "/problems/body-too-large"
+	TypeUnavailable  = "/problems/upstream-unavailable"
+	// TypeIdempotencyKeyReused is used when an Idempotency-Key is repeated
+	// with a different request body.
+	TypeIdempotencyKeyReused = "/problems/idempotency-key-reused"
+	// TypeFaultInjected is used for errors produced by the chaos package
+	// rather than by a handler.
+	TypeFaultInjected = "/problems/fault-injected"
+	// TypeCircuitOpen is used when a call is not sent because the circuit
+	// breaker for the downstream service is open.
+	TypeCircuitOpen = "/problems/circuit-open"
+	// TypeRateLimited is used for requests refused by the ratelimit
+	// package because their client sent too many.
+	TypeRateLimited = "/problems/rate-limited"
+)
+
+// Violation is one problem with a request body, listed by validation
+// problems.
+type Violation struct {
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 problem detail. It implements error so downstream
+// problems can be returned through client code and relayed by proxies.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// TraceID is the hex id of the trace the failing request belongs to.
+	TraceID string `json:"trace_id,omitempty"`
+	// Violations is an extension member set on validation problems.
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// New returns a TypeDefault problem for status. Instance is the request path
+// and TraceID comes from the span in the request context.
+func New(request *http.Request, status int, detail string) *Problem {
+	problem := &Problem{
+		Type:   TypeDefault,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+	if request != nil {
+		problem.Instance = request.URL.Path
+		if spanContext := trace.SpanContextFromContext(request.Context()); spanContext.HasTraceID() {
+			problem.TraceID = spanContext.TraceID().String()
+		}
+	}
+	return problem
+}
+
+// Invalid returns a problem listing what is wrong with a request body: a
+// TypeBodyTooLarge problem for 413 and a TypeValidation problem otherwise.
+func Invalid(request *http.Request, status int, violations []Violation) *Problem {
+	problem := New(request, status, "invalid request body")
+	problem.Type = TypeValidation
+	problem.Title = "Invalid request body"
+	if status == http.StatusRequestEntityTooLarge {
+		problem.Detail = "request body too large"
+		problem.Type = TypeBodyTooLarge
+		problem.Title = "Request body too large"
+	}
+	problem.Violations = violations
+	return problem
+}
+
+// Unavailable returns a TypeUnavailable problem (502) for a downstream
+// service that could not be reached or answered unreadably.
+func Unavailable(request *http.Request, detail string) *Problem {
+	problem := New(request, http.StatusBadGateway, detail)
+	problem.Type = TypeUnavailable
+	problem.Title = "Upstream service unavailable"
+	return problem
+}
+
+func (problem *Problem) Error() string {
+	if problem.Detail == "" {
+		return problem.Title
+	}
+	return problem.Title + ": " + problem.Detail
+}
+
+// Write sends problem as the response.
+func (problem *Problem) Write(response http.ResponseWriter) {
+	writeBody(response, ContentType, problem.Status, problem)
+}
+
+// Write sends a TypeDefault problem for status with detail.
+func Write(response http.ResponseWriter, request *http.Request, status int, detail string) {
+	New(request, status, detail).Write(response)
+}
+
+// WriteJSON sends payload as an application/json response.
+func WriteJSON(response http.ResponseWriter, status int, payload any) {
+	writeBody(response, "application/json", status, payload)
+}
+
+func writeBody(response http.ResponseWriter, contentType string, status int, payload any) {
+	response.Header().Set("Content-Type", contentType)
+	response.WriteHeader(status)
+	_ = json.NewEncoder(response).Encode(payload)
+}
+
+// Is reports whether contentType is the problem media type.
+func Is(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ContentType
+}
+
+// Decode reads the problem document from a downstream response. It returns
+// false, leaving the body unread, when the response is not a problem.
+func Decode(response *http.Response) (*Problem, bool) {
+	if !Is(response.Header.Get("Content-Type")) {
+		return nil, false
+	}
+	var problem Problem
+	err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&problem)
+	if err != nil || problem.Status == 0 {
+		return nil, false
+	}
+	return &problem, true
+}
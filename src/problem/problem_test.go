@@ -0,0 +1,78 @@
+package problem_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+func TestWriteIncludesTraceID(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})
+	request := httptest.NewRequest(http.MethodGet, "/notes/7", nil)
+	request = request.WithContext(trace.ContextWithSpanContext(request.Context(), spanContext))
+
+	recorder := httptest.NewRecorder()
+	problem.Write(recorder, request, http.StatusNotFound, "note not found")
+
+	if recorder.Code != http.StatusNotFound || recorder.Header().Get("Content-Type") != problem.ContentType {
+		t.Fatalf("unexpected response %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	decoded, ok := problem.Decode(recorder.Result())
+	if !ok {
+		t.Fatalf("expected a problem document, got %s", recorder.Body.String())
+	}
+	want := problem.Problem{
+		Type:     problem.TypeDefault,
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "note not found",
+		Instance: "/notes/7",
+		TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+	if decoded.Type != want.Type || decoded.Title != want.Title || decoded.Status != want.Status ||
+		decoded.Detail != want.Detail || decoded.Instance != want.Instance || decoded.TraceID != want.TraceID {
+		t.Fatalf("expected %+v, got %+v", want, *decoded)
+	}
+}
+
+func TestInvalidPicksTypeByStatus(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/notes", nil)
+	violations := []problem.Violation{{Field: "title", Reason: "too_long", Message: "title is too long"}}
+
+	invalid := problem.Invalid(request, http.StatusBadRequest, violations)
+	if invalid.Type != problem.TypeValidation || invalid.Status != http.StatusBadRequest || len(invalid.Violations) != 1 {
+		t.Fatalf("unexpected validation problem %+v", invalid)
+	}
+	tooLarge := problem.Invalid(request, http.StatusRequestEntityTooLarge, violations)
+	if tooLarge.Type != problem.TypeBodyTooLarge || tooLarge.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected body-too-large problem %+v", tooLarge)
+	}
+	if invalid.TraceID != "" {
+		t.Fatalf("expected no trace id without a span, got %q", invalid.TraceID)
+	}
+}
+
+func TestDecodeIgnoresOtherContentTypes(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	problem.WriteJSON(recorder, http.StatusBadRequest, map[string]string{"error": "plain"})
+	if _, ok := problem.Decode(recorder.Result()); ok {
+		t.Fatal("expected application/json not to decode as a problem")
+	}
+
+	response := &http.Response{
+		Header: http.Header{"Content-Type": {problem.ContentType + "; charset=utf-8"}},
+		Body:   io.NopCloser(strings.NewReader(`{"type":"about:blank","title":"Bad Request","status":400}`)),
+	}
+	decoded, ok := problem.Decode(response)
+	if !ok || decoded.Status != http.StatusBadRequest || decoded.Error() != "Bad Request" {
+		t.Fatalf("expected a parameterised problem type to decode, got %+v %v", decoded, ok)
+	}
+}
@@ -0,0 +1,240 @@
+// Package proxy relays a service's incoming requests to the service behind
+// it without holding them in memory.
+//
+// Proxy is built on httputil.ReverseProxy: request and response bodies
+// stream through, event streams and chunked responses are flushed as they
+// arrive, and hop-by-hop headers are dropped in both directions. Only an
+// allowlist of request headers is forwarded, so nothing the caller sets
+// reaches the downstream service by accident; the query string always is.
+// Every response header the downstream service sets is relayed unless the
+// proxying service has already set it.
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+)
+
+// Semantic-convention span attributes recording the size of the bodies
+// relayed.
+const (
+	RequestBodySizeAttributeKey  = "http.request.body.size"
+	ResponseBodySizeAttributeKey = "http.response.body.size"
+)
+
+// DefaultHeaders are the request headers forwarded when Proxy.Headers is
+// nil: content negotiation, conditional and caching headers, and the
+// Idempotency-Key of a write.
+var DefaultHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Cache-Control",
+	"Content-Type",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Last-Event-ID",
+	"Range",
+	idempotency.Header,
+}
+
+// Proxy configures how requests are relayed. The zero value streams every
+// request through http.DefaultTransport with DefaultHeaders.
+type Proxy struct {
+	// Transport sends requests downstream. Nil uses http.DefaultTransport.
+	// Its client timeout does not apply, since a streamed response may
+	// legitimately outlast it; bound the wait for response headers on the
+	// transport instead.
+	Transport http.RoundTripper
+	// Headers lists the request headers forwarded. Nil forwards
+	// DefaultHeaders.
+	Headers []string
+	// MaxBodyBytes caps request bodies. A larger body fails the request
+	// with a *http.MaxBytesError. Zero leaves bodies uncapped.
+	MaxBodyBytes int64
+	// Replayable reads request bodies into memory, at most MaxBodyBytes of
+	// them, so a retrying transport can send them again.
+	Replayable bool
+	// Capture is how many bytes of the response body to keep in
+	// Result.Body, for callers that act on what was relayed.
+	Capture int
+	// Prepare, when set, adjusts each outgoing request before it is sent.
+	Prepare func(*http.Request)
+}
+
+// Result describes one relayed request.
+type Result struct {
+	// Status is the downstream status code, or 0 when no response was
+	// relayed.
+	Status int
+	// Header holds the downstream response headers.
+	Header http.Header
+	// Body holds up to Proxy.Capture bytes of the response body.
+	Body []byte
+	// RequestBytes and ResponseBytes count the body bytes relayed each way.
+	RequestBytes  int64
+	ResponseBytes int64
+	// Err is why no response was relayed: a *http.MaxBytesError for a body
+	// over MaxBodyBytes, or the transport's error. Nothing has been written
+	// to the caller then, so it is left to report Err.
+	Err error
+}
+
+// Serve relays request to target with method, writing the downstream
+// response to response as it arrives. The incoming query string is
+// forwarded with it. Both body sizes are recorded on the span in request's
+// context. As with httputil.ReverseProxy, a response body cut off midway
+// aborts the caller's connection.
+func (proxy Proxy) Serve(response http.ResponseWriter, request *http.Request, method string, target string) Result {
+	var result Result
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if proxy.MaxBodyBytes > 0 && request.ContentLength > proxy.MaxBodyBytes {
+		result.Err = &http.MaxBytesError{Limit: proxy.MaxBodyBytes}
+		return result
+	}
+
+	incoming := request.WithContext(request.Context())
+	body := &countingBody{ReadCloser: http.NoBody}
+	// A request relayed as a GET, whatever its own method, goes without
+	// its body.
+	if request.Body == nil || method == http.MethodGet || method == http.MethodHead {
+		incoming.ContentLength = 0
+	} else {
+		body.ReadCloser = request.Body
+		if proxy.MaxBodyBytes > 0 {
+			body.ReadCloser = http.MaxBytesReader(response, request.Body, proxy.MaxBodyBytes)
+		}
+	}
+	incoming.Body = body
+	var buffered []byte
+	if proxy.Replayable && body.ReadCloser != http.NoBody {
+		if buffered, err = io.ReadAll(body); err != nil {
+			result.Err = err
+			return result
+		}
+		incoming.Body = io.NopCloser(bytes.NewReader(buffered))
+		incoming.ContentLength = int64(len(buffered))
+	}
+
+	headers := proxy.Headers
+	if headers == nil {
+		headers = DefaultHeaders
+	}
+	writer := &capturingWriter{ResponseWriter: response, capture: proxy.Capture}
+	reverse := &httputil.ReverseProxy{
+		Transport: proxy.Transport,
+		Rewrite: func(outgoing *httputil.ProxyRequest) {
+			out := outgoing.Out
+			out.Method = method
+			outURL := *targetURL
+			out.URL = &outURL
+			out.URL.RawQuery = request.URL.RawQuery
+			out.Host = ""
+			// Out.Header has already lost the hop-by-hop headers, including
+			// any the caller named in Connection.
+			forwarded := http.Header{}
+			for _, name := range headers {
+				if values := out.Header.Values(name); len(values) > 0 {
+					forwarded[textproto.CanonicalMIMEHeaderKey(name)] = values
+				}
+			}
+			out.Header = forwarded
+			if buffered != nil {
+				out.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(buffered)), nil
+				}
+			}
+			if proxy.Prepare != nil {
+				proxy.Prepare(out)
+			}
+		},
+		ModifyResponse: func(downstream *http.Response) error {
+			// The proxying service's own headers, such as its rate limit,
+			// win over the downstream service's.
+			for name := range response.Header() {
+				downstream.Header.Del(name)
+			}
+			result.Status = downstream.StatusCode
+			result.Header = downstream.Header
+			return nil
+		},
+		ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, err error) {
+			result.Status = 0
+			result.Err = err
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	reverse.ServeHTTP(writer, incoming)
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(body.err, &tooLarge) {
+		result.Status = 0
+		result.Err = tooLarge
+	}
+	result.Body = writer.captured
+	result.RequestBytes = body.read
+	result.ResponseBytes = writer.written
+	trace.SpanFromContext(request.Context()).SetAttributes(
+		attribute.Int64(RequestBodySizeAttributeKey, result.RequestBytes),
+		attribute.Int64(ResponseBodySizeAttributeKey, result.ResponseBytes),
+	)
+	return result
+}
+
+// countingBody counts the request body bytes read and keeps the first read
+// error.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+	err  error
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	if err != nil && err != io.EOF && body.err == nil {
+		body.err = err
+	}
+	return n, err
+}
+
+// capturingWriter counts the response body bytes written and keeps the first
+// capture of them.
+type capturingWriter struct {
+	http.ResponseWriter
+	capture  int
+	captured []byte
+	written  int64
+}
+
+func (writer *capturingWriter) Write(p []byte) (int, error) {
+	n, err := writer.ResponseWriter.Write(p)
+	writer.written += int64(n)
+	if keep := min(writer.capture-len(writer.captured), n); keep > 0 {
+		writer.captured = append(writer.captured, p[:keep]...)
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController, which ReverseProxy flushes through,
+// reach the underlying writer.
+func (writer *capturingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
@@ -0,0 +1,225 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cldmnky/observability-workshop/src/proxy"
+)
+
+func TestLargeResponsesStreamWithoutBuffering(t *testing.T) {
+	release := make(chan struct{})
+	downstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/markdown")
+		_, _ = io.WriteString(response, "# first chunk\n")
+		http.NewResponseController(response).Flush()
+		// The rest is only written once the caller has read the first
+		// chunk, which it cannot do if the proxy waits for the whole body.
+		select {
+		case <-release:
+		case <-request.Context().Done():
+			return
+		}
+		_, _ = io.WriteString(response, strings.Repeat("a note line\n", 100000))
+	}))
+	defer downstream.Close()
+	front := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		proxy.Proxy{}.Serve(response, request, http.MethodGet, downstream.URL+"/notes/export.md")
+	}))
+	defer front.Close()
+
+	response, err := http.Get(front.URL + "/api/notes/export.md")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	first := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if line != "# first chunk\n" {
+			t.Fatalf("expected the first chunk, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("expected the first chunk before the downstream finished the body")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(reader)
+	if err != nil || len(rest) != len("a note line\n")*100000 {
+		t.Fatalf("expected the rest of the export, got %d bytes: %v", len(rest), err)
+	}
+	if response.Header.Get("Content-Type") != "text/markdown" {
+		t.Fatalf("expected the content type relayed, got %v", response.Header)
+	}
+}
+
+func TestQueryAndAllowedHeadersReachDownstream(t *testing.T) {
+	var received *http.Request
+	downstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received = request
+		response.Header().Set("ETag", `"v1"`)
+		response.Header().Set("Cache-Control", "private, no-cache")
+		response.Header().Set("RateLimit-Limit", "100")
+		response.Header().Set("Connection", "X-Hop")
+		response.Header().Set("X-Hop", "downstream")
+		response.Header().Set("Keep-Alive", "timeout=5")
+		response.WriteHeader(http.StatusNotModified)
+	}))
+	defer downstream.Close()
+
+	request := httptest.NewRequest(http.MethodGet, "/api/events?trace_id=abc&limit=5&tag=a&tag=b", nil)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("If-None-Match", `"v0"`)
+	request.Header.Set("Cookie", "session=secret")
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("Connection", "Accept-Language")
+	request.Header.Set("Accept-Language", "sv")
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("RateLimit-Limit", "50")
+	result := proxy.Proxy{}.Serve(recorder, request, http.MethodGet, downstream.URL+"/events")
+
+	if result.Err != nil || result.Status != http.StatusNotModified || recorder.Code != http.StatusNotModified {
+		t.Fatalf("expected the 304 relayed, got %+v %d", result, recorder.Code)
+	}
+	if received.URL.Path != "/events" || received.URL.RawQuery != "trace_id=abc&limit=5&tag=a&tag=b" {
+		t.Fatalf("expected the path and full query downstream, got %s", received.URL)
+	}
+	if received.Header.Get("Accept") != "application/json" || received.Header.Get("If-None-Match") != `"v0"` {
+		t.Fatalf("expected the negotiation and conditional headers forwarded, got %v", received.Header)
+	}
+	for _, name := range []string{"Cookie", "Authorization", "Accept-Language"} {
+		if received.Header.Get(name) != "" {
+			t.Fatalf("expected %s not forwarded, got %v", name, received.Header)
+		}
+	}
+
+	header := recorder.Header()
+	if header.Get("ETag") != `"v1"` || header.Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("expected the caching headers relayed, got %v", header)
+	}
+	if header.Get("X-Hop") != "" || header.Get("Keep-Alive") != "" || header.Get("Connection") != "" {
+		t.Fatalf("expected hop-by-hop headers dropped, got %v", header)
+	}
+	if values := header.Values("RateLimit-Limit"); len(values) != 1 || values[0] != "50" {
+		t.Fatalf("expected the proxying service's own header kept, got %v", values)
+	}
+}
+
+func TestBodiesOverTheLimitAreNotRelayed(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		_, _ = io.Copy(io.Discard, request.Body)
+	}))
+	defer downstream.Close()
+
+	for name, replayable := range map[string]bool{"streamed": false, "replayable": true} {
+		// Without a declared length the limit is found while the body is
+		// read.
+		request := httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"title":"far too long for the limit"}`))
+		request.ContentLength = -1
+		recorder := httptest.NewRecorder()
+		result := proxy.Proxy{MaxBodyBytes: 16, Replayable: replayable}.Serve(recorder, request, http.MethodPost, downstream.URL+"/notes")
+
+		var tooLarge *http.MaxBytesError
+		if !errors.As(result.Err, &tooLarge) || tooLarge.Limit != 16 || result.Status != 0 {
+			t.Fatalf("%s: expected a MaxBytesError, got %+v", name, result)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Fatalf("%s: expected nothing written, got %q", name, recorder.Body.String())
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"title":"far too long for the limit"}`))
+	result := proxy.Proxy{MaxBodyBytes: 16}.Serve(httptest.NewRecorder(), request, http.MethodPost, downstream.URL+"/notes")
+	if !errors.As(result.Err, new(*http.MaxBytesError)) || result.RequestBytes != 0 {
+		t.Fatalf("expected a declared length over the limit rejected before reading, got %+v", result)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestReplayableBodiesCanBeResent(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusCreated)
+		_, _ = response.Write(append([]byte(`{"id":1,"echo":`), append(body, '}')...))
+	}))
+	defer downstream.Close()
+
+	var attempts []string
+	// A transport that reads the body and then resends it, as a retrying
+	// transport does after a failed attempt.
+	retrying := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		first, _ := io.ReadAll(request.Body)
+		attempts = append(attempts, string(first))
+		if request.GetBody == nil {
+			t.Fatal("expected GetBody on a replayable request")
+		}
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = body
+		return http.DefaultTransport.RoundTrip(request)
+	})
+
+	spans := tracetest.NewSpanRecorder()
+	ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test").Start(context.Background(), "POST /api/notes")
+	request := httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/notes", strings.NewReader(`"hello"`))
+	recorder := httptest.NewRecorder()
+	result := proxy.Proxy{
+		Transport:  retrying,
+		Replayable: true,
+		Capture:    8,
+	}.Serve(recorder, request, http.MethodPost, downstream.URL+"/notes")
+	span.End()
+
+	if result.Err != nil || result.Status != http.StatusCreated || recorder.Body.String() != `{"id":1,"echo":"hello"}` {
+		t.Fatalf("expected the created note relayed, got %+v %q", result, recorder.Body.String())
+	}
+	if len(attempts) != 1 || attempts[0] != `"hello"` {
+		t.Fatalf("expected the body read once before the resend, got %q", attempts)
+	}
+	if string(result.Body) != `{"id":1,` || result.RequestBytes != 7 || result.ResponseBytes != 23 {
+		t.Fatalf("expected 8 captured bytes and both sizes, got %q %d %d", result.Body, result.RequestBytes, result.ResponseBytes)
+	}
+
+	attributes := map[string]int64{}
+	for _, attribute := range spans.Ended()[0].Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.AsInt64()
+	}
+	if attributes[proxy.RequestBodySizeAttributeKey] != 7 || attributes[proxy.ResponseBodySizeAttributeKey] != 23 {
+		t.Fatalf("expected the body sizes on the span, got %v", attributes)
+	}
+}
+
+func TestUnreachableDownstreamIsLeftToTheCaller(t *testing.T) {
+	downstream := httptest.NewServer(http.NotFoundHandler())
+	downstream.Close()
+
+	recorder := httptest.NewRecorder()
+	result := proxy.Proxy{}.Serve(recorder, httptest.NewRequest(http.MethodGet, "/api/notes", nil), http.MethodGet, downstream.URL+"/notes")
+	if result.Err == nil || result.Status != 0 || recorder.Body.Len() != 0 {
+		t.Fatalf("expected the error returned with nothing written, got %+v %q", result, recorder.Body.String())
+	}
+}
@@ -0,0 +1,329 @@
+// Package ratelimit stops a single client from saturating a shared service.
+//
+// Limiter is HTTP middleware holding a token bucket per client and route.
+// A client is identified by its API key, when the key is one of Config's
+// APIKeys, then its X-Forwarded-User, then its IP address. Each bucket
+// holds Burst tokens and refills at Rate tokens per second; a request takes
+// one token, and a request that finds the bucket empty gets a 429 problem
+// with Retry-After. Every answered request carries RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers.
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+// Key types recorded on the requests counter.
+const (
+	KeyAPIKey = "api_key"
+	KeyUser   = "user"
+	KeyIP     = "ip"
+)
+
+// Limit is a token bucket: up to Burst requests at once, refilled at Rate
+// requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Rule applies Limit to Route. A route ending in "/" also matches every path
+// below it, and "/" matches everything. The longest matching route wins.
+type Rule struct {
+	Route string
+	Limit Limit
+}
+
+// Config configures a Limiter.
+type Config struct {
+	Rules []Rule
+	// APIKeyHeader names the header carrying a client's API key. Empty
+	// leaves API keys unused.
+	APIKeyHeader string
+	// APIKeys lists the API keys that identify a client. Any other key is
+	// ignored, so a caller cannot get a fresh bucket by sending a new key on
+	// every request. Empty leaves API keys unused.
+	APIKeys []string
+	// Exempt lists paths that are never limited, such as probes.
+	Exempt []string
+	// MaxBuckets bounds the buckets kept in memory. The least recently used
+	// bucket is forgotten first, since it is the likeliest to have refilled
+	// and a new bucket starts full anyway.
+	MaxBuckets int
+}
+
+// DefaultExempt are the probe and scrape paths every service serves.
+var DefaultExempt = []string{"/healthz", "/readyz", "/metrics"}
+
+// ConfigFromEnv reads the limits shared by every service:
+//
+//	RATE_LIMIT_RPS             requests per second per client on every route; 0 disables the default limit (50)
+//	RATE_LIMIT_BURST           requests a client may send at once (100)
+//	RATE_LIMIT_ROUTES          per-route limits, "ROUTE=RPS:BURST" separated by commas
+//	RATE_LIMIT_API_KEY_HEADER  header carrying a client's API key (X-API-Key)
+//	RATE_LIMIT_API_KEYS        API keys that identify a client, separated by commas
+//
+// An invalid RATE_LIMIT_ROUTES is reported and leaves only the default
+// limit in place.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		APIKeyHeader: envOrDefault("RATE_LIMIT_API_KEY_HEADER", "X-API-Key"),
+		APIKeys:      splitList(os.Getenv("RATE_LIMIT_API_KEYS")),
+		Exempt:       DefaultExempt,
+		MaxBuckets:   10000,
+	}
+	rate, err := strconv.ParseFloat(envOrDefault("RATE_LIMIT_RPS", "50"), 64)
+	if err != nil || rate < 0 {
+		rate = 50
+	}
+	burst, err := strconv.Atoi(envOrDefault("RATE_LIMIT_BURST", "100"))
+	if err != nil || burst < 1 {
+		burst = 100
+	}
+	if rate > 0 {
+		config.Rules = append(config.Rules, Rule{Route: "/", Limit: Limit{Rate: rate, Burst: burst}})
+	}
+	routes, err := ParseRules(os.Getenv("RATE_LIMIT_ROUTES"))
+	if err != nil {
+		return config, err
+	}
+	config.Rules = append(config.Rules, routes...)
+	return config, nil
+}
+
+func envOrDefault(key string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList returns the non-empty comma-separated values of spec.
+func splitList(spec string) []string {
+	var values []string
+	for _, value := range strings.Split(spec, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// ParseRules parses comma-separated "ROUTE=RPS:BURST" rules, such as
+// "/api/notes=5:10,/admin/=1:5". A rate of 0 leaves the route unlimited.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		route, limit, found := strings.Cut(part, "=")
+		rawRate, rawBurst, hasBurst := strings.Cut(limit, ":")
+		rate, rateErr := strconv.ParseFloat(rawRate, 64)
+		burst, burstErr := strconv.Atoi(rawBurst)
+		if !found || !hasBurst || !strings.HasPrefix(route, "/") || rateErr != nil || burstErr != nil || rate < 0 || burst < 1 {
+			return nil, fmt.Errorf("invalid rate limit rule %q, want ROUTE=RPS:BURST", part)
+		}
+		rules = append(rules, Rule{Route: route, Limit: Limit{Rate: rate, Burst: burst}})
+	}
+	return rules, nil
+}
+
+type bucket struct {
+	key    string
+	limit  Limit
+	tokens float64
+	filled time.Time
+}
+
+// refill adds the tokens earned since the bucket was last filled.
+func (current *bucket) refill(now time.Time) {
+	current.tokens = min(float64(current.limit.Burst), current.tokens+now.Sub(current.filled).Seconds()*current.limit.Rate)
+	current.filled = now
+}
+
+// Limiter is safe for concurrent use.
+type Limiter struct {
+	config  Config
+	apiKeys map[string]bool
+	// requests counts requests by route, key type and decision. May be nil.
+	requests metric.Int64Counter
+	now      func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// order holds the buckets, most recently used first.
+	order *list.List
+}
+
+// New returns a Limiter for config. requests, when not nil, counts every
+// limited route's requests as allowed or limited.
+func New(config Config, requests metric.Int64Counter) *Limiter {
+	config.Rules = slices.Clone(config.Rules)
+	// Longest route first, so the first match is the most specific.
+	slices.SortStableFunc(config.Rules, func(a, b Rule) int { return len(b.Route) - len(a.Route) })
+	apiKeys := map[string]bool{}
+	for _, key := range config.APIKeys {
+		apiKeys[key] = true
+	}
+	return &Limiter{
+		config:   config,
+		apiKeys:  apiKeys,
+		requests: requests,
+		now:      time.Now,
+		buckets:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// rule returns the rule for path, if any limits it.
+func (limiter *Limiter) rule(path string) (Rule, bool) {
+	if slices.Contains(limiter.config.Exempt, path) {
+		return Rule{}, false
+	}
+	for _, rule := range limiter.config.Rules {
+		if rule.Route == path || (strings.HasSuffix(rule.Route, "/") && strings.HasPrefix(path, rule.Route)) {
+			return rule, rule.Limit.Rate > 0
+		}
+	}
+	return Rule{}, false
+}
+
+// client returns the key identifying the caller of request, and its type.
+// An API key that is not configured is ignored.
+func (limiter *Limiter) client(request *http.Request) (string, string) {
+	if limiter.config.APIKeyHeader != "" {
+		if key := request.Header.Get(limiter.config.APIKeyHeader); limiter.apiKeys[key] {
+			return KeyAPIKey + ":" + key, KeyAPIKey
+		}
+	}
+	if user := request.Header.Get(tenant.Header); user != "" {
+		return KeyUser + ":" + user, KeyUser
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return KeyIP + ":" + host, KeyIP
+}
+
+// decision is the outcome of taking a token from a bucket.
+type decision struct {
+	allowed   bool
+	remaining int
+	// reset is how long until the bucket is full again, and retryAfter how
+	// long until it holds a token.
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+func (limiter *Limiter) take(key string, limit Limit) decision {
+	now := limiter.now()
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	var current *bucket
+	if element, ok := limiter.buckets[key]; ok {
+		limiter.order.MoveToFront(element)
+		current = element.Value.(*bucket)
+	} else {
+		for limiter.config.MaxBuckets > 0 && len(limiter.buckets) >= limiter.config.MaxBuckets {
+			oldest := limiter.order.Back()
+			limiter.order.Remove(oldest)
+			delete(limiter.buckets, oldest.Value.(*bucket).key)
+		}
+		current = &bucket{key: key, limit: limit, tokens: float64(limit.Burst), filled: now}
+		limiter.buckets[key] = limiter.order.PushFront(current)
+	}
+	current.refill(now)
+
+	result := decision{allowed: current.tokens >= 1}
+	if result.allowed {
+		current.tokens--
+	} else {
+		result.retryAfter = seconds((1 - current.tokens) / limit.Rate)
+	}
+	result.remaining = int(current.tokens)
+	result.reset = seconds((float64(limit.Burst) - current.tokens) / limit.Rate)
+	return result
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// ceilSeconds renders duration as whole seconds, rounded up.
+func ceilSeconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
+
+// Middleware limits requests to next. Exempt paths and routes without a
+// rule pass through untouched.
+func (limiter *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		rule, limited := limiter.rule(request.URL.Path)
+		if !limited {
+			next.ServeHTTP(response, request)
+			return
+		}
+		client, keyType := limiter.client(request)
+		result := limiter.take(rule.Route+" "+client, rule.Limit)
+
+		header := response.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(rule.Limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+		header.Set("RateLimit-Reset", ceilSeconds(result.reset))
+
+		outcome := "allowed"
+		if !result.allowed {
+			outcome = "limited"
+		}
+		if limiter.requests != nil {
+			limiter.requests.Add(request.Context(), 1, metric.WithAttributes(
+				// The rule's route rather than the request path keeps the
+				// label bounded.
+				attribute.String("route", rule.Route),
+				attribute.String("key_type", keyType),
+				attribute.String("decision", outcome),
+			))
+		}
+
+		if result.allowed {
+			next.ServeHTTP(response, request)
+			return
+		}
+		trace.SpanFromContext(request.Context()).AddEvent("rate limit exceeded", trace.WithAttributes(
+			attribute.String("ratelimit.route", rule.Route),
+			attribute.String("ratelimit.key_type", keyType),
+		))
+		header.Set("Retry-After", ceilSeconds(max(result.retryAfter, time.Second)))
+		Exceeded(request, rule).Write(response)
+	})
+}
+
+// Exceeded returns the 429 problem for a request over rule's limit.
+func Exceeded(request *http.Request, rule Rule) *problem.Problem {
+	limited := problem.New(request, http.StatusTooManyRequests,
+		fmt.Sprintf("rate limit of %g requests per second (burst %d) exceeded for %s", rule.Limit.Rate, rule.Limit.Burst, rule.Route))
+	limited.Type = problem.TypeRateLimited
+	limited.Title = "Too many requests"
+	return limited
+}
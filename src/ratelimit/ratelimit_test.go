@@ -0,0 +1,188 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+	"github.com/cldmnky/observability-workshop/src/ratelimit"
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+var ok = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+func serve(handler http.Handler, path string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestClientsOverTheLimitGet429(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{
+		Rules:  []ratelimit.Rule{{Route: "/", Limit: ratelimit.Limit{Rate: 1, Burst: 2}}},
+		Exempt: ratelimit.DefaultExempt,
+	}, nil)
+	handler := limiter.Middleware(ok)
+	user1 := map[string]string{tenant.Header: "user1"}
+
+	for index, remaining := range []string{"1", "0"} {
+		recorder := serve(handler, "/api/notes", user1)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "2" || recorder.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("expected request %d allowed with headers, got %d %v", index+1, recorder.Code, recorder.Header())
+		}
+	}
+
+	limited := serve(handler, "/api/notes", user1)
+	decoded, isProblem := problem.Decode(limited.Result())
+	if limited.Code != http.StatusTooManyRequests || !isProblem || decoded.Type != problem.TypeRateLimited || limited.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected a 429 rate-limited problem with Retry-After 1, got %d %v %s", limited.Code, limited.Header(), limited.Body.String())
+	}
+	if reset := limited.Header().Get("RateLimit-Reset"); reset != "2" {
+		t.Fatalf("expected the bucket full again in 2s, got %q", reset)
+	}
+
+	if recorder := serve(handler, "/api/notes", map[string]string{tenant.Header: "user2"}); recorder.Code != http.StatusOK {
+		t.Fatalf("expected another user unaffected, got %d", recorder.Code)
+	}
+	if recorder := serve(handler, "/healthz", user1); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("expected probes exempt, got %d", recorder.Code)
+	}
+}
+
+func TestBucketsRefill(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{Rules: []ratelimit.Rule{{Route: "/", Limit: ratelimit.Limit{Rate: 100, Burst: 1}}}}, nil)
+	handler := limiter.Middleware(ok)
+
+	serve(handler, "/", nil)
+	if recorder := serve(handler, "/", nil); recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the empty bucket to limit, got %d", recorder.Code)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if recorder := serve(handler, "/", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("expected a token after the refill, got %d", recorder.Code)
+	}
+}
+
+func TestTheMostSpecificRouteAndKeyApply(t *testing.T) {
+	rules, err := ratelimit.ParseRules("/api/notes=1:1, /api/=0:1")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	reader := sdkmetric.NewManualReader()
+	requests, _ := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64Counter("requests")
+	limiter := ratelimit.New(ratelimit.Config{
+		Rules:        append(rules, ratelimit.Rule{Route: "/", Limit: ratelimit.Limit{Rate: 1, Burst: 5}}),
+		APIKeyHeader: "X-API-Key",
+		APIKeys:      []string{"k"},
+	}, requests)
+	handler := limiter.Middleware(ok)
+
+	// The API key wins over the user, so both requests share a bucket.
+	serve(handler, "/api/notes", map[string]string{"X-API-Key": "k", tenant.Header: "user1"})
+	if recorder := serve(handler, "/api/notes", map[string]string{"X-API-Key": "k", tenant.Header: "user2"}); recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the API key's bucket of 1 used up, got %d", recorder.Code)
+	}
+	for range 3 {
+		if recorder := serve(handler, "/api/events", nil); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("expected a rate of 0 to leave /api/ unlimited, got %d", recorder.Code)
+		}
+	}
+	if recorder := serve(handler, "/", nil); recorder.Header().Get("RateLimit-Limit") != "5" {
+		t.Fatalf("expected the default rule elsewhere, got %v", recorder.Header())
+	}
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	counts := map[string]int64{}
+	for _, point := range collected.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints {
+		route, _ := point.Attributes.Value(attribute.Key("route"))
+		keyType, _ := point.Attributes.Value(attribute.Key("key_type"))
+		outcome, _ := point.Attributes.Value(attribute.Key("decision"))
+		counts[strings.Join([]string{route.AsString(), keyType.AsString(), outcome.AsString()}, " ")] = point.Value
+	}
+	if counts["/api/notes api_key allowed"] != 1 || counts["/api/notes api_key limited"] != 1 || counts["/ ip allowed"] != 1 || len(counts) != 3 {
+		t.Fatalf("expected requests counted by route, key type and decision, got %v", counts)
+	}
+}
+
+func TestUnknownAPIKeysAreIgnored(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{
+		Rules:        []ratelimit.Rule{{Route: "/", Limit: ratelimit.Limit{Rate: 1, Burst: 1}}},
+		APIKeyHeader: "X-API-Key",
+		APIKeys:      []string{"known"},
+	}, nil)
+	handler := limiter.Middleware(ok)
+
+	serve(handler, "/", map[string]string{"X-API-Key": "random-1", tenant.Header: "user1"})
+	if recorder := serve(handler, "/", map[string]string{"X-API-Key": "random-2", tenant.Header: "user1"}); recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a new unknown key to share the user's bucket, got %d", recorder.Code)
+	}
+	if recorder := serve(handler, "/", map[string]string{"X-API-Key": "known", tenant.Header: "user1"}); recorder.Code != http.StatusOK {
+		t.Fatalf("expected a configured key to get its own bucket, got %d", recorder.Code)
+	}
+}
+
+func TestTheLeastRecentlyUsedBucketIsForgotten(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{
+		Rules:      []ratelimit.Rule{{Route: "/", Limit: ratelimit.Limit{Rate: 0.001, Burst: 1}}},
+		MaxBuckets: 2,
+	}, nil)
+	handler := limiter.Middleware(ok)
+	user := func(name string) map[string]string { return map[string]string{tenant.Header: name} }
+
+	serve(handler, "/", user("user1"))
+	serve(handler, "/", user("user2"))
+	serve(handler, "/", user("user1"))
+	// user2 is now the least recently used, so user3 takes its place.
+	serve(handler, "/", user("user3"))
+
+	if recorder := serve(handler, "/", user("user1")); recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected user1's empty bucket kept, got %d", recorder.Code)
+	}
+	if recorder := serve(handler, "/", user("user2")); recorder.Code != http.StatusOK {
+		t.Fatalf("expected user2's bucket forgotten and started full, got %d", recorder.Code)
+	}
+}
+
+func TestParseRulesRejectsMalformedRules(t *testing.T) {
+	for _, spec := range []string{"/api=1", "api=1:1", "/api=x:1", "/api=1:0", "/api=-1:1"} {
+		if _, err := ratelimit.ParseRules(spec); err == nil {
+			t.Fatalf("expected %q rejected", spec)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "0")
+	t.Setenv("RATE_LIMIT_ROUTES", "/api/notes=2:4")
+	t.Setenv("RATE_LIMIT_API_KEYS", "alpha, ,beta")
+	config, err := ratelimit.ConfigFromEnv()
+	if err != nil || len(config.Rules) != 1 || config.Rules[0].Limit != (ratelimit.Limit{Rate: 2, Burst: 4}) {
+		t.Fatalf("expected only the route rule with the default limit off, got %+v %v", config.Rules, err)
+	}
+	if !slices.Equal(config.APIKeys, []string{"alpha", "beta"}) {
+		t.Fatalf("expected the configured API keys, got %v", config.APIKeys)
+	}
+
+	t.Setenv("RATE_LIMIT_RPS", "")
+	t.Setenv("RATE_LIMIT_ROUTES", "nonsense")
+	config, err = ratelimit.ConfigFromEnv()
+	if err == nil || len(config.Rules) != 1 || config.Rules[0].Route != "/" || config.APIKeyHeader != "X-API-Key" {
+		t.Fatalf("expected an error and the default rule, got %+v %v", config, err)
+	}
+}
@@ -0,0 +1,244 @@
+// Package retry retries failed outgoing HTTP requests with exponential
+// backoff and jitter. Only requests that are safe to repeat are retried:
+// those with idempotent methods, and POST or PATCH requests carrying an
+// Idempotency-Key, whose repeats the database replays instead of applying
+// twice.
+//
+// Transport makes the attempts. Put it outside the tracing transport and
+// MarkResends inside it, so every attempt gets its own client span and the
+// resent ones carry http.resend_count.
+package retry
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+)
+
+// ResendCountAttributeKey is the semantic-convention span attribute counting
+// how many times a request has been sent before.
+const ResendCountAttributeKey = "http.resend_count"
+
+// Policy says how often and how soon failed requests are retried.
+type Policy struct {
+	// MaxAttempts is the number of attempts including the first. One or
+	// less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. Each further
+	// retry waits twice as long, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the share of each wait that is random: 0 waits exactly the
+	// backoff and 1 waits anywhere between zero and the backoff. Jitter
+	// keeps clients that failed together from retrying together.
+	Jitter float64
+	// RetryableStatuses are the response statuses worth retrying. Transport
+	// errors are always retried.
+	RetryableStatuses []int
+}
+
+// DefaultPolicy makes three attempts, waiting 100ms and then 200ms with half
+// of each wait random, and retries 502, 503 and 504 responses.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:       3,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		Jitter:            0.5,
+		RetryableStatuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+// Backoff returns the wait before retry n, counting the first retry as 1,
+// before jitter is applied.
+func (policy Policy) Backoff(n int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < n && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	return backoff
+}
+
+func (policy Policy) retryableStatus(status int) bool {
+	for _, retryable := range policy.RetryableStatuses {
+		if status == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// Repeatable reports whether request is safe to send again: its method is
+// idempotent, or it is a POST or PATCH with an Idempotency-Key, and its body
+// can be replayed.
+func Repeatable(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost, http.MethodPatch:
+		return request.Header.Get(idempotency.Header) != ""
+	}
+	return false
+}
+
+type resendCountKey struct{}
+
+// ResendCount returns how many times the request with ctx was sent before,
+// as recorded by Transport.
+func ResendCount(ctx context.Context) int {
+	count, _ := ctx.Value(resendCountKey{}).(int)
+	return count
+}
+
+// MarkResends returns a RoundTripper that sets ResendCountAttributeKey on
+// the span in a resent request's context before passing it to next.
+func MarkResends(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		if count := ResendCount(request.Context()); count > 0 {
+			trace.SpanFromContext(request.Context()).SetAttributes(attribute.Int(ResendCountAttributeKey, count))
+		}
+		return next.RoundTrip(request)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// Transport sends requests through next, retrying Repeatable ones that
+// fail with a transport error or a retryable status.
+type Transport struct {
+	next   http.RoundTripper
+	policy Policy
+	// retries counts retries and giveUps requests that failed on their last
+	// attempt, both by method, server address and reason. Either may be
+	// nil.
+	retries metric.Int64Counter
+	giveUps metric.Int64Counter
+}
+
+// NewTransport returns a Transport retrying requests through next according
+// to policy.
+func NewTransport(next http.RoundTripper, policy Policy, retries metric.Int64Counter, giveUps metric.Int64Counter) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{next: next, policy: policy, retries: retries, giveUps: giveUps}
+}
+
+func (transport *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.policy.MaxAttempts <= 1 || !Repeatable(request) {
+		return transport.next.RoundTrip(request)
+	}
+
+	ctx := request.Context()
+	attempt := request
+	for sent := 1; ; sent++ {
+		response, err := transport.next.RoundTrip(attempt)
+		reason := transport.failure(ctx, response, err)
+		if reason == "" {
+			return response, err
+		}
+		attributes := metric.WithAttributes(
+			attribute.String("http.request.method", request.Method),
+			attribute.String("server.address", request.URL.Host),
+			attribute.String("reason", reason),
+		)
+		if sent >= transport.policy.MaxAttempts {
+			if transport.giveUps != nil {
+				transport.giveUps.Add(ctx, 1, attributes)
+			}
+			slog.WarnContext(ctx, "giving up on request",
+				"http.request.method", request.Method,
+				"url.full", request.URL.String(),
+				"retry.attempts", sent,
+				"retry.reason", reason,
+			)
+			return response, err
+		}
+
+		if response != nil {
+			// Drain the body so the connection can be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+		}
+		if transport.retries != nil {
+			transport.retries.Add(ctx, 1, attributes)
+		}
+		wait := transport.jittered(transport.policy.Backoff(sent))
+		slog.InfoContext(ctx, "retrying request",
+			"http.request.method", request.Method,
+			"url.full", request.URL.String(),
+			"http.resend_count", sent,
+			"retry.reason", reason,
+			"retry.backoff_ms", wait.Milliseconds(),
+		)
+		if !sleep(ctx, wait) {
+			return nil, ctx.Err()
+		}
+
+		attempt = request.Clone(context.WithValue(ctx, resendCountKey{}, sent))
+		if request.GetBody != nil {
+			attempt.Body, err = request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// failure returns why an attempt should be retried, or "" when its outcome
+// is final. Errors after ctx is done are final: the caller has given up.
+func (transport *Transport) failure(ctx context.Context, response *http.Response, err error) string {
+	if err != nil {
+		if ctx.Err() != nil {
+			return ""
+		}
+		return "error"
+	}
+	if transport.policy.retryableStatus(response.StatusCode) {
+		return "status_" + strconv.Itoa(response.StatusCode)
+	}
+	return ""
+}
+
+func (transport *Transport) jittered(backoff time.Duration) time.Duration {
+	jitter := min(max(transport.policy.Jitter, 0), 1)
+	return backoff - time.Duration(jitter*rand.Float64()*float64(backoff))
+}
+
+// sleep waits for delay and reports whether it finished before ctx was done.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
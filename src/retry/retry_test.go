@@ -0,0 +1,237 @@
+package retry_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cldmnky/observability-workshop/src/idempotency"
+	"github.com/cldmnky/observability-workshop/src/retry"
+)
+
+// flakyServer fails the first failures requests, by closing the connection
+// when reset is true and with 503 otherwise, then answers with the request
+// body. It records every body it saw.
+type flakyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func newFlakyServer(t *testing.T, failures int, reset bool) *flakyServer {
+	t.Helper()
+	server := &flakyServer{failures: failures}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		server.mu.Lock()
+		server.bodies = append(server.bodies, string(body))
+		failing := len(server.bodies) <= server.failures
+		server.mu.Unlock()
+
+		switch {
+		case failing && reset:
+			panic(http.ErrAbortHandler)
+		case failing:
+			response.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = io.WriteString(response, "ok:"+string(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *flakyServer) requests() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string(nil), server.bodies...)
+}
+
+type testClient struct {
+	*http.Client
+	spans   *tracetest.SpanRecorder
+	tracer  *sdktrace.TracerProvider
+	metrics *sdkmetric.ManualReader
+}
+
+func newTestClient(t *testing.T, policy retry.Policy) *testClient {
+	t.Helper()
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	metrics := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(metrics)).Meter("test")
+	retries, _ := meter.Int64Counter("retries")
+	giveUps, _ := meter.Int64Counter("give_ups")
+
+	traced := otelhttp.NewTransport(retry.MarkResends(http.DefaultTransport), otelhttp.WithTracerProvider(tracer))
+	return &testClient{
+		Client:  &http.Client{Transport: retry.NewTransport(traced, policy, retries, giveUps)},
+		spans:   spans,
+		tracer:  tracer,
+		metrics: metrics,
+	}
+}
+
+// counts returns the retries and give_ups counter totals.
+func (client *testClient) counts(t *testing.T) (int64, int64) {
+	t.Helper()
+	var collected metricdata.ResourceMetrics
+	if err := client.metrics.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	totals := map[string]int64{}
+	for _, scope := range collected.ScopeMetrics {
+		for _, recorded := range scope.Metrics {
+			for _, point := range recorded.Data.(metricdata.Sum[int64]).DataPoints {
+				totals[recorded.Name] += point.Value
+			}
+		}
+	}
+	return totals["retries"], totals["give_ups"]
+}
+
+func fastPolicy() retry.Policy {
+	policy := retry.DefaultPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 4 * time.Millisecond
+	return policy
+}
+
+func TestRetriesIntermittentFailures(t *testing.T) {
+	for name, reset := range map[string]bool{"status": false, "reset": true} {
+		t.Run(name, func(t *testing.T) {
+			server := newFlakyServer(t, 2, reset)
+			client := newTestClient(t, fastPolicy())
+
+			ctx, parent := client.tracer.Tracer("test").Start(context.Background(), "GET /api/events")
+			request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+			response, err := client.Do(request)
+			parent.End()
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("expected success on the third attempt, got %v", err)
+			}
+			response.Body.Close()
+			if sent := len(server.requests()); sent != 3 {
+				t.Fatalf("expected 3 attempts, got %d", sent)
+			}
+
+			var resendCounts []int64
+			for _, span := range client.spans.Ended() {
+				if span.SpanContext().SpanID() == parent.SpanContext().SpanID() {
+					continue
+				}
+				if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+					t.Fatalf("expected every attempt to be a child of the request span")
+				}
+				count := int64(0)
+				for _, kv := range span.Attributes() {
+					if kv.Key == attribute.Key(retry.ResendCountAttributeKey) {
+						count = kv.Value.AsInt64()
+					}
+				}
+				resendCounts = append(resendCounts, count)
+			}
+			if len(resendCounts) != 3 || resendCounts[0] != 0 || resendCounts[1] != 1 || resendCounts[2] != 2 {
+				t.Fatalf("expected attempt spans with resend counts 0, 1, 2, got %v", resendCounts)
+			}
+			if retries, giveUps := client.counts(t); retries != 2 || giveUps != 0 {
+				t.Fatalf("expected 2 retries and no give-ups, got %d and %d", retries, giveUps)
+			}
+		})
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	server := newFlakyServer(t, 10, false)
+	client := newTestClient(t, fastPolicy())
+
+	response, err := client.Get(server.URL)
+	if err != nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last 503 to be returned, got %v", err)
+	}
+	response.Body.Close()
+	if sent := len(server.requests()); sent != 3 {
+		t.Fatalf("expected 3 attempts, got %d", sent)
+	}
+	if retries, giveUps := client.counts(t); retries != 2 || giveUps != 1 {
+		t.Fatalf("expected 2 retries and 1 give-up, got %d and %d", retries, giveUps)
+	}
+}
+
+func TestRetriesPOSTOnlyWithIdempotencyKey(t *testing.T) {
+	server := newFlakyServer(t, 1, false)
+	client := newTestClient(t, fastPolicy())
+
+	post := func(key string) *http.Response {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/events", strings.NewReader(`{"n":1}`))
+		if key != "" {
+			request.Header.Set(idempotency.Header, key)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	if response := post(""); response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected an unkeyed POST not to be retried, got %d", response.StatusCode)
+	}
+	server.mu.Lock()
+	server.failures = 2
+	server.mu.Unlock()
+	if response := post("key-1"); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected a keyed POST to be retried, got %d", response.StatusCode)
+	}
+	if bodies := strings.Join(server.requests(), "|"); bodies != `{"n":1}|{"n":1}|{"n":1}` {
+		t.Fatalf("expected the body replayed on every attempt, got %s", bodies)
+	}
+}
+
+func TestStopsRetryingWhenTheCallerGivesUp(t *testing.T) {
+	server := newFlakyServer(t, 10, false)
+	policy := fastPolicy()
+	policy.InitialBackoff, policy.MaxBackoff, policy.Jitter = time.Hour, time.Hour, 0
+	client := newTestClient(t, policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	start := time.Now()
+	if _, err := client.Do(request); err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the backoff to end with the context, got %v after %s", err, time.Since(start))
+	}
+	if sent := len(server.requests()); sent != 1 {
+		t.Fatalf("expected a single attempt, got %d", sent)
+	}
+}
+
+func TestBackoffDoublesUpToTheCap(t *testing.T) {
+	policy := retry.Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 350 * time.Millisecond}
+	for n, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 350 * time.Millisecond, 10: 350 * time.Millisecond} {
+		if got := policy.Backoff(n); got != want {
+			t.Fatalf("expected backoff %d to be %s, got %s", n, want, got)
+		}
+	}
+
+	for method, want := range map[string]bool{http.MethodGet: true, http.MethodDelete: true, http.MethodPut: true, http.MethodPost: false, http.MethodPatch: false} {
+		request := httptest.NewRequest(method, "/notes", nil)
+		if got := retry.Repeatable(request); got != want {
+			t.Fatalf("expected Repeatable(%s) to be %v", method, want)
+		}
+	}
+}
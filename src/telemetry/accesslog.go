@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -47,6 +48,11 @@ var (
 func init() {
 	promReg.MustRegister(promHTTPRequestsTotal)
 	promReg.MustRegister(promHTTPRequestDurationSeconds)
+	// Go runtime and process metrics (go_goroutines, go_memstats_*,
+	// process_resident_memory_bytes) show leaks such as the chaos
+	// package's memory-leak and goroutine-leak scenarios.
+	promReg.MustRegister(collectors.NewGoCollector())
+	promReg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 }
 
 // MetricsHandler returns an HTTP handler that exposes Prometheus metrics in
@@ -72,52 +78,78 @@ var accessLog = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{}))
 //
 // It is designed to wrap an http.ServeMux so that request.Pattern is set
 // before the middleware records the route label.
+//
+// Requests whose handler panics, such as the connections the chaos package
+// aborts with http.ErrAbortHandler, are recorded too: the log line carries
+// "aborted": true with the status written so far (0 if none) and the status
+// label is ABORTED. The panic is left to carry on to the server.
 func AccessLog(serviceName string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		rec := &statusRecorder{ResponseWriter: w}
+		completed := false
+		// Deferred without recover, so a panic keeps its stack trace.
+		defer func() {
+			logAccess(serviceName, r, rec, time.Since(start), !completed)
+		}()
 		next.ServeHTTP(rec, r)
-
-		duration := time.Since(start)
-
-		// Resolve route pattern – Go 1.22+ ServeMux sets r.Pattern after
-		// matching.  Fall back to URL.Path if no pattern matched.
-		route := r.Pattern
-		if route == "" {
-			route = r.URL.Path
-		}
-		statusStr := http.StatusText(rec.status)
-		if statusStr == "" {
-			statusStr = "UNKNOWN"
-		}
-
-		// --- stdout access log (one JSON line) ---
-		msg := "access"
-		if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
-			sc := span.SpanContext()
-			msg = fmt.Sprintf("access [trace:%s span:%s]",
-				sc.TraceID().String(), sc.SpanID().String())
-		}
-		accessLog.Info(msg,
-			"service", serviceName,
-			"method", r.Method,
-			"path", r.URL.Path,
-			"route", route,
-			"status", rec.status,
-			"duration_ms", duration.Milliseconds(),
-			"bytes", rec.written,
-			"remote_addr", r.RemoteAddr,
-		)
-
-		// --- Prometheus metrics ---
-		promHTTPRequestsTotal.WithLabelValues(r.Method, route, statusStr).Inc()
-		promHTTPRequestDurationSeconds.WithLabelValues(r.Method, route).Observe(duration.Seconds())
+		completed = true
 	})
 }
 
+// logAccess writes the access-log line and records the metrics of one
+// request.
+func logAccess(serviceName string, r *http.Request, rec *statusRecorder, duration time.Duration, aborted bool) {
+	// Resolve route pattern – Go 1.22+ ServeMux sets r.Pattern after
+	// matching.  Fall back to URL.Path if no pattern matched.
+	route := r.Pattern
+	if route == "" {
+		route = r.URL.Path
+	}
+	// A handler that returns without writing has implicitly sent 200.
+	status := rec.status
+	if status == 0 && !aborted {
+		status = http.StatusOK
+	}
+	statusStr := http.StatusText(status)
+	switch {
+	case aborted:
+		statusStr = "ABORTED"
+	case statusStr == "":
+		statusStr = "UNKNOWN"
+	}
+
+	// --- stdout access log (one JSON line) ---
+	msg := "access"
+	if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+		sc := span.SpanContext()
+		msg = fmt.Sprintf("access [trace:%s span:%s]",
+			sc.TraceID().String(), sc.SpanID().String())
+	}
+	attributes := []any{
+		"service", serviceName,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", status,
+		"duration_ms", duration.Milliseconds(),
+		"bytes", rec.written,
+		"remote_addr", r.RemoteAddr,
+	}
+	if aborted {
+		attributes = append(attributes, "aborted", true)
+	}
+	accessLog.Info(msg, attributes...)
+
+	// --- Prometheus metrics ---
+	promHTTPRequestsTotal.WithLabelValues(r.Method, route, statusStr).Inc()
+	promHTTPRequestDurationSeconds.WithLabelValues(r.Method, route).Observe(duration.Seconds())
+}
+
 // statusRecorder wraps http.ResponseWriter to capture the response status code
-// and the number of bytes written.
+// and the number of bytes written. status stays 0 until the header is
+// written.
 type statusRecorder struct {
 	http.ResponseWriter
 	status  int
@@ -130,11 +162,20 @@ func (r *statusRecorder) WriteHeader(statusCode int) {
 }
 
 func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
 	n, err := r.ResponseWriter.Write(p)
 	r.written += int64(n)
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streamed responses can still be flushed.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // ---------------------------------------------------------------------------
 // Compile-time check: ensure io.Writer is implemented (for the metrics
 // handler's own unregistered-collector logging).
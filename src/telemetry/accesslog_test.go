@@ -0,0 +1,58 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cldmnky/observability-workshop/src/chaos"
+)
+
+func TestAccessLogRecordsResetFaults(t *testing.T) {
+	var logged bytes.Buffer
+	previous := accessLog
+	accessLog = slog.New(slog.NewJSONHandler(&logged, nil))
+	t.Cleanup(func() { accessLog = previous })
+
+	injector := chaos.NewInjector(nil)
+	recorder := httptest.NewRecorder()
+	injector.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, chaos.AdminPath, bytes.NewBufferString(`{"route":"/reset","resetRate":1}`)))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected the fault added, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reset", func(response http.ResponseWriter, _ *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(AccessLog("test", injector.Middleware(mux)))
+	defer server.Close()
+	aborted := promHTTPRequestsTotal.WithLabelValues(http.MethodGet, "/reset", "ABORTED")
+	before := testutil.ToFloat64(aborted)
+
+	if response, err := server.Client().Get(server.URL + "/reset"); err == nil {
+		response.Body.Close()
+		t.Fatalf("expected the connection to be reset, got %d", response.StatusCode)
+	}
+	server.Close()
+
+	var line struct {
+		Route   string `json:"route"`
+		Status  int    `json:"status"`
+		Aborted bool   `json:"aborted"`
+	}
+	if err := json.Unmarshal(logged.Bytes(), &line); err != nil {
+		t.Fatalf("expected one access-log line, got %q: %v", logged.String(), err)
+	}
+	if line.Route != "/reset" || line.Status != 0 || !line.Aborted {
+		t.Fatalf("expected an aborted /reset with no status, got %+v", line)
+	}
+	if counted := testutil.ToFloat64(aborted) - before; counted != 1 {
+		t.Fatalf("expected the aborted request counted once, got %v", counted)
+	}
+}
@@ -0,0 +1,76 @@
+package telemetry
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// RegisterDBStats exports db.Stats() – open, in-use and idle connections plus
+// the cumulative wait count and wait time – so pool contention can be told
+// apart from slow statements. poolName labels every series.
+//
+// Prometheus: the client_golang go_sql_* gauges on registerer, labelled
+// db_name; a nil registerer uses the registry MetricsHandler serves. OTel:
+// db.client.connection.* instruments observed on each collection, labelled
+// db.client.connection.pool.name.
+func RegisterDBStats(db *sql.DB, poolName string, registerer prometheus.Registerer, meter metric.Meter) error {
+	if registerer == nil {
+		registerer = promReg
+	}
+	err := registerer.Register(collectors.NewDBStatsCollector(db, poolName))
+	if err != nil {
+		return err
+	}
+
+	count, err := meter.Int64ObservableGauge(
+		"db.client.connection.count",
+		metric.WithDescription("Connections in the pool, by state (idle or used)"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	maxOpen, err := meter.Int64ObservableGauge(
+		"db.client.connection.max",
+		metric.WithDescription("Maximum number of open connections allowed (0 is unlimited)"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitCount, err := meter.Int64ObservableCounter(
+		"db.client.connection.wait_count",
+		metric.WithDescription("Total number of times a caller waited for a free connection"),
+		metric.WithUnit("{wait}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitDuration, err := meter.Float64ObservableCounter(
+		"db.client.connection.wait_duration",
+		metric.WithDescription("Total time callers spent waiting for a free connection"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+
+	pool := attribute.String("db.client.connection.pool.name", poolName)
+	_, err = meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		stats := db.Stats()
+		observer.ObserveInt64(count, int64(stats.Idle),
+			metric.WithAttributes(pool, attribute.String("db.client.connection.state", "idle")))
+		observer.ObserveInt64(count, int64(stats.InUse),
+			metric.WithAttributes(pool, attribute.String("db.client.connection.state", "used")))
+		observer.ObserveInt64(maxOpen, int64(stats.MaxOpenConnections), metric.WithAttributes(pool))
+		observer.ObserveInt64(waitCount, stats.WaitCount, metric.WithAttributes(pool))
+		observer.ObserveFloat64(waitDuration, stats.WaitDuration.Seconds(), metric.WithAttributes(pool))
+		return nil
+	}, count, maxOpen, waitCount, waitDuration)
+	return err
+}
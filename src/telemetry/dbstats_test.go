@@ -0,0 +1,130 @@
+package telemetry_test
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/chaisql/chai"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/cldmnky/observability-workshop/src/telemetry"
+)
+
+func scrapeMetrics(t *testing.T, registry *prometheus.Registry) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	return string(body)
+}
+
+func observedGauge(t *testing.T, reader *sdkmetric.ManualReader, name string, state string) int64 {
+	t.Helper()
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	for _, scope := range collected.ScopeMetrics {
+		for _, instrument := range scope.Metrics {
+			if instrument.Name != name {
+				continue
+			}
+			switch data := instrument.Data.(type) {
+			case metricdata.Gauge[int64]:
+				for _, point := range data.DataPoints {
+					if value, _ := point.Attributes.Value("db.client.connection.state"); value.AsString() == state {
+						return point.Value
+					}
+				}
+			case metricdata.Sum[int64]:
+				if len(data.DataPoints) > 0 {
+					return data.DataPoints[0].Value
+				}
+			}
+		}
+	}
+	t.Fatalf("metric %s not collected", name)
+	return 0
+}
+
+func TestRegisterDBStatsTracksPoolUnderLoad(t *testing.T) {
+	db, err := sql.Open("chai", ":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	registry := prometheus.NewRegistry()
+	if err := telemetry.RegisterDBStats(db, "dbstats_test", registry, meter); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if used := observedGauge(t, reader, "db.client.connection.count", "used"); used != 0 {
+		t.Fatalf("expected an idle pool, got %d used", used)
+	}
+
+	// Hold both connections, then start workers that must wait for one.
+	ctx := context.Background()
+	held := make([]*sql.Conn, 2)
+	for index := range held {
+		held[index], err = db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("conn: %v", err)
+		}
+	}
+
+	var workers sync.WaitGroup
+	for range 6 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Errorf("worker conn: %v", err)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			_ = conn.Close()
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.Stats().WaitCount == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if used := observedGauge(t, reader, "db.client.connection.count", "used"); used != 2 {
+		t.Fatalf("expected 2 used connections under load, got %d", used)
+	}
+	if !strings.Contains(scrapeMetrics(t, registry), `go_sql_in_use_connections{db_name="dbstats_test"} 2`) {
+		t.Fatalf("expected Prometheus in-use gauge at 2")
+	}
+
+	for _, conn := range held {
+		_ = conn.Close()
+	}
+	workers.Wait()
+
+	if waits := observedGauge(t, reader, "db.client.connection.wait_count", ""); waits == 0 {
+		t.Fatalf("expected waits to be counted")
+	}
+	metrics := scrapeMetrics(t, registry)
+	if !strings.Contains(metrics, `go_sql_max_open_connections{db_name="dbstats_test"} 2`) ||
+		strings.Contains(metrics, `go_sql_wait_count_total{db_name="dbstats_test"} 0`) {
+		t.Fatalf("unexpected Prometheus pool metrics:\n%s", metrics)
+	}
+	if used := observedGauge(t, reader, "db.client.connection.count", "used"); used != 0 {
+		t.Fatalf("expected connections returned to the pool, got %d used", used)
+	}
+}
@@ -0,0 +1,178 @@
+// Package tenant identifies which workshop user a request belongs to and
+// carries that identity across the frontend → backend → database hops.
+//
+// The tenant comes from the X-Forwarded-User header set by the OpenShift
+// OAuth proxy (the same header the user-info-api reads), falling back to the
+// tenant.id W3C baggage member. Requests with neither belong to Default.
+// The header is trusted, so only a proxy should be able to set it.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cldmnky/observability-workshop/src/problem"
+)
+
+const (
+	// Header is the trusted request header carrying the tenant id.
+	Header = "X-Forwarded-User"
+	// BaggageKey is the W3C baggage member carrying the tenant id.
+	BaggageKey = "tenant.id"
+	// AttributeKey is the span attribute recording the tenant id.
+	AttributeKey = "tenant.id"
+	// Default owns requests that carry no tenant, and every row written
+	// before tenancy existed.
+	Default = "default"
+	// OtherLabel replaces tenant ids once a Labeler runs out of labels.
+	OtherLabel = "other"
+	// DefaultLabelLimit is the number of distinct tenant metric labels a
+	// service emits before folding the rest into OtherLabel.
+	DefaultLabelLimit = 50
+
+	maxLength = 64
+)
+
+// ErrInvalid is returned for tenant ids that are empty, too long or contain
+// characters outside letters, digits, '.', '_', '@' and '-'.
+var ErrInvalid = errors.New("tenant id must be 1-64 letters, digits, '.', '_', '@' or '-'")
+
+type contextKey struct{}
+
+// Valid reports whether id is a well-formed tenant id. The charset keeps ids
+// safe to use as baggage values, SQL arguments and metric labels.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '@', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FromRequest resolves the tenant of request: the Header first, then the
+// BaggageKey baggage member, then Default.
+func FromRequest(request *http.Request) (string, error) {
+	id := request.Header.Get(Header)
+	if id == "" {
+		id = baggage.FromContext(request.Context()).Member(BaggageKey).Value()
+	}
+	if id == "" {
+		return Default, nil
+	}
+	if !Valid(id) {
+		return "", ErrInvalid
+	}
+	return id, nil
+}
+
+// WithTenant returns ctx carrying id, both for FromContext and as a baggage
+// member so instrumented clients propagate it downstream.
+func WithTenant(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, contextKey{}, id)
+	member, err := baggage.NewMemberRaw(BaggageKey, id)
+	if err != nil {
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// FromContext returns the tenant stored by WithTenant, or Default.
+func FromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(contextKey{}).(string); ok {
+		return id
+	}
+	return Default
+}
+
+// Middleware resolves the tenant of every request, stores it in the request
+// context and records it on the active span. Malformed tenant ids are
+// rejected with 400. Mount it inside otelhttp so the baggage fallback and
+// the span are available.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id, err := FromRequest(request)
+		if err != nil {
+			problem.Write(response, request, http.StatusBadRequest, err.Error())
+			return
+		}
+		trace.SpanFromContext(request.Context()).SetAttributes(attribute.String(AttributeKey, id))
+		next.ServeHTTP(response, request.WithContext(WithTenant(request.Context(), id)))
+	})
+}
+
+// Transport sets Header on outgoing requests from the tenant in their
+// context, so proxies forward the caller's identity even when telemetry
+// (and with it baggage propagation) is disabled.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+// NewTransport wraps base, or http.DefaultTransport when base is nil.
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Base: base}
+}
+
+func (transport *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if id, ok := request.Context().Value(contextKey{}).(string); ok && request.Header.Get(Header) == "" {
+		request = request.Clone(request.Context())
+		request.Header.Set(Header, id)
+	}
+	return transport.Base.RoundTrip(request)
+}
+
+// Labeler maps tenant ids to metric label values, keeping cardinality
+// bounded: the first limit distinct tenants keep their id, later ones are
+// reported as OtherLabel.
+type Labeler struct {
+	mu     sync.Mutex
+	limit  int
+	labels map[string]struct{}
+}
+
+// NewLabeler returns a Labeler allowing limit distinct tenant labels.
+func NewLabeler(limit int) *Labeler {
+	return &Labeler{limit: limit, labels: map[string]struct{}{}}
+}
+
+// Label returns the metric label value for id. A nil Labeler reports every
+// tenant as OtherLabel.
+func (labeler *Labeler) Label(id string) string {
+	if labeler == nil {
+		return OtherLabel
+	}
+	labeler.mu.Lock()
+	defer labeler.mu.Unlock()
+	if _, ok := labeler.labels[id]; ok {
+		return id
+	}
+	if len(labeler.labels) >= labeler.limit {
+		return OtherLabel
+	}
+	labeler.labels[id] = struct{}{}
+	return id
+}
+
+// Attribute returns the "tenant" metric attribute for the tenant in ctx.
+func (labeler *Labeler) Attribute(ctx context.Context) attribute.KeyValue {
+	return attribute.String("tenant", labeler.Label(FromContext(ctx)))
+}
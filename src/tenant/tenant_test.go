@@ -0,0 +1,100 @@
+package tenant_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+
+	"github.com/cldmnky/observability-workshop/src/tenant"
+)
+
+func TestFromRequestPrefersHeaderThenBaggage(t *testing.T) {
+	member, _ := baggage.NewMember(tenant.BaggageKey, "from-baggage")
+	bag, _ := baggage.New(member)
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+
+	for _, test := range []struct {
+		name   string
+		header string
+		ctx    context.Context
+		want   string
+	}{
+		{"header", "user1", ctx, "user1"},
+		{"baggage", "", ctx, "from-baggage"},
+		{"neither", "", context.Background(), tenant.Default},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(test.ctx)
+		if test.header != "" {
+			request.Header.Set(tenant.Header, test.header)
+		}
+		got, err := tenant.FromRequest(request)
+		if err != nil || got != test.want {
+			t.Fatalf("%s: expected %q, got %q (%v)", test.name, test.want, got, err)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set(tenant.Header, "user 1")
+	if _, err := tenant.FromRequest(request); err != tenant.ErrInvalid {
+		t.Fatalf("expected ErrInvalid for a tenant with a space, got %v", err)
+	}
+}
+
+func TestMiddlewareAndTransportForwardTenant(t *testing.T) {
+	var forwarded, forwardedBaggage string
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		forwarded = request.Header.Get(tenant.Header)
+		forwardedBaggage = request.Header.Get("Baggage")
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{Transport: tenant.NewTransport(nil)}
+	handler := tenant.Middleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if got := tenant.FromContext(request.Context()); got != "user1" {
+			t.Errorf("expected user1 in context, got %q", got)
+		}
+		if got := baggage.FromContext(request.Context()).Member(tenant.BaggageKey).Value(); got != "user1" {
+			t.Errorf("expected user1 in baggage, got %q", got)
+		}
+		outgoing, _ := http.NewRequestWithContext(request.Context(), http.MethodGet, upstream.URL, nil)
+		upstreamResponse, err := client.Do(outgoing)
+		if err != nil {
+			t.Errorf("call upstream: %v", err)
+			return
+		}
+		_ = upstreamResponse.Body.Close()
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set(tenant.Header, "user1")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if forwarded != "user1" {
+		t.Fatalf("expected %s user1 upstream, got %q", tenant.Header, forwarded)
+	}
+	// Baggage travels only through an otelhttp transport.
+	if forwardedBaggage != "" {
+		t.Fatalf("expected no baggage header without otelhttp, got %q", forwardedBaggage)
+	}
+}
+
+func TestLabelerBoundsCardinality(t *testing.T) {
+	labeler := tenant.NewLabeler(2)
+	for index := range 5 {
+		id := fmt.Sprintf("user%d", index+1)
+		want := id
+		if index >= 2 {
+			want = tenant.OtherLabel
+		}
+		if got := labeler.Label(id); got != want {
+			t.Fatalf("%s: expected label %q, got %q", id, want, got)
+		}
+	}
+	if got := labeler.Label("user1"); got != "user1" {
+		t.Fatalf("expected a known tenant to keep its label, got %q", got)
+	}
+}